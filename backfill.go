@@ -0,0 +1,360 @@
+package bgpfinder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/alistairking/bgpfinder/internal/metrics"
+)
+
+// DefaultBackfillInterval is how often the backfill looks for windows that
+// are due to be crawled again.
+const DefaultBackfillInterval = time.Minute
+
+// BackfillTier revisits a band of every collector's history on a schedule.
+// A tier covers the time between the previous tier's MaxAge and its own.
+type BackfillTier struct {
+	Name string
+
+	// MaxAge is how far back from now the tier reaches. 0 reaches back to
+	// the start of the backfill. Tiers must be in order of increasing age.
+	MaxAge time.Duration
+
+	// Window is the size of the windows that the tier is crawled in.
+	// Windows are aligned to multiples of it since the epoch, so the same
+	// windows are revisited each time.
+	Window time.Duration
+
+	// Every is how often each of the tier's windows is crawled
+	Every time.Duration
+}
+
+// DefaultBackfillTiers revisit the last day every few minutes, the last month
+// hourly, the last year daily and the rest of history weekly.
+var DefaultBackfillTiers = []BackfillTier{
+	{Name: "day", MaxAge: 24 * time.Hour, Window: 24 * time.Hour, Every: 5 * time.Minute},
+	{Name: "month", MaxAge: 30 * 24 * time.Hour, Window: 7 * 24 * time.Hour, Every: time.Hour},
+	{Name: "year", MaxAge: 365 * 24 * time.Hour, Window: 30 * 24 * time.Hour, Every: 24 * time.Hour},
+	{Name: "history", Window: 365 * 24 * time.Hour, Every: 7 * 24 * time.Hour},
+}
+
+// CrawlWindow records when a backfill last crawled one of a collector's
+// windows.
+type CrawlWindow struct {
+	// Source is the kind of scrape run that crawled the window
+	// (ScrapeRunBackfill or ScrapeRunRange). Each only sees its own.
+	Source string `json:"source"`
+
+	Collector  Collector `json:"collector"`
+	DumpType   DumpType  `json:"type"`
+	Window     Interval  `json:"window"`
+	Crawled    time.Time `json:"crawled"`
+	DumpsFound int       `json:"dumpsFound"`
+}
+
+// BackfillConfig configures the tiered backfill.
+type BackfillConfig struct {
+	// Tiers to revisit history in. DefaultBackfillTiers if empty.
+	Tiers []BackfillTier
+
+	// DumpType to crawl. DumpTypeAny crawls both types in one go.
+	DumpType DumpType
+
+	// Since is the start of the history to backfill. If unset, each
+	// project's history starts at its ArchiveStart (or the epoch, if it
+	// isn't known).
+	Since time.Time
+
+	// Interval is how often to look for due windows.
+	// DefaultBackfillInterval if unset.
+	Interval time.Duration
+
+	// Leaser takes a lease on the collector before crawling each window, so that
+	// replicas share the work. Nothing is leased if unset.
+	Leaser *Leaser
+}
+
+// backfillWindow is a window that's crawled on its tier's schedule.
+type backfillWindow struct {
+	tier   BackfillTier
+	window Interval
+}
+
+// backfillWindows lists each tier's windows as of now, newest first. A
+// window that straddles two tiers belongs to both (or, if they're the same
+// size, just to the more recent tier).
+func backfillWindows(tiers []BackfillTier, since, now time.Time) []backfillWindow {
+	var windows []backfillWindow
+	seen := map[[2]int64]bool{}
+	until := now
+	for _, tier := range tiers {
+		from := since
+		if tier.MaxAge > 0 && now.Add(-tier.MaxAge).After(since) {
+			from = now.Add(-tier.MaxAge)
+		}
+		if !from.Before(until) {
+			continue
+		}
+
+		size := int64(tier.Window.Seconds())
+		start := until.Unix() - 1
+		start -= start % size
+		for ; start+size > from.Unix(); start -= size {
+			if seen[[2]int64{start, start + size}] {
+				continue
+			}
+			seen[[2]int64{start, start + size}] = true
+			windows = append(windows, backfillWindow{
+				tier:   tier,
+				window: Interval{From: time.Unix(start, 0), Until: time.Unix(start+size, 0)},
+			})
+		}
+		until = from
+	}
+	return windows
+}
+
+// Backfiller recrawls each collector's history, visiting recent windows
+// more often than old ones. That picks up dumps that the archives publish
+// late, replace or remove, without recrawling everything each time.
+type Backfiller struct {
+	logger *logging.Logger
+	store  Store
+	finder Finder
+	cfg    BackfillConfig
+}
+
+func NewBackfiller(logger *logging.Logger, store Store, finder Finder, cfg BackfillConfig) (*Backfiller, error) {
+	if len(cfg.Tiers) == 0 {
+		cfg.Tiers = DefaultBackfillTiers
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultBackfillInterval
+	}
+	for i, tier := range cfg.Tiers {
+		if tier.Window < time.Second || tier.Every <= 0 {
+			return nil, fmt.Errorf("backfill tier %s needs a window and an interval", tier.Name)
+		}
+		if i == 0 {
+			continue
+		}
+		if prev := cfg.Tiers[i-1].MaxAge; prev == 0 || (tier.MaxAge != 0 && tier.MaxAge <= prev) {
+			return nil, fmt.Errorf("backfill tier %s must reach further back than the tiers before it", tier.Name)
+		}
+	}
+	return &Backfiller{
+		logger: logger,
+		store:  store,
+		finder: finder,
+		cfg:    cfg,
+	}, nil
+}
+
+// Start runs each tier's backfill in its own goroutine until the context is
+// canceled, looking for due windows every interval. Crawling a tier of old
+// history can take hours, and that mustn't hold up the recent tiers.
+func (b *Backfiller) Start(ctx context.Context) {
+	for _, tier := range b.cfg.Tiers {
+		go func(tier BackfillTier) {
+			for {
+				if err := b.runTier(ctx, tier, time.Now()); err != nil {
+					b.logger.Error().Err(err).Str("tier", tier.Name).Msg("Backfill failed")
+				}
+
+				select {
+				case <-time.After(b.cfg.Interval):
+				case <-ctx.Done():
+					b.logger.Info().Str("tier", tier.Name).Msg("Stopping backfill due to context cancellation")
+					return
+				}
+			}
+		}(tier)
+	}
+}
+
+// RunOnce crawls the windows that are due as of now, a tier at a time
+// (most recent first). Each tier covers every collector before the next
+// one starts.
+func (b *Backfiller) RunOnce(ctx context.Context, now time.Time) error {
+	for _, tier := range b.cfg.Tiers {
+		if err := b.runTier(ctx, tier, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTier crawls each collector's windows of the tier that are due as of
+// now, newest first, recording one scrape run for each project that had
+// any.
+func (b *Backfiller) runTier(ctx context.Context, tier BackfillTier, now time.Time) error {
+	projects, err := b.finder.Projects()
+	if err != nil {
+		return fmt.Errorf("failed to get projects: %w", err)
+	}
+	for _, project := range projects {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var windows []backfillWindow
+		for _, w := range backfillWindows(b.cfg.Tiers, b.since(project), now) {
+			if w.tier.Name == tier.Name {
+				windows = append(windows, w)
+			}
+		}
+		if len(windows) > 0 {
+			b.backfillProject(ctx, project, tier, windows, now)
+		}
+	}
+	return nil
+}
+
+// since returns when the project's history starts.
+func (b *Backfiller) since(project Project) time.Time {
+	if !b.cfg.Since.IsZero() {
+		return b.cfg.Since
+	}
+	if start := ArchiveStart(project.Name); !start.IsZero() {
+		return start
+	}
+	return time.Unix(0, 0)
+}
+
+// backfillProject crawls the due windows of each of the project's
+// collectors. Each window is crawled under a lease on its collector, so that
+// neither other replicas nor this one's other tiers crawl the collector at
+// the same time, but none of them has to wait for more than a window.
+func (b *Backfiller) backfillProject(ctx context.Context, project Project, tier BackfillTier, windows []backfillWindow, now time.Time) {
+	collectors, err := b.finder.Collectors(project.Name)
+	if err != nil {
+		b.logger.Error().Err(err).Str("project", project.Name).Msg("Failed to get collectors")
+		return
+	}
+	leaser := b.cfg.Leaser.Named(tier.Name)
+
+	// Only start a run (and add any collectors that aren't stored yet) once
+	// something turns out to be due. Crawling a window doesn't complete a
+	// crawl of the collector, so stored collectors are left alone.
+	var run *ScrapeRun
+	defer func() {
+		if run != nil {
+			FinishScrapeRun(ctx, b.logger, b.store, run)
+		}
+	}()
+	startRun := func() error {
+		run = NewScrapeRun(ScrapeRunBackfill, project.Name, b.cfg.DumpType)
+		StartScrapeRun(ctx, b.logger, b.store, run)
+		if err := b.store.InsertCollectors(ctx, collectors); err != nil {
+			b.logger.Error().Err(err).Str("project", project.Name).Msg("Failed to insert collectors")
+			run.RecordError(fmt.Errorf("failed to insert collectors: %w", err))
+			return err
+		}
+		return nil
+	}
+
+	for _, collector := range collectors {
+		if ctx.Err() != nil {
+			return
+		}
+		due, err := b.dueWindows(ctx, collector, windows, now)
+		if err != nil {
+			b.logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to fetch crawl windows")
+			continue
+		}
+
+		var crawled, found int
+		var total UpsertStats
+		var firstErr error
+		for _, w := range due {
+			// The window is checked again under the lease, so that it isn't
+			// crawled again if another replica just did.
+			err := leaser.WithLease(ctx, collector, b.cfg.DumpType, func(ctx context.Context) error {
+				due, err := b.dueWindows(ctx, collector, []backfillWindow{w}, now)
+				if err != nil || len(due) == 0 {
+					return err
+				}
+				if run == nil {
+					if err := startRun(); err != nil {
+						return err
+					}
+				}
+				n, stats, err := b.crawlWindow(ctx, collector, w, now)
+				crawled++
+				found += n
+				total.Add(stats)
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				return nil
+			})
+			if errors.Is(err, ErrLeaseHeld) {
+				b.logger.Debug().Str("collector", collector.Name).Msg("Collector is being scraped elsewhere, skipping")
+				break
+			}
+			if err != nil {
+				b.logger.Error().Err(err).Str("project", project.Name).Msg("Stopping backfill of project")
+				return
+			}
+		}
+		if crawled > 0 {
+			run.RecordCollector(collector.Name, found, total, 0, firstErr)
+		}
+	}
+}
+
+// dueWindows returns the windows that the collector hasn't had crawled
+// within their tier's interval.
+func (b *Backfiller) dueWindows(ctx context.Context, collector Collector, windows []backfillWindow, now time.Time) ([]backfillWindow, error) {
+	records, err := b.store.FetchCrawlWindows(ctx, ScrapeRunBackfill, collector, b.cfg.DumpType)
+	if err != nil {
+		return nil, err
+	}
+	crawled := map[[2]int64]time.Time{}
+	for _, r := range records {
+		crawled[[2]int64{r.Window.From.Unix(), r.Window.Until.Unix()}] = r.Crawled
+	}
+
+	var due []backfillWindow
+	for _, w := range windows {
+		last, ok := crawled[[2]int64{w.window.From.Unix(), w.window.Until.Unix()}]
+		if ok && now.Sub(last) < w.tier.Every {
+			continue
+		}
+		due = append(due, w)
+	}
+	return due, nil
+}
+
+// crawlWindow crawls the window, recording when it was crawled if that
+// succeeded.
+func (b *Backfiller) crawlWindow(ctx context.Context, collector Collector, w backfillWindow, now time.Time) (int, UpsertStats, error) {
+	dumps, stats, err := CrawlCollector(ctx, b.logger, b.store, b.finder, collector, b.cfg.DumpType, w.window)
+	if err != nil {
+		metrics.BackfillWindows.WithLabelValues(w.tier.Name, "error").Inc()
+		return len(dumps), stats, fmt.Errorf("window %s: %w", w.window, err)
+	}
+	metrics.BackfillWindows.WithLabelValues(w.tier.Name, "ok").Inc()
+
+	record := CrawlWindow{
+		Source:     ScrapeRunBackfill,
+		Collector:  collector,
+		DumpType:   b.cfg.DumpType,
+		Window:     w.window,
+		Crawled:    now,
+		DumpsFound: len(dumps),
+	}
+	if err := b.store.UpsertCrawlWindow(ctx, record); err != nil {
+		b.logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to record crawl window")
+	}
+	b.logger.Debug().
+		Str("collector", collector.Name).
+		Str("tier", w.tier.Name).
+		Str("window", w.window.String()).
+		Int("dumps_found", len(dumps)).
+		Int("inserted", stats.Inserted).
+		Msg("Backfilled window")
+	return len(dumps), stats, nil
+}
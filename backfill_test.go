@@ -0,0 +1,259 @@
+package bgpfinder
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+func TestBackfillWindows(t *testing.T) {
+	now := time.Date(2020, 3, 15, 12, 30, 0, 0, time.UTC)
+	since := now.AddDate(0, 0, -60)
+	windows := backfillWindows(DefaultBackfillTiers, since, now)
+
+	tiers := map[string]int{}
+	for i, w := range windows {
+		tiers[w.tier.Name]++
+		if w.window.From.Unix()%int64(w.tier.Window.Seconds()) != 0 || w.window.Until.Sub(w.window.From) != w.tier.Window {
+			t.Errorf("Expected window %s to be aligned to %s", w.window, w.tier.Window)
+		}
+		if i > 0 && w.tier.Name == windows[i-1].tier.Name && !w.window.Until.Equal(windows[i-1].window.From) {
+			t.Errorf("Expected the %s tier's windows to be contiguous, newest first", w.tier.Name)
+		}
+	}
+	// Yesterday and today, then the weeks of the rest of the month, then
+	// the 30 day windows back to since.
+	if tiers["day"] != 2 || tiers["month"] != 5 || tiers["year"] != 2 || tiers["history"] != 0 {
+		t.Errorf("Unexpected windows per tier: %v", tiers)
+	}
+	if first := windows[0].window; first.From.After(now) || !first.Until.After(now) {
+		t.Errorf("Expected the newest window to contain now, got %s", first)
+	}
+	if last := windows[len(windows)-1].window; last.From.After(since) {
+		t.Errorf("Expected the oldest window to reach back to since, got %s", last)
+	}
+}
+
+func TestBackfiller(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	finder := &sliceFinder{dumps: testUpdates(now.Add(-48*time.Hour), 12)}
+	backfiller, err := NewBackfiller(logger, store, finder, BackfillConfig{
+		DumpType: DumpTypeUpdates,
+		Since:    now.AddDate(0, 0, -10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The collector was retired after its last full crawl
+	lastCrawl := now.AddDate(0, 0, -30)
+	if err := store.UpsertCollectors(ctx, []Collector{testCollector}, DumpTypeAny, lastCrawl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RetireCollectors(ctx, []Collector{testCollector}, lastCrawl); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first pass crawls every window
+	if err := backfiller.RunOnce(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	allWindows := len(backfillWindows(DefaultBackfillTiers, now.AddDate(0, 0, -10), now))
+	if len(finder.queries) != allWindows {
+		t.Errorf("Expected %d windows to be crawled, got %d", allWindows, len(finder.queries))
+	}
+	records, err := store.FetchCrawlWindows(ctx, ScrapeRunBackfill, testCollector, DumpTypeUpdates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != allWindows {
+		t.Errorf("Expected each window's crawl to be recorded, got %d", len(records))
+	}
+
+	// Nothing is due a minute later
+	finder.queries = nil
+	if err := backfiller.RunOnce(ctx, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(finder.queries) != 0 {
+		t.Errorf("Expected nothing to be due, got %d crawls", len(finder.queries))
+	}
+
+	// A dump that turned up late for yesterday is found once the day tier
+	// is due again, without recrawling older windows.
+	late := testUpdates(now.Add(-20*time.Hour), 1)
+	finder.dumps = append(finder.dumps, late...)
+	if err := backfiller.RunOnce(ctx, now.Add(6*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(finder.queries) != 2 {
+		t.Errorf("Expected only the day tier's 2 windows to be crawled, got %d", len(finder.queries))
+	}
+	stored, err := store.FetchDumps(ctx, Query{
+		Collectors: []Collector{testCollector},
+		DumpType:   DumpTypeUpdates,
+		From:       now.Add(-21 * time.Hour),
+		Until:      now,
+	}, FetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].URL != late[0].URL {
+		t.Errorf("Expected the late dump to be stored, got %+v", stored)
+	}
+
+	runs, err := store.FetchScrapeRuns(ctx, ScrapeRunFilter{Project: RisProject.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first pass had due windows in the day and month tiers
+	if len(runs) != 3 || runs[0].Source != ScrapeRunBackfill || runs[0].DumpsInserted != 1 {
+		t.Errorf("Expected a backfill run for each tier's pass with due windows, got %+v", runs)
+	}
+
+	// Crawling windows doesn't complete a crawl of the collector
+	checkCollectorUntouched(t, store, lastCrawl)
+}
+
+// checkCollectorUntouched checks that testCollector is still retired and was
+// last crawled in full at lastCrawl.
+func checkCollectorUntouched(t *testing.T, store *SQLiteStore, lastCrawl time.Time) {
+	t.Helper()
+	ctx := context.Background()
+	retired, err := store.FetchRetiredCollectors(ctx, RIS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := retired[testCollector.Name]; !ok {
+		t.Error("Expected the collector to stay retired")
+	}
+	var ribs, updates int64
+	err = store.DB().QueryRowContext(ctx, `
+		SELECT last_completed_crawl_time_ribs, last_completed_crawl_time_updates
+		FROM collectors WHERE project_name = $1 AND name = $2
+	`, RIS, testCollector.Name).Scan(&ribs, &updates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ribs != lastCrawl.Unix() || updates != lastCrawl.Unix() {
+		t.Errorf("Expected the last crawl times to be left at %d, got %d and %d", lastCrawl.Unix(), ribs, updates)
+	}
+}
+
+// blockingFinder is a sliceFinder that blocks queries that start before
+// blockBefore until release is closed. It counts the other queries.
+type blockingFinder struct {
+	mu          sync.Mutex
+	finder      sliceFinder
+	blockBefore time.Time
+	release     chan struct{}
+	unblocked   int
+}
+
+func (f *blockingFinder) Projects() ([]Project, error) { return f.finder.Projects() }
+
+func (f *blockingFinder) Project(name string) (Project, error) { return f.finder.Project(name) }
+
+func (f *blockingFinder) Collectors(project string) ([]Collector, error) {
+	return f.finder.Collectors(project)
+}
+
+func (f *blockingFinder) Collector(name string) (Collector, error) { return f.finder.Collector(name) }
+
+func (f *blockingFinder) Find(query Query) ([]BGPDump, error) {
+	if query.From.Before(f.blockBefore) {
+		<-f.release
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !query.From.Before(f.blockBefore) {
+		f.unblocked++
+	}
+	return f.finder.Find(query)
+}
+
+func TestBackfillerTiersRunIndependently(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := newTestSQLiteStore(t)
+
+	// Crawling old history is stuck
+	now := time.Now()
+	finder := &blockingFinder{
+		finder:      sliceFinder{dumps: testUpdates(now.Add(-time.Hour), 6)},
+		blockBefore: now.Add(-48 * time.Hour),
+		release:     make(chan struct{}),
+	}
+	defer close(finder.release)
+	backfiller, err := NewBackfiller(logger, store, finder, BackfillConfig{
+		Tiers: []BackfillTier{
+			{Name: "day", MaxAge: 24 * time.Hour, Window: 24 * time.Hour, Every: 20 * time.Millisecond},
+			{Name: "history", Window: 365 * 24 * time.Hour, Every: 7 * 24 * time.Hour},
+		},
+		DumpType: DumpTypeUpdates,
+		Since:    now.AddDate(-1, 0, 0),
+		Interval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backfiller.Start(ctx)
+
+	// The day tier keeps being crawled regardless
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		finder.mu.Lock()
+		crawls := finder.unblocked
+		finder.mu.Unlock()
+		// Each pass crawls today and yesterday
+		if crawls > 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the day tier to be recrawled while history is stuck, got %d crawls", crawls)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewBackfillerRejectsUnorderedTiers(t *testing.T) {
+	_, err := NewBackfiller(nil, nil, nil, BackfillConfig{Tiers: []BackfillTier{
+		{Name: "history", Window: time.Hour, Every: time.Hour},
+		{Name: "day", MaxAge: 24 * time.Hour, Window: time.Hour, Every: time.Minute},
+	}})
+	if err == nil {
+		t.Error("Expected tiers after an unbounded one to be rejected")
+	}
+}
+
+func TestBackfillerSince(t *testing.T) {
+	backfiller, err := NewBackfiller(nil, nil, nil, BackfillConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since := backfiller.since(RisProject); !since.Equal(ArchiveStart(RIS)) {
+		t.Errorf("Expected RIS history to start with its archive, got %s", since)
+	}
+	if since := backfiller.since(Project{Name: "private"}); since.Unix() != 0 {
+		t.Errorf("Expected an unknown project's history to start at the epoch, got %s", since)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	windows := backfillWindows(DefaultBackfillTiers, backfiller.since(RouteviewsProject), now)
+	if oldest := windows[len(windows)-1].window; oldest.Until.Before(ArchiveStart(ROUTEVIEWS)) {
+		t.Errorf("Expected no windows before the archive starts, got %s", oldest)
+	}
+}
@@ -0,0 +1,269 @@
+package bgpfinder
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/alistairking/bgpfinder/internal/metrics"
+)
+
+// DefaultSettleDelay is how long after a window ends before we trust the
+// archives to have published everything for it. Windows more recent than this
+// are always re-fetched from upstream.
+const DefaultSettleDelay = time.Hour
+
+// DumpStore is a Finder that can also persist dumps found elsewhere.
+type DumpStore interface {
+	Finder
+
+	// StoreDumps saves the given dumps so that later Find calls return them.
+	StoreDumps(dumps []BGPDump) error
+}
+
+// CachingFinder is a read-through cache that sits in front of an upstream
+// Finder. Spans that the Coverage says have already been crawled are answered
+// from the store, and only the uncovered gaps are fetched from upstream (and
+// then written back to the store).
+type CachingFinder struct {
+	store    DumpStore
+	upstream Finder
+	coverage Coverage
+	logger   *logging.Logger
+
+	settleDelay time.Duration
+}
+
+func NewCachingFinder(logger *logging.Logger, store DumpStore, upstream Finder, coverage Coverage) *CachingFinder {
+	return &CachingFinder{
+		store:       store,
+		upstream:    upstream,
+		coverage:    coverage,
+		logger:      logger.ModuleLogger("CachingFinder"),
+		settleDelay: DefaultSettleDelay,
+	}
+}
+
+// SetSettleDelay overrides DefaultSettleDelay.
+func (f *CachingFinder) SetSettleDelay(d time.Duration) {
+	f.settleDelay = d
+}
+
+// The upstream finder is the authority on which projects and collectors exist.
+
+func (f *CachingFinder) Projects() ([]Project, error) {
+	return f.upstream.Projects()
+}
+
+func (f *CachingFinder) Project(name string) (Project, error) {
+	return f.upstream.Project(name)
+}
+
+func (f *CachingFinder) Collectors(project string) ([]Collector, error) {
+	return f.upstream.Collectors(project)
+}
+
+func (f *CachingFinder) Collector(name string) (Collector, error) {
+	return f.upstream.Collector(name)
+}
+
+func (f *CachingFinder) Find(query Query) ([]BGPDump, error) {
+	query, fetched, err := f.fillGaps(query)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := f.store.Find(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dumps in store: %v", err)
+	}
+
+	// Merge in what we fetched, in case it didn't make it into the store.
+	// The fetched copies are fresher (e.g., they're known not to have been
+	// removed), so they win.
+	return mergeDumps(fetched, stored), nil
+}
+
+// FindStream implements StreamingFinder. The uncovered gaps are still
+// fetched up front, but the stored dumps are streamed out of the store
+// (if it supports that) and merged with the fetched ones as they go by.
+func (f *CachingFinder) FindStream(query Query, fn func(BGPDump) error) error {
+	query, fetched, err := f.fillGaps(query)
+	if err != nil {
+		return err
+	}
+
+	fetched = mergeDumps(fetched)
+	fetchedURLs := make(map[string]bool, len(fetched))
+	for _, d := range fetched {
+		fetchedURLs[d.URL] = true
+	}
+	next := 0
+	err = FindStream(f.store, query, func(d BGPDump) error {
+		if fetchedURLs[d.URL] {
+			return nil
+		}
+		for ; next < len(fetched) && !dumpLess(d, fetched[next]); next++ {
+			if err := fn(fetched[next]); err != nil {
+				return err
+			}
+		}
+		return fn(d)
+	})
+	if err != nil {
+		return err
+	}
+	for ; next < len(fetched); next++ {
+		if err := fn(fetched[next]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindPage implements PagingFinder. The uncovered gaps of the whole query
+// are filled first (so later pages are answered from the store alone), and
+// the page is then taken from the store (paged there if it supports that)
+// merged with the fetched dumps.
+func (f *CachingFinder) FindPage(query Query, after *DumpCursor, limit int) ([]BGPDump, error) {
+	query, fetched, err := f.fillGaps(query)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := FindPage(f.store, query, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dumps in store: %v", err)
+	}
+
+	// The first limit of the merged dumps can only come from the first
+	// limit of each list
+	return pageDumps(mergeDumps(pageDumps(fetched, after, limit), stored), nil, limit), nil
+}
+
+// fillGaps fetches the spans of the query that aren't covered from upstream,
+// returning the query with its collectors filled in and the fetched dumps.
+func (f *CachingFinder) fillGaps(query Query) (Query, []BGPDump, error) {
+	if len(query.Collectors) == 0 {
+		collectors, err := f.upstream.Collectors("")
+		if err != nil {
+			return query, nil, fmt.Errorf("failed to get collectors: %v", err)
+		}
+		query.Collectors = collectors
+	}
+
+	// The query's Until is inclusive (a query can be for a single point in
+	// time), but intervals aren't
+	window := Interval{From: query.From, Until: query.Until.Add(time.Second)}
+	horizon := time.Now().Add(-f.settleDelay)
+
+	var fetched []BGPDump
+	for _, collector := range query.Collectors {
+		for _, dumpType := range concreteDumpTypes(query.DumpType) {
+			covered, err := f.coverage.Covered(collector, dumpType, window)
+			if err != nil {
+				return query, nil, fmt.Errorf("failed to get coverage for %s: %v", collector, err)
+			}
+
+			gaps := subtractIntervals(window, covered)
+			if len(gaps) == 0 {
+				metrics.CacheSpans.WithLabelValues("hit").Inc()
+			} else {
+				metrics.CacheSpans.WithLabelValues("miss").Inc()
+			}
+			for _, gap := range gaps {
+				dumps, err := f.fillGap(collector, dumpType, gap, horizon)
+				if err != nil {
+					return query, nil, err
+				}
+				fetched = append(fetched, dumps...)
+			}
+		}
+	}
+	return query, fetched, nil
+}
+
+// fillGap fetches a single uncovered span from upstream and writes it back to
+// the store. The settled part of the span is then marked as covered, apart
+// from any directories that upstream couldn't list, which are left to be
+// fetched again next time.
+func (f *CachingFinder) fillGap(collector Collector, dumpType DumpType, gap Interval, horizon time.Time) ([]BGPDump, error) {
+	f.logger.Info().
+		Str("collector", collector.Name).
+		Str("dump_type", dumpType.String()).
+		Time("from", gap.From).
+		Time("until", gap.Until).
+		Msg("Fetching uncovered span from upstream")
+
+	dumps, err := f.upstream.Find(Query{
+		Collectors: []Collector{collector},
+		From:       gap.From,
+		Until:      gap.Until,
+		DumpType:   dumpType,
+	})
+	var unlisted []Interval
+	var incomplete *IncompleteFindError
+	if errors.As(err, &incomplete) {
+		f.logger.Warn().Err(err).Str("collector", collector.Name).Msg("Upstream couldn't list all of the span")
+		unlisted = incomplete.Unlisted(collector, dumpType, gap)
+	} else if err != nil {
+		return nil, fmt.Errorf("upstream find failed for %s %s: %v", collector, gap, err)
+	}
+
+	if len(dumps) > 0 {
+		if err := f.store.StoreDumps(dumps); err != nil {
+			// Still return what we found, but don't claim the span is covered.
+			f.logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to store fetched dumps")
+			return dumps, nil
+		}
+	}
+
+	settled := gap
+	if settled.Until.After(horizon) {
+		settled.Until = horizon
+	}
+	if !settled.Empty() {
+		for _, listed := range subtractIntervals(settled, unlisted) {
+			if err := f.coverage.MarkCovered(collector, dumpType, listed); err != nil {
+				f.logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to mark span as covered")
+			}
+		}
+	}
+	return dumps, nil
+}
+
+// concreteDumpTypes expands DumpTypeAny into the dump types it stands for.
+func concreteDumpTypes(dumpType DumpType) []DumpType {
+	if dumpType == DumpTypeAny {
+		return []DumpType{DumpTypeRibs, DumpTypeUpdates}
+	}
+	return []DumpType{dumpType}
+}
+
+// mergeDumps combines the given dump lists, dropping duplicate URLs (the
+// first copy wins), and sorts the result by timestamp, dump type and URL (the
+// same order that FetchDataFromDB uses).
+func mergeDumps(lists ...[]BGPDump) []BGPDump {
+	seen := map[string]bool{}
+	var merged []BGPDump
+	for _, list := range lists {
+		for _, d := range list {
+			if seen[d.URL] {
+				continue
+			}
+			seen[d.URL] = true
+			merged = append(merged, d)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return dumpLess(merged[i], merged[j])
+	})
+	return merged
+}
+
+// dumpLess orders dumps by timestamp, dump type and URL.
+func dumpLess(a, b BGPDump) bool {
+	return CursorOf(a).Before(CursorOf(b))
+}
@@ -0,0 +1,245 @@
+package bgpfinder
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+var testCollector = Collector{Project: RisProject, Name: "rrc00"}
+
+// sliceFinder is a Finder that answers queries from a fixed list of dumps
+// and remembers the queries it was asked. The dumps in unlisted windows are
+// left out, as if their directories had failed to load.
+type sliceFinder struct {
+	dumps    []BGPDump
+	queries  []Query
+	unlisted []Interval
+}
+
+func (f *sliceFinder) Projects() ([]Project, error) { return []Project{RisProject}, nil }
+
+func (f *sliceFinder) Project(name string) (Project, error) { return RisProject, nil }
+
+func (f *sliceFinder) Collectors(project string) ([]Collector, error) {
+	return []Collector{testCollector}, nil
+}
+
+func (f *sliceFinder) Collector(name string) (Collector, error) { return testCollector, nil }
+
+func (f *sliceFinder) Find(query Query) ([]BGPDump, error) {
+	f.queries = append(f.queries, query)
+	window := Interval{From: query.From, Until: query.Until}
+	var dirs []DirError
+	for _, u := range clipIntervals(f.unlisted, window) {
+		dirs = append(dirs, DirError{Dir: u.String(), Collector: testCollector, DumpType: query.DumpType, Window: u, Err: errors.New("unavailable")})
+	}
+	var results []BGPDump
+	for _, d := range f.dumps {
+		if query.DumpType != DumpTypeAny && d.DumpType != query.DumpType {
+			continue
+		}
+		if dateInRange(time.Unix(d.Timestamp, 0), query) && len(clipIntervals(f.unlisted, Interval{From: time.Unix(d.Timestamp, 0), Until: time.Unix(d.Timestamp+1, 0)})) == 0 {
+			results = append(results, d)
+		}
+	}
+	return results, incompleteFindError(dirs)
+}
+
+func (f *sliceFinder) StoreDumps(dumps []BGPDump) error {
+	f.dumps = mergeDumps(f.dumps, dumps)
+	return nil
+}
+
+func testUpdates(from time.Time, n int) []BGPDump {
+	var dumps []BGPDump
+	for i := 0; i < n; i++ {
+		ts := from.Add(time.Duration(i) * time.Duration(RISUpdatePeriod))
+		dumps = append(dumps, BGPDump{
+			URL:       "https://data.ris.ripe.net/rrc00/" + ts.Format("2006.01") + "/updates." + ts.Format("20060102.1504") + ".gz",
+			Collector: testCollector,
+			Duration:  RISUpdateDuration,
+			DumpType:  DumpTypeUpdates,
+			Timestamp: ts.Unix(),
+		})
+	}
+	return dumps
+}
+
+func TestSubtractIntervals(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return base.Add(time.Duration(h) * time.Hour) }
+
+	gaps := subtractIntervals(Interval{at(0), at(10)}, []Interval{
+		{at(2), at(4)},
+		{at(3), at(5)}, // overlaps the previous span
+		{at(5), at(6)}, // touches the previous span
+		{at(8), at(12)},
+	})
+	expected := []Interval{{at(0), at(2)}, {at(6), at(8)}}
+	if len(gaps) != len(expected) {
+		t.Fatalf("Expected gaps %v, got %v", expected, gaps)
+	}
+	for i := range expected {
+		if !gaps[i].From.Equal(expected[i].From) || !gaps[i].Until.Equal(expected[i].Until) {
+			t.Errorf("Expected gap %v, got %v", expected[i], gaps[i])
+		}
+	}
+}
+
+func TestCachingFinderFillsOnlyGaps(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	upstreamDumps := testUpdates(base, 24) // two hours of updates
+	upstream := &sliceFinder{dumps: upstreamDumps}
+
+	// The store already has the first hour, and knows it's complete.
+	store := &sliceFinder{dumps: upstreamDumps[:12]}
+	coverage := NewMemoryCoverage()
+	if err := coverage.MarkCovered(testCollector, DumpTypeUpdates, Interval{base, base.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewCachingFinder(logger, store, upstream, coverage)
+	query := Query{
+		Collectors: []Collector{testCollector},
+		From:       base,
+		Until:      base.Add(2 * time.Hour),
+		DumpType:   DumpTypeUpdates,
+	}
+
+	results, err := f.Find(query)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(results) != len(upstreamDumps) {
+		t.Errorf("Expected %d dumps, got %d", len(upstreamDumps), len(results))
+	}
+	if len(upstream.queries) != 1 || !upstream.queries[0].From.Equal(base.Add(time.Hour)) {
+		t.Errorf("Expected a single upstream query for the second hour, got %v", upstream.queries)
+	}
+	if len(store.dumps) != len(upstreamDumps) {
+		t.Errorf("Expected fetched dumps to be written back to the store, store has %d", len(store.dumps))
+	}
+
+	// Now the whole window is covered, so upstream shouldn't be asked again.
+	if _, err := f.Find(query); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(upstream.queries) != 1 {
+		t.Errorf("Expected no more upstream queries, got %d", len(upstream.queries))
+	}
+}
+
+func TestCachingFinderPointQuery(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	upstream := &sliceFinder{dumps: testUpdates(base, 3)}
+	store := &sliceFinder{}
+	coverage := NewMemoryCoverage()
+	f := NewCachingFinder(logger, store, upstream, coverage)
+
+	// A query for a single instant still has to go upstream
+	at := base.Add(5 * time.Minute)
+	results, err := f.Find(Query{
+		Collectors: []Collector{testCollector},
+		From:       at,
+		Until:      at,
+		DumpType:   DumpTypeUpdates,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(upstream.queries) != 1 {
+		t.Errorf("Expected an upstream query, got %v", upstream.queries)
+	}
+	if len(results) != 1 || results[0].Timestamp != at.Unix() {
+		t.Errorf("Expected the dump at %s, got %+v", at, results)
+	}
+}
+
+// readOnlyStore is a sliceFinder that fails to store anything, so that
+// fetched dumps only ever come back from the CachingFinder itself.
+type readOnlyStore struct {
+	*sliceFinder
+}
+
+func (s readOnlyStore) StoreDumps(dumps []BGPDump) error {
+	return fmt.Errorf("read only")
+}
+
+func TestCachingFinderFindStream(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	upstreamDumps := testUpdates(base, 24)
+	upstream := &sliceFinder{dumps: upstreamDumps}
+
+	// The store has every other dump of the (covered) first hour, and a
+	// stale copy of one dump of the second hour.
+	var storedDumps []BGPDump
+	for i := 0; i < 12; i += 2 {
+		storedDumps = append(storedDumps, upstreamDumps[i])
+	}
+	stale := upstreamDumps[20]
+	stale.RemovedAt = base.Unix()
+	storedDumps = append(storedDumps, stale)
+	store := readOnlyStore{&sliceFinder{dumps: storedDumps}}
+	coverage := NewMemoryCoverage()
+	if err := coverage.MarkCovered(testCollector, DumpTypeUpdates, Interval{base, base.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewCachingFinder(logger, store, upstream, coverage)
+	query := Query{
+		Collectors: []Collector{testCollector},
+		From:       base,
+		Until:      base.Add(2 * time.Hour),
+		DumpType:   DumpTypeUpdates,
+	}
+
+	expected, err := f.Find(query)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var streamed []BGPDump
+	err = f.FindStream(query, func(d BGPDump) error {
+		streamed = append(streamed, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(expected) != 18 {
+		t.Errorf("Expected Find to return 18 dumps, got %d", len(expected))
+	}
+	if !reflect.DeepEqual(streamed, expected) {
+		t.Errorf("Expected FindStream to match Find:\n%v\n%v", expected, streamed)
+	}
+
+	// Errors from the callback stop the stream
+	stop := errors.New("stop")
+	calls := 0
+	err = f.FindStream(query, func(d BGPDump) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Expected the stream to stop after one dump, got %v after %d", err, calls)
+	}
+}
@@ -0,0 +1,50 @@
+package bgpfinder
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// ChangeFeedLag is how far behind the present the change feed stays. A dump
+// only gets its mdate when its upsert transaction starts, but only becomes
+// visible when the transaction commits, so without the lag a poller could
+// move its cursor past dumps that were about to appear. Transactions that
+// take longer than the lag are covered by Store.ChangeFeedHorizon.
+const ChangeFeedLag = time.Minute
+
+// ChangeCursor is a position in the change feed: the (mdate, id) of the last
+// dump that the consumer has seen. Dumps are fed in that order, so the next
+// poll picks up exactly where the last one stopped.
+type ChangeCursor struct {
+	// Modified is the mdate of the dump in microseconds since the epoch
+	Modified int64
+
+	// ID is the bgp_dump_id of the dump, to break ties between dumps
+	// changed at the same time
+	ID int64
+}
+
+// ChangesSince returns a cursor that feeds every dump added or changed at
+// or after t.
+func ChangesSince(t time.Time) ChangeCursor {
+	return ChangeCursor{Modified: t.UnixMicro()}
+}
+
+// String encodes the cursor as an opaque token for clients.
+func (c ChangeCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("1:%d:%d", c.Modified, c.ID)))
+}
+
+// ParseChangeCursor decodes a token created by ChangeCursor.String.
+func ParseChangeCursor(s string) (ChangeCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ChangeCursor{}, fmt.Errorf("invalid change cursor")
+	}
+	var c ChangeCursor
+	if _, err := fmt.Sscanf(string(raw), "1:%d:%d", &c.Modified, &c.ID); err != nil {
+		return ChangeCursor{}, fmt.Errorf("invalid change cursor")
+	}
+	return c, nil
+}
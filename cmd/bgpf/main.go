@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/alistairking/bgpfinder"
@@ -69,8 +72,8 @@ type FilesCmd struct {
 	// needs some thought and love about how to make it usable.
 	Project    string             `help:"Find files for the given project"`
 	Collectors []string           `help:"Find files for the given collector"`
-	From       string             `help:"Minimum time to search for (inclusive)" required`
-	Until      string             `help:"Maximum time to search for (exclusive)" required`
+	From       string             `help:"Minimum time to search for (inclusive)" required:""`
+	Until      string             `help:"Maximum time to search for (exclusive)" required:""`
 	Type       bgpfinder.DumpType `help:"Dump type to find (${enum})" default:"${dump_type_def}" enum:"${dump_type_opts}"`
 }
 
@@ -95,17 +98,61 @@ func (f *FilesCmd) Run(parentLogger *logging.Logger, cli BgpfCLI) error {
 		return fmt.Errorf("failed to parse 'until' time: %v", err)
 	}
 
+	collectors, err := findCollectors(f.Project, f.Collectors)
+	if err != nil {
+		return err
+	}
+
+	query := bgpfinder.Query{
+		Collectors: collectors,
+		From:       fromTime,
+		Until:      untilTime,
+		DumpType:   f.Type,
+	}
+
+	logger.Info().Msg("Executing bgpfinder.Find")
+	files, err := bgpfinder.Find(query)
+	var incomplete *bgpfinder.IncompleteFindError
+	if errors.As(err, &incomplete) {
+		// Still print what was found
+		logger.Warn().Err(err).Msg("Some of the archive couldn't be listed")
+	} else if err != nil {
+		qJs, jErr := json.Marshal(query)
+		qStr := string(qJs)
+		if jErr != nil {
+			qStr = jErr.Error()
+		}
+		return fmt.Errorf("failed to find files: %v. query: %s", err.Error(), qStr)
+	}
+
+	for _, f := range files {
+		switch cli.Format {
+		case "json":
+			l, _ := json.Marshal(f)
+			fmt.Println(string(l))
+		case "csv":
+			// TODO
+			//fmt.Println(f.AsCSV())
+		}
+	}
+	return nil
+}
+
+// findCollectors builds the list of collectors matching the given project
+// and collector names. All projects/collectors if unset.
+func findCollectors(project string, collectorNames []string) ([]bgpfinder.Collector, error) {
 	// Retrieve projects
 	var projects []bgpfinder.Project
-	if f.Project == "" {
+	var err error
+	if project == "" {
 		// No project specified, get all projects
 		projects, err = bgpfinder.Projects()
 		if err != nil {
-			return fmt.Errorf("failed to get projects: %v", err)
+			return nil, fmt.Errorf("failed to get projects: %v", err)
 		}
 	} else {
 		// Use the specified project
-		projects = []bgpfinder.Project{{Name: f.Project}}
+		projects = []bgpfinder.Project{{Name: project}}
 	}
 
 	// Build the list of collectors
@@ -114,16 +161,16 @@ func (f *FilesCmd) Run(parentLogger *logging.Logger, cli BgpfCLI) error {
 		// Retrieve collectors for each project
 		projectCollectors, err := bgpfinder.Collectors(project.Name)
 		if err != nil {
-			return fmt.Errorf("failed to get collectors for project %s: %v", project.Name, err)
+			return nil, fmt.Errorf("failed to get collectors for project %s: %v", project.Name, err)
 		}
 
-		if len(f.Collectors) == 0 {
+		if len(collectorNames) == 0 {
 			// No collectors specified, use all collectors from the project
 			collectors = append(collectors, projectCollectors...)
 		} else {
 			// Collectors specified, filter collectors for the project
 			for _, collector := range projectCollectors {
-				for _, collectorName := range f.Collectors {
+				for _, collectorName := range collectorNames {
 					if collector.Name == collectorName {
 						collectors = append(collectors, collector)
 						break
@@ -135,48 +182,423 @@ func (f *FilesCmd) Run(parentLogger *logging.Logger, cli BgpfCLI) error {
 
 	// Check if any collectors were found
 	if len(collectors) == 0 {
-		return fmt.Errorf("no collectors found for the specified parameters")
+		return nil, fmt.Errorf("no collectors found for the specified parameters")
 	}
+	return collectors, nil
+}
 
-	query := bgpfinder.Query{
-		Collectors: collectors,
-		From:       fromTime,
-		Until:      untilTime,
-		DumpType:   f.Type,
+// StoreOptions are the flags shared by commands that use the database
+type StoreOptions struct {
+	DBDriver   string `help:"Database driver (${enum})" default:"postgres" enum:"postgres,sqlite"`
+	EnvFile    string `help:"Path to .env file with the Postgres configuration" default:".env"`
+	SQLitePath string `name:"sqlite-path" help:"Path to the SQLite database file" default:"bgpfinder.db"`
+}
+
+func (o StoreOptions) Open(ctx context.Context, logger *logging.Logger) (bgpfinder.Store, error) {
+	return bgpfinder.OpenStore(ctx, logger, bgpfinder.StoreConfig{
+		Driver:     o.DBDriver,
+		EnvFile:    o.EnvFile,
+		SQLitePath: o.SQLitePath,
+	})
+}
+
+type CoverageCmd struct {
+	Project    string             `help:"Show coverage for the given project"`
+	Collectors []string           `help:"Show coverage for the given collector"`
+	From       string             `help:"Start of the window to check (inclusive)" default:"1970-01-01"`
+	Until      string             `help:"End of the window to check (exclusive). Now if unset"`
+	Type       bgpfinder.DumpType `help:"Dump type to check (${enum})" default:"${dump_type_def}" enum:"${dump_type_opts}"`
+
+	StoreOptions
+}
+
+func (c *CoverageCmd) Run(parentLogger *logging.Logger, cli BgpfCLI) error {
+	logger := parentLogger.ModuleLogger("CoverageCmd")
+
+	window := bgpfinder.Interval{Until: time.Now()}
+	var err error
+	window.From, err = dateparse.ParseAny(c.From)
+	if err != nil {
+		return fmt.Errorf("failed to parse 'from' time: %v", err)
+	}
+	if c.Until != "" {
+		window.Until, err = dateparse.ParseAny(c.Until)
+		if err != nil {
+			return fmt.Errorf("failed to parse 'until' time: %v", err)
+		}
 	}
 
-	logger.Info().Msg("Executing bgpfinder.Find")
-	files, err := bgpfinder.Find(query)
+	collectors, err := findCollectors(c.Project, c.Collectors)
 	if err != nil {
-		qJs, jErr := json.Marshal(query)
-		qStr := string(qJs)
-		if jErr != nil {
-			qStr = jErr.Error()
+		return err
+	}
+
+	store, err := c.Open(context.Background(), logger)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	defer store.Close()
+	if err := bgpfinder.CheckSchemaVersion(context.Background(), store); err != nil {
+		return err
+	}
+
+	logger.Info().
+		Int("collector_count", len(collectors)).
+		Str("window", window.String()).
+		Msg("Fetching crawl coverage")
+
+	reports, err := bgpfinder.GetCoverageReports(bgpfinder.NewDBFinder(logger, store), collectors, c.Type, window)
+	if err != nil {
+		return err
+	}
+	for _, r := range reports {
+		switch cli.Format {
+		case "json":
+			l, _ := json.Marshal(r)
+			fmt.Println(string(l))
+		case "csv":
+			fmt.Println(strings.Join([]string{
+				r.Collector.AsCSV(),
+				r.DumpType.String(),
+				strconv.FormatBool(r.Complete),
+				strconv.Itoa(len(r.Covered)),
+				strconv.Itoa(len(r.Gaps)),
+			}, ","))
 		}
-		return fmt.Errorf("failed to find files: %v. query: %s", err.Error(), qStr)
 	}
+	return nil
+}
 
-	for _, f := range files {
+type GapsCmd struct {
+	Project    string             `help:"Check collectors of the given project"`
+	Collectors []string           `help:"Check the given collector"`
+	From       string             `help:"Start of the window to check (inclusive)" required:""`
+	Until      string             `help:"End of the window to check (exclusive). Now if unset"`
+	Type       bgpfinder.DumpType `help:"Dump type to check (${enum})" default:"${dump_type_def}" enum:"${dump_type_opts}"`
+	Source     string             `help:"Where to look for dumps (${enum})" default:"live" enum:"live,db"`
+
+	StoreOptions
+}
+
+func (g *GapsCmd) Run(parentLogger *logging.Logger, cli BgpfCLI) error {
+	logger := parentLogger.ModuleLogger("GapsCmd")
+
+	window := bgpfinder.Interval{Until: time.Now()}
+	var err error
+	window.From, err = dateparse.ParseAny(g.From)
+	if err != nil {
+		return fmt.Errorf("failed to parse 'from' time: %v", err)
+	}
+	if g.Until != "" {
+		window.Until, err = dateparse.ParseAny(g.Until)
+		if err != nil {
+			return fmt.Errorf("failed to parse 'until' time: %v", err)
+		}
+	}
+
+	collectors, err := findCollectors(g.Project, g.Collectors)
+	if err != nil {
+		return err
+	}
+
+	finder := bgpfinder.DefaultFinder
+	if g.Source == "db" {
+		store, err := g.Open(context.Background(), logger)
+		if err != nil {
+			return fmt.Errorf("failed to connect to database: %v", err)
+		}
+		defer store.Close()
+		if err := bgpfinder.CheckSchemaVersion(context.Background(), store); err != nil {
+			return err
+		}
+		finder = bgpfinder.NewDBFinder(logger, store)
+	}
+
+	logger.Info().
+		Int("collector_count", len(collectors)).
+		Str("window", window.String()).
+		Str("source", g.Source).
+		Msg("Finding gaps")
+
+	reports, err := bgpfinder.GetGapReports(finder, collectors, g.Type, window)
+	if err != nil {
+		return err
+	}
+	for _, r := range reports {
 		switch cli.Format {
 		case "json":
-			l, _ := json.Marshal(f)
+			l, _ := json.Marshal(r)
 			fmt.Println(string(l))
 		case "csv":
-			// TODO
-			//fmt.Println(f.AsCSV())
+			fmt.Println(strings.Join([]string{
+				r.Collector.AsCSV(),
+				r.DumpType.String(),
+				strconv.Itoa(r.Expected),
+				strconv.Itoa(r.Found),
+				strconv.Itoa(len(r.Missing)),
+				strconv.Itoa(len(r.Outages)),
+				strconv.Itoa(len(r.OffSchedule)),
+				strconv.Itoa(len(r.Unknown)),
+			}, ","))
+		}
+	}
+	return nil
+}
+
+type ScrapeRunsCmd struct {
+	Project   string             `help:"Show runs for the given project"`
+	Collector string             `help:"Show runs that scraped the given collector"`
+	Type      bgpfinder.DumpType `help:"Show runs for the given dump type (${enum})" default:"${dump_type_def}" enum:"${dump_type_opts}"`
+	Succeeded bool               `help:"Only show successful runs (for the collector, if given)"`
+	Limit     int                `help:"Maximum number of runs to show (0 for all)" default:"20"`
+
+	StoreOptions
+}
+
+func (c *ScrapeRunsCmd) Run(parentLogger *logging.Logger, cli BgpfCLI) error {
+	logger := parentLogger.ModuleLogger("ScrapeRunsCmd")
+	ctx := context.Background()
+	store, err := c.Open(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	defer store.Close()
+	if err := bgpfinder.CheckSchemaVersion(ctx, store); err != nil {
+		return err
+	}
+
+	runs, err := store.FetchScrapeRuns(ctx, bgpfinder.ScrapeRunFilter{
+		Project:   c.Project,
+		Collector: c.Collector,
+		DumpType:  c.Type,
+		Succeeded: c.Succeeded,
+		Limit:     c.Limit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch scrape runs: %v", err)
+	}
+	for _, r := range runs {
+		printScrapeRun(r, cli.Format)
+	}
+	return nil
+}
+
+func printScrapeRun(r bgpfinder.ScrapeRun, format string) {
+	switch format {
+	case "json":
+		l, _ := json.Marshal(r)
+		fmt.Println(string(l))
+	case "csv":
+		finished := ""
+		if r.Finished != nil {
+			finished = strconv.FormatInt(r.Finished.Unix(), 10)
+		}
+		fmt.Println(strings.Join([]string{
+			strconv.FormatInt(r.ID, 10),
+			r.Source,
+			r.Project,
+			r.DumpType.String(),
+			string(r.Status),
+			strconv.FormatInt(r.Started.Unix(), 10),
+			finished,
+			strconv.Itoa(len(r.CollectorsAttempted)),
+			strconv.Itoa(len(r.CollectorsSucceeded)),
+			strconv.Itoa(r.DumpsFound),
+			strconv.Itoa(r.DumpsInserted),
+			strconv.Itoa(r.Retries),
+			strconv.Itoa(len(r.Errors)),
+		}, ","))
+	}
+}
+
+type BackfillCmd struct {
+	Project       string             `help:"Backfill collectors of the given project" required:""`
+	Collectors    []string           `help:"Backfill the given collector (all of the project's if unset)"`
+	From          string             `help:"Start of the range to backfill (inclusive)" required:""`
+	Until         string             `help:"End of the range to backfill (exclusive)" required:""`
+	Type          bgpfinder.DumpType `help:"Dump type to backfill (${enum})" default:"${dump_type_def}" enum:"${dump_type_opts}"`
+	Chunk         time.Duration      `help:"Size of the pieces each collector's range is crawled and checkpointed in" default:"168h"`
+	Concurrency   int                `help:"Number of collectors to crawl at once" default:"4"`
+	RecrawlBefore string             `help:"Recrawl chunks last crawled before this time (by default, chunks crawled before are skipped)"`
+	Recrawl       bool               `help:"Recrawl every chunk. Same as --recrawl-before now"`
+	DryRun        bool               `help:"Compare what would be found in each chunk with the database and print the differences, without writing anything"`
+	DiffFormat    string             `help:"Format of the dry run's report" default:"text" enum:"text,json"`
+
+	StoreOptions
+}
+
+func (b *BackfillCmd) Run(ctx context.Context, parentLogger *logging.Logger, cli BgpfCLI) error {
+	logger := parentLogger.ModuleLogger("BackfillCmd")
+
+	var window bgpfinder.Interval
+	var err error
+	window.From, err = dateparse.ParseAny(b.From)
+	if err != nil {
+		return fmt.Errorf("failed to parse 'from' time: %v", err)
+	}
+	window.Until, err = dateparse.ParseAny(b.Until)
+	if err != nil {
+		return fmt.Errorf("failed to parse 'until' time: %v", err)
+	}
+	var recrawlBefore time.Time
+	switch {
+	case b.Recrawl && b.RecrawlBefore != "":
+		return fmt.Errorf("only one of --recrawl and --recrawl-before can be given")
+	case b.Recrawl:
+		recrawlBefore = time.Now()
+	case b.RecrawlBefore != "":
+		recrawlBefore, err = dateparse.ParseAny(b.RecrawlBefore)
+		if err != nil {
+			return fmt.Errorf("failed to parse 'recrawl-before' time: %v", err)
+		}
+	}
+
+	collectors, err := findCollectors(b.Project, b.Collectors)
+	if err != nil {
+		return err
+	}
+
+	store, err := b.Open(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	defer store.Close()
+	if err := bgpfinder.CheckSchemaVersion(ctx, store); err != nil {
+		return err
+	}
+
+	if b.DryRun {
+		diffs, err := bgpfinder.DiffRange(ctx, logger, store, bgpfinder.DefaultFinder, bgpfinder.RangeBackfillConfig{
+			Collectors: collectors,
+			DumpType:   b.Type,
+			Window:     window,
+			Chunk:      b.Chunk,
+		})
+		if wErr := bgpfinder.WriteDiffReport(os.Stdout, diffs, b.DiffFormat); wErr != nil {
+			return fmt.Errorf("failed to write diff report: %v", wErr)
 		}
+		return err
+	}
+
+	holder := bgpfinder.NewLeaseHolder()
+	logger.Info().
+		Int("collector_count", len(collectors)).
+		Str("window", window.String()).
+		Str("holder", holder).
+		Msg("Backfilling range")
+	if !recrawlBefore.IsZero() {
+		logger.Info().
+			Str("recrawl_before", recrawlBefore.UTC().Format(time.RFC3339)).
+			Msg("Recrawling chunks. If interrupted, resume with the same --recrawl-before")
+	}
+
+	runs, err := bgpfinder.RunRangeBackfill(ctx, logger, store, bgpfinder.DefaultFinder, bgpfinder.RangeBackfillConfig{
+		Collectors:    collectors,
+		DumpType:      b.Type,
+		Window:        window,
+		Chunk:         b.Chunk,
+		Concurrency:   b.Concurrency,
+		RecrawlBefore: recrawlBefore,
+		Leaser:        bgpfinder.NewLeaser(logger, store, holder, 0),
+	})
+	for _, r := range runs {
+		printScrapeRun(*r, cli.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("backfill stopped, rerun to resume: %v", err)
+	}
+	return nil
+}
+
+type MigrateCmd struct {
+	Up     MigrateUpCmd     `cmd:"" help:"Apply all pending migrations"`
+	Down   MigrateDownCmd   `cmd:"" help:"Roll back the most recent migrations"`
+	Status MigrateStatusCmd `cmd:"" help:"Show the current and latest schema versions"`
+
+	StoreOptions
+}
+
+type MigrateUpCmd struct{}
+
+func (m *MigrateUpCmd) Run(parentLogger *logging.Logger, cli BgpfCLI) error {
+	logger := parentLogger.ModuleLogger("MigrateUpCmd")
+	ctx := context.Background()
+	store, err := cli.Migrate.Open(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	defer store.Close()
+
+	version, err := bgpfinder.MigrateUp(ctx, logger, store)
+	if err != nil {
+		return err
+	}
+	logger.Info().Int("schema_version", version).Msg("Database is up to date")
+	return nil
+}
+
+type MigrateDownCmd struct {
+	Steps int `help:"Number of migrations to roll back" default:"1"`
+}
+
+func (m *MigrateDownCmd) Run(parentLogger *logging.Logger, cli BgpfCLI) error {
+	logger := parentLogger.ModuleLogger("MigrateDownCmd")
+	ctx := context.Background()
+	store, err := cli.Migrate.Open(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	defer store.Close()
+
+	version, err := bgpfinder.MigrateDown(ctx, logger, store, m.Steps)
+	if err != nil {
+		return err
+	}
+	logger.Info().Int("schema_version", version).Msg("Rolled back database migrations")
+	return nil
+}
+
+type MigrateStatusCmd struct{}
+
+func (m *MigrateStatusCmd) Run(parentLogger *logging.Logger, cli BgpfCLI) error {
+	logger := parentLogger.ModuleLogger("MigrateStatusCmd")
+	ctx := context.Background()
+	store, err := cli.Migrate.Open(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	defer store.Close()
+
+	status, err := bgpfinder.GetSchemaStatus(ctx, store)
+	if err != nil {
+		return err
+	}
+	switch cli.Format {
+	case "json":
+		l, _ := json.Marshal(status)
+		fmt.Println(string(l))
+	case "csv":
+		fmt.Printf("%d,%d\n", status.Current, status.Latest)
+	}
+	for _, p := range status.Pending {
+		logger.Info().Str("migration", p.String()).Msg("Pending migration")
 	}
 	return nil
 }
 
 type BgpfCLI struct {
 	// sub commands
-	Projects   ProjectsCmd   `cmd help:"Get information about supported projects"`
-	Collectors CollectorsCmd `cmd help:"Get information about supported collectors"`
-	Files      FilesCmd      `cmd help:"Find BGP dump files"`
+	Projects   ProjectsCmd   `cmd:"" help:"Get information about supported projects"`
+	Collectors CollectorsCmd `cmd:"" help:"Get information about supported collectors"`
+	Files      FilesCmd      `cmd:"" help:"Find BGP dump files"`
+	Coverage   CoverageCmd   `cmd:"" help:"Show which spans have been crawled into the database"`
+	Gaps       GapsCmd       `cmd:"" help:"Show the expected dumps that are missing"`
+	ScrapeRuns ScrapeRunsCmd `cmd:"" help:"Show the history of scrape runs"`
+	Backfill   BackfillCmd   `cmd:"" help:"Crawl a range of history into the database"`
+	Migrate    MigrateCmd    `cmd:"" help:"Manage the database schema"`
 
 	// global options
-	Format string `help"Output format" default:"json" enum:"json,csv"`
+	Format string `help:"Output format" default:"json" enum:"json,csv"`
 
 	// logging configuration
 	logging.LoggerConfig
@@ -226,6 +648,7 @@ func main() {
 	k.FatalIfErrorf(err)
 	defer os.Stderr.Sync() // flush remaining logs
 	handleSignals(ctx, logger, cancel)
+	k.BindTo(ctx, (*context.Context)(nil))
 
 	// TODO: update bgpfinder API to include Context in most/all
 	// calls since any of them might need to do blocking
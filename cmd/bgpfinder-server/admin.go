@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+	"github.com/gorilla/mux"
+)
+
+// adminTokenEnv names the environment variable holding the bearer token that
+// the admin API requires. The admin API is disabled if it's unset.
+const adminTokenEnv = "BGPFINDER_ADMIN_TOKEN"
+
+// ScrapeJobRequest is the body of a POST to /admin/scrapes. Collectors
+// default to all of the project's (or all collectors if there's no
+// project), and the type defaults to both.
+type ScrapeJobRequest struct {
+	Project    string   `json:"project"`
+	Collectors []string `json:"collectors"`
+	Type       string   `json:"type"`
+	From       int64    `json:"from"`
+	Until      int64    `json:"until"`
+}
+
+// requireAdmin is a mux middleware that rejects requests that don't carry
+// the admin bearer token.
+func requireAdmin(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isAdmin(r, token) {
+				adminUnauthorized(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isAdmin reports whether the request carries the admin bearer token. No
+// request does if the token is empty.
+func isAdmin(r *http.Request, token string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func adminUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="bgpfinder-admin"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// registerAdminRoutes adds the admin API, guarded by the token, to the
+// router.
+func registerAdminRoutes(router *mux.Router, token string, finder bgpfinder.Finder, jobs *bgpfinder.ScrapeJobs) {
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin(token))
+	admin.HandleFunc("/scrapes", enqueueScrapeHandler(finder, jobs)).Methods("POST")
+	admin.HandleFunc("/scrapes", listScrapesHandler(jobs)).Methods("GET")
+	admin.HandleFunc("/scrapes/{id}", getScrapeHandler(jobs)).Methods("GET")
+	admin.HandleFunc("/scrapes/{id}", cancelScrapeHandler(jobs)).Methods("DELETE")
+}
+
+// enqueueScrapeHandler handles POST /admin/scrapes
+func enqueueScrapeHandler(finder bgpfinder.Finder, jobs *bgpfinder.ScrapeJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body ScrapeJobRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid scrape request: %v", err), http.StatusBadRequest)
+			return
+		}
+		req, err := parseScrapeJobRequest(body, finder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jsonStatusResponse(w, http.StatusAccepted, jobs.Enqueue(req))
+	}
+}
+
+// parseScrapeJobRequest resolves the collectors and type of the request.
+func parseScrapeJobRequest(body ScrapeJobRequest, finder bgpfinder.Finder) (bgpfinder.ScrapeRequest, error) {
+	var req bgpfinder.ScrapeRequest
+	var projects, types []string
+	if body.Project != "" {
+		projects = []string{body.Project}
+	}
+	if body.Type != "" {
+		types = []string{body.Type}
+	}
+
+	collectors, err := parseCollectors(projects, body.Collectors, finder)
+	if err != nil {
+		return req, err
+	}
+	if len(collectors) == 0 {
+		return req, fmt.Errorf("no collectors to scrape")
+	}
+	dumpType, err := parseDumpType(types)
+	if err != nil {
+		return req, err
+	}
+	window := bgpfinder.Interval{From: time.Unix(body.From, 0), Until: time.Unix(body.Until, 0)}
+	if window.Empty() {
+		return req, fmt.Errorf("until must be after from")
+	}
+
+	req.Collectors = collectors
+	req.DumpType = dumpType
+	req.Window = window
+	return req, nil
+}
+
+// listScrapesHandler handles GET /admin/scrapes
+func listScrapesHandler(jobs *bgpfinder.ScrapeJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonResponse(w, jobs.List())
+	}
+}
+
+// getScrapeHandler handles GET /admin/scrapes/{id}
+func getScrapeHandler(jobs *bgpfinder.ScrapeJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid scrape job ID", http.StatusBadRequest)
+			return
+		}
+		job, err := jobs.Get(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		jsonResponse(w, job)
+	}
+}
+
+// cancelScrapeHandler handles DELETE /admin/scrapes/{id}
+func cancelScrapeHandler(jobs *bgpfinder.ScrapeJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid scrape job ID", http.StatusBadRequest)
+			return
+		}
+		job, err := jobs.Cancel(id)
+		switch {
+		case errors.Is(err, bgpfinder.ErrScrapeJobNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, bgpfinder.ErrScrapeJobFinished):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			jsonResponse(w, job)
+		}
+	}
+}
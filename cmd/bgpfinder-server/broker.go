@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+)
+
+// brokerVersion is the version of the BGPStream broker API that /data
+// implements.
+const brokerVersion = 2
+
+// now is the clock used for response times. Tests replace it so that
+// responses can be compared against golden files.
+var now = time.Now
+
+// QueryParameters echoes the broker parameters of a /data request back to
+// the client, as the BGPStream broker does.
+type QueryParameters struct {
+	Collectors     []string `json:"collectors"`
+	Projects       []string `json:"projects"`
+	Types          []string `json:"types"`
+	Intervals      []string `json:"intervals"`
+	MinInitialTime *int64   `json:"minInitialTime"`
+	DataAddedSince *int64   `json:"dataAddedSince"`
+	Human          bool     `json:"human"`
+}
+
+type Data struct {
+	Resources []bgpfinder.BGPDump `json:"resources"`
+}
+
+// DataResponse is the BGPStream broker response envelope.
+type DataResponse struct {
+	Version         int             `json:"version"`
+	Time            int64           `json:"time"`
+	Type            string          `json:"type"`
+	Error           *string         `json:"error"`
+	QueryParameters QueryParameters `json:"queryParameters"`
+	Data            *Data           `json:"data"`
+
+	// Cursor is where to resume from: the next poll of the change feed,
+	// or the next page of a paged request. Unset if there's nothing more.
+	Cursor string `json:"cursor,omitempty"`
+
+	// Next is the URL of the request that resumes from Cursor
+	Next string `json:"next,omitempty"`
+}
+
+// DataRequest is a parsed /data request.
+type DataRequest struct {
+	Params QueryParameters
+
+	// Queries has one query per requested interval
+	Queries []bgpfinder.Query
+
+	// MinInitialTime drops dumps that start before it (seconds since
+	// epoch, 0 if unset)
+	MinInitialTime int64
+
+	// Human asks for an indented response
+	Human bool
+
+	// Limit caps the number of dumps returned. Unlimited if 0
+	Limit int
+
+	// After resumes a paged request after the cursor
+	After *bgpfinder.DumpCursor
+}
+
+// newQueryParameters collects the broker parameters of the request. Lists
+// are never nil, so that they're encoded as [] rather than null.
+func newQueryParameters(r *http.Request) QueryParameters {
+	values := r.URL.Query()
+	params := QueryParameters{
+		Collectors: append([]string{}, values["collectors[]"]...),
+		Projects:   append([]string{}, values["projects[]"]...),
+		Types:      append([]string{}, values["types[]"]...),
+		Intervals:  append([]string{}, values["intervals[]"]...),
+		Human:      isHuman(r),
+	}
+	if v, err := strconv.ParseInt(values.Get("minInitialTime"), 10, 64); err == nil {
+		params.MinInitialTime = &v
+	}
+	if v, err := strconv.ParseInt(values.Get("dataAddedSince"), 10, 64); err == nil {
+		params.DataAddedSince = &v
+	}
+	return params
+}
+
+// isHuman reports whether the request asked for human readable output.
+func isHuman(r *http.Request) bool {
+	human := strings.ToLower(r.URL.Query().Get("human"))
+	return human == "true" || human == "1"
+}
+
+// findAll runs a query per interval and merges the results in bgpstream
+// order, dropping dumps found by more than one query.
+func findAll(find func(bgpfinder.Query) ([]bgpfinder.BGPDump, error), queries []bgpfinder.Query) ([]bgpfinder.BGPDump, error) {
+	if len(queries) == 1 {
+		return find(queries[0])
+	}
+
+	seen := map[string]bool{}
+	var results []bgpfinder.BGPDump
+	for _, query := range queries {
+		dumps, err := find(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range dumps {
+			if !seen[d.URL] {
+				seen[d.URL] = true
+				results = append(results, d)
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return bgpfinder.CursorOf(results[i]).Before(bgpfinder.CursorOf(results[j]))
+	})
+	return results, nil
+}
+
+// filterMinInitialTime drops the dumps that start before minInitialTime.
+func filterMinInitialTime(dumps []bgpfinder.BGPDump, minInitialTime int64) []bgpfinder.BGPDump {
+	if minInitialTime == 0 {
+		return dumps
+	}
+	filtered := dumps[:0]
+	for _, d := range dumps {
+		if d.Timestamp >= minInitialTime {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// dataResponse sends a successful broker response.
+func dataResponse(w http.ResponseWriter, req DataRequest, responseTime time.Time, results []bgpfinder.BGPDump, cursor string, next string) {
+	if results == nil {
+		results = []bgpfinder.BGPDump{}
+	}
+	writeDataResponse(w, req.Human, http.StatusOK, DataResponse{
+		Version:         brokerVersion,
+		Time:            responseTime.Unix(),
+		Type:            "data",
+		QueryParameters: req.Params,
+		Data:            &Data{Resources: results},
+		Cursor:          cursor,
+		Next:            next,
+	})
+}
+
+// dataError sends a broker response that reports an error.
+func dataError(w http.ResponseWriter, r *http.Request, status int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	writeDataResponse(w, isHuman(r), status, DataResponse{
+		Version:         brokerVersion,
+		Time:            now().Unix(),
+		Type:            "data",
+		Error:           &msg,
+		QueryParameters: newQueryParameters(r),
+	})
+}
+
+func writeDataResponse(w http.ResponseWriter, human bool, status int, resp DataResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	if human {
+		enc.SetIndent("", "  ")
+	}
+	// The status has already been sent, so there's nothing more to do if
+	// this fails.
+	_ = enc.Encode(resp)
+}
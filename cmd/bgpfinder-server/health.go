@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+	"github.com/alistairking/bgpfinder/periodicscraper"
+)
+
+// readinessTimeout bounds how long the readiness checks may take, so that a
+// hung database makes the server unready rather than hanging the probe.
+const readinessTimeout = 5 * time.Second
+
+// defaultScrapeRunsLimit is how many scrape runs /status/scrape-runs returns
+// unless asked for a different limit.
+const defaultScrapeRunsLimit = 100
+
+// HealthResponse is the body of /healthz and /readyz. Checks maps the name of
+// each readiness check to "ok" or the reason that it failed.
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// CollectorStatus reports how fresh the known dumps of a collector are.
+type CollectorStatus struct {
+	Project   string `json:"project"`
+	Collector string `json:"collector"`
+	DumpType  string `json:"type"`
+
+	// Newest is the timestamp of the newest known dump. Unset if there's
+	// none (or no DB to know about them).
+	Newest *int64 `json:"newest"`
+
+	// ExpectedLatest is the timestamp of the newest dump the archive should
+	// have published by now. Unset for projects we don't know the period of.
+	ExpectedLatest *int64 `json:"expectedLatest"`
+
+	// Status is "ok", "stale" (the newest dump is older than expected) or
+	// "unknown".
+	Status string `json:"status"`
+}
+
+// healthHandler handles /healthz. It only reports that the process is up
+// and serving requests.
+func healthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonResponse(w, HealthResponse{Status: "ok"})
+	}
+}
+
+// readyHandler handles /readyz. The server is ready once the collector lists
+// have been loaded and, if the DB is enabled, the DB is reachable and its
+// schema is current.
+func readyHandler(finder bgpfinder.Finder, store bgpfinder.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		checks := map[string]string{}
+		ready := true
+		check := func(name string, err error) {
+			if err != nil {
+				checks[name] = err.Error()
+				ready = false
+			} else {
+				checks[name] = "ok"
+			}
+		}
+
+		collectors, err := finder.Collectors("")
+		if err == nil && len(collectors) == 0 {
+			err = fmt.Errorf("no collectors loaded")
+		}
+		check("collectors", err)
+
+		if store != nil {
+			_, err := store.SchemaVersion(ctx)
+			check("database", err)
+			if err == nil {
+				check("migrations", bgpfinder.CheckSchemaVersion(ctx, store))
+			}
+		}
+
+		resp := HealthResponse{Status: "ok", Checks: checks}
+		status := http.StatusOK
+		if !ready {
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+		jsonStatusResponse(w, status, resp)
+	}
+}
+
+// collectorStatusHandler handles /status/collectors, which compares the
+// newest known dump of each collector and dump type against the newest one
+// that its archive should have published by now.
+func collectorStatusHandler(finder bgpfinder.Finder, store bgpfinder.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collectors, err := parseCollectors(r.URL.Query()["projects[]"], r.URL.Query()["collectors[]"], finder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		statuses, err := collectorStatuses(r.Context(), collectors, store)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching collector status: %v", err), http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, statuses)
+	}
+}
+
+// collectorStatuses builds the status of each of the collectors for each
+// dump type. Newest dumps are only known if there's a store.
+func collectorStatuses(ctx context.Context, collectors []bgpfinder.Collector, store bgpfinder.Store) ([]CollectorStatus, error) {
+	type latestKey struct {
+		project  string
+		dumpType bgpfinder.DumpType
+	}
+	latest := map[latestKey]map[string]time.Time{}
+
+	statuses := []CollectorStatus{}
+	for _, collector := range collectors {
+		for _, dumpType := range []bgpfinder.DumpType{bgpfinder.DumpTypeRibs, bgpfinder.DumpTypeUpdates} {
+			status := CollectorStatus{
+				Project:   collector.Project.Name,
+				Collector: collector.Name,
+				DumpType:  dumpType.String(),
+				Status:    "unknown",
+			}
+
+			expected := periodicscraper.ExpectedMostRecent(collector.Project.Name, dumpType == bgpfinder.DumpTypeRibs)
+			if !expected.IsZero() {
+				ts := expected.Unix()
+				status.ExpectedLatest = &ts
+			}
+
+			if store != nil {
+				key := latestKey{project: collector.Project.Name, dumpType: dumpType}
+				times, ok := latest[key]
+				if !ok {
+					var err error
+					times, err = store.FetchLatestDumpTimes(ctx, key.project, dumpType)
+					if err != nil {
+						return nil, err
+					}
+					latest[key] = times
+				}
+				if newest, ok := times[collector.Name]; ok {
+					ts := newest.Unix()
+					status.Newest = &ts
+				}
+			}
+
+			if status.Newest != nil && status.ExpectedLatest != nil {
+				if *status.Newest < *status.ExpectedLatest {
+					status.Status = "stale"
+				} else {
+					status.Status = "ok"
+				}
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// scrapeRunsHandler handles /status/scrape-runs, which lists the scrape
+// history, newest first. It can be filtered by project, collector and type,
+// and to successful runs (for that collector, if there is one) with
+// succeeded=true.
+func scrapeRunsHandler(store bgpfinder.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			http.Error(w, "Scrape history is only kept when the DB is enabled", http.StatusNotFound)
+			return
+		}
+		params := r.URL.Query()
+		filter := bgpfinder.ScrapeRunFilter{
+			Project:   params.Get("project"),
+			Collector: params.Get("collector"),
+			Succeeded: strings.ToLower(params.Get("succeeded")) == "true",
+			Limit:     defaultScrapeRunsLimit,
+		}
+		var err error
+		if filter.DumpType, err = parseDumpType(params["type"]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if limit, err := parseLimit(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if limit > 0 {
+			filter.Limit = limit
+		}
+
+		runs, err := store.FetchScrapeRuns(r.Context(), filter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching scrape runs: %v", err), http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, runs)
+	}
+}
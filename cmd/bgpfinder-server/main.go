@@ -17,65 +17,28 @@ import (
 
 	"github.com/alistairking/bgpfinder"
 	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/alistairking/bgpfinder/internal/metrics"
 	"github.com/gorilla/mux"
-	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/joho/godotenv"
 	"golang.org/x/sync/errgroup"
 )
 
-type DBConfig struct {
-	Host     string
-	Port     string
-	User     string
-	Password string
-	DBName   string
-}
-
-/*
-type QueryParameters struct {
-}*/
-
-type Data struct {
-	Resources []bgpfinder.BGPDump `json:"resources"`
-}
-
-type DataResponse struct {
-	//Version string `json:"version,omitempty"`
-	//Time int `json:"time,omitempty"`
-	//Type string `json:"type,omitempty"`
-	//Error *string `json:"error"`
-	//QueryParameters QueryParameters `json:"queryParameters"`
-	Query bgpfinder.Query `json:"queryParameters"`
-	Data            Data            `json:"data"`
-}
-
-func loadDBConfig(envFile string) (*DBConfig, error) {
-	if err := godotenv.Load(envFile); err != nil {
-		return nil, fmt.Errorf("error loading env file: %w", err)
-	}
-
-	config := &DBConfig{
-		Host:     os.Getenv("POSTGRES_HOST"),
-		Port:     os.Getenv("POSTGRES_PORT"),
-		User:     os.Getenv("POSTGRES_USER"),
-		Password: os.Getenv("POSTGRES_PASSWORD"),
-		DBName:   os.Getenv("POSTGRES_DB"),
-	}
-
-	// Validate required fields
-	if config.User == "" || config.Password == "" || config.DBName == "" {
-		return nil, fmt.Errorf("missing required database configuration")
-	}
-
-	return config, nil
-}
+// changeFeedPageSize is the most dumps that a single change feed poll
+// returns. Consumers that get a full page should poll again straight away.
+const changeFeedPageSize = 10000
 
 func main() {
 	portPtr := flag.String("port", "8080", "port to listen on")
 	logLevel := flag.String("loglevel", "info", "Log level (debug, info, warn, error)")
-	scrapeFreq := flag.Duration("scrape-frequency", 168*time.Hour, "Scraping frequency")
+	scrapeFreq := flag.Duration("scrape-frequency", 0, "Full re-crawl frequency (0 to leave it to the tiered backfill, or weekly if that's disabled too)")
+	backfillInterval := flag.Duration("backfill-interval", bgpfinder.DefaultBackfillInterval, "How often the tiered backfill looks for windows to recrawl (0 to disable)")
 	useDB := flag.Bool("use-db", false, "Enable database functionality")
-	envFile := flag.String("env-file", ".env", "Path to .env file (required if use-db is true)")
+	envFile := flag.String("env-file", ".env", "Path to .env file (required if use-db is true and db-driver is postgres)")
+	dbDriver := flag.String("db-driver", bgpfinder.StoreDriverPostgres, "Database driver (postgres, sqlite)")
+	sqlitePath := flag.String("sqlite-path", "bgpfinder.db", "Path to the SQLite database file (if db-driver is sqlite)")
+	autoMigrate := flag.Bool("auto-migrate", false, "Apply pending database migrations on startup")
+	maintenanceFreq := flag.Duration("maintenance-frequency", 24*time.Hour, "Database maintenance (partitioning and retention) frequency")
+	var retention bgpfinder.RetentionPolicies
+	flag.Var(&retention, "retention", "Retention policy as <type>=<age> (e.g., updates=2y). May be repeated")
 	flag.Parse()
 
 	loggerConfig := logging.LoggerConfig{
@@ -87,27 +50,28 @@ func main() {
 		os.Exit(1)
 	}
 
-	var db *pgxpool.Pool
+	var store bgpfinder.Store
 	if *useDB {
-		config, err := loadDBConfig(*envFile)
+		store, err = bgpfinder.OpenStore(context.Background(), logger, bgpfinder.StoreConfig{
+			Driver:     *dbDriver,
+			EnvFile:    *envFile,
+			SQLitePath: *sqlitePath,
+		})
 		if err != nil {
-			logger.Fatal().Err(err).Msg("Failed to load database configuration")
+			logger.Fatal().Err(err).Msg("Unable to connect to database")
 		}
+		defer store.Close()
 
-		connStr := fmt.Sprintf(
-			"postgres://%s:%s@%s:%s/%s?sslmode=disable",
-			config.User,
-			config.Password,
-			config.Host,
-			config.Port,
-			config.DBName,
-		)
-
-		db, err = pgxpool.New(context.Background(), connStr)
-		if err != nil {
-			logger.Fatal().Err(err).Msg("Unable to connect to database")
+		if *autoMigrate {
+			version, err := bgpfinder.MigrateUp(context.Background(), logger, store)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("Failed to apply database migrations")
+			}
+			logger.Info().Int("schema_version", version).Msg("Database migrations applied")
+		}
+		if err := bgpfinder.CheckSchemaVersion(context.Background(), store); err != nil {
+			logger.Fatal().Err(err).Msg("Refusing to start")
 		}
-		defer db.Close()
 		logger.Info().Msg("Successfully connected to Database")
 	}
 
@@ -116,18 +80,61 @@ func main() {
 	defer stop()
 
 	// Start periodic scraping with the configured frequency
+	var leaser *bgpfinder.Leaser
 	if *useDB {
-		bgpfinder.StartPeriodicScraping(ctx, logger, *scrapeFreq, db, bgpfinder.DefaultFinder)
+		bgpfinder.StartPeriodicMaintenance(ctx, logger, *maintenanceFreq, store, bgpfinder.MaintenanceConfig{
+			Retention:          retention,
+			PartitionLookahead: bgpfinder.DefaultPartitionLookahead,
+		})
+		// Leases keep the scraping here from duplicating a standalone
+		// periodic scraper's (or another server's)
+		holder := bgpfinder.NewLeaseHolder()
+		logger.Info().Str("holder", holder).Msg("Taking scrape leases")
+		leaser = bgpfinder.NewLeaser(logger, store, holder, 0)
+		// The backfill already revisits the whole history, so a full
+		// re-crawl is only needed without it
+		if *scrapeFreq == 0 && *backfillInterval == 0 {
+			*scrapeFreq = 168 * time.Hour
+		}
+		if *scrapeFreq > 0 {
+			bgpfinder.StartPeriodicScraping(ctx, logger, *scrapeFreq, store, bgpfinder.DefaultFinder, leaser)
+		}
+		if *backfillInterval > 0 {
+			backfiller, err := bgpfinder.NewBackfiller(logger, store, bgpfinder.DefaultFinder, bgpfinder.BackfillConfig{
+				Interval: *backfillInterval,
+				Leaser:   leaser,
+			})
+			if err != nil {
+				logger.Fatal().Err(err).Msg("Invalid backfill configuration")
+			}
+			backfiller.Start(ctx)
+		}
 		// periodicscraper.Main(ctx, logger, db)
 	}
 
 	// // Handle HTTP requests
+	finder := bgpfinder.DefaultFinder
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/meta/projects", projectHandler).Methods("GET")
-	router.HandleFunc("/meta/projects/{project}", projectHandler).Methods("GET")
-	router.HandleFunc("/meta/collectors", collectorHandler).Methods("GET")
-	router.HandleFunc("/meta/collectors/{collector}", collectorHandler).Methods("GET")
-	router.HandleFunc("/data", dataHandler(db, logger)).Methods("GET")
+	router.HandleFunc("/meta/projects", projectHandler(finder)).Methods("GET")
+	router.HandleFunc("/meta/projects/{project}", projectHandler(finder)).Methods("GET")
+	router.HandleFunc("/meta/collectors", collectorHandler(finder)).Methods("GET")
+	router.HandleFunc("/meta/collectors/{collector}", collectorHandler(finder)).Methods("GET")
+	router.HandleFunc("/meta/coverage", coverageHandler(finder, store, logger)).Methods("GET")
+	router.HandleFunc("/meta/gaps", gapsHandler(finder, store, logger, os.Getenv(adminTokenEnv))).Methods("GET")
+	router.HandleFunc("/data", dataHandler(finder, store, logger)).Methods("GET")
+	router.HandleFunc("/status/collectors", collectorStatusHandler(finder, store)).Methods("GET")
+	router.HandleFunc("/status/scrape-runs", scrapeRunsHandler(store)).Methods("GET")
+	router.HandleFunc("/healthz", healthHandler()).Methods("GET")
+	router.HandleFunc("/readyz", readyHandler(finder, store)).Methods("GET")
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	if token := os.Getenv(adminTokenEnv); *useDB && token != "" {
+		jobs := bgpfinder.NewScrapeJobs(logger, store, bgpfinder.DefaultFinder, leaser)
+		jobs.Start(ctx)
+		registerAdminRoutes(router, token, finder, jobs)
+	} else {
+		logger.Info().Msgf("Admin API disabled (it needs --use-db and %s to be set)", adminTokenEnv)
+	}
+	router.Use(instrumentRoutes)
 
 	server := &http.Server{
 		Addr:    ":" + *portPtr,
@@ -171,211 +178,542 @@ func main() {
 }
 
 // projectHandler handles /meta/projects and /meta/projects/{project} endpoints
-func projectHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	projectName := vars["project"]
+func projectHandler(finder bgpfinder.Finder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		projectName := vars["project"]
 
-	projects, err := bgpfinder.Projects()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching projects: %v", err), http.StatusInternalServerError)
-		return
-	}
+		projects, err := finder.Projects()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching projects: %v", err), http.StatusInternalServerError)
+			return
+		}
 
-	if projectName == "" {
-		// Return all projects
-		jsonResponse(w, projects)
-	} else {
-		// Return specific project if exists
-		for _, project := range projects {
-			if project.Name == projectName {
-				jsonResponse(w, project)
-				return
+		if projectName == "" {
+			// Return all projects
+			jsonResponse(w, projects)
+		} else {
+			// Return specific project if exists
+			for _, project := range projects {
+				if project.Name == projectName {
+					jsonResponse(w, project)
+					return
+				}
 			}
+			http.Error(w, "Project not found", http.StatusNotFound)
 		}
-		http.Error(w, "Project not found", http.StatusNotFound)
 	}
 }
 
 // collectorHandler handles /meta/collectors and /meta/collectors/{collector} endpoints
-func collectorHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	collectorName := vars["collector"]
+func collectorHandler(finder bgpfinder.Finder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collectorName := vars["collector"]
 
-	collectors, err := bgpfinder.Collectors("")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching collectors: %v", err), http.StatusInternalServerError)
-		return
-	}
+		collectors, err := finder.Collectors("")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching collectors: %v", err), http.StatusInternalServerError)
+			return
+		}
 
-	if collectorName == "" {
-		// Return all collectors
-		jsonResponse(w, collectors)
-	} else {
-		// Return specific collector if exists
-		for _, collector := range collectors {
-			if collector.Name == collectorName {
-				jsonResponse(w, collector)
+		if collectorName == "" {
+			// Return all collectors, a page at a time if asked to
+			limit, err := parseLimit(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			var after *collectorCursor
+			if param := r.URL.Query().Get("cursor"); param != "" {
+				cursor, err := parseCollectorCursor(param)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				after = &cursor
+			}
+			if limit > 0 || after != nil {
+				var next *collectorCursor
+				collectors, next = pageCollectors(collectors, after, limit)
+				if next != nil {
+					nextLink(w, r, next.String())
+				}
+			}
+			jsonResponse(w, collectors)
+		} else {
+			// Return specific collector if exists
+			for _, collector := range collectors {
+				if collector.Name == collectorName {
+					jsonResponse(w, collector)
+					return
+				}
+			}
+			http.Error(w, "Collector not found", http.StatusNotFound)
 		}
-		http.Error(w, "Collector not found", http.StatusNotFound)
 	}
 }
 
-// parseDataRequest parses the HTTP request and builds a bgpfinder.Query object
-func parseDataRequest(r *http.Request) (bgpfinder.Query, error) {
-	query := bgpfinder.Query{}
+// parseDataRequest parses the broker parameters of the HTTP request and
+// builds a bgpfinder.Query for each requested interval
+func parseDataRequest(r *http.Request, finder bgpfinder.Finder) (DataRequest, error) {
+	req := DataRequest{
+		Params: newQueryParameters(r),
+		Human:  isHuman(r),
+	}
+	params := r.URL.Query()
+	var err error
+
+	if v := params.Get("minInitialTime"); v != "" {
+		if req.Params.MinInitialTime == nil {
+			return req, fmt.Errorf("invalid minInitialTime: %s", v)
+		}
+		req.MinInitialTime = *req.Params.MinInitialTime
+	}
+	if v := params.Get("dataAddedSince"); v != "" && req.Params.DataAddedSince == nil {
+		return req, fmt.Errorf("invalid dataAddedSince: %s", v)
+	}
+
+	// Parse paging. A cursor is either a page cursor or a change feed
+	// cursor, which parseChangeCursor handles.
+	if req.Limit, err = parseLimit(r); err != nil {
+		return req, err
+	}
+	if cursor := params.Get("cursor"); cursor != "" && !isChangeFeedRequest(r) {
+		after, err := bgpfinder.ParseDumpCursor(cursor)
+		if err != nil {
+			return req, err
+		}
+		req.After = &after
+	}
+
+	// Parse collectors
+	collectors, err := parseCollectors(req.Params.Projects, req.Params.Collectors, finder)
+	if err != nil {
+		return req, err
+	}
+
+	// Parse types
+	dumpType, err := parseDumpType(req.Params.Types)
+	if err != nil {
+		return req, err
+	}
 
-	intervalsParams := r.URL.Query()["intervals[]"]
-	collectorsParams := r.URL.Query()["collectors[]"]
-	typesParams := r.URL.Query()["types[]"]
+	// Parse intervals. The change feed defaults to the whole history of
+	// the collectors, since it's the change times that matter.
+	var windows []bgpfinder.Interval
+	for _, interval := range req.Params.Intervals {
+		window, err := parseInterval(interval)
+		if err != nil {
+			return req, err
+		}
+		windows = append(windows, window)
+	}
+	if len(windows) == 0 {
+		if !isChangeFeedRequest(r) {
+			return req, fmt.Errorf("at least one interval is required")
+		}
+		windows = append(windows, bgpfinder.Interval{From: time.Unix(0, 0), Until: now()})
+	}
 
-	// Parse interval
-	if len(intervalsParams) == 0 {
-		return query, fmt.Errorf("at least one interval is required")
+	for _, window := range windows {
+		req.Queries = append(req.Queries, bgpfinder.Query{
+			Collectors: collectors,
+			From:       window.From,
+			Until:      window.Until,
+			DumpType:   dumpType,
+		})
 	}
+	return req, nil
+}
 
-	times := strings.Split(intervalsParams[0], ",")
+// isChangeFeedRequest reports whether the request asks for the dumps added
+// or changed since some point, rather than for all matching dumps.
+func isChangeFeedRequest(r *http.Request) bool {
+	params := r.URL.Query()
+	if params.Get("dataAddedSince") != "" {
+		return true
+	}
+	_, err := bgpfinder.ParseChangeCursor(params.Get("cursor"))
+	return err == nil
+}
+
+// parseChangeCursor parses the cursor parameter, or failing that the
+// dataAddedSince parameter (a unix timestamp, as sent by BGPStream).
+func parseChangeCursor(r *http.Request) (bgpfinder.ChangeCursor, error) {
+	params := r.URL.Query()
+	if cursor := params.Get("cursor"); cursor != "" {
+		return bgpfinder.ParseChangeCursor(cursor)
+	}
+	since, err := strconv.ParseInt(params.Get("dataAddedSince"), 10, 64)
+	if err != nil {
+		return bgpfinder.ChangeCursor{}, fmt.Errorf("invalid dataAddedSince: %v", err)
+	}
+	return bgpfinder.ChangesSince(time.Unix(since, 0)), nil
+}
+
+// parseInterval parses a "start,end" pair of unix timestamps
+func parseInterval(interval string) (bgpfinder.Interval, error) {
+	times := strings.Split(interval, ",")
 	if len(times) != 2 {
-		return query, fmt.Errorf("invalid interval format. Expected format: start,end")
+		return bgpfinder.Interval{}, fmt.Errorf("invalid interval format. Expected format: start,end")
 	}
 
 	startInt, err := strconv.ParseInt(times[0], 10, 64)
 	if err != nil {
-		return query, fmt.Errorf("invalid start time: %v", err)
+		return bgpfinder.Interval{}, fmt.Errorf("invalid start time: %v", err)
 	}
 
 	endInt, err := strconv.ParseInt(times[1], 10, 64)
 	if err != nil {
-		return query, fmt.Errorf("invalid end time: %v", err)
+		return bgpfinder.Interval{}, fmt.Errorf("invalid end time: %v", err)
 	}
 
-	query.From = time.Unix(startInt, 0)
-	query.Until = time.Unix(endInt, 0)
+	return bgpfinder.Interval{From: time.Unix(startInt, 0), Until: time.Unix(endInt, 0)}, nil
+}
 
-	// Parse collectors
-	var collectors []bgpfinder.Collector
+// parseCollectors looks up the named collectors of the given projects. All
+// of the projects' collectors if none are named, and all projects if none
+// are given.
+func parseCollectors(projectsParams []string, collectorsParams []string, finder bgpfinder.Finder) ([]bgpfinder.Collector, error) {
+	allCollectors, err := finder.Collectors("")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching collectors: %v", err)
+	}
+	if len(projectsParams) > 0 {
+		projects := make(map[string]bool)
+		for _, name := range projectsParams {
+			projects[name] = true
+		}
+		var projectCollectors []bgpfinder.Collector
+		for _, c := range allCollectors {
+			if projects[c.Project.Name] {
+				projectCollectors = append(projectCollectors, c)
+			}
+		}
+		allCollectors = projectCollectors
+	}
 	if len(collectorsParams) == 0 {
 		// Use all collectors
-		collectors, err = bgpfinder.Collectors("")
-		if err != nil {
-			return query, fmt.Errorf("error fetching collectors: %v", err)
+		return allCollectors, nil
+	}
+
+	// Use specified collectors
+	collectorMap := make(map[string]bgpfinder.Collector)
+	for _, c := range allCollectors {
+		collectorMap[c.Name] = c
+	}
+
+	var collectors []bgpfinder.Collector
+	for _, name := range collectorsParams {
+		if collector, exists := collectorMap[name]; exists {
+			collectors = append(collectors, collector)
+		} else {
+			return nil, fmt.Errorf("collector not found: %s", name)
 		}
-	} else {
-		// Use specified collectors
-		allCollectors, err := bgpfinder.Collectors("")
+	}
+	return collectors, nil
+}
+
+// parseDumpType parses the types[] parameter. Any type if unset or if more
+// than one type is given.
+func parseDumpType(typesParams []string) (bgpfinder.DumpType, error) {
+	dumpType := bgpfinder.DumpTypeAny
+	for i, param := range typesParams {
+		t, err := bgpfinder.DumpTypeString(param)
 		if err != nil {
-			return query, fmt.Errorf("error fetching collectors: %v", err)
+			return bgpfinder.DumpTypeAny, fmt.Errorf("invalid type: %s", param)
+		}
+		if i == 0 {
+			dumpType = t
+		} else if t != dumpType {
+			dumpType = bgpfinder.DumpTypeAny
 		}
+	}
+	return dumpType, nil
+}
 
-		collectorMap := make(map[string]bgpfinder.Collector)
-		for _, c := range allCollectors {
-			collectorMap[c.Name] = c
+// coverageHandler handles the /meta/coverage endpoint
+func coverageHandler(finder bgpfinder.Finder, store bgpfinder.Store, logger *logging.Logger) http.HandlerFunc {
+	var coverage bgpfinder.Coverage
+	if store != nil {
+		coverage = bgpfinder.NewDBFinder(logger, store)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if coverage == nil {
+			http.Error(w, "Coverage is only tracked when the DB is enabled", http.StatusNotFound)
+			return
 		}
 
-		for _, name := range collectorsParams {
-			if collector, exists := collectorMap[name]; exists {
-				collectors = append(collectors, collector)
-			} else {
-				return query, fmt.Errorf("collector not found: %s", name)
+		// Default to the whole history of the collector
+		window := bgpfinder.Interval{From: time.Unix(0, 0), Until: time.Now()}
+		if intervals := r.URL.Query()["intervals[]"]; len(intervals) > 0 {
+			var err error
+			window, err = parseInterval(intervals[0])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 		}
-	}
-	query.Collectors = collectors
+		collectors, err := parseCollectors(r.URL.Query()["projects[]"], r.URL.Query()["collectors[]"], finder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dumpType, err := parseDumpType(r.URL.Query()["types[]"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-	// Parse types
-	if len(typesParams) == 0 {
-		query.DumpType = bgpfinder.DumpTypeAny
-	} else {
-		// Use the first type parameter
-		dumpType, err := bgpfinder.DumpTypeString(typesParams[0])
+		reports, err := bgpfinder.GetCoverageReports(coverage, collectors, dumpType, window)
 		if err != nil {
-			return query, fmt.Errorf("invalid type: %s", typesParams[0])
+			http.Error(w, fmt.Sprintf("Error fetching coverage: %v", err), http.StatusInternalServerError)
+			return
 		}
-		query.DumpType = dumpType
+		jsonResponse(w, reports)
 	}
+}
 
-	return query, nil
+// maxGapWindow is the longest window that /meta/gaps will look at, since
+// each update slot in it is listed.
+const maxGapWindow = 24 * time.Hour
+
+// gapsHandler handles the /meta/gaps endpoint. The dumps are looked for in
+// the DB (if it's enabled) unless source=live is given. Crawling the
+// archives is expensive, so that needs the admin token and explicit
+// collectors.
+func gapsHandler(finder bgpfinder.Finder, store bgpfinder.Store, logger *logging.Logger, adminToken string) http.HandlerFunc {
+	var dbFinder bgpfinder.Finder
+	if store != nil {
+		dbFinder = bgpfinder.NewDBFinder(logger, store)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var source bgpfinder.Finder
+		switch r.URL.Query().Get("source") {
+		case "live":
+		case "", "db":
+			if dbFinder != nil {
+				source = dbFinder
+			} else if r.URL.Query().Get("source") == "db" {
+				http.Error(w, "The DB is not enabled", http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "invalid source (expected live or db)", http.StatusBadRequest)
+			return
+		}
+		// Without the DB, the archives are always crawled
+		if source == nil {
+			if !isAdmin(r, adminToken) {
+				adminUnauthorized(w)
+				return
+			}
+			if len(r.URL.Query()["collectors[]"]) == 0 {
+				http.Error(w, "source=live needs collectors[]", http.StatusBadRequest)
+				return
+			}
+			source = finder
+		}
+
+		// Default to the last day, since a collector's whole history has
+		// far too many update slots to list
+		now := time.Now()
+		window := bgpfinder.Interval{From: now.Add(-24 * time.Hour), Until: now}
+		if intervals := r.URL.Query()["intervals[]"]; len(intervals) > 0 {
+			var err error
+			window, err = parseInterval(intervals[0])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if window.Until.Sub(window.From) > maxGapWindow {
+			http.Error(w, fmt.Sprintf("interval is longer than %s", maxGapWindow), http.StatusBadRequest)
+			return
+		}
+		collectors, err := parseCollectors(r.URL.Query()["projects[]"], r.URL.Query()["collectors[]"], finder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dumpType, err := parseDumpType(r.URL.Query()["types[]"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		reports, err := bgpfinder.GetGapReports(source, collectors, dumpType, window)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error finding gaps: %v", err), http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, reports)
+	}
 }
 
 // dataHandler handles /data endpoint
-func dataHandler(db *pgxpool.Pool, logger *logging.Logger) http.HandlerFunc {
+func dataHandler(finder bgpfinder.Finder, store bgpfinder.Store, logger *logging.Logger) http.HandlerFunc {
+	var cachingFinder, auditFinder *bgpfinder.CachingFinder
+	if store != nil {
+		dbFinder := bgpfinder.NewDBFinder(logger, store)
+		cachingFinder = bgpfinder.NewCachingFinder(logger, dbFinder, finder, dbFinder)
+
+		// Also returns dumps that have since disappeared from the archive
+		auditDBFinder := bgpfinder.NewDBFinder(logger, store)
+		auditDBFinder.SetFetchOptions(bgpfinder.FetchOptions{IncludeRemoved: true})
+		auditFinder = bgpfinder.NewCachingFinder(logger, auditDBFinder, finder, auditDBFinder)
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		query, err := parseDataRequest(r)
+		req, err := parseDataRequest(r, finder)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			dataError(w, r, http.StatusBadRequest, "%v", err)
 			return
 		}
 
 		// Log the parsed query details in UTC
-		logger.Info().
-			Time("from", query.From.UTC()).
-			Time("until", query.Until.UTC()).
-			Str("dump_type", query.DumpType.String()).
-			Int("collector_count", len(query.Collectors)).
-			Msg("Parsed query parameters")
+		for _, query := range req.Queries {
+			logger.Info().
+				Time("from", query.From.UTC()).
+				Time("until", query.Until.UTC()).
+				Str("dump_type", query.DumpType.String()).
+				Int("collector_count", len(query.Collectors)).
+				Msg("Parsed query parameters")
+		}
 
 		// Log collector details
-		for _, c := range query.Collectors {
+		for _, c := range req.Queries[0].Collectors {
 			logger.Info().
 				Str("collector_name", c.Name).
 				Str("project", c.Project.Name).
 				Msg("Query collector")
 		}
 
+		// Parse "include-removed" flag. Only the database knows about
+		// removed dumps.
+		includeRemoved := strings.ToLower(r.URL.Query().Get("include-removed")) == "true"
+
+		// The change feed is already paged, so it's never streamed
+		if isChangeFeedRequest(r) {
+			changeFeedResponse(w, r, store, req, bgpfinder.FetchOptions{IncludeRemoved: includeRemoved})
+			return
+		}
+
 		// Parse "no-cache" flag from query parameters
 		noCacheParam := r.URL.Query().Get("no-cache")
-		noCache := db == nil || strings.ToLower(noCacheParam) == "true"
-
-		var results []bgpfinder.BGPDump
+		noCache := store == nil || strings.ToLower(noCacheParam) == "true"
 
+		var source bgpfinder.Finder
 		if noCache {
 			// If "no-cache" is true, fetch data from remote source
 			logger.Info().Msg("No-cache flag detected or DB not connected. Fetching data from remote source.")
-			results, err = bgpfinder.Find(query)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error finding BGP dumps: %v", err), http.StatusInternalServerError)
-				return
-			}
+			source = finder
+			metrics.DataSource.WithLabelValues("live").Inc()
 		} else {
-			// Fetch data from the database
-			logger.Info().Msg("Fetching BGP dumps from the database.")
-			results, err = bgpfinder.FetchDataFromDB(r.Context(), db, query)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error fetching BGP dumps from DB: %v", err), http.StatusInternalServerError)
-				return
+			// Serve what we have from the database, filling any
+			// uncovered spans from the remote source
+			logger.Info().Bool("include_removed", includeRemoved).Msg("Fetching BGP dumps through the database cache.")
+			if includeRemoved {
+				source = auditFinder
+			} else {
+				source = cachingFinder
 			}
+			metrics.DataSource.WithLabelValues("db").Inc()
+		}
 
-			// If no data found in DB, optionally fetch from remote
-			if len(results) == 0 {
-				logger.Info().Msg("No BGP dumps found in DB. Fetching from remote source.")
-				results, err = bgpfinder.Find(query)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Error finding BGP dumps: %v", err), http.StatusInternalServerError)
-					return
-				}
+		// Pages are already bounded, so they're never streamed
+		if req.Limit > 0 || req.After != nil {
+			pagedDataResponse(w, r, req, source)
+			return
+		}
+		if isStreamRequest(r) {
+			streamDataResponse(w, req, source)
+			return
+		}
 
-				// Optionally, upsert the fetched data into the DB for future caching
-				if len(results) > 0 {
-					err = bgpfinder.UpsertBGPDumps(r.Context(), logger, db, results)
-					if err != nil {
-						logger.Error().Err(err).Msg("Failed to upsert newly fetched BGP dumps into DB")
-						// Continue without failing the request
-					} else {
-						logger.Info().Int("dumps_upserted", len(results)).Msg("Successfully upserted BGP dumps into DB")
-					}
-				}
-			}
+		results, err := findAll(source.Find, req.Queries)
+		if err != nil {
+			dataError(w, r, http.StatusInternalServerError, "Error finding BGP dumps: %v", err)
+			return
 		}
-        dataResponse := DataResponse{Query: query, Data: Data{results}}
-		jsonResponse(w, dataResponse)
+		dataResponse(w, req, now(), filterMinInitialTime(results, req.MinInitialTime), "", "")
 	}
 }
 
+// changeFeedResponse answers a /data request for the dumps added or changed
+// since a cursor. Only the database knows when dumps were added, so the
+// remote sources are never consulted.
+func changeFeedResponse(w http.ResponseWriter, r *http.Request, store bgpfinder.Store, req DataRequest, opts bgpfinder.FetchOptions) {
+	if store == nil {
+		dataError(w, r, http.StatusNotFound, "dataAddedSince is only supported when the DB is enabled")
+		return
+	}
+	if len(req.Queries) > 1 {
+		dataError(w, r, http.StatusBadRequest, "dataAddedSince only supports a single interval")
+		return
+	}
+	since, err := parseChangeCursor(r)
+	if err != nil {
+		dataError(w, r, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	until, err := store.ChangeFeedHorizon(r.Context())
+	if err != nil {
+		dataError(w, r, http.StatusInternalServerError, "Error fetching changed BGP dumps: %v", err)
+		return
+	}
+	results, next, err := store.FetchDumpChanges(r.Context(), req.Queries[0], since, until, changeFeedPageSize, opts)
+	if err != nil {
+		dataError(w, r, http.StatusInternalServerError, "Error fetching changed BGP dumps: %v", err)
+		return
+	}
+
+	// BGPStream sends the response time back as the next dataAddedSince,
+	// so it mustn't be past anything that wasn't returned. It may repeat
+	// dumps changed within the same second, but won't skip any.
+	responseTime := until
+	if len(results) == changeFeedPageSize {
+		responseTime = time.UnixMicro(next.Modified)
+	}
+	cursor := next.String()
+	dataResponse(w, req, responseTime, filterMinInitialTime(results, req.MinInitialTime), cursor, nextLink(w, r, cursor))
+}
+
+// pagedDataResponse answers a /data request for a single page of dumps,
+// with a link to the next page if there may be more.
+func pagedDataResponse(w http.ResponseWriter, r *http.Request, req DataRequest, finder bgpfinder.Finder) {
+	results, err := findAll(func(query bgpfinder.Query) ([]bgpfinder.BGPDump, error) {
+		return bgpfinder.FindPage(finder, query, req.After, req.Limit)
+	}, req.Queries)
+	if err != nil {
+		dataError(w, r, http.StatusInternalServerError, "Error finding BGP dumps: %v", err)
+		return
+	}
+	// Each interval's page may have contributed
+	if req.Limit > 0 && len(results) > req.Limit {
+		results = results[:req.Limit]
+	}
+
+	// The cursor has to come from the page before minInitialTime is
+	// applied, or filtered dumps would be found again on the next page.
+	var cursor, link string
+	if req.Limit > 0 && len(results) == req.Limit {
+		cursor = bgpfinder.CursorOf(results[len(results)-1]).String()
+		link = nextLink(w, r, cursor)
+	}
+	dataResponse(w, req, now(), filterMinInitialTime(results, req.MinInitialTime), cursor, link)
+}
+
 // jsonResponse sends a JSON response
 func jsonResponse(w http.ResponseWriter, data interface{}) {
+	jsonStatusResponse(w, http.StatusOK, data)
+}
+
+// jsonStatusResponse sends a JSON response with the given status
+func jsonStatusResponse(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		http.Error(w, fmt.Sprintf("Error encoding JSON: %v", err), http.StatusInternalServerError)
 	}
@@ -1,15 +1,89 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alistairking/bgpfinder"
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/alistairking/bgpfinder/internal/metrics"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+var (
+	testRouteViews2 = bgpfinder.Collector{Project: bgpfinder.Project{Name: "routeviews"}, Name: "route-views2"}
+	testRRC00       = bgpfinder.Collector{Project: bgpfinder.Project{Name: "ris"}, Name: "rrc00"}
+)
+
+// testDumpsFinder is a Finder that answers queries from a fixed list of
+// dumps, without going out to the archives.
+type testDumpsFinder struct {
+	dumps []bgpfinder.BGPDump
+}
+
+func (f *testDumpsFinder) Projects() ([]bgpfinder.Project, error) {
+	return []bgpfinder.Project{testRRC00.Project, testRouteViews2.Project}, nil
+}
+
+func (f *testDumpsFinder) Project(name string) (bgpfinder.Project, error) {
+	return bgpfinder.Project{Name: name}, nil
+}
+
+func (f *testDumpsFinder) Collectors(project string) ([]bgpfinder.Collector, error) {
+	return []bgpfinder.Collector{testRRC00, testRouteViews2}, nil
+}
+
+func (f *testDumpsFinder) Collector(name string) (bgpfinder.Collector, error) {
+	return bgpfinder.Collector{}, nil
+}
+
+func (f *testDumpsFinder) Find(query bgpfinder.Query) ([]bgpfinder.BGPDump, error) {
+	var results []bgpfinder.BGPDump
+	for _, d := range f.dumps {
+		end := d.Timestamp + int64(time.Duration(d.Duration).Seconds())
+		if query.DumpType != bgpfinder.DumpTypeAny && d.DumpType != query.DumpType {
+			continue
+		}
+		if d.Timestamp > query.Until.Unix() || end < query.From.Unix() {
+			continue
+		}
+		for _, c := range query.Collectors {
+			if c == d.Collector {
+				results = append(results, d)
+			}
+		}
+	}
+	return results, nil
+}
+
+func testBrokerDumps() []bgpfinder.BGPDump {
+	updates := bgpfinder.DumpDuration(15 * time.Minute)
+	risUpdates := bgpfinder.DumpDuration(5 * time.Minute)
+	return []bgpfinder.BGPDump{
+		{URL: "http://archive.routeviews.org/bgpdata/2020.12/UPDATES/updates.20201231.2345.bz2", Collector: testRouteViews2, DumpType: bgpfinder.DumpTypeUpdates, Duration: updates, Timestamp: 1609458300},
+		{URL: "http://archive.routeviews.org/bgpdata/2021.01/RIBS/rib.20210101.0000.bz2", Collector: testRouteViews2, DumpType: bgpfinder.DumpTypeRibs, Timestamp: 1609459200},
+		{URL: "http://archive.routeviews.org/bgpdata/2021.01/UPDATES/updates.20210101.0000.bz2", Collector: testRouteViews2, DumpType: bgpfinder.DumpTypeUpdates, Duration: updates, Timestamp: 1609459200},
+		{URL: "https://data.ris.ripe.net/rrc00/2021.01/bview.20210101.0000.gz", Collector: testRRC00, DumpType: bgpfinder.DumpTypeRibs, Timestamp: 1609459200},
+		{URL: "https://data.ris.ripe.net/rrc00/2021.01/updates.20210101.0000.gz", Collector: testRRC00, DumpType: bgpfinder.DumpTypeUpdates, Duration: risUpdates, Timestamp: 1609459200},
+		{URL: "https://data.ris.ripe.net/rrc00/2021.01/updates.20210101.0005.gz", Collector: testRRC00, DumpType: bgpfinder.DumpTypeUpdates, Duration: risUpdates, Timestamp: 1609459500},
+	}
+}
+
 func TestParseDataRequest(t *testing.T) {
 	// Test parameters
 	startTimeStr := "1609459200"
@@ -33,10 +107,11 @@ func TestParseDataRequest(t *testing.T) {
 	}
 
 	// Parse the request
-	query, err := parseDataRequest(req)
+	dataReq, err := parseDataRequest(req, bgpfinder.DefaultFinder)
 	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
+		t.Fatalf("Expected no error, got %v", err)
 	}
+	query := dataReq.Queries[0]
 
 	// Verify start and end time
 	startTimeInt64, err := strconv.ParseInt(startTimeStr, 10, 64)
@@ -72,3 +147,539 @@ func TestParseDataRequest(t *testing.T) {
 		t.Errorf("Expected DumpType: %v, got %v", expectedDumpType, query.DumpType)
 	}
 }
+
+// brokerGoldenTests are the /data queries that are checked against the
+// BGPStream broker. Each golden file is this server's expected response to
+// the query, and testdata/recorded holds the real broker's response to it.
+var brokerGoldenTests = []struct {
+	golden string
+	query  string
+	status int
+}{
+	{
+		golden: "broker_routeviews_updates.json",
+		query:  "projects[]=routeviews&types[]=updates&intervals[]=1609459200,1609460100",
+		status: http.StatusOK,
+	},
+	{
+		golden: "broker_multiple_intervals.json",
+		query:  "collectors[]=rrc00&collectors[]=route-views2&types[]=ribs&types[]=updates&intervals[]=1609459200,1609459200&intervals[]=1609459500,1609459800&minInitialTime=1609459200&human=true",
+		status: http.StatusOK,
+	},
+	{
+		golden: "broker_missing_interval.json",
+		query:  "collectors[]=rrc00",
+		status: http.StatusBadRequest,
+	},
+}
+
+// recordBroker is the broker to record testdata/recorded from, e.g.
+//
+//	go test -run TestBrokerRecordings -record-broker=https://broker.bgpstream.caida.org/v2
+var recordBroker = flag.String("record-broker", "", "record the broker responses from this broker URL")
+
+// TestBrokerGolden checks /data responses against BGPStream broker
+// responses, so that libbgpstream can use this server as its broker.
+func TestBrokerGolden(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(orig func() time.Time) { now = orig }(now)
+	now = func() time.Time { return time.Unix(1609545600, 0) }
+
+	handler := dataHandler(&testDumpsFinder{dumps: testBrokerDumps()}, nil, logger)
+	for _, tc := range brokerGoldenTests {
+		t.Run(tc.golden, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", "/data?"+tc.query, nil))
+			if rec.Code != tc.status {
+				t.Errorf("Expected status %d, got %d", tc.status, rec.Code)
+			}
+
+			expected := readJSON(t, filepath.Join("testdata", tc.golden))
+			var actual interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &actual); err != nil {
+				t.Fatalf("Invalid response: %v", err)
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("Response doesn't match %s:\n%s", tc.golden, rec.Body.String())
+			}
+		})
+	}
+}
+
+// TestBrokerRecordings checks the envelope of the golden files against the
+// real broker's responses to the same queries. The dumps themselves differ,
+// since the goldens come from testBrokerDumps, so only their fields are
+// compared.
+func TestBrokerRecordings(t *testing.T) {
+	for _, tc := range brokerGoldenTests {
+		t.Run(tc.golden, func(t *testing.T) {
+			recorded := filepath.Join("testdata", "recorded", tc.golden)
+			if *recordBroker != "" {
+				recordBrokerResponse(t, *recordBroker+"/data?"+tc.query, tc.status, recorded)
+			}
+			if _, err := os.Stat(recorded); errors.Is(err, os.ErrNotExist) {
+				t.Skipf("%s hasn't been recorded, see -record-broker", recorded)
+			}
+
+			expected := readJSON(t, recorded).(map[string]interface{})
+			actual := readJSON(t, filepath.Join("testdata", tc.golden)).(map[string]interface{})
+			for _, field := range []string{"version", "type", "queryParameters"} {
+				if !reflect.DeepEqual(expected[field], actual[field]) {
+					t.Errorf("Expected %s to be %v, got %v", field, expected[field], actual[field])
+				}
+			}
+			if expected, actual := jsonShape(expected), jsonShape(actual); !reflect.DeepEqual(expected, actual) {
+				t.Errorf("Expected the envelope to look like\n%v\ngot\n%v", expected, actual)
+			}
+		})
+	}
+}
+
+// recordBrokerResponse saves the broker's response to the URL at path.
+func recordBrokerResponse(t *testing.T, url string, status int, path string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to query the broker: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Errorf("Expected the broker to respond with status %d, got %d", status, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, body, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readJSON(t *testing.T, path string) interface{} {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("Invalid JSON in %s: %v", path, err)
+	}
+	return v
+}
+
+// jsonShape replaces the values in decoded JSON with their types, keeping
+// the object keys. An array's shape is the shape of its first element.
+func jsonShape(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		shape := map[string]interface{}{}
+		for k, e := range v {
+			shape[k] = jsonShape(e)
+		}
+		return shape
+	case []interface{}:
+		if len(v) == 0 {
+			return []interface{}{}
+		}
+		return []interface{}{jsonShape(v[0])}
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// failingFinder is a testDumpsFinder whose queries fail.
+type failingFinder struct {
+	testDumpsFinder
+}
+
+func (f *failingFinder) Find(query bgpfinder.Query) ([]bgpfinder.BGPDump, error) {
+	return nil, errors.New("archive unavailable")
+}
+
+func TestStreamData(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := "/data?projects[]=routeviews&types[]=updates&intervals[]=1609459200,1609460100"
+
+	readStream := func(rec *httptest.ResponseRecorder) ([]map[string]interface{}, StreamTrailer) {
+		t.Helper()
+		if ct := rec.Header().Get("Content-Type"); ct != ndjsonContentType {
+			t.Errorf("Expected Content-Type %s, got %s", ndjsonContentType, ct)
+		}
+		lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+		var resources []map[string]interface{}
+		for _, line := range lines[:len(lines)-1] {
+			var resource map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &resource); err != nil {
+				t.Fatalf("Invalid record %q: %v", line, err)
+			}
+			resources = append(resources, resource)
+		}
+		var trailer StreamTrailer
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &trailer); err != nil {
+			t.Fatalf("Invalid trailer: %v", err)
+		}
+		return resources, trailer
+	}
+
+	// Via the format parameter
+	handler := dataHandler(&testDumpsFinder{dumps: testBrokerDumps()}, nil, logger)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", query+"&format=ndjson", nil))
+	resources, trailer := readStream(rec)
+	if len(resources) != 2 || resources[1]["url"] != "http://archive.routeviews.org/bgpdata/2021.01/UPDATES/updates.20210101.0000.bz2" {
+		t.Errorf("Expected the two route-views2 updates dumps, got %v", resources)
+	}
+	if trailer.Trailer.Count != 2 || trailer.Trailer.Error != nil {
+		t.Errorf("Expected a trailer with 2 dumps and no error, got %+v", trailer)
+	}
+
+	// Via the Accept header, with an error once the stream has started
+	handler = dataHandler(&failingFinder{}, nil, logger)
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", query, nil)
+	req.Header.Set("Accept", "application/x-ndjson; charset=utf-8, application/json;q=0.5")
+	handler(rec, req)
+	resources, trailer = readStream(rec)
+	if len(resources) != 0 {
+		t.Errorf("Expected no dumps, got %v", resources)
+	}
+	if trailer.Trailer.Error == nil || !strings.Contains(*trailer.Trailer.Error, "archive unavailable") {
+		t.Errorf("Expected the trailer to report the error, got %+v", trailer)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finder := &testDumpsFinder{dumps: testBrokerDumps()}
+
+	// Follow the next links through all of the dumps
+	handler := dataHandler(finder, nil, logger)
+	var urls []string
+	link := "/data?intervals[]=1609459200,1609460100&limit=4"
+	for pages := 0; link != ""; pages++ {
+		if pages > 2 {
+			t.Fatalf("Expected 2 pages, still going at %s", link)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", link, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var page struct {
+			Next string `json:"next"`
+			Data struct {
+				Resources []struct {
+					URL string `json:"url"`
+				} `json:"resources"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Invalid response: %v", err)
+		}
+		for _, r := range page.Data.Resources {
+			urls = append(urls, r.URL)
+		}
+		if page.Next != "" && rec.Header().Get("Link") != "<"+page.Next+">; rel=\"next\"" {
+			t.Errorf("Expected a Link header for %s, got %s", page.Next, rec.Header().Get("Link"))
+		}
+		link = page.Next
+	}
+	if len(urls) != 6 || urls[0] != testBrokerDumps()[0].URL {
+		t.Errorf("Expected all 6 dumps in order, got %v", urls)
+	}
+
+	// Collectors are paged by project and then name
+	handler = collectorHandler(finder)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/meta/collectors?limit=1", nil))
+	var collectors []bgpfinder.Collector
+	if err := json.Unmarshal(rec.Body.Bytes(), &collectors); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if len(collectors) != 1 || collectors[0] != testRRC00 || rec.Header().Get("Link") == "" {
+		t.Errorf("Expected a page with rrc00 and a next link, got %v", collectors)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finder := &testDumpsFinder{dumps: testBrokerDumps()}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/meta/collectors/{collector}", collectorHandler(finder)).Methods("GET")
+	router.HandleFunc("/data", dataHandler(finder, nil, logger)).Methods("GET")
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	router.Use(instrumentRoutes)
+
+	// Other tests call dataHandler too
+	liveBefore := testutil.ToFloat64(metrics.DataSource.WithLabelValues("live"))
+	for _, target := range []string{
+		"/meta/collectors/rrc00",
+		"/meta/collectors/missing",
+		"/data?intervals[]=1609459200,1609460100",
+	} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`bgpfinder_http_requests_total{code="200",method="GET",route="/meta/collectors/{collector}"} 1`,
+		`bgpfinder_http_requests_total{code="404",method="GET",route="/meta/collectors/{collector}"} 1`,
+		`bgpfinder_http_request_duration_seconds_count{method="GET",route="/data"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+	if live := testutil.ToFloat64(metrics.DataSource.WithLabelValues("live")); live != liveBefore+1 {
+		t.Errorf("Expected one more live data request, got %v after %v", live, liveBefore)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store, err := bgpfinder.OpenSQLiteStore(ctx, logger, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	finder := &testDumpsFinder{dumps: testBrokerDumps()}
+
+	readyz := func(store bgpfinder.Store) (int, HealthResponse) {
+		rec := httptest.NewRecorder()
+		readyHandler(finder, store)(rec, httptest.NewRequest("GET", "/readyz", nil))
+		var resp HealthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Invalid response: %v", err)
+		}
+		return rec.Code, resp
+	}
+
+	// Not ready until the schema has been migrated
+	if code, resp := readyz(store); code != http.StatusServiceUnavailable || resp.Checks["migrations"] == "ok" {
+		t.Errorf("Expected unready with an old schema, got %d %+v", code, resp)
+	}
+	if _, err := bgpfinder.MigrateUp(ctx, logger, store); err != nil {
+		t.Fatal(err)
+	}
+	if code, resp := readyz(store); code != http.StatusOK || resp.Status != "ok" {
+		t.Errorf("Expected ready, got %d %+v", code, resp)
+	}
+	if code, _ := readyz(nil); code != http.StatusOK {
+		t.Errorf("Expected ready without a DB, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	healthHandler()(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected healthz to be ok, got %d", rec.Code)
+	}
+
+	// Only rrc00 has (old) updates dumps stored
+	var rrc00Updates []bgpfinder.BGPDump
+	for _, d := range testBrokerDumps() {
+		if d.Collector == testRRC00 && d.DumpType == bgpfinder.DumpTypeUpdates {
+			rrc00Updates = append(rrc00Updates, d)
+		}
+	}
+	if _, err := store.UpsertDumps(ctx, rrc00Updates); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	collectorStatusHandler(finder, store)(rec, httptest.NewRequest("GET", "/status/collectors", nil))
+	var statuses []CollectorStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	got := map[string]string{}
+	for _, s := range statuses {
+		if s.ExpectedLatest == nil {
+			t.Errorf("Expected an expected latest dump for %s %s", s.Collector, s.DumpType)
+		}
+		got[s.Collector+" "+s.DumpType] = s.Status
+	}
+	want := map[string]string{
+		"rrc00 ribs":           "unknown",
+		"rrc00 updates":        "stale",
+		"route-views2 ribs":    "unknown",
+		"route-views2 updates": "unknown",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected statuses %v, got %v", want, got)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finder := &testDumpsFinder{dumps: testBrokerDumps()}
+	// The jobs are never started, so they stay queued
+	jobs := bgpfinder.NewScrapeJobs(logger, nil, finder, nil)
+	router := mux.NewRouter()
+	registerAdminRoutes(router, "secret", finder, jobs)
+
+	send := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("GET", "/admin/scrapes", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", rec.Code)
+	}
+	if rec := send("GET", "/admin/scrapes", "wrong", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with the wrong token, got %d", rec.Code)
+	}
+
+	rec := send("POST", "/admin/scrapes", "secret", `{"project":"ris","type":"updates","from":1609459200,"until":1609462800}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job bgpfinder.ScrapeJob
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if len(job.Collectors) != 1 || job.Collectors[0] != testRRC00 || job.DumpType != bgpfinder.DumpTypeUpdates {
+		t.Errorf("Expected an updates scrape of rrc00, got %+v", job)
+	}
+
+	if rec := send("POST", "/admin/scrapes", "secret", `{"collectors":["missing"],"from":1,"until":2}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown collector, got %d", rec.Code)
+	}
+	if rec := send("POST", "/admin/scrapes", "secret", `{"from":2,"until":1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty window, got %d", rec.Code)
+	}
+
+	target := "/admin/scrapes/" + strconv.FormatInt(job.ID, 10)
+	if rec := send("DELETE", target, "secret", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected the job to be canceled, got %d", rec.Code)
+	}
+	if rec := send("DELETE", target, "secret", ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a finished job, got %d", rec.Code)
+	}
+	if rec := send("GET", "/admin/scrapes/999", "secret", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown job, got %d", rec.Code)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store, err := bgpfinder.OpenSQLiteStore(ctx, logger, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := bgpfinder.MigrateUp(ctx, logger, store); err != nil {
+		t.Fatal(err)
+	}
+	finder := &testDumpsFinder{dumps: testBrokerDumps()}
+	handler := coverageHandler(finder, store, logger)
+
+	// Without an interval, the whole history is reported on
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/meta/coverage?collectors[]=rrc00&types[]=updates", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var reports []bgpfinder.CoverageReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Window.From.Unix() != 0 || reports[0].Complete {
+		t.Errorf("Expected the whole history to be uncovered, got %+v", reports)
+	}
+}
+
+func TestGaps(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finder := &testDumpsFinder{dumps: testBrokerDumps()}
+	handler := gapsHandler(finder, nil, logger, "secret")
+	send := func(target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	rec := send("/meta/gaps?source=live&collectors[]=rrc00&types[]=updates&intervals[]=1609459200,1609460100", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var reports []bgpfinder.GapReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Expected != 3 || reports[0].Found != 2 ||
+		len(reports[0].Missing) != 1 || reports[0].Missing[0] != 1609459800 {
+		t.Errorf("Expected the 00:10 updates to be missing, got %+v", reports)
+	}
+
+	for target, want := range map[string]int{
+		"/meta/gaps?source=db":      http.StatusNotFound,
+		"/meta/gaps?source=archive": http.StatusBadRequest,
+		// Crawling the archives needs the token and collectors
+		"/meta/gaps?source=live&collectors[]=rrc00": http.StatusUnauthorized,
+		"/meta/gaps?collectors[]=rrc00":             http.StatusUnauthorized,
+	} {
+		if rec := send(target, ""); rec.Code != want {
+			t.Errorf("Expected %s to give %d, got %d", target, want, rec.Code)
+		}
+	}
+	for target, want := range map[string]int{
+		"/meta/gaps?source=live&projects[]=ris":                                       http.StatusBadRequest,
+		"/meta/gaps?source=live&collectors[]=rrc00&intervals[]=1609459200,1609632000": http.StatusBadRequest,
+	} {
+		if rec := send(target, "secret"); rec.Code != want {
+			t.Errorf("Expected %s to give %d, got %d", target, want, rec.Code)
+		}
+	}
+	if rec := send("/meta/gaps?source=live&collectors[]=rrc00", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with the wrong token, got %d", rec.Code)
+	}
+
+	// Nothing can crawl the archives without an admin token
+	handler = gapsHandler(finder, nil, logger, "")
+	if rec := send("/meta/gaps?source=live&collectors[]=rrc00", "secret"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without an admin token configured, got %d", rec.Code)
+	}
+}
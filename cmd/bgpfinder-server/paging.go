@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alistairking/bgpfinder"
+)
+
+// parseLimit parses the limit parameter. Unlimited (0) if unset.
+func parseLimit(r *http.Request) (int, error) {
+	param := r.URL.Query().Get("limit")
+	if param == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid limit: %s", param)
+	}
+	return limit, nil
+}
+
+// nextLink returns the URL of the page that follows the request's, which is
+// the same request with the cursor replaced. It also sets it as the Link
+// header of the response.
+func nextLink(w http.ResponseWriter, r *http.Request, cursor string) string {
+	params := r.URL.Query()
+	params.Set("cursor", cursor)
+	// The cursor supersedes the change feed's starting point
+	params.Del("dataAddedSince")
+	link := r.URL.Path + "?" + params.Encode()
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", link))
+	return link
+}
+
+// collectorCursor is a position in the /meta/collectors listing, which is
+// ordered by project and then collector name.
+type collectorCursor struct {
+	project string
+	name    string
+}
+
+func (c collectorCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte("c1:" + c.project + ":" + c.name))
+}
+
+func parseCollectorCursor(s string) (collectorCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return collectorCursor{}, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 || parts[0] != "c1" {
+		return collectorCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return collectorCursor{project: parts[1], name: parts[2]}, nil
+}
+
+// pageCollectors sorts the collectors and returns up to limit of them,
+// starting after the cursor (if any). It also returns the cursor of the
+// next page, or nil if this is the last one.
+func pageCollectors(collectors []bgpfinder.Collector, after *collectorCursor, limit int) ([]bgpfinder.Collector, *collectorCursor) {
+	less := func(a, b collectorCursor) bool {
+		if a.project != b.project {
+			return a.project < b.project
+		}
+		return a.name < b.name
+	}
+	cursorOf := func(c bgpfinder.Collector) collectorCursor {
+		return collectorCursor{project: c.Project.Name, name: c.Name}
+	}
+
+	sorted := append([]bgpfinder.Collector(nil), collectors...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return less(cursorOf(sorted[i]), cursorOf(sorted[j]))
+	})
+	if after != nil {
+		start := sort.Search(len(sorted), func(i int) bool {
+			return less(*after, cursorOf(sorted[i]))
+		})
+		sorted = sorted[start:]
+	}
+	if limit == 0 || len(sorted) <= limit {
+		return sorted, nil
+	}
+	next := cursorOf(sorted[limit-1])
+	return sorted[:limit], &next
+}
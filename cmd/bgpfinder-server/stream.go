@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+)
+
+// ndjsonContentType is the media type of streamed /data responses.
+const ndjsonContentType = "application/x-ndjson"
+
+// streamFlushInterval is how often streamed responses are flushed to the
+// client while dumps are being written.
+const streamFlushInterval = time.Second
+
+// StreamTrailer is the last record of a streamed /data response. Clients can
+// tell a complete stream from a truncated one by its presence, and it reports
+// any error that happened after the stream had started.
+type StreamTrailer struct {
+	Trailer struct {
+		Count int     `json:"count"`
+		Error *string `json:"error"`
+	} `json:"trailer"`
+}
+
+// isStreamRequest reports whether the client asked for a streamed /data
+// response, either with format=ndjson or with an NDJSON Accept header.
+func isStreamRequest(r *http.Request) bool {
+	if strings.ToLower(r.URL.Query().Get("format")) == "ndjson" {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.TrimSpace(mediaType) == ndjsonContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamDataResponse writes the dumps found for the request as one JSON
+// resource per line, followed by a StreamTrailer. Dumps are written as the
+// finder hands them out, so they're never all held in memory (unless the
+// finder itself does that).
+func streamDataResponse(w http.ResponseWriter, req DataRequest, finder bgpfinder.Finder) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	lastFlush := now()
+
+	var trailer StreamTrailer
+	write := func(d bgpfinder.BGPDump) error {
+		if d.Timestamp < req.MinInitialTime {
+			return nil
+		}
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+		trailer.Trailer.Count++
+		if flusher != nil && now().Sub(lastFlush) >= streamFlushInterval {
+			flusher.Flush()
+			lastFlush = now()
+		}
+		return nil
+	}
+
+	// Dumps found by more than one interval are only written once
+	if len(req.Queries) > 1 {
+		seen := map[string]bool{}
+		writeOnce := write
+		write = func(d bgpfinder.BGPDump) error {
+			if seen[d.URL] {
+				return nil
+			}
+			seen[d.URL] = true
+			return writeOnce(d)
+		}
+	}
+
+	for _, query := range req.Queries {
+		if err := bgpfinder.FindStream(finder, query, write); err != nil {
+			msg := "Error finding BGP dumps: " + err.Error()
+			trailer.Trailer.Error = &msg
+			break
+		}
+	}
+
+	// There's no way to report a failure to write the trailer, since the
+	// client has gone away by then anyway.
+	_ = enc.Encode(trailer)
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
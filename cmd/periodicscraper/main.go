@@ -4,19 +4,51 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/alistairking/bgpfinder"
 	"github.com/alistairking/bgpfinder/internal/logging"
 	"github.com/alistairking/bgpfinder/periodicscraper"
 )
 
 func main() {
 	logLevel := flag.String("loglevel", "info", "Log level (debug, info, warn, error)")
-	envFile := flag.String("env-file", ".env", "Path to .env file (required if use-db is true)")
+	envFile := flag.String("env-file", ".env", "Path to .env file (required if db-driver is postgres)")
+	dbDriver := flag.String("db-driver", bgpfinder.StoreDriverPostgres, "Database driver (postgres, sqlite)")
+	sqlitePath := flag.String("sqlite-path", "bgpfinder.db", "Path to the SQLite database file (if db-driver is sqlite)")
+	autoMigrate := flag.Bool("auto-migrate", false, "Apply pending database migrations on startup")
+	maintenanceFreq := flag.Duration("maintenance-frequency", 24*time.Hour, "Database maintenance (partitioning and retention) frequency")
+	metricsAddr := flag.String("metrics-addr", ":9091", "Address to serve Prometheus metrics on (empty to disable)")
+	leaseTTL := flag.Duration("lease-ttl", bgpfinder.DefaultLeaseTTL, "How long a replica's lease on a collector lasts without being renewed")
+	shutdownTimeout := flag.Duration("shutdown-timeout", periodicscraper.DefaultShutdownTimeout, "How long to wait for in-flight scrapes to finish when stopping")
+	scheduleFile := flag.String("schedule", "", "Path to a JSON scrape schedule (default: every project at its publishing cadence)")
+	dryRun := flag.Bool("dry-run", false, "Compare what the schedule would scrape now with the database, print the differences and exit")
+	diffFormat := flag.String("diff-format", bgpfinder.DiffFormatText, "Format of the dry run's report (text, json)")
+	var retention bgpfinder.RetentionPolicies
+	flag.Var(&retention, "retention", "Retention policy as <type>=<age> (e.g., updates=2y). May be repeated")
 	flag.Parse()
 
 	logger := setupLogger(logLevel)
 
-	periodicscraper.Start(logger, envFile)
+	periodicscraper.Start(logger, periodicscraper.Options{
+		Store: bgpfinder.StoreConfig{
+			Driver:     *dbDriver,
+			EnvFile:    *envFile,
+			SQLitePath: *sqlitePath,
+		},
+		AutoMigrate: *autoMigrate,
+		Maintenance: bgpfinder.MaintenanceConfig{
+			Retention:          retention,
+			PartitionLookahead: bgpfinder.DefaultPartitionLookahead,
+		},
+		MaintenanceFrequency: *maintenanceFreq,
+		MetricsAddr:          *metricsAddr,
+		ScheduleFile:         *scheduleFile,
+		LeaseTTL:             *leaseTTL,
+		ShutdownTimeout:      *shutdownTimeout,
+		DryRun:               *dryRun,
+		DiffFormat:           *diffFormat,
+	})
 }
 
 func setupLogger(logLevel *string) *logging.Logger {
@@ -0,0 +1,187 @@
+package bgpfinder
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Interval is a half-open time span [From, Until).
+type Interval struct {
+	From  time.Time `json:"from"`
+	Until time.Time `json:"until"`
+}
+
+func (i Interval) String() string {
+	return fmt.Sprintf("[%s, %s)", i.From.UTC().Format(time.RFC3339), i.Until.UTC().Format(time.RFC3339))
+}
+
+// Empty returns true if the interval contains no time at all.
+func (i Interval) Empty() bool {
+	return !i.From.Before(i.Until)
+}
+
+// Coverage keeps track of which spans of a collector's archive have been
+// fully crawled, so that a cache knows which parts of a query it can answer
+// without going back to the archive. Coverage is tracked separately for each
+// concrete dump type (i.e., never DumpTypeAny).
+type Coverage interface {
+	// Covered returns the crawled spans that overlap the given window,
+	// clipped to the window, sorted and merged.
+	Covered(collector Collector, dumpType DumpType, window Interval) ([]Interval, error)
+
+	// MarkCovered records that the given window has been fully crawled.
+	MarkCovered(collector Collector, dumpType DumpType, window Interval) error
+}
+
+// IsCovered returns true if the whole window has been crawled for the
+// collector. For DumpTypeAny, both ribs and updates need to be covered.
+func IsCovered(c Coverage, collector Collector, dumpType DumpType, window Interval) (bool, error) {
+	for _, dt := range concreteDumpTypes(dumpType) {
+		covered, err := c.Covered(collector, dt, window)
+		if err != nil {
+			return false, err
+		}
+		if len(subtractIntervals(window, covered)) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// CoverageReport describes how much of a window has been crawled for a
+// single collector and dump type.
+type CoverageReport struct {
+	Collector Collector  `json:"collector"`
+	DumpType  DumpType   `json:"type"`
+	Window    Interval   `json:"window"`
+	Covered   []Interval `json:"covered"`
+	Gaps      []Interval `json:"gaps"`
+	Complete  bool       `json:"complete"`
+}
+
+// GetCoverageReports builds a CoverageReport for each of the given collectors
+// and (concrete) dump types.
+func GetCoverageReports(c Coverage, collectors []Collector, dumpType DumpType, window Interval) ([]CoverageReport, error) {
+	var reports []CoverageReport
+	for _, collector := range collectors {
+		for _, dt := range concreteDumpTypes(dumpType) {
+			covered, err := c.Covered(collector, dt, window)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get coverage for %s: %v", collector, err)
+			}
+			gaps := subtractIntervals(window, covered)
+			reports = append(reports, CoverageReport{
+				Collector: collector,
+				DumpType:  dt,
+				Window:    window,
+				Covered:   covered,
+				Gaps:      gaps,
+				Complete:  len(gaps) == 0,
+			})
+		}
+	}
+	return reports, nil
+}
+
+type coverageKey struct {
+	project   string
+	collector string
+	dumpType  DumpType
+}
+
+// MemoryCoverage is a Coverage implementation that only lives as long as the
+// process does.
+type MemoryCoverage struct {
+	mu    *sync.RWMutex
+	spans map[coverageKey][]Interval
+}
+
+func NewMemoryCoverage() *MemoryCoverage {
+	return &MemoryCoverage{
+		mu:    &sync.RWMutex{},
+		spans: map[coverageKey][]Interval{},
+	}
+}
+
+func (m *MemoryCoverage) Covered(collector Collector, dumpType DumpType, window Interval) ([]Interval, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key := coverageKey{collector.Project.Name, collector.Name, dumpType}
+	return clipIntervals(m.spans[key], window), nil
+}
+
+func (m *MemoryCoverage) MarkCovered(collector Collector, dumpType DumpType, window Interval) error {
+	if window.Empty() {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := coverageKey{collector.Project.Name, collector.Name, dumpType}
+	m.spans[key] = mergeIntervals(append(m.spans[key], window))
+	return nil
+}
+
+// mergeIntervals sorts the given intervals and collapses any that overlap or
+// touch into a single interval.
+func mergeIntervals(intervals []Interval) []Interval {
+	sorted := make([]Interval, 0, len(intervals))
+	for _, i := range intervals {
+		if !i.Empty() {
+			sorted = append(sorted, i)
+		}
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].From.Before(sorted[b].From)
+	})
+
+	var merged []Interval
+	for _, i := range sorted {
+		if n := len(merged); n > 0 && !i.From.After(merged[n-1].Until) {
+			if i.Until.After(merged[n-1].Until) {
+				merged[n-1].Until = i.Until
+			}
+			continue
+		}
+		merged = append(merged, i)
+	}
+	return merged
+}
+
+// clipIntervals returns the parts of the given intervals that fall inside
+// window, merged.
+func clipIntervals(intervals []Interval, window Interval) []Interval {
+	var clipped []Interval
+	for _, i := range intervals {
+		if i.From.Before(window.From) {
+			i.From = window.From
+		}
+		if i.Until.After(window.Until) {
+			i.Until = window.Until
+		}
+		if !i.Empty() {
+			clipped = append(clipped, i)
+		}
+	}
+	return mergeIntervals(clipped)
+}
+
+// subtractIntervals returns the parts of window that are not covered by any
+// of the given intervals.
+func subtractIntervals(window Interval, covered []Interval) []Interval {
+	var gaps []Interval
+	cur := window.From
+	for _, c := range clipIntervals(covered, window) {
+		if c.From.After(cur) {
+			gaps = append(gaps, Interval{From: cur, Until: c.From})
+		}
+		if c.Until.After(cur) {
+			cur = c.Until
+		}
+	}
+	if cur.Before(window.Until) {
+		gaps = append(gaps, Interval{From: cur, Until: window.Until})
+	}
+	return gaps
+}
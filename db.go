@@ -2,10 +2,12 @@ package bgpfinder
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -42,11 +44,11 @@ func UpsertCollectors(ctx context.Context, logger *logging.Logger, db *pgxpool.P
 
 	stmt := `
 		INSERT INTO collectors (name, project_name, cdate, mdate, most_recent_file_timestamp, ` + timestampField + `)
-		VALUES ($1, $2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, COALESCE((SELECT max(timestamp) FROM bgp_dumps WHERE collector_name = $3), '1970-01-01 00:00:00'), ` + timestampValue + `)
-		ON CONFLICT (name) DO UPDATE
-		SET project_name = EXCLUDED.project_name,
-			mdate = EXCLUDED.mdate,
-			most_recent_file_timestamp = EXCLUDED.most_recent_file_timestamp,` + timestampCondition
+		VALUES ($1, $2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, COALESCE((SELECT max(timestamp) FROM bgp_dumps WHERE project_name = $2 AND collector_name = $3), '1970-01-01 00:00:00'), ` + timestampValue + `)
+		ON CONFLICT (project_name, name) DO UPDATE
+		SET mdate = EXCLUDED.mdate,
+			most_recent_file_timestamp = EXCLUDED.most_recent_file_timestamp,
+			retired_at = NULL,` + timestampCondition
 
 	logger.Info().Int("collector_count", len(collectors)).Msg("Upserting collectors into DB")
 	for _, c := range collectors {
@@ -83,6 +85,14 @@ func UpsertCollectors(ctx context.Context, logger *logging.Logger, db *pgxpool.P
 func UpsertBGPDumps(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, dumps []BGPDump) error {
 	const batchSize = 10000 // Define an appropriate batch size
 
+	if err := checkDumpDurations(dumps); err != nil {
+		return err
+	}
+	if err := ensureDumpPartitions(ctx, db, dumps); err != nil {
+		logger.Error().Err(err).Msg("Failed to create partitions for UpsertBGPDumps")
+		return err
+	}
+
 	total := len(dumps)
 	for start := 0; start < total; start += batchSize {
 		end := start + batchSize
@@ -98,18 +108,38 @@ func UpsertBGPDumps(ctx context.Context, logger *logging.Logger, db *pgxpool.Poo
 			return err
 		}
 
+		if err := insertMissingCollectors(ctx, tx, batch); err != nil {
+			logger.Error().Err(err).Msg("Failed to insert collectors for UpsertBGPDumps batch")
+			tx.Rollback(ctx)
+			return err
+		}
+
+		// A stored row for the URL with a different type or timestamp is
+		// replaced, keeping its id, creation time and tombstone (see
+		// BulkUpsertBGPDumps).
 		stmt := `
-			INSERT INTO bgp_dumps (collector_name, url, dump_type, duration, timestamp, cdate, mdate)
-			VALUES ($1, $2, $3, $4, to_timestamp($5), CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
-			ON CONFLICT (collector_name, url) DO UPDATE
-			SET dump_type = EXCLUDED.dump_type,
-				duration = EXCLUDED.duration,
-				timestamp = EXCLUDED.timestamp,
+			WITH moved AS (
+				DELETE FROM bgp_dumps
+				WHERE project_name = $1
+				AND collector_name = $2
+				AND url = $3
+				AND (dump_type != $4 OR timestamp != to_timestamp($6))
+				RETURNING bgp_dump_id, cdate, removed_at
+			)
+			INSERT INTO bgp_dumps (bgp_dump_id, project_name, collector_name, url, dump_type, duration, timestamp, cdate, mdate, removed_at)
+			VALUES (
+				COALESCE((SELECT bgp_dump_id FROM moved LIMIT 1), nextval('bgp_dumps_bgp_dump_id_seq')),
+				$1, $2, $3, $4, $5, to_timestamp($6),
+				COALESCE((SELECT cdate FROM moved LIMIT 1), CURRENT_TIMESTAMP), CURRENT_TIMESTAMP,
+				(SELECT removed_at FROM moved LIMIT 1)
+			)
+			ON CONFLICT (project_name, collector_name, url, dump_type, timestamp) DO UPDATE
+			SET duration = EXCLUDED.duration,
 				mdate = EXCLUDED.mdate
 		`
 
 		for _, d := range batch {
-			_, err := tx.Exec(ctx, stmt, d.Collector.Name, d.URL, int16(d.DumpType), time.Duration(d.Duration), d.Timestamp)
+			_, err := tx.Exec(ctx, stmt, d.Collector.Project.Name, d.Collector.Name, d.URL, int16(d.DumpType), time.Duration(d.Duration), d.Timestamp)
 			if err != nil {
 				logger.Error().Err(err).Str("collector", d.Collector.Name).Str("url", d.URL).Msg("Failed to execute upsert for BGP dump")
 				tx.Rollback(ctx)
@@ -128,64 +158,440 @@ func UpsertBGPDumps(ctx context.Context, logger *logging.Logger, db *pgxpool.Poo
 	return nil
 }
 
+// InsertCollectors adds a collectors row for each of the collectors that
+// isn't already stored.
+func InsertCollectors(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, collectors []Collector) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to begin transaction for InsertCollectors")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertCollectors(ctx, tx, collectors); err != nil {
+		logger.Error().Err(err).Msg("Failed to insert collectors")
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// insertMissingCollectors adds a collectors row for any collector of the
+// given dumps that isn't already stored, so that the dumps satisfy the
+// foreign key.
+func insertMissingCollectors(ctx context.Context, tx pgx.Tx, dumps []BGPDump) error {
+	return insertCollectors(ctx, tx, dumpCollectors(dumps))
+}
+
+// insertCollectors adds a collectors row for each of the collectors that
+// isn't already stored. Nothing is known to have been crawled for them.
+func insertCollectors(ctx context.Context, tx pgx.Tx, collectors []Collector) error {
+	var projects, names []string
+	for _, c := range collectors {
+		projects = append(projects, c.Project.Name)
+		names = append(names, c.Name)
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO collectors (project_name, name, cdate, mdate, most_recent_file_timestamp, last_completed_crawl_time_ribs, last_completed_crawl_time_updates)
+		SELECT p, n, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 'epoch', 'epoch', 'epoch'
+		FROM unnest($1::text[], $2::text[]) AS c(p, n)
+		ON CONFLICT (project_name, name) DO NOTHING
+	`, projects, names)
+	return err
+}
+
+// FetchProjectsFromDB retrieves the distinct projects that have collectors in the DB.
+func FetchProjectsFromDB(ctx context.Context, db *pgxpool.Pool) ([]Project, error) {
+	rows, err := db.Query(ctx, `SELECT DISTINCT project_name FROM collectors ORDER BY project_name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []Project
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		projects = append(projects, Project{Name: name})
+	}
+	return projects, rows.Err()
+}
+
+// FetchCollectorsFromDB retrieves the collectors stored in the DB for the
+// given project. All projects if project is empty.
+func FetchCollectorsFromDB(ctx context.Context, db *pgxpool.Pool, project string) ([]Collector, error) {
+	rows, err := db.Query(ctx, `
+		SELECT name, project_name
+		FROM collectors
+		WHERE $1 = '' OR project_name = $1
+		ORDER BY project_name ASC, name ASC
+	`, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collectors []Collector
+	for rows.Next() {
+		var name, projectName string
+		if err := rows.Scan(&name, &projectName); err != nil {
+			return nil, err
+		}
+		collectors = append(collectors, Collector{
+			Project: Project{Name: projectName},
+			Name:    name,
+		})
+	}
+	return collectors, rows.Err()
+}
+
+// RetireCollectorsInDB flags the collectors as retired as of at, returning
+// how many weren't already retired.
+func RetireCollectorsInDB(ctx context.Context, db *pgxpool.Pool, collectors []Collector, at time.Time) (int, error) {
+	retired := 0
+	for _, c := range collectors {
+		tag, err := db.Exec(ctx, `
+			UPDATE collectors
+			SET retired_at = to_timestamp($3), mdate = CURRENT_TIMESTAMP
+			WHERE project_name = $1
+			AND name = $2
+			AND retired_at IS NULL
+		`, c.Project.Name, c.Name, at.Unix())
+		if err != nil {
+			return retired, err
+		}
+		retired += int(tag.RowsAffected())
+	}
+	return retired, nil
+}
+
+// FetchRetiredCollectorsFromDB retrieves when each of the project's retired
+// collectors was retired, keyed by collector name.
+func FetchRetiredCollectorsFromDB(ctx context.Context, db *pgxpool.Pool, project string) (map[string]time.Time, error) {
+	rows, err := db.Query(ctx, `
+		SELECT name, EXTRACT(EPOCH FROM retired_at)::bigint
+		FROM collectors
+		WHERE project_name = $1
+		AND retired_at IS NOT NULL
+	`, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retired := map[string]time.Time{}
+	for rows.Next() {
+		var name string
+		var at int64
+		if err := rows.Scan(&name, &at); err != nil {
+			return nil, err
+		}
+		retired[name] = time.Unix(at, 0)
+	}
+	return retired, rows.Err()
+}
+
 // FetchDataFromDB retrieves BGP dump data filtered by collector names and dump types.
-func FetchDataFromDB(ctx context.Context, db *pgxpool.Pool, query Query) ([]BGPDump, error) {
+func FetchDataFromDB(ctx context.Context, db *pgxpool.Pool, query Query, opts FetchOptions) ([]BGPDump, error) {
+	var results []BGPDump
+	err := StreamDataFromDB(ctx, db, query, opts, func(d BGPDump) error {
+		results = append(results, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// StreamDataFromDB calls fn for each BGP dump that FetchDataFromDB would
+// return, as the rows are read from the database.
+func StreamDataFromDB(ctx context.Context, db *pgxpool.Pool, query Query, opts FetchOptions, fn func(BGPDump) error) error {
 	sqlQuery := `
-        SELECT url, dump_type, duration, collector_name, EXTRACT(EPOCH FROM timestamp)::bigint
-        FROM bgp_dumps
-        WHERE collector_name = ANY($1)
-        AND timestamp + duration >= to_timestamp($2)
-        AND timestamp <= to_timestamp($3)
-		ORDER BY timestamp ASC, dump_type ASC
-    ` // This ORDER BY may be bad for performance? But putting it there to match bgpstream ordering (which I think this is)
+        SELECT d.url, d.dump_type, d.duration, d.collector_name, d.project_name, EXTRACT(EPOCH FROM d.timestamp)::bigint,
+            COALESCE(EXTRACT(EPOCH FROM d.removed_at)::bigint, 0)
+        FROM bgp_dumps d
+        WHERE (d.project_name, d.collector_name) IN (SELECT * FROM unnest($1::text[], $2::text[]))
+        AND d.timestamp >= to_timestamp($3)
+        AND d.timestamp + d.duration >= to_timestamp($4)
+        AND d.timestamp <= to_timestamp($5)
+    `
 
 	if query.DumpType != DumpTypeAny {
-		sqlQuery += " AND dump_type = $4"
+		sqlQuery += " AND d.dump_type = $6"
+	}
+	if !opts.IncludeRemoved {
+		sqlQuery += " AND d.removed_at IS NULL"
 	}
 
-	// Extract collector names from the query
+	// Extract collector identities from the query
+	projectNames := make([]string, len(query.Collectors))
 	collectorNames := make([]string, len(query.Collectors))
 	for i, c := range query.Collectors {
+		projectNames[i] = c.Project.Name
 		collectorNames[i] = c.Name
 	}
 
 	var args []interface{}
-	args = append(args, collectorNames, query.From.Unix(), query.Until.Unix())
+	// Nothing that starts before this can overlap the window. Unlike the
+	// overlap check, it can use the index and prune partitions.
+	earliest := query.From.Add(-time.Duration(MaxDumpDuration))
+	args = append(args, projectNames, collectorNames, earliest.Unix(), query.From.Unix(), query.Until.Unix())
 	if query.DumpType != DumpTypeAny {
 		args = append(args, int16(query.DumpType))
 	}
 
+	// Keyset pagination, so that later pages cost the same as the first
+	if opts.After != nil {
+		args = append(args, opts.After.Timestamp, int16(opts.After.DumpType), opts.After.URL)
+		sqlQuery += fmt.Sprintf(" AND (d.timestamp, d.dump_type, d.url) > (to_timestamp($%d), $%d, $%d)", len(args)-2, len(args)-1, len(args))
+	}
+
+	// This ORDER BY may be bad for performance? But putting it there to match bgpstream ordering (which I think this is)
+	sqlQuery += " ORDER BY d.timestamp ASC, d.dump_type ASC, d.url ASC"
+	if opts.Limit > 0 {
+		args = append(args, opts.Limit)
+		sqlQuery += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
 	rows, err := db.Query(ctx, sqlQuery, args...)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			url           string
+			dumpTypeInt   int16
+			duration      time.Duration
+			collectorName string
+			projectName   string
+			timestamp     int64
+			removedAt     int64
+		)
+
+		err := rows.Scan(&url, &dumpTypeInt, &duration, &collectorName, &projectName, &timestamp, &removedAt)
+		if err != nil {
+			return err
+		}
+
+		err = fn(BGPDump{
+			URL:       url,
+			DumpType:  DumpType(dumpTypeInt),
+			Duration:  DumpDuration(duration),
+			Collector: Collector{Project: Project{Name: projectName}, Name: collectorName},
+			Timestamp: timestamp,
+			RemovedAt: removedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ChangeFeedHorizonFromDB returns the latest time that the change feed can
+// reach. Dumps are stamped with the start time of the transaction that
+// changes them, by the database's clock, so the horizon is taken from that
+// clock too, and mustn't pass the start of any transaction that has written
+// but not committed. Only the transactions that pg_stat_activity shows to
+// this role are considered, which includes all of bgpfinder's own.
+func ChangeFeedHorizonFromDB(ctx context.Context, db *pgxpool.Pool) (time.Time, error) {
+	return changeFeedHorizonFromDB(ctx, db, ChangeFeedLag)
+}
+
+// changeFeedHorizonFromDB is ChangeFeedHorizonFromDB with the given lag.
+func changeFeedHorizonFromDB(ctx context.Context, db *pgxpool.Pool, lag time.Duration) (time.Time, error) {
+	// LEAST ignores the NULL from min when there are no open transactions
+	var horizon time.Time
+	err := db.QueryRow(ctx, `
+		SELECT LEAST(
+			now() - make_interval(secs => $1),
+			min(xact_start) - interval '1 microsecond'
+		)
+		FROM pg_stat_activity
+		WHERE datname = current_database()
+		AND backend_type = 'client backend'
+		AND backend_xid IS NOT NULL
+		AND pid != pg_backend_pid()
+	`, lag.Seconds()).Scan(&horizon)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return horizon, nil
+}
+
+// FetchDataChangesFromDB retrieves up to limit BGP dumps matching the query
+// that were added or changed after the cursor (and no later than until),
+// ordered by mdate. It returns the cursor of the last dump, or since if there
+// were none.
+func FetchDataChangesFromDB(ctx context.Context, db *pgxpool.Pool, query Query, since ChangeCursor, until time.Time, limit int, opts FetchOptions) ([]BGPDump, ChangeCursor, error) {
+	projectNames := make([]string, len(query.Collectors))
+	collectorNames := make([]string, len(query.Collectors))
+	for i, c := range query.Collectors {
+		projectNames[i] = c.Project.Name
+		collectorNames[i] = c.Name
+	}
+
+	// See FetchDataFromDB for why the earliest start time is needed. The
+	// cursor is kept in microseconds, which is the resolution of mdate.
+	earliest := query.From.Add(-time.Duration(MaxDumpDuration))
+	args := []interface{}{
+		projectNames, collectorNames, earliest.Unix(), query.From.Unix(), query.Until.Unix(),
+		since.Modified, since.ID, until.UnixMicro(), limit,
+	}
+	sqlQuery := `
+        SELECT d.url, d.dump_type, d.duration, d.collector_name, d.project_name, EXTRACT(EPOCH FROM d.timestamp)::bigint,
+            COALESCE(EXTRACT(EPOCH FROM d.removed_at)::bigint, 0),
+            (EXTRACT(EPOCH FROM d.mdate) * 1000000)::bigint, d.bgp_dump_id
+        FROM bgp_dumps d
+        WHERE (d.project_name, d.collector_name) IN (SELECT * FROM unnest($1::text[], $2::text[]))
+        AND d.timestamp >= to_timestamp($3)
+        AND d.timestamp + d.duration >= to_timestamp($4)
+        AND d.timestamp <= to_timestamp($5)
+        AND (d.mdate, d.bgp_dump_id) > ('epoch'::timestamp + $6 * INTERVAL '1 microsecond', $7)
+        AND d.mdate <= 'epoch'::timestamp + $8 * INTERVAL '1 microsecond'
+    `
+	if query.DumpType != DumpTypeAny {
+		args = append(args, int16(query.DumpType))
+		sqlQuery += " AND d.dump_type = $10"
+	}
+	if !opts.IncludeRemoved {
+		sqlQuery += " AND d.removed_at IS NULL"
+	}
+	sqlQuery += " ORDER BY d.mdate ASC, d.bgp_dump_id ASC LIMIT $9"
+
+	rows, err := db.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, since, err
 	}
 	defer rows.Close()
 
 	var results []BGPDump
+	next := since
 	for rows.Next() {
 		var (
 			url           string
 			dumpTypeInt   int16
 			duration      time.Duration
 			collectorName string
+			projectName   string
 			timestamp     int64
+			removedAt     int64
+			id            int32
 		)
 
-		err := rows.Scan(&url, &dumpTypeInt, &duration, &collectorName, &timestamp)
+		err := rows.Scan(&url, &dumpTypeInt, &duration, &collectorName, &projectName, &timestamp, &removedAt, &next.Modified, &id)
 		if err != nil {
-			return nil, err
+			return nil, since, err
 		}
+		next.ID = int64(id)
 
 		results = append(results, BGPDump{
 			URL:       url,
 			DumpType:  DumpType(dumpTypeInt),
 			Duration:  DumpDuration(duration),
-			Collector: Collector{Name: collectorName},
+			Collector: Collector{Project: Project{Name: projectName}, Name: collectorName},
 			Timestamp: timestamp,
+			RemovedAt: removedAt,
 		})
 	}
+	if err := rows.Err(); err != nil {
+		return nil, since, err
+	}
+	return results, next, nil
+}
 
-	return results, nil
+// ReconcileBGPDumps marks the collector's stored dumps in the window that
+// weren't found by the crawl as removed, and restores any removed dumps that
+// were found again.
+func ReconcileBGPDumps(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, collector Collector, dumpType DumpType, window Interval, found []BGPDump) (ReconcileStats, error) {
+	dumpTypes := concreteDumpTypes(dumpType)
+	dumpTypeValues := make([]int16, len(dumpTypes))
+	for i, dt := range dumpTypes {
+		dumpTypeValues[i] = int16(dt)
+	}
+	urls := make([]string, len(found))
+	for i, d := range found {
+		urls[i] = d.URL
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to begin transaction for ReconcileBGPDumps")
+		return ReconcileStats{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	args := []any{collector.Project.Name, collector.Name, dumpTypeValues, window.From.Unix(), window.Until.Unix(), urls}
+	removed, err := tx.Exec(ctx, `
+		UPDATE bgp_dumps
+		SET removed_at = CURRENT_TIMESTAMP, mdate = CURRENT_TIMESTAMP
+		WHERE project_name = $1
+		AND collector_name = $2
+		AND dump_type = ANY($3)
+		AND timestamp >= to_timestamp($4)
+		AND timestamp < to_timestamp($5)
+		AND removed_at IS NULL
+		AND url NOT IN (SELECT unnest($6::text[]))
+	`, args...)
+	if err != nil {
+		return ReconcileStats{}, err
+	}
+	restored, err := tx.Exec(ctx, `
+		UPDATE bgp_dumps
+		SET removed_at = NULL, mdate = CURRENT_TIMESTAMP
+		WHERE project_name = $1
+		AND collector_name = $2
+		AND dump_type = ANY($3)
+		AND timestamp >= to_timestamp($4)
+		AND timestamp < to_timestamp($5)
+		AND removed_at IS NOT NULL
+		AND url IN (SELECT unnest($6::text[]))
+	`, args...)
+	if err != nil {
+		return ReconcileStats{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logger.Error().Err(err).Msg("Failed to commit transaction for ReconcileBGPDumps")
+		return ReconcileStats{}, err
+	}
+	return ReconcileStats{
+		Removed:  int(removed.RowsAffected()),
+		Restored: int(restored.RowsAffected()),
+	}, nil
+}
+
+// FetchLatestDumpTimesFromDB retrieves the timestamp of the newest dump of
+// the given type for each of the project's collectors, keyed by collector
+// name.
+func FetchLatestDumpTimesFromDB(ctx context.Context, db *pgxpool.Pool, project string, dumpType DumpType) (map[string]time.Time, error) {
+	rows, err := db.Query(ctx, `
+		SELECT collector_name, EXTRACT(EPOCH FROM MAX(timestamp))::bigint
+		FROM bgp_dumps
+		WHERE project_name = $1
+		AND dump_type = $2
+		GROUP BY collector_name
+	`, project, int16(dumpType))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	latest := map[string]time.Time{}
+	for rows.Next() {
+		var collectorName string
+		var timestamp int64
+		if err := rows.Scan(&collectorName, &timestamp); err != nil {
+			return nil, err
+		}
+		latest[collectorName] = time.Unix(timestamp, 0)
+	}
+	return latest, rows.Err()
 }
 
 func parseInterval(val interface{}) time.Duration {
@@ -0,0 +1,52 @@
+package bgpfinder
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UpsertCrawlWindowToDB records when the window's source last crawled it.
+func UpsertCrawlWindowToDB(ctx context.Context, db *pgxpool.Pool, window CrawlWindow) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO crawl_windows (source, project_name, collector_name, dump_type, from_time, until_time, crawled, dumps_found)
+		VALUES ($1, $2, $3, $4, to_timestamp($5), to_timestamp($6), to_timestamp($7), $8)
+		ON CONFLICT (source, project_name, collector_name, dump_type, from_time, until_time)
+		DO UPDATE SET crawled = EXCLUDED.crawled, dumps_found = EXCLUDED.dumps_found
+	`, window.Source, window.Collector.Project.Name, window.Collector.Name, int16(window.DumpType),
+		window.Window.From.Unix(), window.Window.Until.Unix(), window.Crawled.Unix(), window.DumpsFound)
+	return err
+}
+
+// FetchCrawlWindowsFromDB retrieves the source's records of the collector's
+// windows for the dump type.
+func FetchCrawlWindowsFromDB(ctx context.Context, db *pgxpool.Pool, source string, collector Collector, dumpType DumpType) ([]CrawlWindow, error) {
+	rows, err := db.Query(ctx, `
+		SELECT EXTRACT(EPOCH FROM from_time)::bigint, EXTRACT(EPOCH FROM until_time)::bigint,
+			EXTRACT(EPOCH FROM crawled)::bigint, dumps_found
+		FROM crawl_windows
+		WHERE source = $1
+		AND project_name = $2
+		AND collector_name = $3
+		AND dump_type = $4
+		ORDER BY from_time ASC
+	`, source, collector.Project.Name, collector.Name, int16(dumpType))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []CrawlWindow
+	for rows.Next() {
+		var from, until, crawled int64
+		w := CrawlWindow{Source: source, Collector: collector, DumpType: dumpType}
+		if err := rows.Scan(&from, &until, &crawled, &w.DumpsFound); err != nil {
+			return nil, err
+		}
+		w.Window = Interval{From: time.Unix(from, 0), Until: time.Unix(until, 0)}
+		w.Crawled = time.Unix(crawled, 0)
+		windows = append(windows, w)
+	}
+	return windows, rows.Err()
+}
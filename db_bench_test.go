@@ -0,0 +1,134 @@
+package bgpfinder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The Postgres benchmarks need a scratch database. Point
+// BGPFINDER_BENCH_ENV_FILE at an env file in the format LoadDBConfig expects
+// to run them, e.g.:
+//
+//	BGPFINDER_BENCH_ENV_FILE=.env go test -run '^$' -bench Upsert
+const benchEnvFileVar = "BGPFINDER_BENCH_ENV_FILE"
+
+var benchCollector = Collector{Project: RisProject, Name: "bench00"}
+
+func benchDumps(n int, variant int) []BGPDump {
+	dumps := make([]BGPDump, n)
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range dumps {
+		ts := base.Add(time.Duration(i) * time.Duration(RISUpdatePeriod))
+		dumps[i] = BGPDump{
+			URL:       fmt.Sprintf("https://example.net/bench00/updates.%d.gz", ts.Unix()),
+			Collector: benchCollector,
+			Duration:  RISUpdateDuration + DumpDuration(variant)*DumpDuration(time.Second),
+			DumpType:  DumpTypeUpdates,
+			Timestamp: ts.Unix(),
+		}
+	}
+	return dumps
+}
+
+func newBenchPostgresStore(b *testing.B) *PostgresStore {
+	b.Helper()
+	envFile := os.Getenv(benchEnvFileVar)
+	if envFile == "" {
+		b.Skipf("%s not set", benchEnvFileVar)
+	}
+	ctx := context.Background()
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err := ConnectDB(ctx, envFile)
+	if err != nil {
+		b.Fatalf("Failed to connect to Postgres: %v", err)
+	}
+	store := NewPostgresStore(logger, db)
+	b.Cleanup(store.Close)
+	if _, err := MigrateUp(ctx, logger, store); err != nil {
+		b.Fatalf("Failed to migrate Postgres store: %v", err)
+	}
+	cleanup := func() {
+		if _, err := db.Exec(ctx, `DELETE FROM bgp_dumps WHERE collector_name = $1`, benchCollector.Name); err != nil {
+			b.Fatal(err)
+		}
+	}
+	cleanup()
+	b.Cleanup(cleanup)
+	return store
+}
+
+type upsertFunc func(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, dumps []BGPDump) error
+
+// benchmarkPostgresUpsert times the first load of n dumps into an empty
+// table, and then a re-upsert of the same (changed) dumps.
+func benchmarkPostgresUpsert(b *testing.B, n int, upsert upsertFunc) {
+	store := newBenchPostgresStore(b)
+	ctx := context.Background()
+
+	b.Run("insert", func(b *testing.B) {
+		dumps := benchDumps(n, 0)
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			if _, err := store.db.Exec(ctx, `DELETE FROM bgp_dumps WHERE collector_name = $1`, benchCollector.Name); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			if err := upsert(ctx, store.logger, store.db, dumps); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("update", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			dumps := benchDumps(n, i+1)
+			b.StartTimer()
+			if err := upsert(ctx, store.logger, store.db, dumps); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUpsertBGPDumps(b *testing.B) {
+	benchmarkPostgresUpsert(b, 50000, UpsertBGPDumps)
+}
+
+func BenchmarkBulkUpsertBGPDumps(b *testing.B) {
+	benchmarkPostgresUpsert(b, 50000, func(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, dumps []BGPDump) error {
+		_, err := BulkUpsertBGPDumps(ctx, logger, db, dumps)
+		return err
+	})
+}
+
+func BenchmarkSQLiteStoreUpsertDumps(b *testing.B) {
+	ctx := context.Background()
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	store, err := OpenSQLiteStore(ctx, logger, ":memory:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := MigrateUp(ctx, logger, store); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.UpsertDumps(ctx, benchDumps(50000, i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package bgpfinder
+
+import (
+	"context"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// bulkBatchSize bounds the size of the staging table (and the length of each
+// transaction) used by BulkUpsertBGPDumps.
+const bulkBatchSize = 100000
+
+// BulkUpsertBGPDumps inserts or updates BGP dump records by streaming them
+// into a temporary staging table with COPY and then merging the staging
+// table into bgp_dumps with a single INSERT ... ON CONFLICT. Rows whose
+// metadata hasn't changed are left alone (including their mdate).
+func BulkUpsertBGPDumps(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, dumps []BGPDump) (UpsertStats, error) {
+	var stats UpsertStats
+
+	if err := checkDumpDurations(dumps); err != nil {
+		return stats, err
+	}
+	if err := ensureDumpPartitions(ctx, db, dumps); err != nil {
+		logger.Error().Err(err).Msg("Failed to create partitions for BulkUpsertBGPDumps")
+		return stats, err
+	}
+
+	// The merge can't touch the same row twice, so drop duplicate URLs
+	// up front (last one wins, as it would with UpsertBGPDumps).
+	dumps = dedupeDumps(dumps)
+
+	for start := 0; start < len(dumps); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(dumps) {
+			end = len(dumps)
+		}
+		batchStats, err := bulkUpsertBatch(ctx, db, dumps[start:end])
+		if err != nil {
+			logger.Error().Err(err).Int("batch_start", start).Int("batch_end", end).Msg("Failed to bulk upsert BGP dumps batch")
+			return stats, err
+		}
+		stats.Add(batchStats)
+		logger.Info().
+			Int("batch_start", start).
+			Int("batch_end", end).
+			Int("inserted", batchStats.Inserted).
+			Int("updated", batchStats.Updated).
+			Int("unchanged", batchStats.Unchanged).
+			Msg("Bulk upserted BGP dumps batch")
+	}
+	return stats, nil
+}
+
+func bulkUpsertBatch(ctx context.Context, db *pgxpool.Pool, dumps []BGPDump) (UpsertStats, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return UpsertStats{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		CREATE TEMPORARY TABLE bgp_dumps_staging (
+			project_name VARCHAR(255) NOT NULL,
+			collector_name VARCHAR(255) NOT NULL,
+			url TEXT NOT NULL,
+			dump_type SMALLINT NOT NULL,
+			duration INTERVAL,
+			timestamp TIMESTAMP NOT NULL,
+			bgp_dump_id INTEGER,
+			cdate TIMESTAMP,
+			removed_at TIMESTAMP
+		) ON COMMIT DROP
+	`)
+	if err != nil {
+		return UpsertStats{}, err
+	}
+
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"bgp_dumps_staging"},
+		[]string{"project_name", "collector_name", "url", "dump_type", "duration", "timestamp"},
+		pgx.CopyFromSlice(len(dumps), func(i int) ([]any, error) {
+			d := dumps[i]
+			return []any{
+				d.Collector.Project.Name,
+				d.Collector.Name,
+				d.URL,
+				int16(d.DumpType),
+				time.Duration(d.Duration),
+				time.Unix(d.Timestamp, 0).UTC(),
+			}, nil
+		}),
+	)
+	if err != nil {
+		return UpsertStats{}, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO collectors (project_name, name, cdate, mdate, most_recent_file_timestamp, last_completed_crawl_time_ribs, last_completed_crawl_time_updates)
+		SELECT DISTINCT project_name, collector_name, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 'epoch'::timestamp, 'epoch'::timestamp, 'epoch'::timestamp
+		FROM bgp_dumps_staging
+		ON CONFLICT (project_name, name) DO NOTHING
+	`)
+	if err != nil {
+		return UpsertStats{}, err
+	}
+
+	// The unique constraint has to include the partition keys, so it can't
+	// stop a URL that's now found with a different type or timestamp from
+	// being stored twice. Such rows are taken out and put back below as
+	// the same dump (keeping its id, creation time and tombstone), which
+	// makes them updates, as they are in the other stores.
+	tag, err := tx.Exec(ctx, `
+		WITH moved AS (
+			DELETE FROM bgp_dumps d
+			USING bgp_dumps_staging s
+			WHERE d.project_name = s.project_name
+			AND d.collector_name = s.collector_name
+			AND d.url = s.url
+			AND (d.dump_type != s.dump_type OR d.timestamp != s.timestamp)
+			RETURNING d.project_name, d.collector_name, d.url, d.bgp_dump_id, d.cdate, d.removed_at
+		)
+		UPDATE bgp_dumps_staging s
+		SET bgp_dump_id = moved.bgp_dump_id,
+			cdate = moved.cdate,
+			removed_at = moved.removed_at
+		FROM moved
+		WHERE s.project_name = moved.project_name
+		AND s.collector_name = moved.collector_name
+		AND s.url = moved.url
+	`)
+	if err != nil {
+		return UpsertStats{}, err
+	}
+	moved := int(tag.RowsAffected())
+
+	// xmax is only set on rows that already existed, so it tells us
+	// whether each returned row was inserted or updated. Unchanged rows
+	// are filtered out by the WHERE clause and not returned at all.
+	var inserted, updated int
+	err = tx.QueryRow(ctx, `
+		WITH merged AS (
+			INSERT INTO bgp_dumps (bgp_dump_id, project_name, collector_name, url, dump_type, duration, timestamp, cdate, mdate, removed_at)
+			SELECT COALESCE(bgp_dump_id, nextval('bgp_dumps_bgp_dump_id_seq')), project_name, collector_name, url, dump_type, duration, timestamp,
+				COALESCE(cdate, CURRENT_TIMESTAMP), CURRENT_TIMESTAMP, removed_at
+			FROM bgp_dumps_staging
+			ON CONFLICT (project_name, collector_name, url, dump_type, timestamp) DO UPDATE
+			SET duration = EXCLUDED.duration,
+				mdate = EXCLUDED.mdate
+			WHERE bgp_dumps.duration IS DISTINCT FROM EXCLUDED.duration
+			RETURNING (xmax = 0) AS inserted
+		)
+		SELECT COUNT(*) FILTER (WHERE inserted), COUNT(*) FILTER (WHERE NOT inserted)
+		FROM merged
+	`).Scan(&inserted, &updated)
+	if err != nil {
+		return UpsertStats{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return UpsertStats{}, err
+	}
+	return UpsertStats{
+		Inserted:  inserted - moved,
+		Updated:   updated + moved,
+		Unchanged: len(dumps) - inserted - updated,
+	}, nil
+}
+
+// dedupeDumps drops all but the last dump for each (collector, URL) pair,
+// otherwise preserving order.
+func dedupeDumps(dumps []BGPDump) []BGPDump {
+	type key struct {
+		collector Collector
+		url       string
+	}
+	last := make(map[key]int, len(dumps))
+	for i, d := range dumps {
+		last[key{d.Collector, d.URL}] = i
+	}
+	if len(last) == len(dumps) {
+		return dumps
+	}
+	deduped := make([]BGPDump, 0, len(last))
+	for i, d := range dumps {
+		if last[key{d.Collector, d.URL}] == i {
+			deduped = append(deduped, d)
+		}
+	}
+	return deduped
+}
+
+// dumpCollectors returns the distinct collectors of the given dumps, in order
+// of first appearance.
+func dumpCollectors(dumps []BGPDump) []Collector {
+	seen := map[Collector]bool{}
+	var collectors []Collector
+	for _, d := range dumps {
+		if !seen[d.Collector] {
+			seen[d.Collector] = true
+			collectors = append(collectors, d.Collector)
+		}
+	}
+	return collectors
+}
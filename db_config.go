@@ -0,0 +1,69 @@
+package bgpfinder
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+)
+
+type DBConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	DBName   string
+}
+
+// LoadDBConfig reads the Postgres connection settings from the given env
+// file (and the environment).
+func LoadDBConfig(envFile string) (*DBConfig, error) {
+	if err := godotenv.Load(envFile); err != nil {
+		return nil, fmt.Errorf("error loading env file: %w", err)
+	}
+
+	config := &DBConfig{
+		Host:     os.Getenv("POSTGRES_HOST"),
+		Port:     os.Getenv("POSTGRES_PORT"),
+		User:     os.Getenv("POSTGRES_USER"),
+		Password: os.Getenv("POSTGRES_PASSWORD"),
+		DBName:   os.Getenv("POSTGRES_DB"),
+	}
+
+	// Validate required fields
+	if config.User == "" || config.Password == "" || config.DBName == "" {
+		return nil, fmt.Errorf("missing required database configuration")
+	}
+
+	return config, nil
+}
+
+func (c *DBConfig) ConnString() string {
+	return fmt.Sprintf(
+		"postgres://%s:%s@%s:%s/%s?sslmode=disable",
+		c.User,
+		c.Password,
+		c.Host,
+		c.Port,
+		c.DBName,
+	)
+}
+
+// ConnectDB loads the configuration from envFile and opens a connection pool.
+// Sessions are pinned to UTC: the timestamp columns have no time zone, so
+// to_timestamp and CURRENT_TIMESTAMP would otherwise store local times that
+// don't match the UTC times that COPY writes.
+func ConnectDB(ctx context.Context, envFile string) (*pgxpool.Pool, error) {
+	config, err := LoadDBConfig(envFile)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig, err := pgxpool.ParseConfig(config.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.ConnConfig.RuntimeParams["timezone"] = "UTC"
+	return pgxpool.NewWithConfig(ctx, poolConfig)
+}
@@ -0,0 +1,116 @@
+package bgpfinder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UpsertCrawlCoverage records that the given window has been fully crawled
+// for the collector and dump type. Any stored spans that overlap or touch the
+// window are merged with it into a single row.
+func UpsertCrawlCoverage(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, collector Collector, dumpType DumpType, window Interval) error {
+	if dumpType == DumpTypeAny {
+		return fmt.Errorf("coverage must be recorded for a specific dump type")
+	}
+	if window.Empty() {
+		return nil
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to begin transaction for UpsertCrawlCoverage")
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialize writers for this collector/dump type so that two concurrent
+	// merges can't both miss each other's new row.
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1 || '/' || $2), $3)`, collector.Project.Name, collector.Name, int32(dumpType))
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx, `
+		DELETE FROM crawl_coverage
+		WHERE project_name = $1
+		AND collector_name = $2
+		AND dump_type = $3
+		AND from_time <= to_timestamp($5)
+		AND until_time >= to_timestamp($4)
+		RETURNING EXTRACT(EPOCH FROM from_time)::bigint, EXTRACT(EPOCH FROM until_time)::bigint
+	`, collector.Project.Name, collector.Name, int16(dumpType), window.From.Unix(), window.Until.Unix())
+	if err != nil {
+		return err
+	}
+	spans := []Interval{window}
+	for rows.Next() {
+		var from, until int64
+		if err := rows.Scan(&from, &until); err != nil {
+			rows.Close()
+			return err
+		}
+		spans = append(spans, Interval{From: time.Unix(from, 0), Until: time.Unix(until, 0)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Everything we deleted touched the window, so this is a single span.
+	merged := mergeIntervals(spans)[0]
+	_, err = tx.Exec(ctx, `
+		INSERT INTO crawl_coverage (project_name, collector_name, dump_type, from_time, until_time, cdate, mdate)
+		VALUES ($1, $2, $3, to_timestamp($4), to_timestamp($5), CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	`, collector.Project.Name, collector.Name, int16(dumpType), merged.From.Unix(), merged.Until.Unix())
+	if err != nil {
+		logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to insert crawl coverage")
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logger.Error().Err(err).Msg("Failed to commit transaction for UpsertCrawlCoverage")
+		return err
+	}
+	logger.Debug().
+		Str("collector", collector.Name).
+		Str("dump_type", dumpType.String()).
+		Str("span", merged.String()).
+		Msg("Recorded crawl coverage")
+	return nil
+}
+
+// FetchCrawlCoverageFromDB retrieves the crawled spans for the collector and
+// dump type that overlap the given window, clipped to the window.
+func FetchCrawlCoverageFromDB(ctx context.Context, db *pgxpool.Pool, collector Collector, dumpType DumpType, window Interval) ([]Interval, error) {
+	rows, err := db.Query(ctx, `
+		SELECT EXTRACT(EPOCH FROM from_time)::bigint, EXTRACT(EPOCH FROM until_time)::bigint
+		FROM crawl_coverage
+		WHERE project_name = $1
+		AND collector_name = $2
+		AND dump_type = $3
+		AND from_time < to_timestamp($5)
+		AND until_time > to_timestamp($4)
+		ORDER BY from_time ASC
+	`, collector.Project.Name, collector.Name, int16(dumpType), window.From.Unix(), window.Until.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spans []Interval
+	for rows.Next() {
+		var from, until int64
+		if err := rows.Scan(&from, &until); err != nil {
+			return nil, err
+		}
+		spans = append(spans, Interval{From: time.Unix(from, 0), Until: time.Unix(until, 0)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return clipIntervals(spans, window), nil
+}
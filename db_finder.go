@@ -0,0 +1,140 @@
+package bgpfinder
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+// DBFinder is a Finder implementation backed by the collectors and
+// bgp_dumps tables of a Store. It only knows about what has already been
+// scraped into the DB, so it never goes out to the archives itself.
+type DBFinder struct {
+	store     Store
+	logger    *logging.Logger
+	fetchOpts FetchOptions
+}
+
+func NewDBFinder(logger *logging.Logger, store Store) *DBFinder {
+	return &DBFinder{
+		store:  store,
+		logger: logger.ModuleLogger("DBFinder"),
+	}
+}
+
+// SetFetchOptions changes which stored dumps Find returns (e.g., to include
+// dumps that have been removed from the archive).
+func (f *DBFinder) SetFetchOptions(opts FetchOptions) {
+	f.fetchOpts = opts
+}
+
+// TODO: plumb a Context through the Finder interface so that these
+// queries can be cancelled by the caller.
+
+func (f *DBFinder) Projects() ([]Project, error) {
+	return f.store.FetchProjects(context.Background())
+}
+
+func (f *DBFinder) Project(name string) (Project, error) {
+	projects, err := f.Projects()
+	if err != nil {
+		return Project{}, err
+	}
+	for _, p := range projects {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return Project{}, fmt.Errorf("unknown project: '%s'", name)
+}
+
+func (f *DBFinder) Collectors(project string) ([]Collector, error) {
+	return f.store.FetchCollectors(context.Background(), project)
+}
+
+func (f *DBFinder) Collector(name string) (Collector, error) {
+	collectors, err := f.Collectors("")
+	if err != nil {
+		return Collector{}, err
+	}
+	for _, c := range collectors {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return Collector{}, fmt.Errorf("collector not found: %s", name)
+}
+
+// Find returns the dumps stored in the DB that match the query. If the query
+// has no collectors, all collectors known to the DB are searched.
+func (f *DBFinder) Find(query Query) ([]BGPDump, error) {
+	if len(query.Collectors) == 0 {
+		collectors, err := f.Collectors("")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get collectors from DB: %v", err)
+		}
+		query.Collectors = collectors
+	}
+
+	f.logger.Debug().
+		Int("collector_count", len(query.Collectors)).
+		Time("from", query.From).
+		Time("until", query.Until).
+		Str("dump_type", query.DumpType.String()).
+		Msg("Fetching BGP dumps from DB")
+
+	return f.store.FetchDumps(context.Background(), query, f.fetchOpts)
+}
+
+// FindPage implements PagingFinder using keyset pagination in the store.
+func (f *DBFinder) FindPage(query Query, after *DumpCursor, limit int) ([]BGPDump, error) {
+	if len(query.Collectors) == 0 {
+		collectors, err := f.Collectors("")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get collectors from DB: %v", err)
+		}
+		query.Collectors = collectors
+	}
+	opts := f.fetchOpts
+	opts.After = after
+	opts.Limit = limit
+	return f.store.FetchDumps(context.Background(), query, opts)
+}
+
+// FindStream implements StreamingFinder by streaming the rows out of the
+// store.
+func (f *DBFinder) FindStream(query Query, fn func(BGPDump) error) error {
+	if len(query.Collectors) == 0 {
+		collectors, err := f.Collectors("")
+		if err != nil {
+			return fmt.Errorf("failed to get collectors from DB: %v", err)
+		}
+		query.Collectors = collectors
+	}
+	return f.store.StreamDumps(context.Background(), query, f.fetchOpts, fn)
+}
+
+// StoreDumps upserts the given dumps into the store.
+func (f *DBFinder) StoreDumps(dumps []BGPDump) error {
+	stats, err := f.store.UpsertDumps(context.Background(), dumps)
+	if err != nil {
+		return err
+	}
+	f.logger.Debug().
+		Int("inserted", stats.Inserted).
+		Int("updated", stats.Updated).
+		Int("unchanged", stats.Unchanged).
+		Msg("Stored BGP dumps")
+	return nil
+}
+
+// Covered implements Coverage using the store's crawl coverage.
+func (f *DBFinder) Covered(collector Collector, dumpType DumpType, window Interval) ([]Interval, error) {
+	return f.store.FetchCrawlCoverage(context.Background(), collector, dumpType, window)
+}
+
+// MarkCovered implements Coverage using the store's crawl coverage.
+func (f *DBFinder) MarkCovered(collector Collector, dumpType DumpType, window Interval) error {
+	return f.store.UpsertCrawlCoverage(context.Background(), collector, dumpType, window)
+}
@@ -0,0 +1,45 @@
+package bgpfinder
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AcquireLeaseInDB takes or renews the holder's lease. Expiry is judged by
+// the database's clock, so replicas with skewed clocks still agree on it.
+func AcquireLeaseInDB(ctx context.Context, db *pgxpool.Pool, collector Collector, dumpType DumpType, holder string, ttl time.Duration) (bool, error) {
+	var got string
+	err := db.QueryRow(ctx, `
+		INSERT INTO scrape_leases (project_name, collector_name, dump_type, holder, acquired, expires)
+		VALUES ($1, $2, $3, $4, NOW(), NOW() + make_interval(secs => $5))
+		ON CONFLICT (project_name, collector_name, dump_type) DO UPDATE
+		SET holder = EXCLUDED.holder,
+			acquired = CASE WHEN scrape_leases.holder = EXCLUDED.holder THEN scrape_leases.acquired ELSE EXCLUDED.acquired END,
+			expires = EXCLUDED.expires
+		WHERE scrape_leases.holder = EXCLUDED.holder OR scrape_leases.expires < NOW()
+		RETURNING holder
+	`, collector.Project.Name, collector.Name, int16(dumpType), holder, ttl.Seconds()).Scan(&got)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReleaseLeaseInDB gives up the holder's lease, if it still has it.
+func ReleaseLeaseInDB(ctx context.Context, db *pgxpool.Pool, collector Collector, dumpType DumpType, holder string) error {
+	_, err := db.Exec(ctx, `
+		DELETE FROM scrape_leases
+		WHERE project_name = $1
+		AND collector_name = $2
+		AND dump_type = $3
+		AND holder = $4
+	`, collector.Project.Name, collector.Name, int16(dumpType), holder)
+	return err
+}
@@ -0,0 +1,180 @@
+package bgpfinder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// partitionParents maps each dump type to the table that holds its monthly
+// partitions (see the 0004 migration).
+var partitionParents = map[DumpType]string{
+	DumpTypeRibs:    "bgp_dumps_ribs",
+	DumpTypeUpdates: "bgp_dumps_updates",
+}
+
+// partitionMonth is the first instant of the month that holds t, which is
+// the lower bound of the partition that t belongs in.
+func partitionMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func partitionName(dumpType DumpType, month time.Time) string {
+	return fmt.Sprintf("%s_y%04dm%02d", partitionParents[dumpType], month.Year(), month.Month())
+}
+
+// EnsureDumpPartitions creates the monthly bgp_dumps partitions for both dump
+// types between from and until (inclusive), if they don't already exist.
+func EnsureDumpPartitions(ctx context.Context, db *pgxpool.Pool, from, until time.Time) error {
+	for month := partitionMonth(from); !month.After(until); month = month.AddDate(0, 1, 0) {
+		for _, dumpType := range concreteDumpTypes(DumpTypeAny) {
+			if err := ensureDumpPartition(ctx, db, dumpType, month); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureDumpPartitions creates any partitions that the given dumps need. It
+// runs outside of the upsert transaction so that the lock that creating a
+// partition takes on bgp_dumps is only held briefly.
+func ensureDumpPartitions(ctx context.Context, db *pgxpool.Pool, dumps []BGPDump) error {
+	type key struct {
+		dumpType DumpType
+		month    time.Time
+	}
+	seen := map[key]bool{}
+	for _, d := range dumps {
+		k := key{d.DumpType, partitionMonth(time.Unix(d.Timestamp, 0))}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if err := ensureDumpPartition(ctx, db, k.dumpType, k.month); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureDumpPartition(ctx context.Context, db *pgxpool.Pool, dumpType DumpType, month time.Time) error {
+	_, err := db.Exec(ctx, `SELECT bgp_dumps_ensure_partition($1, to_timestamp($2)::timestamp)`, int16(dumpType), month.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to create partition %s: %w", partitionName(dumpType, month), err)
+	}
+	return nil
+}
+
+// DeleteBGPDumpsBefore removes dumps of the given type (both if DumpTypeAny)
+// with timestamps before the cutoff. Partitions that are entirely older than
+// the cutoff are dropped, and the remainder is deleted row by row. Crawl
+// coverage before the cutoff is removed too, so that the cache doesn't
+// think the deleted spans are still stored.
+func DeleteBGPDumpsBefore(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, dumpType DumpType, before time.Time) (int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to begin transaction for DeleteBGPDumpsBefore")
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var deleted int64
+	dumpTypes := concreteDumpTypes(dumpType)
+	for _, dt := range dumpTypes {
+		partitions, err := expiredPartitions(ctx, tx, dt, before)
+		if err != nil {
+			return 0, err
+		}
+		for _, partition := range partitions {
+			var rows int64
+			if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM `+pgx.Identifier{partition}.Sanitize()).Scan(&rows); err != nil {
+				return 0, err
+			}
+			if _, err := tx.Exec(ctx, `DROP TABLE `+pgx.Identifier{partition}.Sanitize()); err != nil {
+				logger.Error().Err(err).Str("partition", partition).Msg("Failed to drop partition")
+				return 0, err
+			}
+			logger.Info().Str("partition", partition).Int64("dumps", rows).Msg("Dropped expired partition")
+			deleted += rows
+		}
+	}
+
+	dumpTypeValues := make([]int16, len(dumpTypes))
+	for i, dt := range dumpTypes {
+		dumpTypeValues[i] = int16(dt)
+	}
+
+	ct, err := tx.Exec(ctx, `
+		DELETE FROM bgp_dumps
+		WHERE dump_type = ANY($1)
+		AND timestamp < to_timestamp($2)
+	`, dumpTypeValues, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	deleted += ct.RowsAffected()
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM crawl_coverage
+		WHERE dump_type = ANY($1)
+		AND until_time <= to_timestamp($2)
+	`, dumpTypeValues, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE crawl_coverage
+		SET from_time = to_timestamp($2), mdate = CURRENT_TIMESTAMP
+		WHERE dump_type = ANY($1)
+		AND from_time < to_timestamp($2)
+	`, dumpTypeValues, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logger.Error().Err(err).Msg("Failed to commit transaction for DeleteBGPDumpsBefore")
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// expiredPartitions lists the monthly partitions of the dump type that only
+// hold dumps from before the cutoff.
+func expiredPartitions(ctx context.Context, tx pgx.Tx, dumpType DumpType, before time.Time) ([]string, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT c.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = $1::regclass
+		ORDER BY c.relname ASC
+	`, partitionParents[dumpType])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		var year, month int
+		if _, err := fmt.Sscanf(name, partitionParents[dumpType]+"_y%04dm%02d", &year, &month); err != nil {
+			// Not one of ours, so leave it alone
+			continue
+		}
+		end := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
+		if !end.After(before) {
+			expired = append(expired, name)
+		}
+	}
+	return expired, rows.Err()
+}
@@ -0,0 +1,77 @@
+package bgpfinder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// InsertScrapeRunToDB records a new scrape run and sets its ID.
+func InsertScrapeRunToDB(ctx context.Context, db *pgxpool.Pool, run *ScrapeRun) error {
+	return db.QueryRow(ctx, `
+		INSERT INTO scrape_runs (source, project_name, dump_type, status, started, finished,
+			collectors_attempted, collectors_succeeded, dumps_found, dumps_inserted, retries, errors)
+		VALUES ($1, $2, $3, $4, to_timestamp($5), to_timestamp($6), $7, $8, $9, $10, $11, $12)
+		RETURNING scrape_run_id
+	`, run.Source, run.Project, int16(run.DumpType), string(run.Status), run.Started.Unix(), unixOrNil(run.Finished),
+		run.CollectorsAttempted, run.CollectorsSucceeded, run.DumpsFound, run.DumpsInserted, run.Retries, run.Errors,
+	).Scan(&run.ID)
+}
+
+// UpdateScrapeRunInDB overwrites the outcome of the scrape run.
+func UpdateScrapeRunInDB(ctx context.Context, db *pgxpool.Pool, run ScrapeRun) error {
+	tag, err := db.Exec(ctx, `
+		UPDATE scrape_runs
+		SET status = $2, finished = to_timestamp($3),
+			collectors_attempted = $4, collectors_succeeded = $5,
+			dumps_found = $6, dumps_inserted = $7, retries = $8, errors = $9
+		WHERE scrape_run_id = $1
+	`, run.ID, string(run.Status), unixOrNil(run.Finished),
+		run.CollectorsAttempted, run.CollectorsSucceeded, run.DumpsFound, run.DumpsInserted, run.Retries, run.Errors)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("scrape run %d not found", run.ID)
+	}
+	return nil
+}
+
+// FetchScrapeRunsFromDB retrieves the scrape runs that match the filter,
+// newest first.
+func FetchScrapeRunsFromDB(ctx context.Context, db *pgxpool.Pool, filter ScrapeRunFilter) ([]ScrapeRun, error) {
+	where, args := scrapeRunConditions(filter, func(column, placeholder string) string {
+		return fmt.Sprintf("%s @> ARRAY[%s::text]", column, placeholder)
+	})
+	rows, err := db.Query(ctx, `
+		SELECT scrape_run_id, source, project_name, dump_type, status,
+			EXTRACT(EPOCH FROM started)::bigint, EXTRACT(EPOCH FROM finished)::bigint,
+			collectors_attempted, collectors_succeeded, dumps_found, dumps_inserted, retries, errors
+		FROM scrape_runs
+		WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []ScrapeRun{}
+	for rows.Next() {
+		var run ScrapeRun
+		var dumpType int16
+		var status string
+		var started int64
+		var finished *int64
+		if err := rows.Scan(&run.ID, &run.Source, &run.Project, &dumpType, &status, &started, &finished,
+			&run.CollectorsAttempted, &run.CollectorsSucceeded, &run.DumpsFound, &run.DumpsInserted, &run.Retries, &run.Errors); err != nil {
+			return nil, err
+		}
+		run.DumpType = DumpType(dumpType)
+		run.Status = ScrapeRunStatus(status)
+		run.Started = time.Unix(started, 0)
+		run.Finished = timeOrNil(finished)
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
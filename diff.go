@@ -0,0 +1,197 @@
+package bgpfinder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Diff report formats accepted by WriteDiffReport.
+const (
+	DiffFormatText = "text"
+	DiffFormatJSON = "json"
+)
+
+// DumpChange is a dump whose metadata upstream differs from what's stored.
+type DumpChange struct {
+	URL    string  `json:"url"`
+	Stored BGPDump `json:"stored"`
+	Found  BGPDump `json:"found"`
+
+	// Fields names the metadata that differs (timestamp, duration, type or
+	// removedAt, for stored dumps that have reappeared upstream)
+	Fields []string `json:"fields"`
+}
+
+// CrawlDiff compares what a crawl of one of a collector's windows would
+// find with what's stored for it.
+type CrawlDiff struct {
+	Collector Collector `json:"collector"`
+	DumpType  DumpType  `json:"type"`
+	Window    Interval  `json:"window"`
+
+	// New dumps are found upstream but not stored
+	New []BGPDump `json:"new"`
+
+	// Changed dumps are stored with different metadata
+	Changed []DumpChange `json:"changed"`
+
+	// Missing dumps are stored but no longer found upstream
+	Missing []BGPDump `json:"missing"`
+
+	// Unchanged counts the dumps that are stored as found
+	Unchanged int `json:"unchanged"`
+
+	// Error is set if the window couldn't be compared
+	Error string `json:"error,omitempty"`
+}
+
+// Empty reports whether the crawl would change nothing.
+func (d CrawlDiff) Empty() bool {
+	return len(d.New) == 0 && len(d.Changed) == 0 && len(d.Missing) == 0 && d.Error == ""
+}
+
+// DiffCrawl finds the collector's dumps of the type in the window and
+// compares them with the stored ones, without writing anything. Only dumps
+// whose timestamps are in the window are compared, on both sides.
+func DiffCrawl(ctx context.Context, store Store, finder Finder, collector Collector, dumpType DumpType, window Interval) (CrawlDiff, error) {
+	diff := CrawlDiff{Collector: collector, DumpType: dumpType, Window: window}
+	query := Query{
+		Collectors: []Collector{collector},
+		DumpType:   dumpType,
+		From:       window.From,
+		Until:      window.Until,
+	}
+
+	found, err := finder.Find(query)
+	if err != nil {
+		return diff, fmt.Errorf("failed to find dumps for %s: %w", collector, err)
+	}
+	stored, err := store.FetchDumps(ctx, query, FetchOptions{IncludeRemoved: true})
+	if err != nil {
+		return diff, fmt.Errorf("failed to fetch stored dumps for %s: %w", collector, err)
+	}
+
+	storedByURL := map[string]BGPDump{}
+	for _, d := range stored {
+		if dateInRange(time.Unix(d.Timestamp, 0), query) {
+			storedByURL[d.URL] = d
+		}
+	}
+	for _, f := range found {
+		if !dateInRange(time.Unix(f.Timestamp, 0), query) {
+			continue
+		}
+		s, ok := storedByURL[f.URL]
+		if !ok {
+			diff.New = append(diff.New, f)
+			continue
+		}
+		delete(storedByURL, f.URL)
+		if fields := changedFields(s, f); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, DumpChange{URL: f.URL, Stored: s, Found: f, Fields: fields})
+		} else {
+			diff.Unchanged++
+		}
+	}
+	for _, s := range storedByURL {
+		// Dumps already known to be gone aren't news
+		if s.RemovedAt == 0 {
+			diff.Missing = append(diff.Missing, s)
+		}
+	}
+	sort.Slice(diff.Missing, func(i, j int) bool {
+		if diff.Missing[i].Timestamp != diff.Missing[j].Timestamp {
+			return diff.Missing[i].Timestamp < diff.Missing[j].Timestamp
+		}
+		return diff.Missing[i].URL < diff.Missing[j].URL
+	})
+	return diff, nil
+}
+
+// changedFields names the metadata that an upsert of found would change.
+// Dumps are stored once per URL, so a new timestamp or type updates the
+// stored dump rather than adding another.
+func changedFields(stored, found BGPDump) []string {
+	var fields []string
+	if stored.Timestamp != found.Timestamp {
+		fields = append(fields, "timestamp")
+	}
+	if stored.Duration != found.Duration {
+		fields = append(fields, "duration")
+	}
+	if stored.DumpType != found.DumpType {
+		fields = append(fields, "type")
+	}
+	if stored.RemovedAt != 0 {
+		fields = append(fields, "removedAt")
+	}
+	return fields
+}
+
+// WriteDiffReport writes the diffs as text (one line per difference,
+// grouped by window) or JSON (one diff per line). Windows without any
+// differences are left out of text reports.
+func WriteDiffReport(w io.Writer, diffs []CrawlDiff, format string) error {
+	switch format {
+	case DiffFormatJSON:
+		enc := json.NewEncoder(w)
+		for _, d := range diffs {
+			if err := enc.Encode(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	case DiffFormatText:
+		return writeDiffText(w, diffs)
+	default:
+		return fmt.Errorf("unknown diff format %q", format)
+	}
+}
+
+func writeDiffText(w io.Writer, diffs []CrawlDiff) error {
+	var b strings.Builder
+	var added, changed, missing, windows int
+	for _, d := range diffs {
+		added += len(d.New)
+		changed += len(d.Changed)
+		missing += len(d.Missing)
+		if d.Empty() {
+			continue
+		}
+		windows++
+		fmt.Fprintf(&b, "%s %s %s\n", d.Collector, d.DumpType, d.Window)
+		if d.Error != "" {
+			fmt.Fprintf(&b, "  ! %s\n", d.Error)
+		}
+		for _, n := range d.New {
+			fmt.Fprintf(&b, "  + %s\n", n.URL)
+		}
+		for _, c := range d.Changed {
+			var parts []string
+			for _, f := range c.Fields {
+				switch f {
+				case "timestamp":
+					parts = append(parts, fmt.Sprintf("timestamp %d -> %d", c.Stored.Timestamp, c.Found.Timestamp))
+				case "duration":
+					parts = append(parts, fmt.Sprintf("duration %s -> %s", time.Duration(c.Stored.Duration), time.Duration(c.Found.Duration)))
+				case "type":
+					parts = append(parts, fmt.Sprintf("type %s -> %s", c.Stored.DumpType, c.Found.DumpType))
+				case "removedAt":
+					parts = append(parts, "reappeared")
+				}
+			}
+			fmt.Fprintf(&b, "  ~ %s (%s)\n", c.URL, strings.Join(parts, ", "))
+		}
+		for _, m := range d.Missing {
+			fmt.Fprintf(&b, "  - %s\n", m.URL)
+		}
+	}
+	fmt.Fprintf(&b, "%d new, %d changed, %d missing upstream in %d of %d windows\n", added, changed, missing, windows, len(diffs))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,120 @@
+package bgpfinder
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+func TestDiffCrawl(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := Interval{From: base, Until: base.Add(time.Hour)}
+
+	// Stored: 0-5, with 5 known to be gone
+	stored := testUpdates(base, 6)
+	if _, err := store.UpsertDumps(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReconcileDumps(ctx, testCollector, DumpTypeUpdates, window, stored[:5]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upstream: 0 and 1 as stored, 2 with a new duration, 3 and 4 gone, 5
+	// back again and 6 new
+	upstream := testUpdates(base, 7)
+	upstream = append(upstream[:3], upstream[5:]...)
+	upstream[2].Duration = DumpDuration(10 * time.Minute)
+	finder := &sliceFinder{dumps: upstream}
+
+	diff, err := DiffCrawl(ctx, store, finder, testCollector, DumpTypeUpdates, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Unchanged != 2 {
+		t.Errorf("Expected 2 unchanged dumps, got %d", diff.Unchanged)
+	}
+	if len(diff.New) != 1 || diff.New[0].URL != upstream[4].URL {
+		t.Errorf("Expected the 7th dump to be new, got %+v", diff.New)
+	}
+	if len(diff.Changed) != 2 || diff.Changed[0].Fields[0] != "duration" || diff.Changed[1].Fields[0] != "removedAt" {
+		t.Errorf("Expected a changed duration and a reappeared dump, got %+v", diff.Changed)
+	}
+	if len(diff.Missing) != 2 || diff.Missing[0].URL != stored[3].URL || diff.Missing[1].URL != stored[4].URL {
+		t.Errorf("Expected the 4th and 5th dumps to be missing upstream, got %+v", diff.Missing)
+	}
+
+	// Nothing was written
+	after, err := store.FetchDumps(ctx, Query{Collectors: []Collector{testCollector}, DumpType: DumpTypeUpdates, From: window.From, Until: window.Until}, FetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 5 {
+		t.Errorf("Expected the stored dumps to be left alone, got %d", len(after))
+	}
+
+	var report strings.Builder
+	if err := WriteDiffReport(&report, []CrawlDiff{diff, {Collector: testCollector}}, DiffFormatText); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+	if len(lines) != 7 || !strings.HasPrefix(lines[1], "  + ") || lines[6] != "1 new, 2 changed, 2 missing upstream in 1 of 2 windows" {
+		t.Errorf("Unexpected text report:\n%s", report.String())
+	}
+	if err := WriteDiffReport(&report, nil, "yaml"); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+}
+
+func TestDiffCrawlMatchesUpsert(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		window := Interval{From: base, Until: base.Add(time.Hour)}
+		stored := testUpdates(base, 3)
+		if _, err := store.UpsertDumps(ctx, stored); err != nil {
+			t.Fatal(err)
+		}
+
+		// Upstream: 0 with a later timestamp, 1 as a RIB and 2 as stored
+		upstream := testUpdates(base, 3)
+		upstream[0].Timestamp += 60
+		upstream[1].DumpType = DumpTypeRibs
+		finder := &sliceFinder{dumps: upstream}
+
+		diff, err := DiffCrawl(ctx, store, finder, testCollector, DumpTypeAny, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diff.New) != 0 || len(diff.Changed) != 2 || diff.Unchanged != 1 {
+			t.Fatalf("Expected 2 changed dumps, got %+v", diff)
+		}
+		if diff.Changed[0].Fields[0] != "timestamp" || diff.Changed[1].Fields[0] != "type" {
+			t.Errorf("Expected a changed timestamp and type, got %+v", diff.Changed)
+		}
+
+		// Crawling makes the changes that the diff reported, and no others
+		logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, stats, err := CrawlCollector(ctx, logger, store, finder, testCollector, DumpTypeAny, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (UpsertStats{Updated: 2, Unchanged: 1}); stats != expected {
+			t.Errorf("Expected %+v, got %+v", expected, stats)
+		}
+		diff, err = DiffCrawl(ctx, store, finder, testCollector, DumpTypeAny, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !diff.Empty() || diff.Unchanged != 3 {
+			t.Errorf("Expected nothing left to change after the crawl, got %+v", diff)
+		}
+	})
+}
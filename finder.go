@@ -2,6 +2,7 @@ package bgpfinder
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -28,17 +29,129 @@ type Finder interface {
 	Find(query Query) ([]BGPDump, error)
 }
 
+// StreamingFinder is a Finder that can hand out the dumps it finds one at a
+// time, rather than collecting them all in memory first.
+type StreamingFinder interface {
+	Finder
+
+	// FindStream calls fn for each dump that matches the query, in the
+	// same order that Find would return them. It stops at the first error
+	// returned by fn.
+	FindStream(query Query, fn func(BGPDump) error) error
+}
+
+// RefreshingFinder is a Finder that can reload its collector lists from the
+// archives.
+type RefreshingFinder interface {
+	Finder
+
+	// RefreshCollectors reloads the collector lists. The old lists are kept
+	// if it fails.
+	RefreshCollectors() error
+}
+
+// RefreshCollectors reloads the collector lists of f if it's a
+// RefreshingFinder. Other finders' lists are assumed to be current.
+func RefreshCollectors(f Finder) error {
+	if rf, ok := f.(RefreshingFinder); ok {
+		return rf.RefreshCollectors()
+	}
+	return nil
+}
+
+// FindStream calls fn for each dump that matches the query, streaming them
+// from f if it's a StreamingFinder.
+func FindStream(f Finder, query Query, fn func(BGPDump) error) error {
+	if sf, ok := f.(StreamingFinder); ok {
+		return sf.FindStream(query, fn)
+	}
+	dumps, err := f.Find(query)
+	if err != nil {
+		return err
+	}
+	for _, d := range dumps {
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DirError is an archive directory that a finder couldn't list.
+type DirError struct {
+	// Dir is the directory's URL
+	Dir string
+
+	// Collector and DumpType are whose dumps the directory holds. DumpType
+	// is DumpTypeAny if it holds both types.
+	Collector Collector
+	DumpType  DumpType
+
+	// Window is the span of dump timestamps that the directory holds
+	Window Interval
+
+	Err error
+}
+
+// IncompleteFindError is returned by Find, along with the dumps it did find,
+// when some of the directories that the query spans couldn't be listed. The
+// dumps in the rest of the query are complete.
+type IncompleteFindError struct {
+	Dirs []DirError
+}
+
+func (e *IncompleteFindError) Error() string {
+	if len(e.Dirs) == 1 {
+		return fmt.Sprintf("failed to list %s: %v", e.Dirs[0].Dir, e.Dirs[0].Err)
+	}
+	return fmt.Sprintf("failed to list %d directories, including %s: %v", len(e.Dirs), e.Dirs[0].Dir, e.Dirs[0].Err)
+}
+
+// Unlisted returns the parts of window that the directories the collector's
+// dumps of the (concrete) type are in couldn't be listed for, merged.
+func (e *IncompleteFindError) Unlisted(collector Collector, dumpType DumpType, window Interval) []Interval {
+	var unlisted []Interval
+	for _, d := range e.Dirs {
+		if d.Collector == collector && (d.DumpType == dumpType || d.DumpType == DumpTypeAny) {
+			unlisted = append(unlisted, d.Window)
+		}
+	}
+	return clipIntervals(unlisted, window)
+}
+
+// appendDirErrors adds the directories from err, if it's an
+// IncompleteFindError, to dirs. Other errors are returned as they are.
+func appendDirErrors(dirs []DirError, err error) ([]DirError, error) {
+	var incomplete *IncompleteFindError
+	if !errors.As(err, &incomplete) {
+		return dirs, err
+	}
+	return append(dirs, incomplete.Dirs...), nil
+}
+
+// incompleteFindError returns an IncompleteFindError for dirs, or nil if
+// there aren't any.
+func incompleteFindError(dirs []DirError) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	return &IncompleteFindError{Dirs: dirs}
+}
+
 func (d BGPDump) MarshalJSON() ([]byte, error) {
 	custom := map[string]interface{}{
 		"url":         d.URL,
 		"format":      "mrt",  // TODO temporarily hardcoding, may need to fix
 		"transport":   "file", // TODO temporarily hardcoding, may need to fix
-		"project":     "",
+		"project":     d.Collector.Project.Name,
 		"collector":   d.Collector.Name,
 		"type":        d.DumpType,
 		"initialTime": d.Timestamp,
 		"duration":    d.Duration,
-		"attr":        []string{},
+		"attr":        map[string]string{},
+	}
+	if d.RemovedAt != 0 {
+		custom["removedAt"] = d.RemovedAt
 	}
 	return json.Marshal(custom)
 }
@@ -131,6 +244,10 @@ type BGPDump struct {
 
 	// Timestamp of when this dump was created (seconds since epoch)
 	Timestamp int64 `json:"timestamp"`
+
+	// RemovedAt is when the dump was found to have disappeared from the
+	// archive (seconds since epoch), or 0 if it's still there
+	RemovedAt int64 `json:"removedAt,omitempty"`
 }
 
 // monthInRange checks if any part of the month overlaps with the query range
@@ -0,0 +1,160 @@
+package bgpfinder
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// dumpPeriods are how often the built-in projects publish each type of
+// dump. Each project's dumps are published on multiples of the period since
+// the epoch.
+var dumpPeriods = map[string]map[DumpType]DumpDuration{
+	RIS: {
+		DumpTypeRibs:    RISRibPeriod,
+		DumpTypeUpdates: RISUpdatePeriod,
+	},
+	ROUTEVIEWS: {
+		DumpTypeRibs:    RVRibPeriod,
+		DumpTypeUpdates: RVUpdatePeriod,
+	},
+}
+
+// archiveStarts are when the built-in projects' archives begin: RIS's first
+// collector (rrc00) started in October 1999 and RouteViews' archive in
+// October 2001.
+var archiveStarts = map[string]time.Time{
+	RIS:        time.Date(1999, 10, 1, 0, 0, 0, 0, time.UTC),
+	ROUTEVIEWS: time.Date(2001, 10, 1, 0, 0, 0, 0, time.UTC),
+}
+
+// ArchiveStart returns when the project's archive begins, or the zero time
+// if it isn't known.
+func ArchiveStart(project string) time.Time {
+	return archiveStarts[project]
+}
+
+// DumpPeriod returns how often the project publishes dumps of the (concrete)
+// type, or 0 if it isn't known.
+func DumpPeriod(project string, dumpType DumpType) DumpDuration {
+	return dumpPeriods[project][dumpType]
+}
+
+// GapReport lists the expected dumps that are missing from one of a
+// collector's windows.
+type GapReport struct {
+	Collector Collector    `json:"collector"`
+	DumpType  DumpType     `json:"type"`
+	Window    Interval     `json:"window"`
+	Period    DumpDuration `json:"period"`
+
+	// Expected is the number of slots in the window that should have a
+	// dump, and Found is how many of them do
+	Expected int `json:"expected"`
+	Found    int `json:"found"`
+
+	// Missing are the timestamps of the slots without a dump
+	Missing []int64 `json:"missing"`
+
+	// Outages are the runs of consecutive missing slots
+	Outages []Interval `json:"outages"`
+
+	// OffSchedule are the dumps whose timestamps aren't on a slot
+	OffSchedule []BGPDump `json:"offSchedule"`
+
+	// Unknown are the parts of the window whose directories couldn't be
+	// listed. Their empty slots aren't counted as expected or missing,
+	// since there's no telling whether they have a dump.
+	Unknown []Interval `json:"unknown"`
+}
+
+// FindGaps compares the collector's dumps of the (concrete) type with the
+// slots that the period says the window should have, one every period
+// since the epoch. Dumps of other collectors or types, or outside the
+// window, are ignored. The slots in the unknown parts of the window are only
+// counted if they have a dump.
+func FindGaps(dumps []BGPDump, collector Collector, dumpType DumpType, window Interval, period DumpDuration, unknown []Interval) GapReport {
+	report := GapReport{
+		Collector: collector,
+		DumpType:  dumpType,
+		Window:    window,
+		Period:    period,
+		Unknown:   unknown,
+	}
+	step := int64(time.Duration(period).Seconds())
+	if step <= 0 || window.Empty() {
+		return report
+	}
+
+	filled := map[int64]bool{}
+	for _, d := range dumps {
+		if d.Collector.Project.Name != collector.Project.Name || d.Collector.Name != collector.Name || d.DumpType != dumpType {
+			continue
+		}
+		if d.Timestamp < window.From.Unix() || d.Timestamp >= window.Until.Unix() {
+			continue
+		}
+		if d.Timestamp%step != 0 {
+			report.OffSchedule = append(report.OffSchedule, d)
+			continue
+		}
+		filled[d.Timestamp] = true
+	}
+	sort.Slice(report.OffSchedule, func(i, j int) bool {
+		return report.OffSchedule[i].Timestamp < report.OffSchedule[j].Timestamp
+	})
+
+	first := window.From.Unix()
+	if rem := first % step; rem != 0 {
+		first += step - rem
+	}
+	for slot := first; slot < window.Until.Unix(); slot += step {
+		if !filled[slot] && len(clipIntervals(unknown, Interval{From: time.Unix(slot, 0), Until: time.Unix(slot+1, 0)})) > 0 {
+			continue
+		}
+		report.Expected++
+		if filled[slot] {
+			report.Found++
+			continue
+		}
+		report.Missing = append(report.Missing, slot)
+		if n := len(report.Outages); n > 0 && report.Outages[n-1].Until.Unix() == slot {
+			report.Outages[n-1].Until = time.Unix(slot+step, 0)
+		} else {
+			report.Outages = append(report.Outages, Interval{From: time.Unix(slot, 0), Until: time.Unix(slot+step, 0)})
+		}
+	}
+	return report
+}
+
+// GetGapReports finds each collector's dumps in the window with the finder
+// (which can be the live archives or a DBFinder) and reports the gaps in
+// them. DumpTypeAny reports on both types separately. The parts of the
+// window that the finder couldn't list are reported as unknown.
+func GetGapReports(finder Finder, collectors []Collector, dumpType DumpType, window Interval) ([]GapReport, error) {
+	var reports []GapReport
+	for _, collector := range collectors {
+		for _, dt := range concreteDumpTypes(dumpType) {
+			period := DumpPeriod(collector.Project.Name, dt)
+			if period == 0 {
+				return nil, fmt.Errorf("no known %s period for project %s", dt, collector.Project.Name)
+			}
+			dumps, err := finder.Find(Query{
+				Collectors: []Collector{collector},
+				DumpType:   dt,
+				From:       window.From,
+				Until:      window.Until,
+			})
+			var unknown []Interval
+			var incomplete *IncompleteFindError
+			if errors.As(err, &incomplete) {
+				unknown = incomplete.Unlisted(collector, dt, window)
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to find dumps for %s: %w", collector, err)
+			}
+			reports = append(reports, FindGaps(dumps, collector, dt, window, period, unknown))
+		}
+	}
+	return reports, nil
+}
@@ -0,0 +1,102 @@
+package bgpfinder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindGaps(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	period := RISUpdatePeriod
+	dumps := testUpdates(base, 12)
+
+	// Knock out 00:10, 00:15 and 00:40, and move 00:50 off schedule
+	dumps[10].Timestamp += 30
+	dumps = append(dumps[:8], dumps[9:]...)
+	dumps = append(dumps[:2], dumps[4:]...)
+
+	// Starting mid-slot, so the first slot is 00:05
+	window := Interval{From: base.Add(time.Minute), Until: base.Add(time.Hour)}
+	report := FindGaps(dumps, testCollector, DumpTypeUpdates, window, period, nil)
+	if report.Expected != 11 || report.Found != 7 {
+		t.Errorf("Expected 7 of 11 slots to be found, got %d of %d", report.Found, report.Expected)
+	}
+	wantMissing := []int64{
+		base.Add(10 * time.Minute).Unix(),
+		base.Add(15 * time.Minute).Unix(),
+		base.Add(40 * time.Minute).Unix(),
+		base.Add(50 * time.Minute).Unix(),
+	}
+	if len(report.Missing) != len(wantMissing) {
+		t.Fatalf("Expected %d missing slots, got %v", len(wantMissing), report.Missing)
+	}
+	for i, ts := range wantMissing {
+		if report.Missing[i] != ts {
+			t.Errorf("Expected slot %d to be missing, got %d", ts, report.Missing[i])
+		}
+	}
+	wantOutages := []Interval{
+		{From: base.Add(10 * time.Minute), Until: base.Add(20 * time.Minute)},
+		{From: base.Add(40 * time.Minute), Until: base.Add(45 * time.Minute)},
+		{From: base.Add(50 * time.Minute), Until: base.Add(55 * time.Minute)},
+	}
+	if len(report.Outages) != len(wantOutages) {
+		t.Fatalf("Expected %d outages, got %v", len(wantOutages), report.Outages)
+	}
+	for i, o := range wantOutages {
+		if !report.Outages[i].From.Equal(o.From) || !report.Outages[i].Until.Equal(o.Until) {
+			t.Errorf("Expected outage %s, got %s", o, report.Outages[i])
+		}
+	}
+	if len(report.OffSchedule) != 1 || report.OffSchedule[0].Timestamp != base.Add(50*time.Minute).Unix()+30 {
+		t.Errorf("Expected the 00:50 dump to be off schedule, got %+v", report.OffSchedule)
+	}
+
+	// A collector of the same name in another project doesn't fill slots
+	other := Collector{Project: RouteviewsProject, Name: testCollector.Name}
+	if report := FindGaps(dumps, other, DumpTypeUpdates, window, period, nil); report.Found != 0 {
+		t.Errorf("Expected another project's dumps to be ignored, got %d found", report.Found)
+	}
+}
+
+func TestGetGapReports(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	finder := &sliceFinder{dumps: testUpdates(base, 6)}
+	window := Interval{From: base, Until: base.Add(time.Hour)}
+
+	reports, err := GetGapReports(finder, []Collector{testCollector}, DumpTypeAny, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || reports[0].DumpType != DumpTypeRibs || reports[1].DumpType != DumpTypeUpdates {
+		t.Fatalf("Expected a report for each type, got %+v", reports)
+	}
+	// The RIB at 00:00 and the updates after 00:25 are missing
+	if reports[0].Expected != 1 || len(reports[0].Missing) != 1 {
+		t.Errorf("Expected the RIB slot to be missing, got %+v", reports[0])
+	}
+	if reports[1].Found != 6 || len(reports[1].Outages) != 1 || !reports[1].Outages[0].Until.Equal(window.Until) {
+		t.Errorf("Expected one outage to the end of the window, got %+v", reports[1])
+	}
+
+	// The second half hour's directory couldn't be listed, so its empty
+	// slots aren't known to be missing
+	secondHalf := Interval{From: base.Add(30 * time.Minute), Until: window.Until}
+	finder.unlisted = []Interval{secondHalf}
+	reports, err = GetGapReports(finder, []Collector{testCollector}, DumpTypeUpdates, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Expected != 6 || reports[0].Found != 6 || len(reports[0].Missing) != 0 {
+		t.Errorf("Expected only the listed slots to be counted, got %+v", reports)
+	}
+	if len(reports[0].Unknown) != 1 || !reports[0].Unknown[0].From.Equal(secondHalf.From) {
+		t.Errorf("Expected the unlisted half hour to be unknown, got %v", reports[0].Unknown)
+	}
+	finder.unlisted = nil
+
+	unknown := Collector{Project: Project{Name: "nope"}, Name: "x"}
+	if _, err := GetGapReports(finder, []Collector{unknown}, DumpTypeUpdates, window); err == nil {
+		t.Error("Expected a project without known periods to be rejected")
+	}
+}
@@ -0,0 +1,155 @@
+// Package metrics defines the Prometheus metrics exported by the server and
+// the periodic scraper.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "bgpfinder"
+
+var (
+	// HTTPRequests counts server requests by route, method and status code
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPRequestDuration measures server request latency by route
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// DataSource counts /data requests by where they were answered from:
+	// "db" (through the database cache) or "live" (straight from the
+	// archives).
+	DataSource = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "data_requests_total",
+		Help:      "Data requests, by whether they were answered from the database or a live find.",
+	}, []string{"source"})
+
+	// CacheSpans counts the collector/dump type spans looked up by the
+	// caching finder, by whether they were already covered ("hit") or had
+	// to be fetched from the archives ("miss").
+	CacheSpans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_spans_total",
+		Help:      "Spans looked up by the caching finder, by whether they were covered by the database.",
+	}, []string{"result"})
+
+	// UpstreamFetches counts HTTP fetches from the archives by host
+	UpstreamFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_fetches_total",
+		Help:      "HTTP fetches from the archives, by host.",
+	}, []string{"host"})
+
+	// UpstreamFetchErrors counts failed HTTP fetches from the archives by
+	// host
+	UpstreamFetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_fetch_errors_total",
+		Help:      "Failed HTTP fetches from the archives, by host.",
+	}, []string{"host"})
+
+	// DumpsDiscovered counts the dumps found by scrapes, per collector
+	DumpsDiscovered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dumps_discovered_total",
+		Help:      "Dumps found in the archives by scrapes, by collector.",
+	}, []string{"project", "collector"})
+
+	// DumpsUpserted counts the dumps written by scrapes, per collector and
+	// by outcome ("inserted", "updated" or "unchanged")
+	DumpsUpserted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dumps_upserted_total",
+		Help:      "Dumps upserted into the database by scrapes, by collector and outcome.",
+	}, []string{"project", "collector", "result"})
+
+	// ScrapeDuration measures how long scrapes take per project and dump
+	// type
+	ScrapeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scrape_duration_seconds",
+		Help:      "Scrape run duration, by project and dump type.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"project", "dump_type"})
+
+	// BackfillWindows counts the windows crawled by the tiered backfill, by
+	// tier and outcome ("ok" or "error")
+	BackfillWindows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backfill_windows_total",
+		Help:      "Windows crawled by the tiered backfill, by tier and outcome.",
+	}, []string{"tier", "result"})
+)
+
+// newestDumps tracks the newest dump seen for each collector, so that its
+// age can be reported as of the time of each scrape of the metrics.
+var newestDumps = &newestDumpCollector{
+	desc: prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "newest_dump_age_seconds"),
+		"Age of the newest known dump, by collector and dump type.",
+		[]string{"project", "collector", "dump_type"}, nil,
+	),
+	newest: map[newestDumpKey]time.Time{},
+}
+
+func init() {
+	prometheus.MustRegister(newestDumps)
+}
+
+type newestDumpKey struct {
+	project   string
+	collector string
+	dumpType  string
+}
+
+type newestDumpCollector struct {
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	newest map[newestDumpKey]time.Time
+}
+
+func (c *newestDumpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *newestDumpCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, newest := range c.newest {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(newest).Seconds(),
+			key.project, key.collector, key.dumpType)
+	}
+}
+
+// ObserveNewestDump records a dump of the collector with the given
+// timestamp. Older dumps than the newest one already seen are ignored.
+func ObserveNewestDump(project, collector, dumpType string, timestamp time.Time) {
+	key := newestDumpKey{project: project, collector: collector, dumpType: dumpType}
+	newestDumps.mu.Lock()
+	defer newestDumps.mu.Unlock()
+	if timestamp.After(newestDumps.newest[key]) {
+		newestDumps.newest[key] = timestamp
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -3,8 +3,10 @@ package scraper
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/alistairking/bgpfinder/internal/metrics"
 )
 
 // XXX: refactor these once we get a better sense of the type of crawling we'll
@@ -29,6 +31,16 @@ func ScrapeLinks(url string) ([]string, error) {
 }
 
 func LoadDocument(url string) (*goquery.Document, error) {
+	host := hostOf(url)
+	metrics.UpstreamFetches.WithLabelValues(host).Inc()
+	doc, err := loadDocument(url)
+	if err != nil {
+		metrics.UpstreamFetchErrors.WithLabelValues(host).Inc()
+	}
+	return doc, err
+}
+
+func loadDocument(url string) (*goquery.Document, error) {
 	// Grab the HTML
 	res, err := http.Get(url)
 	if err != nil {
@@ -41,3 +53,12 @@ func LoadDocument(url string) (*goquery.Document, error) {
 	// and parse it
 	return goquery.NewDocumentFromReader(res.Body)
 }
+
+// hostOf returns the host of the URL, for labelling metrics.
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return u.Host
+}
@@ -0,0 +1,194 @@
+package bgpfinder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+// DefaultLeaseTTL is how long a lease lasts without being renewed. Leases
+// are renewed well before then while they're held, so it's roughly how long
+// a replica that dies keeps its collectors from being scraped.
+const DefaultLeaseTTL = 5 * time.Minute
+
+// ErrLeaseHeld is returned when another holder has the lease.
+var ErrLeaseHeld = errors.New("lease is held by another scraper")
+
+// NewLeaseHolder returns a name for a scraper replica that's unique to this
+// process: the hostname (the container name under docker), the PID and a
+// random suffix.
+func NewLeaseHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// Leaser takes leases on collectors on behalf of one scraper replica, so
+// that replicas sharing a database don't scrape the same collector at the
+// same time. A nil Leaser hands out leases without taking them, for
+// scrapers that run alone.
+type Leaser struct {
+	logger *logging.Logger
+	store  Store
+	holder string
+	ttl    time.Duration
+}
+
+// NewLeaser returns a Leaser for the holder. The ttl is DefaultLeaseTTL if
+// unset.
+func NewLeaser(logger *logging.Logger, store Store, holder string, ttl time.Duration) *Leaser {
+	if ttl == 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &Leaser{
+		logger: logger,
+		store:  store,
+		holder: holder,
+		ttl:    ttl,
+	}
+}
+
+// Named returns a Leaser for one of the replica's concurrent tasks. Its
+// leases exclude the replica's other tasks as well as other replicas, and
+// releasing them doesn't release the others' leases. It's nil if l is.
+func (l *Leaser) Named(name string) *Leaser {
+	if l == nil {
+		return nil
+	}
+	named := *l
+	named.holder = l.holder + "/" + name
+	return &named
+}
+
+// Lease is a held lease on scraping a collector's dumps. It's renewed in
+// the background until it's released.
+type Lease struct {
+	leaser    *Leaser
+	collector Collector
+	dumpTypes []DumpType
+	cancel    context.CancelFunc
+	done      chan struct{}
+	once      sync.Once
+}
+
+// Acquire takes the lease on scraping the collector's dumps of the type
+// (both types for DumpTypeAny), or returns ErrLeaseHeld if another replica
+// has it. The returned context is canceled if the lease is lost (e.g., the
+// database was unreachable for longer than the ttl and another replica took
+// over), so the scrape should use it.
+func (l *Leaser) Acquire(ctx context.Context, collector Collector, dumpType DumpType) (*Lease, context.Context, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	lease := &Lease{
+		leaser:    l,
+		collector: collector,
+		dumpTypes: concreteDumpTypes(dumpType),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	if l == nil {
+		close(lease.done)
+		return lease, ctx, nil
+	}
+
+	for i, dt := range lease.dumpTypes {
+		acquired, err := l.store.AcquireLease(ctx, collector, dt, l.holder, l.ttl)
+		if err == nil && !acquired {
+			err = ErrLeaseHeld
+		}
+		if err != nil {
+			lease.dumpTypes = lease.dumpTypes[:i]
+			lease.release()
+			cancel()
+			return nil, nil, err
+		}
+	}
+	go lease.renew(ctx)
+	return lease, ctx, nil
+}
+
+// WithLease calls fn while holding the lease on scraping the collector's
+// dumps of the type, with a context that's canceled if the lease is lost.
+// It returns ErrLeaseHeld without calling fn if another replica has it.
+func (l *Leaser) WithLease(ctx context.Context, collector Collector, dumpType DumpType, fn func(ctx context.Context) error) error {
+	lease, leaseCtx, err := l.Acquire(ctx, collector, dumpType)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+	return fn(leaseCtx)
+}
+
+// renew keeps the lease alive until it's released, giving it up if it
+// can't be renewed before it would expire.
+func (lease *Lease) renew(ctx context.Context) {
+	defer close(lease.done)
+	l := lease.leaser
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		held := true
+		var err error
+		for _, dt := range lease.dumpTypes {
+			var acquired bool
+			acquired, err = l.store.AcquireLease(ctx, lease.collector, dt, l.holder, l.ttl)
+			if err != nil {
+				break
+			}
+			held = held && acquired
+		}
+		switch {
+		case err != nil && time.Since(renewed) < l.ttl:
+			l.logger.Warn().Err(err).Str("collector", lease.collector.Name).Msg("Failed to renew lease, will retry")
+			continue
+		case err != nil || !held:
+			l.logger.Error().Err(err).Str("collector", lease.collector.Name).Msg("Lost lease, stopping scrape")
+			lease.cancel()
+			return
+		}
+		renewed = time.Now()
+	}
+}
+
+// Release stops renewing the lease and gives it up. It's safe to call more
+// than once.
+func (lease *Lease) Release() {
+	lease.once.Do(func() {
+		lease.cancel()
+		<-lease.done
+		if lease.leaser != nil {
+			lease.release()
+		}
+	})
+}
+
+// release gives up the lease's dump types in the database. That's done even
+// if the scrape's context has been canceled, since otherwise the collector
+// isn't scraped until the lease expires.
+func (lease *Lease) release() {
+	l := lease.leaser
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, dt := range lease.dumpTypes {
+		if err := l.store.ReleaseLease(ctx, lease.collector, dt, l.holder); err != nil {
+			l.logger.Error().Err(err).Str("collector", lease.collector.Name).Msg("Failed to release lease")
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package bgpfinder
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+func TestLeaser(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+	a := NewLeaser(logger, store, "a", 0)
+	b := NewLeaser(logger, store, "b", 0)
+
+	lease, _, err := a.Acquire(ctx, testCollector, DumpTypeAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both dump types are leased, so b can't take either
+	for _, dt := range []DumpType{DumpTypeRibs, DumpTypeUpdates} {
+		called := false
+		err := b.WithLease(ctx, testCollector, dt, func(ctx context.Context) error {
+			called = true
+			return nil
+		})
+		if !errors.Is(err, ErrLeaseHeld) || called {
+			t.Errorf("Expected b's %s lease to be refused, got %v", dt, err)
+		}
+	}
+
+	// a can renew its own lease, and b can take it once it's released
+	if acquired, err := store.AcquireLease(ctx, testCollector, DumpTypeRibs, "a", time.Minute); err != nil || !acquired {
+		t.Errorf("Expected a to renew its lease, got %v (%v)", acquired, err)
+	}
+	lease.Release()
+	lease.Release()
+	if err := b.WithLease(ctx, testCollector, DumpTypeRibs, func(ctx context.Context) error { return nil }); err != nil {
+		t.Errorf("Expected b to take the released lease, got %v", err)
+	}
+
+	// An expired lease can be taken over
+	if acquired, err := store.AcquireLease(ctx, testCollector, DumpTypeUpdates, "a", -time.Second); err != nil || !acquired {
+		t.Fatalf("Expected a to take the lease, got %v (%v)", acquired, err)
+	}
+	if acquired, err := store.AcquireLease(ctx, testCollector, DumpTypeUpdates, "b", time.Minute); err != nil || !acquired {
+		t.Errorf("Expected b to take over the expired lease, got %v (%v)", acquired, err)
+	}
+}
+
+func TestNilLeaser(t *testing.T) {
+	var l *Leaser
+	called := false
+	err := l.WithLease(context.Background(), testCollector, DumpTypeAny, func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Errorf("Expected a nil Leaser to grant the lease, got %v", err)
+	}
+}
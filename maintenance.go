@@ -0,0 +1,144 @@
+package bgpfinder
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+// DefaultPartitionLookahead is how many months of partitions ahead of the
+// current one the maintenance job creates.
+const DefaultPartitionLookahead = 2
+
+// RetentionPolicy limits how long dumps of a type are kept.
+type RetentionPolicy struct {
+	DumpType DumpType
+	MaxAge   time.Duration
+}
+
+func (p RetentionPolicy) String() string {
+	return fmt.Sprintf("%s=%s", p.DumpType, p.MaxAge)
+}
+
+// ParseRetentionPolicy parses a policy of the form "<type>=<age>", e.g.,
+// "updates=2y". The age is either a Go duration or a whole number of days
+// ("d") or (365 day) years ("y").
+func ParseRetentionPolicy(s string) (RetentionPolicy, error) {
+	typeStr, ageStr, ok := strings.Cut(s, "=")
+	if !ok {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention policy '%s': expected <type>=<age>", s)
+	}
+	dumpType, err := DumpTypeString(typeStr)
+	if err != nil {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention policy '%s': %v", s, err)
+	}
+	age, err := parseAge(ageStr)
+	if err != nil {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention policy '%s': %v", s, err)
+	}
+	if age <= 0 {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention policy '%s': age must be positive", s)
+	}
+	return RetentionPolicy{DumpType: dumpType, MaxAge: age}, nil
+}
+
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, fmt.Errorf("invalid age '%s'", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// RetentionPolicies is a list of policies that can be used as a repeatable
+// command line flag.
+type RetentionPolicies []RetentionPolicy
+
+func (p *RetentionPolicies) String() string {
+	if p == nil {
+		return ""
+	}
+	strs := make([]string, len(*p))
+	for i, policy := range *p {
+		strs[i] = policy.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+func (p *RetentionPolicies) Set(s string) error {
+	policy, err := ParseRetentionPolicy(s)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, policy)
+	return nil
+}
+
+// MaintenanceConfig configures the database maintenance job.
+type MaintenanceConfig struct {
+	// Retention policies to apply. Dumps of types without a policy are kept
+	// forever.
+	Retention RetentionPolicies
+
+	// PartitionLookahead is the number of future months to create
+	// partitions for
+	PartitionLookahead int
+}
+
+// RunMaintenance creates upcoming partitions and applies the retention
+// policies, treating now as the current time.
+func RunMaintenance(ctx context.Context, logger *logging.Logger, store Store, cfg MaintenanceConfig, now time.Time) error {
+	until := now.AddDate(0, cfg.PartitionLookahead, 0)
+	if err := store.EnsurePartitions(ctx, now, until); err != nil {
+		return fmt.Errorf("failed to create partitions: %w", err)
+	}
+
+	for _, policy := range cfg.Retention {
+		before := now.Add(-policy.MaxAge)
+		deleted, err := store.DeleteDumpsBefore(ctx, policy.DumpType, before)
+		if err != nil {
+			return fmt.Errorf("failed to apply retention policy %s: %w", policy, err)
+		}
+		logger.Info().
+			Str("policy", policy.String()).
+			Time("before", before).
+			Int64("deleted", deleted).
+			Msg("Applied retention policy")
+	}
+	return nil
+}
+
+// StartPeriodicMaintenance starts a goroutine that calls RunMaintenance
+// immediately and then every interval.
+func StartPeriodicMaintenance(ctx context.Context, logger *logging.Logger, interval time.Duration, store Store, cfg MaintenanceConfig) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			if err := RunMaintenance(ctx, logger, store, cfg, time.Now()); err != nil {
+				logger.Error().Err(err).Msg("Database maintenance failed")
+			} else {
+				logger.Info().Msg("Database maintenance completed successfully")
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				logger.Info().Msg("Stopping periodic maintenance due to context cancellation")
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,33 @@
+package bgpfinder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected RetentionPolicy
+		wantErr  bool
+	}{
+		{"updates=2y", RetentionPolicy{DumpTypeUpdates, 2 * 365 * 24 * time.Hour}, false},
+		{"ribs=90d", RetentionPolicy{DumpTypeRibs, 90 * 24 * time.Hour}, false},
+		{"any=36h", RetentionPolicy{DumpTypeAny, 36 * time.Hour}, false},
+		{"updates", RetentionPolicy{}, true},
+		{"bogus=1y", RetentionPolicy{}, true},
+		{"updates=xy", RetentionPolicy{}, true},
+		{"updates=0d", RetentionPolicy{}, true},
+	}
+
+	for _, tt := range tests {
+		policy, err := ParseRetentionPolicy(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRetentionPolicy(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if policy != tt.expected {
+			t.Errorf("ParseRetentionPolicy(%q) = %v, expected %v", tt.input, policy, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package bgpfinder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/alistairking/bgpfinder/migrations"
+)
+
+// ErrSchemaIncompatible is returned by CheckSchemaVersion when the database
+// schema doesn't match the migrations built into this binary.
+var ErrSchemaIncompatible = errors.New("incompatible database schema")
+
+// SchemaStatus describes where a database is relative to the embedded
+// migrations.
+type SchemaStatus struct {
+	Current int                    `json:"current"`
+	Latest  int                    `json:"latest"`
+	Pending []migrations.Migration `json:"-"`
+}
+
+func GetSchemaStatus(ctx context.Context, store Store) (SchemaStatus, error) {
+	all, err := migrations.Load(store.Dialect())
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	current, err := store.SchemaVersion(ctx)
+	if err != nil {
+		return SchemaStatus{}, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	status := SchemaStatus{Current: current, Latest: len(all)}
+	if current < len(all) {
+		status.Pending = all[current:]
+	}
+	return status, nil
+}
+
+// CheckSchemaVersion returns ErrSchemaIncompatible unless the database has
+// exactly the migrations that this binary knows about. Binaries that write
+// to the database should refuse to start if this fails.
+func CheckSchemaVersion(ctx context.Context, store Store) error {
+	status, err := GetSchemaStatus(ctx, store)
+	if err != nil {
+		return err
+	}
+	if status.Current < status.Latest {
+		return fmt.Errorf("%w: schema version %d is older than %d, run migrations first",
+			ErrSchemaIncompatible, status.Current, status.Latest)
+	}
+	if status.Current > status.Latest {
+		return fmt.Errorf("%w: schema version %d is newer than %d, upgrade this binary",
+			ErrSchemaIncompatible, status.Current, status.Latest)
+	}
+	return nil
+}
+
+// MigrateUp applies all pending migrations, returning the new schema version.
+func MigrateUp(ctx context.Context, logger *logging.Logger, store Store) (int, error) {
+	status, err := GetSchemaStatus(ctx, store)
+	if err != nil {
+		return 0, err
+	}
+	if status.Current > status.Latest {
+		return status.Current, fmt.Errorf("%w: schema version %d is newer than %d",
+			ErrSchemaIncompatible, status.Current, status.Latest)
+	}
+	for _, m := range status.Pending {
+		logger.Info().Str("migration", m.String()).Msg("Applying migration")
+		if err := store.ApplyMigration(ctx, m, true); err != nil {
+			return m.Version - 1, fmt.Errorf("migration %s failed: %w", m, err)
+		}
+	}
+	return status.Latest, nil
+}
+
+// MigrateDown rolls back the given number of migrations, returning the new
+// schema version.
+func MigrateDown(ctx context.Context, logger *logging.Logger, store Store, steps int) (int, error) {
+	all, err := migrations.Load(store.Dialect())
+	if err != nil {
+		return 0, err
+	}
+	current, err := store.SchemaVersion(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	if current > len(all) {
+		return current, fmt.Errorf("%w: can't roll back migration %d, this binary only knows up to %d",
+			ErrSchemaIncompatible, current, len(all))
+	}
+	for ; steps > 0 && current > 0; steps-- {
+		m := all[current-1]
+		logger.Info().Str("migration", m.String()).Msg("Rolling back migration")
+		if err := store.ApplyMigration(ctx, m, false); err != nil {
+			return current, fmt.Errorf("rollback of %s failed: %w", m, err)
+		}
+		current--
+	}
+	return current, nil
+}
+
+// checkMigrationOrder makes sure that applying (or rolling back) m from the
+// given schema version makes sense. It returns false if there's nothing to
+// do because someone else got there first.
+func checkMigrationOrder(current int, m migrations.Migration, up bool) (bool, error) {
+	if up {
+		if current >= m.Version {
+			return false, nil
+		}
+		if current != m.Version-1 {
+			return false, fmt.Errorf("can't apply %s to schema version %d", m, current)
+		}
+		return true, nil
+	}
+	if current < m.Version {
+		return false, nil
+	}
+	if current != m.Version {
+		return false, fmt.Errorf("can't roll back %s from schema version %d", m, current)
+	}
+	return true, nil
+}
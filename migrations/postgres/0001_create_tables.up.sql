@@ -1,3 +1,5 @@
+-- IF NOT EXISTS so that databases created before schema_version existed
+-- (e.g., by the docker-compose init scripts) can be adopted by MigrateUp.
 CREATE TABLE IF NOT EXISTS collectors (
     collector_id SERIAL PRIMARY KEY,
     name VARCHAR(255) UNIQUE NOT NULL,
@@ -0,0 +1,15 @@
+-- Spans of each collector's archive that have been fully crawled. Adjacent
+-- and overlapping spans are merged on write, so for a given collector and
+-- dump type the spans never overlap.
+CREATE TABLE IF NOT EXISTS crawl_coverage (
+    crawl_coverage_id SERIAL PRIMARY KEY,
+    collector_name VARCHAR(255) NOT NULL,
+    dump_type SMALLINT NOT NULL,
+    from_time TIMESTAMP NOT NULL,
+    until_time TIMESTAMP NOT NULL,
+    cdate TIMESTAMP NOT NULL DEFAULT NOW(),
+    mdate TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT crawl_coverage_span CHECK (from_time < until_time)
+);
+
+CREATE INDEX IF NOT EXISTS crawl_coverage_lookup ON crawl_coverage (collector_name, dump_type, from_time);
@@ -0,0 +1,12 @@
+-- This will fail if two projects have stored collectors with the same name.
+DROP INDEX crawl_coverage_lookup;
+CREATE INDEX crawl_coverage_lookup ON crawl_coverage (collector_name, dump_type, from_time);
+ALTER TABLE crawl_coverage DROP COLUMN project_name;
+
+ALTER TABLE bgp_dumps DROP CONSTRAINT bgp_dumps_collector_fk;
+ALTER TABLE bgp_dumps DROP CONSTRAINT unique_bgp_dump;
+ALTER TABLE bgp_dumps ADD CONSTRAINT unique_bgp_dump UNIQUE (collector_name, url);
+ALTER TABLE bgp_dumps DROP COLUMN project_name;
+
+ALTER TABLE collectors DROP CONSTRAINT unique_collector;
+ALTER TABLE collectors ADD CONSTRAINT collectors_name_key UNIQUE (name);
@@ -0,0 +1,49 @@
+-- Collector names are only unique within a project, so (project_name, name)
+-- identifies a collector everywhere, and dumps must belong to a known
+-- collector.
+
+ALTER TABLE bgp_dumps ADD COLUMN project_name VARCHAR(255);
+
+UPDATE bgp_dumps d
+SET project_name = c.project_name
+FROM collectors c
+WHERE c.name = d.collector_name;
+
+-- Before this migration only RIS and RouteViews were stored, and only RIS
+-- collector names start with "rrc", so that's enough to place any dumps whose
+-- collector was never recorded.
+UPDATE bgp_dumps
+SET project_name = CASE WHEN collector_name LIKE 'rrc%' THEN 'ris' ELSE 'routeviews' END
+WHERE project_name IS NULL;
+
+INSERT INTO collectors (name, project_name, most_recent_file_timestamp, last_completed_crawl_time_ribs, last_completed_crawl_time_updates)
+SELECT d.collector_name, d.project_name, MAX(d.timestamp), 'epoch', 'epoch'
+FROM bgp_dumps d
+WHERE NOT EXISTS (SELECT 1 FROM collectors c WHERE c.name = d.collector_name)
+GROUP BY d.collector_name, d.project_name;
+
+ALTER TABLE bgp_dumps ALTER COLUMN project_name SET NOT NULL;
+
+ALTER TABLE collectors DROP CONSTRAINT collectors_name_key;
+ALTER TABLE collectors ADD CONSTRAINT unique_collector UNIQUE (project_name, name);
+
+ALTER TABLE bgp_dumps DROP CONSTRAINT unique_bgp_dump;
+ALTER TABLE bgp_dumps ADD CONSTRAINT unique_bgp_dump UNIQUE (project_name, collector_name, url);
+ALTER TABLE bgp_dumps ADD CONSTRAINT bgp_dumps_collector_fk
+    FOREIGN KEY (project_name, collector_name) REFERENCES collectors (project_name, name);
+
+ALTER TABLE crawl_coverage ADD COLUMN project_name VARCHAR(255);
+
+UPDATE crawl_coverage cc
+SET project_name = c.project_name
+FROM collectors c
+WHERE c.name = cc.collector_name;
+
+UPDATE crawl_coverage
+SET project_name = CASE WHEN collector_name LIKE 'rrc%' THEN 'ris' ELSE 'routeviews' END
+WHERE project_name IS NULL;
+
+ALTER TABLE crawl_coverage ALTER COLUMN project_name SET NOT NULL;
+
+DROP INDEX crawl_coverage_lookup;
+CREATE INDEX crawl_coverage_lookup ON crawl_coverage (project_name, collector_name, dump_type, from_time);
@@ -0,0 +1,31 @@
+-- This will fail if the same URL has been stored with more than one
+-- timestamp or dump type.
+ALTER TABLE bgp_dumps RENAME TO bgp_dumps_partitioned;
+ALTER TABLE bgp_dumps_partitioned RENAME CONSTRAINT bgp_dumps_pkey TO bgp_dumps_partitioned_pkey;
+ALTER TABLE bgp_dumps_partitioned RENAME CONSTRAINT unique_bgp_dump TO unique_bgp_dump_partitioned;
+ALTER INDEX bgp_dumps_lookup RENAME TO bgp_dumps_partitioned_lookup;
+ALTER SEQUENCE bgp_dumps_bgp_dump_id_seq OWNED BY NONE;
+
+CREATE TABLE bgp_dumps (
+    bgp_dump_id INTEGER PRIMARY KEY DEFAULT nextval('bgp_dumps_bgp_dump_id_seq'),
+    collector_name VARCHAR(255) NOT NULL,
+    url TEXT NOT NULL,
+    dump_type SMALLINT NOT NULL,
+    duration INTERVAL,
+    timestamp TIMESTAMP NOT NULL,
+    cdate TIMESTAMP NOT NULL DEFAULT NOW(),
+    mdate TIMESTAMP NOT NULL DEFAULT NOW(),
+    project_name VARCHAR(255) NOT NULL,
+    CONSTRAINT unique_bgp_dump UNIQUE (project_name, collector_name, url),
+    CONSTRAINT bgp_dumps_collector_fk FOREIGN KEY (project_name, collector_name)
+        REFERENCES collectors (project_name, name)
+);
+
+ALTER SEQUENCE bgp_dumps_bgp_dump_id_seq OWNED BY bgp_dumps.bgp_dump_id;
+
+INSERT INTO bgp_dumps (bgp_dump_id, project_name, collector_name, url, dump_type, duration, timestamp, cdate, mdate)
+SELECT bgp_dump_id, project_name, collector_name, url, dump_type, duration, timestamp, cdate, mdate
+FROM bgp_dumps_partitioned;
+
+DROP TABLE bgp_dumps_partitioned;
+DROP FUNCTION bgp_dumps_ensure_partition(SMALLINT, TIMESTAMP);
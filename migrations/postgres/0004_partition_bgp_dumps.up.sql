@@ -0,0 +1,68 @@
+-- Partition bgp_dumps by dump type and then by month, so that time range
+-- queries only touch the partitions they need and so that retention can drop
+-- whole partitions. Unique constraints on a partitioned table have to include
+-- the partition keys, so a dump is now identified by its URL together with
+-- its type and timestamp (which the URL encodes anyway).
+
+ALTER TABLE bgp_dumps RENAME TO bgp_dumps_unpartitioned;
+ALTER TABLE bgp_dumps_unpartitioned RENAME CONSTRAINT bgp_dumps_pkey TO bgp_dumps_unpartitioned_pkey;
+ALTER TABLE bgp_dumps_unpartitioned RENAME CONSTRAINT unique_bgp_dump TO unique_bgp_dump_unpartitioned;
+ALTER SEQUENCE bgp_dumps_bgp_dump_id_seq OWNED BY NONE;
+
+CREATE TABLE bgp_dumps (
+    bgp_dump_id INTEGER NOT NULL DEFAULT nextval('bgp_dumps_bgp_dump_id_seq'),
+    project_name VARCHAR(255) NOT NULL,
+    collector_name VARCHAR(255) NOT NULL,
+    url TEXT NOT NULL,
+    dump_type SMALLINT NOT NULL,
+    duration INTERVAL,
+    timestamp TIMESTAMP NOT NULL,
+    cdate TIMESTAMP NOT NULL DEFAULT NOW(),
+    mdate TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT bgp_dumps_pkey PRIMARY KEY (bgp_dump_id, dump_type, timestamp),
+    CONSTRAINT unique_bgp_dump UNIQUE (project_name, collector_name, url, dump_type, timestamp),
+    CONSTRAINT bgp_dumps_collector_fk FOREIGN KEY (project_name, collector_name)
+        REFERENCES collectors (project_name, name)
+) PARTITION BY LIST (dump_type);
+
+ALTER SEQUENCE bgp_dumps_bgp_dump_id_seq OWNED BY bgp_dumps.bgp_dump_id;
+
+CREATE TABLE bgp_dumps_ribs PARTITION OF bgp_dumps FOR VALUES IN (1) PARTITION BY RANGE (timestamp);
+CREATE TABLE bgp_dumps_updates PARTITION OF bgp_dumps FOR VALUES IN (2) PARTITION BY RANGE (timestamp);
+
+-- The dump type is implied by the partition, so this serves the
+-- collector/time range lookups done by FetchDataFromDB.
+CREATE INDEX bgp_dumps_lookup ON bgp_dumps (project_name, collector_name, timestamp);
+
+-- Creates the monthly partition that holds dumps of the given type at the
+-- given time, if it doesn't already exist. There's no default partition, so
+-- this has to be called before inserting into a new month.
+CREATE OR REPLACE FUNCTION bgp_dumps_ensure_partition(p_dump_type SMALLINT, p_time TIMESTAMP)
+RETURNS VOID AS $$
+DECLARE
+    parent TEXT := CASE p_dump_type WHEN 1 THEN 'bgp_dumps_ribs' WHEN 2 THEN 'bgp_dumps_updates' END;
+    month_start TIMESTAMP := date_trunc('month', p_time);
+    part_name TEXT;
+BEGIN
+    IF parent IS NULL THEN
+        RAISE EXCEPTION 'unknown dump type %', p_dump_type;
+    END IF;
+    part_name := parent || to_char(month_start, '"_y"YYYY"m"MM');
+    IF to_regclass(part_name) IS NOT NULL THEN
+        RETURN;
+    END IF;
+    -- Serialize concurrent writers creating the same partition
+    PERFORM pg_advisory_xact_lock(hashtext(part_name));
+    EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+        part_name, parent, month_start, month_start + INTERVAL '1 month');
+END;
+$$ LANGUAGE plpgsql;
+
+SELECT bgp_dumps_ensure_partition(dump_type, month)
+FROM (SELECT DISTINCT dump_type, date_trunc('month', timestamp) AS month FROM bgp_dumps_unpartitioned) months;
+
+INSERT INTO bgp_dumps (bgp_dump_id, project_name, collector_name, url, dump_type, duration, timestamp, cdate, mdate)
+SELECT bgp_dump_id, project_name, collector_name, url, dump_type, duration, timestamp, cdate, mdate
+FROM bgp_dumps_unpartitioned;
+
+DROP TABLE bgp_dumps_unpartitioned;
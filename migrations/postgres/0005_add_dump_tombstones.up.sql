@@ -0,0 +1,4 @@
+-- Tombstones for dumps that have disappeared from the upstream archive. The
+-- scrapers set this when a crawl no longer finds a stored URL, and clear it
+-- if the URL comes back.
+ALTER TABLE bgp_dumps ADD COLUMN removed_at TIMESTAMP;
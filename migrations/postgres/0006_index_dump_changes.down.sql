@@ -0,0 +1 @@
+DROP INDEX bgp_dumps_changes;
@@ -0,0 +1,3 @@
+-- Serves the change feed (FetchDataChangesFromDB), which walks dumps in the
+-- order they were added or changed.
+CREATE INDEX bgp_dumps_changes ON bgp_dumps (mdate, bgp_dump_id);
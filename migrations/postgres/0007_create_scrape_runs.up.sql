@@ -0,0 +1,21 @@
+-- History of scrape runs, one row per project and dump type scraped. Rows
+-- are inserted when a run starts and updated when it finishes, so a run
+-- that never finished (e.g., the scraper crashed) is left as 'running'.
+CREATE TABLE IF NOT EXISTS scrape_runs (
+    scrape_run_id SERIAL PRIMARY KEY,
+    source VARCHAR(32) NOT NULL,
+    project_name VARCHAR(255) NOT NULL,
+    dump_type SMALLINT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    started TIMESTAMP NOT NULL,
+    finished TIMESTAMP,
+    collectors_attempted TEXT[] NOT NULL DEFAULT '{}',
+    collectors_succeeded TEXT[] NOT NULL DEFAULT '{}',
+    dumps_found INTEGER NOT NULL DEFAULT 0,
+    dumps_inserted INTEGER NOT NULL DEFAULT 0,
+    retries INTEGER NOT NULL DEFAULT 0,
+    errors TEXT[] NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS scrape_runs_started ON scrape_runs (started);
+CREATE INDEX IF NOT EXISTS scrape_runs_collectors ON scrape_runs USING GIN (collectors_attempted);
@@ -0,0 +1,15 @@
+-- When the tiered backfill last crawled each of a collector's aligned
+-- windows, so that recent windows can be revisited more often than old ones.
+-- Windows are keyed by their bounds, so a tier that changes its window size
+-- simply starts on a new set of rows.
+CREATE TABLE IF NOT EXISTS crawl_windows (
+    project_name VARCHAR(255) NOT NULL,
+    collector_name VARCHAR(255) NOT NULL,
+    dump_type SMALLINT NOT NULL,
+    from_time TIMESTAMP NOT NULL,
+    until_time TIMESTAMP NOT NULL,
+    crawled TIMESTAMP NOT NULL,
+    dumps_found INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (project_name, collector_name, dump_type, from_time, until_time),
+    CONSTRAINT crawl_windows_span CHECK (from_time < until_time)
+);
@@ -0,0 +1,4 @@
+-- Collectors that their archive no longer lists are flagged as retired
+-- rather than deleted, so that their dumps stay queryable. The flag is
+-- cleared if the collector comes back.
+ALTER TABLE collectors ADD COLUMN retired_at TIMESTAMP;
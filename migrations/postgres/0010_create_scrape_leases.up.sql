@@ -0,0 +1,12 @@
+-- Leases on scraping a collector's dumps of a type, so that scraper
+-- replicas share the work instead of duplicating it. A lease that isn't
+-- renewed before it expires can be taken over by another holder.
+CREATE TABLE IF NOT EXISTS scrape_leases (
+    project_name VARCHAR(255) NOT NULL,
+    collector_name VARCHAR(255) NOT NULL,
+    dump_type SMALLINT NOT NULL,
+    holder VARCHAR(255) NOT NULL,
+    acquired TIMESTAMP NOT NULL,
+    expires TIMESTAMP NOT NULL,
+    PRIMARY KEY (project_name, collector_name, dump_type)
+);
@@ -0,0 +1,2 @@
+-- The removed duplicates can't be brought back, and nothing else changed.
+SELECT 1;
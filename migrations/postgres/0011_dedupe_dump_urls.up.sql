@@ -0,0 +1,11 @@
+-- A dump is identified by its collector and URL, but since the 0004
+-- migration the unique constraint also has to include the partition keys, so
+-- a URL that was found again with a different type or timestamp could be
+-- stored twice. The upserts now replace the old row; this removes the
+-- duplicates stored before that, keeping the most recently modified row.
+DELETE FROM bgp_dumps d
+USING bgp_dumps newer
+WHERE newer.project_name = d.project_name
+AND newer.collector_name = d.collector_name
+AND newer.url = d.url
+AND (newer.mdate, newer.bgp_dump_id) > (d.mdate, d.bgp_dump_id);
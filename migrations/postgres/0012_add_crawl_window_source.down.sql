@@ -0,0 +1,4 @@
+DELETE FROM crawl_windows WHERE source != 'backfill';
+ALTER TABLE crawl_windows DROP CONSTRAINT crawl_windows_pkey;
+ALTER TABLE crawl_windows ADD PRIMARY KEY (project_name, collector_name, dump_type, from_time, until_time);
+ALTER TABLE crawl_windows DROP COLUMN source;
@@ -0,0 +1,10 @@
+-- The tiered backfill and range backfills both checkpoint their windows in
+-- crawl_windows, and their windows can coincide (e.g. a week-long range
+-- chunk and the month tier's weeks), so each record the other's crawls as
+-- their own. The source (the kind of scrape run, backfill or range) keeps
+-- them apart. Existing rows can't be told apart, so they're left to the
+-- tiered backfill, and ranges crawl them again.
+ALTER TABLE crawl_windows ADD COLUMN source VARCHAR(32) NOT NULL DEFAULT 'backfill';
+ALTER TABLE crawl_windows DROP CONSTRAINT crawl_windows_pkey;
+ALTER TABLE crawl_windows ADD PRIMARY KEY (source, project_name, collector_name, dump_type, from_time, until_time);
+ALTER TABLE crawl_windows ALTER COLUMN source DROP DEFAULT;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS bgp_dumps;
+DROP TABLE IF EXISTS collectors;
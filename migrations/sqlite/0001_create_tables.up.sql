@@ -0,0 +1,24 @@
+-- Mirrors the Postgres schema, except that all times are stored as seconds
+-- since the epoch.
+CREATE TABLE IF NOT EXISTS collectors (
+    collector_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL,
+    project_name TEXT NOT NULL,
+    cdate INTEGER NOT NULL,
+    mdate INTEGER NOT NULL,
+    most_recent_file_timestamp INTEGER NOT NULL DEFAULT 0,
+    last_completed_crawl_time_ribs INTEGER NOT NULL DEFAULT 0,
+    last_completed_crawl_time_updates INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS bgp_dumps (
+    bgp_dump_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    collector_name TEXT NOT NULL,
+    url TEXT NOT NULL,
+    dump_type INTEGER NOT NULL,
+    duration INTEGER NOT NULL,
+    timestamp INTEGER NOT NULL,
+    cdate INTEGER NOT NULL,
+    mdate INTEGER NOT NULL,
+    CONSTRAINT unique_bgp_dump UNIQUE (collector_name, url)
+);
@@ -0,0 +1,14 @@
+-- Spans of each collector's archive that have been fully crawled. See the
+-- Postgres version for details.
+CREATE TABLE IF NOT EXISTS crawl_coverage (
+    crawl_coverage_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    collector_name TEXT NOT NULL,
+    dump_type INTEGER NOT NULL,
+    from_time INTEGER NOT NULL,
+    until_time INTEGER NOT NULL,
+    cdate INTEGER NOT NULL,
+    mdate INTEGER NOT NULL,
+    CONSTRAINT crawl_coverage_span CHECK (from_time < until_time)
+);
+
+CREATE INDEX IF NOT EXISTS crawl_coverage_lookup ON crawl_coverage (collector_name, dump_type, from_time);
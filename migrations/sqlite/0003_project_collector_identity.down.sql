@@ -0,0 +1,42 @@
+-- This will fail if two projects have stored collectors with the same name.
+DROP INDEX crawl_coverage_lookup;
+CREATE INDEX crawl_coverage_lookup ON crawl_coverage (collector_name, dump_type, from_time);
+ALTER TABLE crawl_coverage DROP COLUMN project_name;
+
+CREATE TABLE bgp_dumps_old (
+    bgp_dump_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    collector_name TEXT NOT NULL,
+    url TEXT NOT NULL,
+    dump_type INTEGER NOT NULL,
+    duration INTEGER NOT NULL,
+    timestamp INTEGER NOT NULL,
+    cdate INTEGER NOT NULL,
+    mdate INTEGER NOT NULL,
+    CONSTRAINT unique_bgp_dump UNIQUE (collector_name, url)
+);
+
+INSERT INTO bgp_dumps_old
+SELECT bgp_dump_id, collector_name, url, dump_type, duration, timestamp, cdate, mdate
+FROM bgp_dumps;
+
+DROP TABLE bgp_dumps;
+ALTER TABLE bgp_dumps_old RENAME TO bgp_dumps;
+
+CREATE TABLE collectors_old (
+    collector_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL,
+    project_name TEXT NOT NULL,
+    cdate INTEGER NOT NULL,
+    mdate INTEGER NOT NULL,
+    most_recent_file_timestamp INTEGER NOT NULL DEFAULT 0,
+    last_completed_crawl_time_ribs INTEGER NOT NULL DEFAULT 0,
+    last_completed_crawl_time_updates INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO collectors_old
+SELECT collector_id, name, project_name, cdate, mdate, most_recent_file_timestamp,
+    last_completed_crawl_time_ribs, last_completed_crawl_time_updates
+FROM collectors;
+
+DROP TABLE collectors;
+ALTER TABLE collectors_old RENAME TO collectors;
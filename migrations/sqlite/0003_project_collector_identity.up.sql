@@ -0,0 +1,66 @@
+-- Collector names are only unique within a project, so (project_name, name)
+-- identifies a collector everywhere. See the Postgres version for details.
+-- SQLite can't alter constraints, so the tables are rebuilt.
+
+CREATE TABLE collectors_new (
+    collector_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    project_name TEXT NOT NULL,
+    cdate INTEGER NOT NULL,
+    mdate INTEGER NOT NULL,
+    most_recent_file_timestamp INTEGER NOT NULL DEFAULT 0,
+    last_completed_crawl_time_ribs INTEGER NOT NULL DEFAULT 0,
+    last_completed_crawl_time_updates INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT unique_collector UNIQUE (project_name, name)
+);
+
+INSERT INTO collectors_new
+SELECT collector_id, name, project_name, cdate, mdate, most_recent_file_timestamp,
+    last_completed_crawl_time_ribs, last_completed_crawl_time_updates
+FROM collectors;
+
+INSERT INTO collectors_new (name, project_name, cdate, mdate, most_recent_file_timestamp)
+SELECT collector_name,
+    CASE WHEN collector_name LIKE 'rrc%' THEN 'ris' ELSE 'routeviews' END,
+    MIN(cdate), MAX(mdate), MAX(timestamp)
+FROM bgp_dumps
+WHERE collector_name NOT IN (SELECT name FROM collectors)
+GROUP BY collector_name;
+
+DROP TABLE collectors;
+ALTER TABLE collectors_new RENAME TO collectors;
+
+CREATE TABLE bgp_dumps_new (
+    bgp_dump_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    project_name TEXT NOT NULL,
+    collector_name TEXT NOT NULL,
+    url TEXT NOT NULL,
+    dump_type INTEGER NOT NULL,
+    duration INTEGER NOT NULL,
+    timestamp INTEGER NOT NULL,
+    cdate INTEGER NOT NULL,
+    mdate INTEGER NOT NULL,
+    CONSTRAINT unique_bgp_dump UNIQUE (project_name, collector_name, url),
+    CONSTRAINT bgp_dumps_collector_fk FOREIGN KEY (project_name, collector_name)
+        REFERENCES collectors (project_name, name)
+);
+
+INSERT INTO bgp_dumps_new
+SELECT d.bgp_dump_id, c.project_name, d.collector_name, d.url, d.dump_type,
+    d.duration, d.timestamp, d.cdate, d.mdate
+FROM bgp_dumps d
+JOIN collectors c ON c.name = d.collector_name;
+
+DROP TABLE bgp_dumps;
+ALTER TABLE bgp_dumps_new RENAME TO bgp_dumps;
+
+ALTER TABLE crawl_coverage ADD COLUMN project_name TEXT NOT NULL DEFAULT '';
+
+UPDATE crawl_coverage
+SET project_name = COALESCE(
+    (SELECT c.project_name FROM collectors c WHERE c.name = crawl_coverage.collector_name),
+    CASE WHEN collector_name LIKE 'rrc%' THEN 'ris' ELSE 'routeviews' END
+);
+
+DROP INDEX crawl_coverage_lookup;
+CREATE INDEX crawl_coverage_lookup ON crawl_coverage (project_name, collector_name, dump_type, from_time);
@@ -0,0 +1,2 @@
+DROP INDEX bgp_dumps_retention;
+DROP INDEX bgp_dumps_lookup;
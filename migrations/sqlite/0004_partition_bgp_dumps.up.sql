@@ -0,0 +1,4 @@
+-- SQLite has no partitioning, so this just adds the index that time range
+-- queries and retention need. See the Postgres version for details.
+CREATE INDEX bgp_dumps_lookup ON bgp_dumps (project_name, collector_name, dump_type, timestamp);
+CREATE INDEX bgp_dumps_retention ON bgp_dumps (dump_type, timestamp);
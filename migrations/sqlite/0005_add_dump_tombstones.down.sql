@@ -0,0 +1 @@
+ALTER TABLE bgp_dumps DROP COLUMN removed_at;
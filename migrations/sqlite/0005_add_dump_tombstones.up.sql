@@ -0,0 +1,3 @@
+-- Tombstones for dumps that have disappeared from the upstream archive. See
+-- the Postgres version for details.
+ALTER TABLE bgp_dumps ADD COLUMN removed_at INTEGER;
@@ -0,0 +1,2 @@
+-- Serves the change feed. See the Postgres version for details.
+CREATE INDEX bgp_dumps_changes ON bgp_dumps (mdate, bgp_dump_id);
@@ -0,0 +1,19 @@
+-- History of scrape runs. See the Postgres version for details. The
+-- collector and error lists are stored as JSON arrays.
+CREATE TABLE IF NOT EXISTS scrape_runs (
+    scrape_run_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    source TEXT NOT NULL,
+    project_name TEXT NOT NULL,
+    dump_type INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    started INTEGER NOT NULL,
+    finished INTEGER,
+    collectors_attempted TEXT NOT NULL DEFAULT '[]',
+    collectors_succeeded TEXT NOT NULL DEFAULT '[]',
+    dumps_found INTEGER NOT NULL DEFAULT 0,
+    dumps_inserted INTEGER NOT NULL DEFAULT 0,
+    retries INTEGER NOT NULL DEFAULT 0,
+    errors TEXT NOT NULL DEFAULT '[]'
+);
+
+CREATE INDEX IF NOT EXISTS scrape_runs_started ON scrape_runs (started);
@@ -0,0 +1,13 @@
+-- When the tiered backfill last crawled each of a collector's aligned
+-- windows. See the Postgres version for details.
+CREATE TABLE IF NOT EXISTS crawl_windows (
+    project_name TEXT NOT NULL,
+    collector_name TEXT NOT NULL,
+    dump_type INTEGER NOT NULL,
+    from_time INTEGER NOT NULL,
+    until_time INTEGER NOT NULL,
+    crawled INTEGER NOT NULL,
+    dumps_found INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (project_name, collector_name, dump_type, from_time, until_time),
+    CONSTRAINT crawl_windows_span CHECK (from_time < until_time)
+);
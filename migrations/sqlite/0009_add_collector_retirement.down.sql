@@ -0,0 +1 @@
+ALTER TABLE collectors DROP COLUMN retired_at;
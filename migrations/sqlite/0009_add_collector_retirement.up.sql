@@ -0,0 +1,3 @@
+-- Collectors that their archive no longer lists are flagged as retired. See
+-- the Postgres version for details.
+ALTER TABLE collectors ADD COLUMN retired_at INTEGER;
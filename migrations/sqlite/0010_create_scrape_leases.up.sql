@@ -0,0 +1,11 @@
+-- Leases on scraping a collector's dumps of a type. See the Postgres version
+-- for details.
+CREATE TABLE IF NOT EXISTS scrape_leases (
+    project_name TEXT NOT NULL,
+    collector_name TEXT NOT NULL,
+    dump_type INTEGER NOT NULL,
+    holder TEXT NOT NULL,
+    acquired INTEGER NOT NULL,
+    expires INTEGER NOT NULL,
+    PRIMARY KEY (project_name, collector_name, dump_type)
+);
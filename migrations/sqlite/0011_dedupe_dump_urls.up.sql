@@ -0,0 +1,3 @@
+-- SQLite's unique constraint was never widened, so there are no duplicates
+-- to remove. See the Postgres version for details.
+SELECT 1;
@@ -0,0 +1,19 @@
+CREATE TABLE crawl_windows_old (
+    project_name TEXT NOT NULL,
+    collector_name TEXT NOT NULL,
+    dump_type INTEGER NOT NULL,
+    from_time INTEGER NOT NULL,
+    until_time INTEGER NOT NULL,
+    crawled INTEGER NOT NULL,
+    dumps_found INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (project_name, collector_name, dump_type, from_time, until_time),
+    CONSTRAINT crawl_windows_span CHECK (from_time < until_time)
+);
+
+INSERT INTO crawl_windows_old
+SELECT project_name, collector_name, dump_type, from_time, until_time, crawled, dumps_found
+FROM crawl_windows
+WHERE source = 'backfill';
+
+DROP TABLE crawl_windows;
+ALTER TABLE crawl_windows_old RENAME TO crawl_windows;
@@ -0,0 +1,23 @@
+-- Crawl windows are kept apart by the kind of scrape run that crawled them.
+-- See the Postgres version for details. SQLite can't alter the primary key,
+-- so the table is rebuilt.
+
+CREATE TABLE crawl_windows_new (
+    source TEXT NOT NULL,
+    project_name TEXT NOT NULL,
+    collector_name TEXT NOT NULL,
+    dump_type INTEGER NOT NULL,
+    from_time INTEGER NOT NULL,
+    until_time INTEGER NOT NULL,
+    crawled INTEGER NOT NULL,
+    dumps_found INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (source, project_name, collector_name, dump_type, from_time, until_time),
+    CONSTRAINT crawl_windows_span CHECK (from_time < until_time)
+);
+
+INSERT INTO crawl_windows_new
+SELECT 'backfill', project_name, collector_name, dump_type, from_time, until_time, crawled, dumps_found
+FROM crawl_windows;
+
+DROP TABLE crawl_windows;
+ALTER TABLE crawl_windows_new RENAME TO crawl_windows;
@@ -1,6 +1,7 @@
 package bgpfinder
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 )
@@ -100,6 +101,18 @@ func (m *MultiFinder) Collectors(project string) ([]Collector, error) {
 	return allColls, nil
 }
 
+// RefreshCollectors reloads the collector lists of each of the sub finders
+// that can, carrying on past failures.
+func (m *MultiFinder) RefreshCollectors() error {
+	var errs []error
+	for _, f := range m.getFinders() {
+		if err := RefreshCollectors(f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func (m *MultiFinder) Collector(name string) (Collector, error) {
 	// tricky, we don't know where to send this request.
 	// TODO: we should cache project->collector mappings
@@ -115,8 +128,12 @@ func (m *MultiFinder) Collector(name string) (Collector, error) {
 	return Collector{}, nil
 }
 
+// Find routes the query to each of its collectors' projects' finders. The
+// directories that any of them couldn't list are returned together in an
+// IncompleteFindError, along with all the dumps that were found.
 func (m *MultiFinder) Find(query Query) ([]BGPDump, error) {
 	var dumps []BGPDump
+	var unlisted []DirError
 
 	if len(query.Collectors) == 0 {
 		return nil, fmt.Errorf("no collectors specified in query")
@@ -142,13 +159,14 @@ func (m *MultiFinder) Find(query Query) ([]BGPDump, error) {
 
 		// Perform the search using the appropriate finder
 		dump, err := finder.Find(projectQuery)
+		unlisted, err = appendDirErrors(unlisted, err)
 		if err != nil {
 			return nil, fmt.Errorf("find failed for %s: %v", projectName, err)
 		}
 		dumps = append(dumps, dump...)
 	}
 
-	return dumps, nil
+	return dumps, incompleteFindError(unlisted)
 }
 
 func (m *MultiFinder) getFinderByProject(projName string) (Finder, bool) {
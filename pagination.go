@@ -0,0 +1,97 @@
+package bgpfinder
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DumpCursor is a position in the order that dumps are returned in: by
+// timestamp, then dump type, then URL (which makes the order total, so that
+// pages never overlap or skip dumps).
+type DumpCursor struct {
+	Timestamp int64
+	DumpType  DumpType
+	URL       string
+}
+
+// CursorOf returns the cursor that resumes after the given dump.
+func CursorOf(d BGPDump) DumpCursor {
+	return DumpCursor{Timestamp: d.Timestamp, DumpType: d.DumpType, URL: d.URL}
+}
+
+// Before reports whether the dump at cursor c comes before the one at other.
+func (c DumpCursor) Before(other DumpCursor) bool {
+	if c.Timestamp != other.Timestamp {
+		return c.Timestamp < other.Timestamp
+	}
+	if c.DumpType != other.DumpType {
+		return c.DumpType < other.DumpType
+	}
+	return c.URL < other.URL
+}
+
+// String encodes the cursor as an opaque token for clients.
+func (c DumpCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("p1:%d:%d:%s", c.Timestamp, c.DumpType, c.URL)))
+}
+
+// ParseDumpCursor decodes a token created by DumpCursor.String.
+func ParseDumpCursor(s string) (DumpCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return DumpCursor{}, fmt.Errorf("invalid page cursor")
+	}
+	// The URL may contain colons, so only split off the fields before it
+	parts := strings.SplitN(string(raw), ":", 4)
+	if len(parts) != 4 || parts[0] != "p1" {
+		return DumpCursor{}, fmt.Errorf("invalid page cursor")
+	}
+	var c DumpCursor
+	if _, err := fmt.Sscanf(parts[1]+" "+parts[2], "%d %d", &c.Timestamp, &c.DumpType); err != nil {
+		return DumpCursor{}, fmt.Errorf("invalid page cursor")
+	}
+	c.URL = parts[3]
+	return c, nil
+}
+
+// PagingFinder is a Finder that can return its results a page at a time.
+type PagingFinder interface {
+	Finder
+
+	// FindPage returns up to limit of the dumps that Find would return,
+	// starting after the cursor (or from the start if it's nil).
+	FindPage(query Query, after *DumpCursor, limit int) ([]BGPDump, error)
+}
+
+// FindPage returns a page of the dumps that match the query, letting f do
+// the paging if it's a PagingFinder.
+func FindPage(f Finder, query Query, after *DumpCursor, limit int) ([]BGPDump, error) {
+	if pf, ok := f.(PagingFinder); ok {
+		return pf.FindPage(query, after, limit)
+	}
+	dumps, err := f.Find(query)
+	if err != nil {
+		return nil, err
+	}
+	return pageDumps(dumps, after, limit), nil
+}
+
+// pageDumps sorts the dumps and returns up to limit of them, starting after
+// the cursor.
+func pageDumps(dumps []BGPDump, after *DumpCursor, limit int) []BGPDump {
+	sort.SliceStable(dumps, func(i, j int) bool {
+		return dumpLess(dumps[i], dumps[j])
+	})
+	if after != nil {
+		start := sort.Search(len(dumps), func(i int) bool {
+			return after.Before(CursorOf(dumps[i]))
+		})
+		dumps = dumps[start:]
+	}
+	if limit > 0 && len(dumps) > limit {
+		dumps = dumps[:limit]
+	}
+	return dumps
+}
@@ -0,0 +1,47 @@
+package periodicscraper
+
+import (
+	"context"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+// DryRun compares what each of the schedule's entries would scrape as of now
+// with what's stored, without writing anything. Each collector's window
+// starts where its next scrape would. Collectors without any stored dumps
+// (which the scraper would onboard) aren't included.
+func DryRun(ctx context.Context,
+	logger *logging.Logger,
+	store bgpfinder.Store,
+	finder bgpfinder.Finder,
+	schedule []ScheduleEntry,
+	now time.Time) []bgpfinder.CrawlDiff {
+
+	var diffs []bgpfinder.CrawlDiff
+	for _, entry := range schedule {
+		collectors, prevRuntimes, err := getCollectorsAndPrevRuntime(ctx, logger, store, entry.Project, entry.isRibs())
+		if err != nil {
+			logger.Error().Err(err).Str("schedule", entry.String()).Msg("Failed to fetch collectors")
+			continue
+		}
+		collectors, prevRuntimes = entry.selectCollectors(collectors, prevRuntimes)
+		for i, collector := range collectors {
+			if ctx.Err() != nil {
+				return diffs
+			}
+			window := bgpfinder.Interval{
+				From:  prevRuntimes[i],
+				Until: now.AddDate(0, 0, 1), // As the scrape would, to get today's data
+			}
+			diff, err := bgpfinder.DiffCrawl(ctx, store, finder, collector, entry.DumpType, window)
+			if err != nil {
+				logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to diff collector")
+				diff.Error = err.Error()
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs
+}
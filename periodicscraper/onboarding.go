@@ -0,0 +1,171 @@
+package periodicscraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+// wants reports whether the entry scrapes the named collector.
+func (e ScheduleEntry) wants(name string) bool {
+	if len(e.Collectors) == 0 {
+		return true
+	}
+	for _, c := range e.Collectors {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// syncCollectors reconciles the collectors that have stored dumps (and the
+// times to scrape them from) with the finder's live list of the entry's
+// project's collectors. Stored collectors that the archive no longer lists
+// are retired and not scraped. Live collectors without any stored dumps of
+// the entry's type are returned to be onboarded.
+//
+// If the live list can't be had (or is empty, which is more likely to be an
+// archive problem than every collector going away), the stored collectors
+// are scraped as they are and nothing is retired or onboarded.
+func syncCollectors(ctx context.Context,
+	logger *logging.Logger,
+	store bgpfinder.Store,
+	finder bgpfinder.Finder,
+	entry ScheduleEntry,
+	collectors []bgpfinder.Collector,
+	prevRuntimes []time.Time) ([]bgpfinder.Collector, []time.Time, []bgpfinder.Collector) {
+
+	if err := bgpfinder.RefreshCollectors(finder); err != nil {
+		logger.Warn().Err(err).Str("project", entry.Project).Msg("Failed to refresh collector list, using the previous one")
+	}
+	live, err := finder.Collectors(entry.Project)
+	if err != nil || len(live) == 0 {
+		logger.Warn().Err(err).Str("project", entry.Project).Msg("No live collector list, not onboarding or retiring collectors")
+		return collectors, prevRuntimes, nil
+	}
+
+	listed := map[string]bool{}
+	for _, c := range live {
+		listed[c.Name] = true
+	}
+
+	var scrape []bgpfinder.Collector
+	var from []time.Time
+	var retire []bgpfinder.Collector
+	known := map[string]bool{}
+	for i, c := range collectors {
+		known[c.Name] = true
+		if !listed[c.Name] {
+			retire = append(retire, c)
+			continue
+		}
+		scrape = append(scrape, c)
+		from = append(from, prevRuntimes[i])
+	}
+
+	// Collectors that were recorded but never had dumps stored need
+	// retiring too.
+	stored, err := store.FetchCollectors(ctx, entry.Project)
+	if err != nil {
+		logger.Error().Err(err).Str("project", entry.Project).Msg("Failed to fetch stored collectors")
+	}
+	for _, c := range stored {
+		if !listed[c.Name] && !known[c.Name] {
+			retire = append(retire, c)
+		}
+	}
+	if len(retire) > 0 {
+		retired, err := store.RetireCollectors(ctx, retire, time.Now())
+		if err != nil {
+			logger.Error().Err(err).Str("project", entry.Project).Msg("Failed to retire collectors")
+		} else if retired > 0 {
+			logger.Info().Str("project", entry.Project).Int("retired", retired).Msg("Retired collectors that are no longer listed")
+		}
+	}
+
+	var onboard []bgpfinder.Collector
+	for _, c := range live {
+		if !known[c.Name] && entry.wants(c.Name) {
+			onboard = append(onboard, c)
+		}
+	}
+	return scrape, from, onboard
+}
+
+// onboardCollectors backfills the history of each of the new collectors,
+// after which they're scraped like the rest (since they have stored dumps).
+func onboardCollectors(ctx context.Context,
+	logger *logging.Logger,
+	store bgpfinder.Store,
+	leaser *bgpfinder.Leaser,
+	finder bgpfinder.Finder,
+	entry ScheduleEntry,
+	collectors []bgpfinder.Collector,
+	run *bgpfinder.ScrapeRun) {
+
+	for _, collector := range collectors {
+		if ctx.Err() != nil {
+			return
+		}
+		var found int
+		var stats bgpfinder.UpsertStats
+		err := leaser.WithLease(ctx, collector, entry.DumpType, func(ctx context.Context) error {
+			logger.Info().Str("collector", collector.Name).Str("schedule", entry.String()).Msg("Onboarding new collector")
+			var err error
+			found, stats, err = onboardCollector(ctx, logger, store, finder, entry, collector)
+			return err
+		})
+		if errors.Is(err, bgpfinder.ErrLeaseHeld) {
+			logger.Info().Str("collector", collector.Name).Msg("Collector is being onboarded by another replica, skipping")
+			continue
+		}
+		run.RecordCollector(collector.Name, found, stats, 0, err)
+		if err != nil {
+			logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to onboard collector")
+		}
+	}
+}
+
+// onboardCollector crawls the collector's history up to now. A collector
+// that's been onboarded before without any dumps turning up is only crawled
+// from where that left off.
+func onboardCollector(ctx context.Context,
+	logger *logging.Logger,
+	store bgpfinder.Store,
+	finder bgpfinder.Finder,
+	entry ScheduleEntry,
+	collector bgpfinder.Collector) (int, bgpfinder.UpsertStats, error) {
+
+	// The collector has to be stored before its dumps are, but it hasn't
+	// been crawled yet.
+	if err := store.UpsertCollectors(ctx, []bgpfinder.Collector{collector}, entry.DumpType, time.Unix(0, 0)); err != nil {
+		return 0, bgpfinder.UpsertStats{}, fmt.Errorf("failed to upsert collector: %w", err)
+	}
+
+	now := time.Now()
+	window := bgpfinder.Interval{
+		From:  time.Unix(0, 0),
+		Until: now.AddDate(0, 0, 1), // Until tomorrow (to ensure we get today's data)
+	}
+	covered, err := store.FetchCrawlCoverage(ctx, collector, entry.DumpType, bgpfinder.Interval{From: window.From, Until: now})
+	if err != nil {
+		return 0, bgpfinder.UpsertStats{}, fmt.Errorf("failed to fetch crawl coverage: %w", err)
+	}
+	if len(covered) > 0 {
+		window.From = covered[len(covered)-1].Until
+	}
+
+	dumps, stats, err := bgpfinder.CrawlCollector(ctx, logger, store, finder, collector, entry.DumpType, window)
+	if err != nil {
+		return len(dumps), stats, err
+	}
+	if err := store.UpsertCollectors(ctx, []bgpfinder.Collector{collector}, entry.DumpType, now); err != nil {
+		return len(dumps), stats, fmt.Errorf("failed to upsert collector: %w", err)
+	}
+	return len(dumps), stats, nil
+}
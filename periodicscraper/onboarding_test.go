@@ -0,0 +1,150 @@
+package periodicscraper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+// listFinder is a Finder with a fixed (but changeable) collector list, whose
+// dumps are one RIB a day for the last few days.
+type listFinder struct {
+	collectors []bgpfinder.Collector
+	refreshes  int
+}
+
+func (f *listFinder) Projects() ([]bgpfinder.Project, error) {
+	return []bgpfinder.Project{bgpfinder.RisProject}, nil
+}
+
+func (f *listFinder) Project(name string) (bgpfinder.Project, error) {
+	return bgpfinder.RisProject, nil
+}
+
+func (f *listFinder) Collectors(project string) ([]bgpfinder.Collector, error) {
+	return f.collectors, nil
+}
+
+func (f *listFinder) Collector(name string) (bgpfinder.Collector, error) {
+	return bgpfinder.Collector{Project: bgpfinder.RisProject, Name: name}, nil
+}
+
+func (f *listFinder) RefreshCollectors() error {
+	f.refreshes++
+	return nil
+}
+
+func (f *listFinder) Find(query bgpfinder.Query) ([]bgpfinder.BGPDump, error) {
+	var dumps []bgpfinder.BGPDump
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for _, c := range query.Collectors {
+		for day := 3; day > 0; day-- {
+			ts := today.AddDate(0, 0, -day)
+			if ts.Before(query.From) || !ts.Before(query.Until) {
+				continue
+			}
+			dumps = append(dumps, bgpfinder.BGPDump{
+				URL:       "https://data.ris.ripe.net/" + c.Name + "/bview." + ts.Format("20060102.1504") + ".gz",
+				Collector: c,
+				Duration:  bgpfinder.RISRibDuration,
+				DumpType:  bgpfinder.DumpTypeRibs,
+				Timestamp: ts.Unix(),
+			})
+		}
+	}
+	return dumps, nil
+}
+
+func newTestStore(t *testing.T) (*logging.Logger, bgpfinder.Store) {
+	t.Helper()
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := bgpfinder.OpenSQLiteStore(context.Background(), logger, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	if _, err := bgpfinder.MigrateUp(context.Background(), logger, store); err != nil {
+		t.Fatal(err)
+	}
+	return logger, store
+}
+
+func TestOnboardAndRetireCollectors(t *testing.T) {
+	ctx := context.Background()
+	logger, store := newTestStore(t)
+	rrc00 := bgpfinder.Collector{Project: bgpfinder.RisProject, Name: "rrc00"}
+	rrc01 := bgpfinder.Collector{Project: bgpfinder.RisProject, Name: "rrc01"}
+	finder := &listFinder{collectors: []bgpfinder.Collector{rrc00}}
+	entry, err := ScheduleEntry{Project: RIS, DumpType: bgpfinder.DumpTypeRibs}.withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is stored yet, so rrc00 is onboarded with its history
+	scrape, _, onboard := syncCollectors(ctx, logger, store, finder, entry, nil, nil)
+	if len(scrape) != 0 || len(onboard) != 1 || onboard[0] != rrc00 {
+		t.Fatalf("Expected rrc00 to be onboarded, got scrape=%v onboard=%v", scrape, onboard)
+	}
+	run := bgpfinder.NewScrapeRun(bgpfinder.ScrapeRunPeriodic, RIS, entry.DumpType)
+	onboardCollectors(ctx, logger, store, nil, finder, entry, onboard, run)
+	if run.DumpsInserted != 3 || len(run.CollectorsSucceeded) != 1 {
+		t.Errorf("Expected rrc00's 3 RIBs to be backfilled, got %+v", run)
+	}
+
+	// rrc00 now has dumps, so it's scraped as usual. rrc01 is new.
+	finder.collectors = []bgpfinder.Collector{rrc00, rrc01}
+	collectors, prevRuntimes, err := getCollectorsAndPrevRuntime(ctx, logger, store, RIS, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrape, from, onboard := syncCollectors(ctx, logger, store, finder, entry, collectors, prevRuntimes)
+	if len(scrape) != 1 || scrape[0].Name != "rrc00" || len(from) != 1 || len(onboard) != 1 || onboard[0] != rrc01 {
+		t.Fatalf("Expected rrc00 to be scraped and rrc01 onboarded, got scrape=%v onboard=%v", scrape, onboard)
+	}
+	onboardCollectors(ctx, logger, store, nil, finder, entry, onboard, run)
+
+	// rrc00 vanishes upstream, so it's retired and no longer scraped
+	finder.collectors = []bgpfinder.Collector{rrc01}
+	collectors, prevRuntimes, err = getCollectorsAndPrevRuntime(ctx, logger, store, RIS, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrape, _, onboard = syncCollectors(ctx, logger, store, finder, entry, collectors, prevRuntimes)
+	if len(scrape) != 1 || scrape[0].Name != "rrc01" || len(onboard) != 0 {
+		t.Errorf("Expected only rrc01 to be scraped, got scrape=%v onboard=%v", scrape, onboard)
+	}
+	retired, err := store.FetchRetiredCollectors(ctx, RIS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := retired["rrc00"]; !ok || len(retired) != 1 {
+		t.Errorf("Expected rrc00 to be retired, got %v", retired)
+	}
+	if finder.refreshes != 3 {
+		t.Errorf("Expected the collector list to be refreshed each cycle, got %d", finder.refreshes)
+	}
+
+	// It's brought back if it reappears
+	if err := store.UpsertCollectors(ctx, []bgpfinder.Collector{rrc00}, bgpfinder.DumpTypeRibs, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if retired, err := store.FetchRetiredCollectors(ctx, RIS); err != nil || len(retired) != 0 {
+		t.Errorf("Expected upserting rrc00 to clear its retirement, got %v (%v)", retired, err)
+	}
+
+	// An empty live list doesn't retire anything
+	finder.collectors = nil
+	scrape, _, _ = syncCollectors(ctx, logger, store, finder, entry, collectors, prevRuntimes)
+	if len(scrape) != len(collectors) {
+		t.Errorf("Expected the stored collectors to be scraped as they are, got %v", scrape)
+	}
+	if retired, err := store.FetchRetiredCollectors(ctx, RIS); err != nil || len(retired) != 0 {
+		t.Errorf("Expected nothing to be retired, got %v (%v)", retired, err)
+	}
+}
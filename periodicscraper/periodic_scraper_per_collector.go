@@ -2,24 +2,26 @@ package periodicscraper
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/alistairking/bgpfinder"
 	"github.com/alistairking/bgpfinder/internal/logging"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 func PeriodicScraper(ctx context.Context,
 	logger *logging.Logger,
-	retryMultInterval int64,
+	retry RetryPolicy,
 	prevRuntimes []time.Time,
 	collectors []bgpfinder.Collector,
-	db *pgxpool.Pool,
+	store bgpfinder.Store,
+	leaser *bgpfinder.Leaser,
 	finder bgpfinder.Finder,
 	isRibsData bool,
-	expectedLatest time.Time) error {
+	expectedLatest time.Time,
+	run *bgpfinder.ScrapeRun) error {
 
 	var successfullyWrittenCollectors []bgpfinder.Collector
 	var wg sync.WaitGroup
@@ -30,115 +32,173 @@ func PeriodicScraper(ctx context.Context,
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := ScrapeCollector(ctx, logger, retryMultInterval, prevRuntimes[j], collectors[j], db, finder, isRibsData, expectedLatest); err != nil {
-				logger.Error().Err(err).Str("collector", collectors[j].Name).Msg("Failed to upsert dumps")
+			// Another replica may already be scraping the collector
+			var found, retries int
+			var stats bgpfinder.UpsertStats
+			err := leaser.WithLease(ctx, collectors[j], getDumpTypeFromBool(isRibsData), func(ctx context.Context) error {
+				var err error
+				found, stats, retries, err = ScrapeCollector(ctx, logger, retry, prevRuntimes[j], collectors[j], store, finder, isRibsData, expectedLatest)
+				return err
+			})
+			if errors.Is(err, bgpfinder.ErrLeaseHeld) {
+				logger.Info().Str("collector", collectors[j].Name).Msg("Collector is being scraped by another replica, skipping")
 				return
 			}
 			mu.Lock()
+			defer mu.Unlock()
+			run.RecordCollector(collectors[j].Name, found, stats, retries, err)
+			if err != nil {
+				logger.Error().Err(err).Str("collector", collectors[j].Name).Msg("Failed to upsert dumps")
+				return
+			}
 			successfullyWrittenCollectors = append(successfullyWrittenCollectors, collectors[j])
-			mu.Unlock()
 		}()
 	}
 
 	wg.Wait()
 
-	return bgpfinder.UpsertCollectors(ctx, logger, db, successfullyWrittenCollectors, getDumpTypeFromBool(isRibsData), time.Now())
+	ctx, cancel := checkpointContext(ctx)
+	defer cancel()
+	return store.UpsertCollectors(ctx, successfullyWrittenCollectors, getDumpTypeFromBool(isRibsData), time.Now())
 }
 
 // PeriodicScraper starts a goroutine that scraps the collectors for data.
 // startTime defines the start time from which we collect the for.
-// retryMultInterval defines the interval for exponential retry
+// retry defines the intervals and number of attempts for exponential retry.
+// Waiting to retry stops as soon as the context is canceled.
 // finder defines the finder.
 // isRibsData tells us if it is a Ribs data we want to collect or updates data.
+// It returns the number of dumps found, how upserting them went, and how
+// many times the find was retried.
 func ScrapeCollector(ctx context.Context,
 	logger *logging.Logger,
-	retryMultInterval int64,
+	retry RetryPolicy,
 	prevRuntime time.Time,
 	collector bgpfinder.Collector,
-	db *pgxpool.Pool,
+	store bgpfinder.Store,
 	finder bgpfinder.Finder,
 	isRibsData bool,
-	expectedLatest time.Time) error {
+	expectedLatest time.Time) (found int, stats bgpfinder.UpsertStats, retries int, err error) {
 
-	allowedRetries := 4
+	// Retries upsert what they found before trying again, so those count
+	// towards the stats too.
+	dumps, retries, err := getDumps(ctx, logger, store, finder, prevRuntime, collector, isRibsData, expectedLatest, retry, &stats)
 
-	dumps, err := getDumps(ctx, logger, db, finder, prevRuntime, collector, isRibsData, expectedLatest, retryMultInterval, int64(allowedRetries))
-    
-    if dumps == nil && err != nil {
-        logger.Error().Err(err).Msg("Failed to update collectors data for collector: "+collector.Name)
-		return err
+	if dumps == nil && err != nil {
+		logger.Error().Err(err).Msg("Failed to update collectors data for collector: " + collector.Name)
+		return 0, stats, retries, err
 	}
 
-	if err := bgpfinder.UpsertBGPDumps(ctx, logger, db, dumps); err != nil {
+	// If the scraper is being stopped, what's been found is still stored
+	ctx, cancel := checkpointContext(ctx)
+	defer cancel()
+
+	finalStats, err := store.UpsertDumps(ctx, dumps)
+	if err != nil {
 		logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to upsert dumps")
-		return err
+		return len(dumps), stats, retries, err
+	}
+	stats.Add(finalStats)
+	logger.Info().
+		Str("collector", collector.Name).
+		Int("inserted", finalStats.Inserted).
+		Int("updated", finalStats.Updated).
+		Int("unchanged", finalStats.Unchanged).
+		Msg("Upserted BGP dumps")
+	bgpfinder.RecordScrapeMetrics(collector, dumps, finalStats)
+
+	// Everything from the previous run up to (and including) the newest dump
+	// we found has now been crawled.
+	if mostRecent := getMostRecentTimestamp(dumps); mostRecent >= prevRuntime.Unix() {
+		crawled := bgpfinder.Interval{From: prevRuntime, Until: time.Unix(mostRecent+1, 0)}
+		if err := store.UpsertCrawlCoverage(ctx, collector, getDumpTypeFromBool(isRibsData), crawled); err != nil {
+			logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to record crawl coverage")
+		}
+
+		// Retries only return the dumps from their own (later) start, so
+		// only reconcile the span that the returned dumps came from.
+		listed := bgpfinder.Interval{From: time.Unix(getOldestTimestamp(dumps), 0), Until: crawled.Until}
+		bgpfinder.ReconcileCrawl(ctx, logger, store, collector, getDumpTypeFromBool(isRibsData), listed, dumps)
 	}
 
 	logger.Info().Msg("Scraping completed successfully")
-	return nil
+	return len(dumps), stats, retries, nil
 }
 
 func getDumps(ctx context.Context,
 	logger *logging.Logger,
-	db *pgxpool.Pool,
+	store bgpfinder.Store,
 	finder bgpfinder.Finder,
 	prevRunTimeEnd time.Time,
 	collector bgpfinder.Collector,
 	isRibsData bool,
 	expectedLatest time.Time,
-	retryInterval int64,
-	allowedRetries int64) ([]bgpfinder.BGPDump, error) {
+	retry RetryPolicy,
+	stats *bgpfinder.UpsertStats) ([]bgpfinder.BGPDump, int, error) {
 
 	logger.Info().Str("collector", collector.Name).Msg("Starting to scrape collector data")
 
 	dumpType := getDumpTypeFromBool(isRibsData)
+	writeCtx, cancel := checkpointContext(ctx)
+	defer cancel()
+
+	for retries := 0; ; retries++ {
+		query := bgpfinder.Query{
+			Collectors: []bgpfinder.Collector{collector},
+			DumpType:   dumpType,
+			From:       prevRunTimeEnd,              // Start from prevRuntime
+			Until:      time.Now().AddDate(0, 0, 1), // Until tomorrow (to ensure we get today's data)
+		}
 
-	query := bgpfinder.Query{
-		Collectors: []bgpfinder.Collector{collector},
-		DumpType:   dumpType,
-		From:       prevRunTimeEnd,              // Start from prevRuntime
-		Until:      time.Now().AddDate(0, 0, 1), // Until tomorrow (to ensure we get today's data)
-	}
+		dumps, err := finder.Find(query)
 
-	dumps, err := finder.Find(query)
+		mostRecentDump := getMostRecentTimestamp(dumps)
 
-	mostRecentDump := int64(0)
-	for _, dump := range dumps {
-		if dump.Timestamp > mostRecentDump {
-			mostRecentDump = dump.Timestamp
+		if err == nil && len(dumps) == 0 {
+			err = fmt.Errorf("didn't recieve enough records for collector %s", collector.Name)
 		}
-	}
 
-	if err == nil && len(dumps) == 0 {
-		err = fmt.Errorf("didn't recieve enough records for collector %s", collector.Name)
-	}
+		// If some of the archive's directories couldn't be listed, what was
+		// found may have holes, so it's neither kept nor reconciled until a
+		// retry lists everything.
+		latest := time.Unix(mostRecentDump, 0)
+		var incomplete *bgpfinder.IncompleteFindError
+		if errors.As(err, &incomplete) {
+			logger.Warn().Err(err).Str("collector", collector.Name).Msg("Finder couldn't list all of the archive")
+		} else if latest.Before(expectedLatest) {
+			if expectedLatest.Sub(latest) > (24 * 60 * time.Hour) {
+				logger.Warn().Str("collector", collector.Name).Msg("Collector appears to be out of date, skipping retry")
+				err = nil
+			} else {
+				err = fmt.Errorf("most recent expected not available (collector: %s got: %s, expected: %s)", collector.Name, latest, expectedLatest)
+				// Keep what's been found so far, which is also all that's
+				// kept if the scraper is stopped while waiting to retry.
+				if partialStats, err := store.UpsertDumps(writeCtx, dumps); err != nil {
+					logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to upsert dumps")
+				} else {
+					stats.Add(partialStats)
+					prevRunTimeEnd = latest
+				}
+			}
+		}
 
-	latest := time.Unix(mostRecentDump, 0)
-	if latest.Before(expectedLatest) {
-        if expectedLatest.Sub(latest) > ( 24 * 60 * time.Hour) {
-            fmt.Printf("collector (%s) appears to be out of date. Skipping retry")
-            err = nil
-        } else {
-            err = fmt.Errorf("most recent expected not available (collector: %s got: %s, expected: %s)", collector.Name, latest, expectedLatest)
-            if err := bgpfinder.UpsertBGPDumps(ctx, logger, db, dumps); err != nil {
-                logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to upsert dumps")
-            } else {
-                prevRunTimeEnd = latest
-            }
-        }
-	}
+		if err == nil {
+			logger.Info().Str("collector", collector.Name).Int("dumps_found", len(dumps)).Msg("Found BGP dumps for collector")
+			return dumps, retries, nil
+		}
 
-	if err != nil {
 		logger.Error().Err(err).Str("collector", collector.Name).Msg("Finder.Find failed")
-		if allowedRetries == 0 {
-			return nil, err
+		if retries >= retry.Attempts {
+			return nil, retries, err
+		}
+		delay := retry.delay(retries)
+		logger.Info().
+			Str("collector", collector.Name).
+			Int("retries left", retry.Attempts-retries).
+			Dur("delay", delay).
+			Msg("Will retry scraping collector after waiting")
+		if err := sleep(ctx, delay); err != nil {
+			return nil, retries, fmt.Errorf("stopped before retrying: %w", err)
 		}
-		logger.Info().Str("collector", collector.Name).Int("retries left", int(allowedRetries)).Msg("Will retry scraping collectors after sleeping.")
-		time.Sleep(time.Duration(retryInterval) * time.Second)
-		return getDumps(ctx, logger, db, finder, prevRunTimeEnd, collector, isRibsData, expectedLatest, 2*retryInterval, allowedRetries-1)
 	}
-
-	logger.Info().Str("collector", collector.Name).Int("dumps_found", len(dumps)).Msg("Found BGP dumps for collector")
-
-	return dumps, nil
 }
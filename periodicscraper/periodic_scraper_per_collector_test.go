@@ -0,0 +1,36 @@
+package periodicscraper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+)
+
+func TestGetDumpsStopsRetryingOnCancel(t *testing.T) {
+	logger, store := newTestStore(t)
+	rrc00 := bgpfinder.Collector{Project: bgpfinder.RisProject, Name: "rrc00"}
+	finder := &listFinder{collectors: []bgpfinder.Collector{rrc00}}
+
+	// The finder's newest dump is from yesterday, so expecting one from now
+	// retries, which would wait an hour if the scraper weren't stopping.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	retry := RetryPolicy{Interval: Duration(time.Hour), Attempts: 3, Multiplier: 2}
+	var stats bgpfinder.UpsertStats
+	start := time.Now()
+	dumps, retries, err := getDumps(ctx, logger, store, finder, time.Unix(0, 0), rrc00, true, time.Now(), retry, &stats)
+	if !errors.Is(err, context.Canceled) || dumps != nil || retries != 0 {
+		t.Errorf("Expected the retry to be abandoned, got %d dumps, %d retries (%v)", len(dumps), retries, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected getDumps to return without waiting, took %v", elapsed)
+	}
+
+	// What was found before stopping is still stored
+	if stats.Inserted != 3 {
+		t.Errorf("Expected the 3 dumps found to be stored, got %+v", stats)
+	}
+}
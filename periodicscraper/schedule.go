@@ -0,0 +1,278 @@
+package periodicscraper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+)
+
+const (
+	// defaultOffset is how long after each aligned start time a scrape
+	// actually starts, so that it doesn't race the archive publishing the
+	// dump it's after.
+	defaultOffset = 40 * time.Second
+
+	// defaultRetryAttempts is how many times a collector's scrape is retried
+	// when the newest expected dump isn't there yet.
+	defaultRetryAttempts = 4
+
+	// defaultRetryDivisor sets the default first retry interval as a
+	// fraction of the cadence. Retry intervals double each time.
+	defaultRetryDivisor = 64
+
+	// defaultRetryMultiplier is how much longer each retry interval is than
+	// the one before.
+	defaultRetryMultiplier = 2
+)
+
+// Duration is a time.Duration that's written as a string (e.g., "15m") in
+// schedule files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"15m\": %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// RetryPolicy says how to retry a collector whose newest expected dump
+// isn't available yet.
+type RetryPolicy struct {
+	// Interval is how long to wait before the first retry. It's multiplied
+	// by Multiplier for each later one.
+	Interval Duration `json:"interval"`
+
+	// Attempts is how many times to retry
+	Attempts int `json:"attempts"`
+
+	// Multiplier is how much longer each retry interval is than the one
+	// before. Defaults to 2.
+	Multiplier float64 `json:"multiplier"`
+
+	// MaxInterval caps the retry interval. Defaults to the cadence, since
+	// the next run picks the collector up by then anyway.
+	MaxInterval Duration `json:"maxInterval"`
+}
+
+// delay returns how long to wait before the nth retry (counting from 0).
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := float64(p.Interval)
+	for i := 0; i < n; i++ {
+		d *= p.Multiplier
+		if p.MaxInterval > 0 && d >= float64(p.MaxInterval) {
+			break
+		}
+	}
+	if p.MaxInterval > 0 && d > float64(p.MaxInterval) {
+		return time.Duration(p.MaxInterval)
+	}
+	return time.Duration(d)
+}
+
+// ScheduleEntry is a periodic scrape of one type of dump for a project's
+// collectors.
+type ScheduleEntry struct {
+	Project string `json:"project"`
+
+	// Collectors limits the scrape to the named collectors. All of the
+	// project's collectors if empty.
+	Collectors []string `json:"collectors,omitempty"`
+
+	// DumpType is the type of dump to scrape (ribs or updates)
+	DumpType bgpfinder.DumpType `json:"type"`
+
+	// Cadence is how often to scrape. Runs are aligned to multiples of it
+	// since the epoch. Defaults to how often the project publishes dumps
+	// of the type, if it's a built-in project.
+	Cadence Duration `json:"cadence"`
+
+	// Offset delays each run past its aligned start time. Defaults to 40s.
+	Offset Duration `json:"offset"`
+
+	// Retry defaults to 4 attempts, starting at 1/64th of the cadence and
+	// doubling up to the cadence
+	Retry RetryPolicy `json:"retry"`
+
+	// Lookback re-scrapes this far before each collector's newest stored
+	// dump, to pick up dumps that the archive published late. 0 scrapes
+	// from the newest stored dump.
+	Lookback Duration `json:"lookback"`
+}
+
+func (e ScheduleEntry) String() string {
+	s := e.Project + "/" + e.DumpType.String()
+	if len(e.Collectors) > 0 {
+		s += "[" + strings.Join(e.Collectors, ",") + "]"
+	}
+	return s
+}
+
+// isRibs reports whether the entry scrapes RIB dumps.
+func (e ScheduleEntry) isRibs() bool {
+	return e.DumpType == bgpfinder.DumpTypeRibs
+}
+
+// expectedMostRecent returns the timestamp of the newest dump that the
+// archive should have published by now. Updates are given an extra period
+// to show up, since they're published after the period they cover. The
+// period is how often the archive publishes dumps, which is unrelated to
+// how often they're scraped, so the cadence is only used for projects
+// whose period isn't known.
+func (e ScheduleEntry) expectedMostRecent(now time.Time) time.Time {
+	interval := time.Duration(bgpfinder.DumpPeriod(e.Project, e.DumpType))
+	if interval == 0 {
+		interval = time.Duration(e.Cadence)
+	}
+	last := now.Add(-interval)
+	if !e.isRibs() {
+		last = now.Add(-interval * 2)
+	}
+
+	remainder := last.Unix() % int64(interval.Seconds())
+	secondsUntilNext := int64(interval.Seconds()) - remainder
+	return last.Add(time.Duration(secondsUntilNext) * time.Second).Truncate(time.Minute)
+}
+
+// selectCollectors limits the collectors (and the times to scrape each of
+// them from) to those named by the entry, and moves those times back by the
+// entry's lookback.
+func (e ScheduleEntry) selectCollectors(collectors []bgpfinder.Collector, prevRuntimes []time.Time) ([]bgpfinder.Collector, []time.Time) {
+	var selected []bgpfinder.Collector
+	var from []time.Time
+	for i, collector := range collectors {
+		if !e.wants(collector.Name) {
+			continue
+		}
+		selected = append(selected, collector)
+		from = append(from, prevRuntimes[i].Add(-time.Duration(e.Lookback)))
+	}
+	return selected, from
+}
+
+// withDefaults fills in the unset fields of the entry, and checks that it
+// makes sense.
+func (e ScheduleEntry) withDefaults() (ScheduleEntry, error) {
+	if e.Project == "" {
+		return e, fmt.Errorf("schedule entry has no project")
+	}
+	if e.DumpType != bgpfinder.DumpTypeRibs && e.DumpType != bgpfinder.DumpTypeUpdates {
+		return e, fmt.Errorf("schedule entry %s must be for ribs or updates", e)
+	}
+	if e.Cadence == 0 {
+		// How often the project publishes, if it's a built-in project
+		e.Cadence = Duration(bgpfinder.DumpPeriod(e.Project, e.DumpType))
+	}
+	if e.Cadence < Duration(time.Second) {
+		return e, fmt.Errorf("schedule entry %s needs a cadence of at least 1s", e)
+	}
+	if e.Offset == 0 {
+		e.Offset = Duration(defaultOffset)
+	}
+	if e.Retry.Interval == 0 {
+		e.Retry.Interval = e.Cadence / defaultRetryDivisor
+	}
+	if e.Retry.Attempts == 0 {
+		e.Retry.Attempts = defaultRetryAttempts
+	}
+	if e.Retry.Multiplier == 0 {
+		e.Retry.Multiplier = defaultRetryMultiplier
+	}
+	if e.Retry.MaxInterval == 0 {
+		e.Retry.MaxInterval = e.Cadence
+	}
+	if e.Offset < 0 || e.Retry.Interval < 0 || e.Retry.Attempts < 0 || e.Retry.MaxInterval < 0 || e.Lookback < 0 {
+		return e, fmt.Errorf("schedule entry %s has a negative setting", e)
+	}
+	if e.Retry.Multiplier < 1 {
+		return e, fmt.Errorf("schedule entry %s needs a retry multiplier of at least 1", e)
+	}
+	return e, nil
+}
+
+// scheduleFile is the format of schedule files.
+type scheduleFile struct {
+	Schedules []ScheduleEntry `json:"schedules"`
+}
+
+// DefaultSchedule scrapes both types of dump for each of the finder's
+// projects that has default cadences.
+func DefaultSchedule(finder bgpfinder.Finder) ([]ScheduleEntry, error) {
+	projects, err := finder.Projects()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get projects: %w", err)
+	}
+	var entries []ScheduleEntry
+	for _, project := range projects {
+		if bgpfinder.DumpPeriod(project.Name, bgpfinder.DumpTypeRibs) == 0 {
+			continue
+		}
+		for _, dumpType := range []bgpfinder.DumpType{bgpfinder.DumpTypeRibs, bgpfinder.DumpTypeUpdates} {
+			entry, err := ScheduleEntry{Project: project.Name, DumpType: dumpType}.withDefaults()
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// LoadSchedule reads a schedule file, checking that each entry is for one
+// of the finder's projects.
+func LoadSchedule(path string, finder bgpfinder.Finder) ([]ScheduleEntry, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule: %w", err)
+	}
+	return parseSchedule(raw, finder)
+}
+
+func parseSchedule(raw []byte, finder bgpfinder.Finder) ([]ScheduleEntry, error) {
+	var file scheduleFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("invalid schedule: %w", err)
+	}
+	if len(file.Schedules) == 0 {
+		return nil, fmt.Errorf("schedule has no entries")
+	}
+	entries := make([]ScheduleEntry, 0, len(file.Schedules))
+	for _, entry := range file.Schedules {
+		if _, err := finder.Project(entry.Project); err != nil {
+			return nil, fmt.Errorf("schedule entry %s: %w", entry, err)
+		}
+		entry, err := entry.withDefaults()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ExpectedMostRecent returns the timestamp of the newest dump that the
+// project's archive should have published by now, given how often it
+// publishes dumps of the type. It's the zero time for projects without
+// default cadences.
+func ExpectedMostRecent(project string, isRibs bool) time.Time {
+	dumpType := getDumpTypeFromBool(isRibs)
+	if bgpfinder.DumpPeriod(project, dumpType) == 0 {
+		return time.Time{}
+	}
+	entry := ScheduleEntry{Project: project, DumpType: dumpType}
+	return entry.expectedMostRecent(time.Now())
+}
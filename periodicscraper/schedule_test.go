@@ -0,0 +1,121 @@
+package periodicscraper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder"
+)
+
+func TestParseSchedule(t *testing.T) {
+	entries, err := LoadSchedule("../example.schedule.json", bgpfinder.DefaultFinder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(entries))
+	}
+
+	risRibs := entries[0]
+	if risRibs.Cadence != Duration(bgpfinder.RISRibPeriod) || risRibs.Offset != Duration(defaultOffset) {
+		t.Errorf("Expected the default RIS ribs cadence and offset, got %+v", risRibs)
+	}
+	if risRibs.Retry.Interval != risRibs.Cadence/defaultRetryDivisor || risRibs.Retry.Attempts != defaultRetryAttempts {
+		t.Errorf("Expected the default retry policy, got %+v", risRibs.Retry)
+	}
+
+	rvUpdates := entries[3]
+	if rvUpdates.Retry.Interval != Duration(30*time.Second) || rvUpdates.Retry.Attempts != 6 ||
+		rvUpdates.Retry.Multiplier != 1.5 || rvUpdates.Retry.MaxInterval != Duration(5*time.Minute) {
+		t.Errorf("Expected the configured retry policy, got %+v", rvUpdates.Retry)
+	}
+	if rvUpdates.String() != "routeviews/updates[route-views2,route-views.sydney]" {
+		t.Errorf("Unexpected entry name %s", rvUpdates)
+	}
+
+	for name, raw := range map[string]string{
+		"unknown project": `{"schedules": [{"project": "nope", "type": "ribs"}]}`,
+		"no type":         `{"schedules": [{"project": "ris"}]}`,
+		"bad duration":    `{"schedules": [{"project": "ris", "type": "ribs", "cadence": "soon"}]}`,
+		"negative offset": `{"schedules": [{"project": "ris", "type": "ribs", "offset": "-1m"}]}`,
+		"low multiplier":  `{"schedules": [{"project": "ris", "type": "ribs", "retry": {"multiplier": 0.5}}]}`,
+		"no entries":      `{"schedules": []}`,
+	} {
+		if _, err := parseSchedule([]byte(raw), bgpfinder.DefaultFinder); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestDefaultSchedule(t *testing.T) {
+	entries, err := DefaultSchedule(bgpfinder.DefaultFinder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected ribs and updates for both projects, got %+v", entries)
+	}
+	for _, entry := range entries {
+		if entry.Cadence != Duration(bgpfinder.DumpPeriod(entry.Project, entry.DumpType)) {
+			t.Errorf("Expected %s to use the project's cadence, got %v", entry, time.Duration(entry.Cadence))
+		}
+	}
+}
+
+func TestScheduleEntrySelectCollectors(t *testing.T) {
+	project := bgpfinder.Project{Name: ROUTEVIEWS}
+	collectors := []bgpfinder.Collector{
+		{Project: project, Name: "route-views2"},
+		{Project: project, Name: "route-views3"},
+	}
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := ScheduleEntry{
+		Project:    ROUTEVIEWS,
+		Collectors: []string{"route-views3"},
+		DumpType:   bgpfinder.DumpTypeUpdates,
+		Lookback:   Duration(time.Hour),
+	}
+	selected, from := entry.selectCollectors(collectors, []time.Time{base, base})
+	if len(selected) != 1 || selected[0].Name != "route-views3" {
+		t.Fatalf("Expected only route-views3, got %+v", selected)
+	}
+	if !from[0].Equal(base.Add(-time.Hour)) {
+		t.Errorf("Expected the lookback to be applied, got %v", from[0])
+	}
+}
+
+func TestNextDivisibleTimestamp(t *testing.T) {
+	now := time.Unix(1000, 0)
+	if got := nextDivisibleTimestamp(now, 15*time.Minute, 40*time.Second); got.Unix() != 1800+40 {
+		t.Errorf("Expected the next boundary plus the offset, got %d", got.Unix())
+	}
+	if got := nextDivisibleTimestamp(time.Unix(900, 0), 15*time.Minute, 40*time.Second); got.Unix() != 900 {
+		t.Errorf("Expected now on a boundary, got %d", got.Unix())
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retry := RetryPolicy{Interval: Duration(time.Minute), Multiplier: 2, MaxInterval: Duration(5 * time.Minute)}
+	for n, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		if got := retry.delay(n); got != want {
+			t.Errorf("Expected retry %d to wait %v, got %v", n, want, got)
+		}
+	}
+}
+
+func TestScheduleEntryExpectedMostRecent(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 7, 0, 0, time.UTC)
+
+	// Scraping RIS ribs more often than they're published doesn't make the
+	// newer ones any more due
+	entry := ScheduleEntry{Project: bgpfinder.RIS, DumpType: bgpfinder.DumpTypeRibs, Cadence: Duration(15 * time.Minute)}
+	if got, want := entry.expectedMostRecent(now), time.Date(2020, 1, 1, 8, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Expected the 08:00 RIB, got %s", got.UTC())
+	}
+
+	// Projects without a known period fall back to the cadence
+	entry = ScheduleEntry{Project: "private", DumpType: bgpfinder.DumpTypeRibs, Cadence: Duration(time.Hour)}
+	if got, want := entry.expectedMostRecent(now), time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Expected the 12:00 RIB, got %s", got.UTC())
+	}
+}
@@ -2,133 +2,241 @@ package periodicscraper
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/alistairking/bgpfinder"
 	"github.com/alistairking/bgpfinder/internal/logging"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/alistairking/bgpfinder/internal/metrics"
 )
 
-func Start(logger *logging.Logger, envFile *string) {
-	db := setupDB(logger, envFile)
-	defer db.Close()
+// Options configures the periodic scraper.
+type Options struct {
+	// Store selects the database to scrape into
+	Store bgpfinder.StoreConfig
+
+	// AutoMigrate applies pending schema migrations before starting
+	AutoMigrate bool
+
+	// Maintenance configures partition creation and retention
+	Maintenance bgpfinder.MaintenanceConfig
+
+	// MaintenanceFrequency is how often maintenance runs
+	MaintenanceFrequency time.Duration
+
+	// MetricsAddr is the address to serve Prometheus metrics on. Metrics
+	// aren't served if it's empty.
+	MetricsAddr string
+
+	// ScheduleFile is the path of the schedule to scrape on. Each of the
+	// finder's projects is scraped at its default cadences if it's empty.
+	ScheduleFile string
+
+	// Finder finds the dumps to scrape. bgpfinder.DefaultFinder if unset.
+	Finder bgpfinder.Finder
+
+	// LeaseTTL is how long a replica's lease on a collector lasts without
+	// being renewed. bgpfinder.DefaultLeaseTTL if unset.
+	LeaseTTL time.Duration
+
+	// ShutdownTimeout is how long to wait for in-flight scrapes to finish
+	// (or store what they've found) once the scraper is asked to stop.
+	// DefaultShutdownTimeout if unset.
+	ShutdownTimeout time.Duration
+
+	// DryRun compares what the schedule would scrape now with what's
+	// stored, writes the differences to stdout and exits, without writing
+	// to the database.
+	DryRun bool
+
+	// DiffFormat is the format of the dry run's report
+	// (bgpfinder.DiffFormatText or bgpfinder.DiffFormatJSON). Text if unset.
+	DiffFormat string
+}
+
+// DefaultShutdownTimeout is long enough for in-flight scrapes to store what
+// they've found, but not for finds that are stuck on the archive.
+const DefaultShutdownTimeout = time.Minute
+
+func Start(logger *logging.Logger, opts Options) {
+	if opts.DryRun && opts.AutoMigrate {
+		logger.Warn().Msg("Not applying migrations in a dry run")
+		opts.AutoMigrate = false
+	}
+	store := setupStore(logger, opts.Store, opts.AutoMigrate)
+	defer store.Close()
 	ctx, stop := setupContext()
 	defer stop()
 
 	logger.Info().Msg("Starting runn")
 
-	var wg sync.WaitGroup
+	finder := opts.Finder
+	if finder == nil {
+		finder = bgpfinder.DefaultFinder
+	}
+	schedule, err := setupSchedule(opts.ScheduleFile, finder)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Invalid scrape schedule")
+	}
 
-	projectTuples := getProjectTuples()
+	if opts.DryRun {
+		if opts.DiffFormat == "" {
+			opts.DiffFormat = bgpfinder.DiffFormatText
+		}
+		diffs := DryRun(ctx, logger, store, finder, schedule, time.Now())
+		if err := bgpfinder.WriteDiffReport(os.Stdout, diffs, opts.DiffFormat); err != nil {
+			logger.Error().Err(err).Msg("Failed to write diff report")
+		}
+		return
+	}
+
+	// Replicas sharing the DB take leases on the collectors they scrape
+	holder := bgpfinder.NewLeaseHolder()
+	logger.Info().Str("holder", holder).Msg("Taking scrape leases")
+	leaser := bgpfinder.NewLeaser(logger, store, holder, opts.LeaseTTL)
+
+	if opts.MetricsAddr != "" {
+		startMetricsServer(ctx, logger, opts.MetricsAddr)
+	}
+
+	bgpfinder.StartPeriodicMaintenance(ctx, logger, opts.MaintenanceFrequency, store, opts.Maintenance)
 
-	for _, projectTuple := range projectTuples {
+	var wg sync.WaitGroup
+
+	for _, scheduleEntry := range schedule {
 		// Start each scraping task in its own goroutine
-		tuple := projectTuple
+		entry := scheduleEntry
+		logger.Info().
+			Str("schedule", entry.String()).
+			Dur("cadence", time.Duration(entry.Cadence)).
+			Msg("Scheduling scrape")
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			startScraping(ctx, logger, db, tuple)
+			startScraping(ctx, logger, store, leaser, finder, entry)
 		}()
 	}
 
-	// Wait for all scraping tasks to complete
-	wg.Wait()
-
-	<-ctx.Done() // Wait for context cancellation
+	// Scrapes stop waiting and retrying as soon as we're asked to stop, but
+	// in-flight ones get a while to store what they've found.
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	<-ctx.Done()
+	logger.Info().Msg("Stopping, waiting for in-flight scrapes")
+
+	timeout := opts.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warn().Dur("timeout", timeout).Msg("In-flight scrapes didn't finish in time, exiting anyway")
+	}
 
 	logger.Info().Msg("Exiting Main()")
 }
 
+// setupSchedule loads the schedule file, or builds the default schedule if
+// there isn't one.
+func setupSchedule(path string, finder bgpfinder.Finder) ([]ScheduleEntry, error) {
+	if path == "" {
+		return DefaultSchedule(finder)
+	}
+	return LoadSchedule(path, finder)
+}
+
 func startScraping(ctx context.Context,
 	logger *logging.Logger,
-	db *pgxpool.Pool,
-	projectTuple ProjectTuple) {
-	wait(projectTuple.interval, logger)
-	for {
-		if ctx.Err() != nil {
-			return
-		}
+	store bgpfinder.Store,
+	leaser *bgpfinder.Leaser,
+	finder bgpfinder.Finder,
+	entry ScheduleEntry) {
+	for wait(ctx, entry, logger) {
 		startTime := time.Now()
-		driver(ctx, logger, db, projectTuple.project, projectTuple.isRibs)
+		driver(ctx, logger, store, leaser, finder, entry)
 		elapsedTime := time.Since(startTime)
-		logger.Info().Msgf("Scraping runtime for project %s and isribs %t is %v", projectTuple.project, projectTuple.isRibs, elapsedTime)
-		wait(projectTuple.interval, logger) // or <-tick.C
+		metrics.ScrapeDuration.WithLabelValues(entry.Project, entry.DumpType.String()).Observe(elapsedTime.Seconds())
+		logger.Info().Msgf("Scraping runtime for %s is %v", entry, elapsedTime)
 	}
 }
 
-func wait(intervalSeconds int64, logger *logging.Logger) {
-	waitTill := nextDivisibleTimestamp(intervalSeconds)
-	waitUntilTimestamp(waitTill)
+// startMetricsServer serves the Prometheus metrics on addr until the context
+// is canceled.
+func startMetricsServer(ctx context.Context, logger *logging.Logger, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		logger.Info().Msgf("Serving metrics on %s", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("Metrics server error")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+}
+
+// wait waits for the entry's next run, returning false if the context is
+// canceled first.
+func wait(ctx context.Context, entry ScheduleEntry, logger *logging.Logger) bool {
+	waitTill := nextDivisibleTimestamp(time.Now(), time.Duration(entry.Cadence), time.Duration(entry.Offset))
+	if err := sleep(ctx, time.Until(waitTill)); err != nil {
+		return false
+	}
 	logger.Info().Msgf("Reached target time: %v", waitTill)
+	return true
 }
 
-func nextDivisibleTimestamp(intervalSeconds int64) time.Time {
-	now := time.Now()
-	interval := time.Duration(intervalSeconds) * time.Second
+// nextDivisibleTimestamp returns the next multiple of the interval since the
+// epoch, delayed by offset. It's now if now is exactly on a multiple.
+func nextDivisibleTimestamp(now time.Time, interval time.Duration, offset time.Duration) time.Time {
 	remainder := now.Unix() % int64(interval.Seconds()) // This is the modulo time of now with the interval frequency
 	if remainder == 0 {
 		return now
 	}
-	return now.Add(time.Duration(int64(interval.Seconds())-remainder+epsilonTime) * time.Second)
-}
-
-func waitUntilTimestamp(targetTime time.Time) {
-	duration := time.Until(targetTime)
-
-	if duration <= 0 {
-		return
-	}
-
-	time.Sleep(duration)
+	return now.Add(time.Duration(int64(interval.Seconds())-remainder)*time.Second + offset)
 }
 
-func getExpectedMostRecent(project string, isRibs bool) time.Time {
-	var last time.Time
-	var interval time.Duration
-	if project == "ris" {
-		if isRibs {
-			interval = time.Duration(risRibsInterval) * time.Second
-	        last = time.Now().Add(-interval)
-		} else {
-			interval = time.Duration(risUpdatesInterval) * time.Second
-	        last = time.Now().Add(-interval*2)
-		}
-	} else if project == "routeviews" {
-		if isRibs {
-			interval = time.Duration(routeviewRibsInterval) * time.Second
-	        last = time.Now().Add(-interval)
-		} else {
-			interval = time.Duration(routeviewUpdatesInterval) * time.Second
-	        last = time.Now().Add(-interval*2)
-		}
-	} else {
-		return time.Now()
-	}
-
-	remainder := last.Unix() % int64(interval.Seconds())
-	secondsUntilNext := int64(interval.Seconds()) - remainder
-	return last.Add(time.Duration(secondsUntilNext) * time.Second).Truncate(time.Minute)
-}
+func driver(ctx context.Context, logger *logging.Logger, store bgpfinder.Store, leaser *bgpfinder.Leaser, finder bgpfinder.Finder, entry ScheduleEntry) {
+	project, isRibs := entry.Project, entry.isRibs()
+	logger.Info().Msgf("Starting periodic collectors data for %s", entry)
+	run := bgpfinder.NewScrapeRun(bgpfinder.ScrapeRunPeriodic, project, entry.DumpType)
+	bgpfinder.StartScrapeRun(ctx, logger, store, run)
+	defer bgpfinder.FinishScrapeRun(ctx, logger, store, run)
 
-func driver(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, project string, isRibs bool) {
-	logger.Info().Msgf("Starting periodic collectors data for %s isribs: %t", project, isRibs)
-	collectors, prevRuntimes, err := getCollectorsAndPrevRuntime(ctx, logger, db, project, isRibs)
+	collectors, prevRuntimes, err := getCollectorsAndPrevRuntime(ctx, logger, store, project, isRibs)
 	if err != nil {
 		logger.Error().Err(err).Msgf("Failed to run db to collect data for %s isribs: %t data for collectors", project, isRibs)
+		run.RecordError(err)
 	} else {
 		logger.Info().Msgf("Run of db on %s isribs: %t completed successfully", project, isRibs)
 	}
-	var finder bgpfinder.Finder
-	if project == RIS {
-		finder = bgpfinder.NewRISFinder()
-	} else {
-		finder = bgpfinder.NewRouteViewsFinder()
+	// Without knowing which collectors have dumps, every one would look new
+	var onboard []bgpfinder.Collector
+	if err == nil {
+		collectors, prevRuntimes, onboard = syncCollectors(ctx, logger, store, finder, entry, collectors, prevRuntimes)
 	}
-	err = PeriodicScraper(ctx, logger, getRetryInterval(project, isRibs), prevRuntimes, collectors, db, finder, isRibs, getExpectedMostRecent(project, isRibs))
+	collectors, prevRuntimes = entry.selectCollectors(collectors, prevRuntimes)
+	err = PeriodicScraper(ctx, logger, entry.Retry, prevRuntimes, collectors, store, leaser, finder, isRibs, entry.expectedMostRecent(time.Now()), run)
 	if err != nil {
+		run.RecordError(err)
 		logger.Error().Err(err).Msgf("Failed to run periodic scraper %s isribs: %t data for collectors", project, isRibs)
 	} else {
 		logger.Info().Msgf("Run of periodic scraper %s isribs: %t completed successfully", project, isRibs)
 	}
+
+	// New collectors join the regular scrape once their history is in
+	onboardCollectors(ctx, logger, store, leaser, finder, entry, onboard, run)
 }
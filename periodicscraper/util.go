@@ -2,179 +2,121 @@ package periodicscraper
 
 import (
 	"context"
-	"fmt"
-	"os"
 	"os/signal"
-	"strings"
+	"sort"
 	"syscall"
 	"time"
 
 	"github.com/alistairking/bgpfinder"
 	"github.com/alistairking/bgpfinder/internal/logging"
-	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/joho/godotenv"
+	"github.com/alistairking/bgpfinder/internal/metrics"
 )
 
 const (
-	RIS                      = "ris"
-	ROUTEVIEWS               = "routeviews"
-	routeviewRibsInterval    = (2*60 + 0) * 60
-	routeviewUpdatesInterval = (0*60 + 15) * 60
-	risRibsInterval          = (8*60 + 0) * 60
-	risUpdatesInterval       = (0*60 + 5) * 60
-	divVal                   = 64
-	epsilonTime              = 40 // buffer time so that the scraper code doesn't immediately kick off at the designated time.
+	RIS        = "ris"
+	ROUTEVIEWS = "routeviews"
 )
 
-type DBConfig struct {
-	Host     string
-	Port     string
-	User     string
-	Password string
-	DBName   string
-}
-
-type ProjectTuple struct {
-	project  string
-	isRibs   bool
-	interval int64
-}
-
-func getProjectTuples() [4]ProjectTuple {
-	return [4]ProjectTuple{
-		{RIS, true, risRibsInterval},
-		{RIS, false, risUpdatesInterval},
-		{ROUTEVIEWS, true, routeviewRibsInterval},
-		{ROUTEVIEWS, false, routeviewUpdatesInterval},
-	}
-}
+// checkpointTimeout is how long writes that are in flight when the scraper
+// is asked to stop get to finish, so that what's been found isn't lost.
+const checkpointTimeout = 30 * time.Second
 
-func loadDBConfig(envFile string) (*DBConfig, error) {
-	if err := godotenv.Load(envFile); err != nil {
-		return nil, fmt.Errorf("error loading env file: %w", err)
+func setupStore(logger *logging.Logger, storeConfig bgpfinder.StoreConfig, autoMigrate bool) bgpfinder.Store {
+	ctx := context.Background()
+	store, err := bgpfinder.OpenStore(ctx, logger, storeConfig)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Unable to connect to database")
 	}
+	logger.Info().Str("driver", storeConfig.Driver).Msg("Successfully connected to Database")
 
-	config := &DBConfig{
-		Host:     os.Getenv("POSTGRES_HOST"),
-		Port:     os.Getenv("POSTGRES_PORT"),
-		User:     os.Getenv("POSTGRES_USER"),
-		Password: os.Getenv("POSTGRES_PASSWORD"),
-		DBName:   os.Getenv("POSTGRES_DB"),
+	if autoMigrate {
+		version, err := bgpfinder.MigrateUp(ctx, logger, store)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to apply database migrations")
+		}
+		logger.Info().Int("schema_version", version).Msg("Database migrations applied")
 	}
-
-	// Validate required fields
-	if config.User == "" || config.Password == "" || config.DBName == "" {
-		return nil, fmt.Errorf("missing required database configuration")
+	if err := bgpfinder.CheckSchemaVersion(ctx, store); err != nil {
+		logger.Fatal().Err(err).Msg("Refusing to start")
 	}
+	return store
+}
 
-	return config, nil
+func setupContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
+	return ctx, stop
 }
 
-func setupDB(logger *logging.Logger, envFile *string) *pgxpool.Pool {
-	config, err := loadDBConfig(*envFile)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to load database configuration")
+// sleep waits for d, returning early with the context's error if it's
+// canceled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
 	}
-	connStr := fmt.Sprintf(
-		"postgres://%s:%s@%s:%s/%s?sslmode=disable",
-		config.User,
-		config.Password,
-		config.Host,
-		config.Port,
-		config.DBName,
-	)
-
-	db, err := pgxpool.New(context.Background(), connStr)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("Unable to connect to database")
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-	logger.Info().Msg("Successfully connected to Database")
-	return db
 }
 
-func setupContext() (context.Context, context.CancelFunc) {
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
-	return ctx, stop
+// checkpointContext returns a context for writing a scrape's results that
+// outlives ctx by up to checkpointTimeout, so that a scrape that's stopped
+// mid-way still stores what it found.
+func checkpointContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	writeCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(checkpointTimeout, cancel)
+	})
+	return writeCtx, func() {
+		stop()
+		cancel()
+	}
 }
 
 func getCollectorsAndPrevRuntime(ctx context.Context,
 	logger *logging.Logger,
-	db *pgxpool.Pool,
+	store bgpfinder.Store,
 	project string,
 	isRibs bool) ([]bgpfinder.Collector, []time.Time, error) {
 
-	var dumpType int
-	if isRibs {
-		dumpType = 2
-	} else {
-		dumpType = 1
-	}
-
-	stmt := `SELECT collector_name, MAX(timestamp) as timestamp from bgp_dumps WHERE dump_type = $1 GROUP BY collector_name`
-	rows, err := db.Query(ctx, stmt, dumpType)
-
+	latest, err := store.FetchLatestDumpTimes(ctx, project, getDumpTypeFromBool(isRibs))
 	if err != nil {
 		logger.Error().Err(err).Msg("Query failed")
 		return nil, nil, err
 	}
-	defer rows.Close()
 
-	// Iterate over rows
+	collectorNames := make([]string, 0, len(latest))
+	for name := range latest {
+		collectorNames = append(collectorNames, name)
+	}
+	sort.Strings(collectorNames)
+
 	var collectors []bgpfinder.Collector
 	var timeArray []time.Time
 
-	for rows.Next() {
-		var collectorName string
-		var collector bgpfinder.Collector
-		var lastCompletedCrawlTime time.Time // Use time.Time if it's a timestamp
-
-		err := rows.Scan(&collectorName, &lastCompletedCrawlTime)
-		if err != nil {
-			logger.Error().Err(err).Msg("Scan failed")
-		}
-		collector.Project.Name = project
-		collector.Name = collectorName
-		if project == "ris" {
-			if !strings.Contains(collector.Name, "rrc") {
-				continue
-			}
-		} else {
-			if strings.Contains(collector.Name, "rrc") {
-				continue
-			}
+	for _, collectorName := range collectorNames {
+		lastCompletedCrawlTime := latest[collectorName]
+		collector := bgpfinder.Collector{
+			Project: bgpfinder.Project{Name: project},
+			Name:    collectorName,
 		}
 
-		fmt.Printf("Collector: %s, Last Completed Crawl Time: %s\n", collectorName, lastCompletedCrawlTime)
+		logger.Debug().
+			Str("collector", collectorName).
+			Time("last_completed_crawl_time", lastCompletedCrawlTime).
+			Msg("Found collector")
+		metrics.ObserveNewestDump(project, collectorName, getDumpTypeFromBool(isRibs).String(), lastCompletedCrawlTime)
 		collectors = append(collectors, collector)
 		timeArray = append(timeArray, lastCompletedCrawlTime)
 	}
 
-	// Check for errors after iteration
-	if err := rows.Err(); err != nil {
-		logger.Error().Err(err).Msg("Row iteration error")
-	}
-
 	return collectors, timeArray, nil
 }
 
-func getRetryInterval(project string, isRibs bool) int64 {
-	switch project {
-	case ROUTEVIEWS:
-		if isRibs {
-			return routeviewRibsInterval / divVal
-		} else {
-			return routeviewUpdatesInterval / divVal
-		}
-	case RIS:
-		if isRibs {
-			return risRibsInterval / divVal
-		} else {
-			return risUpdatesInterval / divVal
-		}
-	}
-	return 0
-}
-
 func getDumpTypeFromBool(isRibs bool) bgpfinder.DumpType {
 	var dumpType bgpfinder.DumpType
 
@@ -198,3 +140,23 @@ func getTimestampForDumpType(isRibs bool) string {
 
 	return timestampField
 }
+
+func getMostRecentTimestamp(dumps []bgpfinder.BGPDump) int64 {
+	mostRecent := int64(0)
+	for _, dump := range dumps {
+		if dump.Timestamp > mostRecent {
+			mostRecent = dump.Timestamp
+		}
+	}
+	return mostRecent
+}
+
+func getOldestTimestamp(dumps []bgpfinder.BGPDump) int64 {
+	var oldest int64
+	for i, dump := range dumps {
+		if i == 0 || dump.Timestamp < oldest {
+			oldest = dump.Timestamp
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,201 @@
+package bgpfinder
+
+import (
+	"context"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/alistairking/bgpfinder/migrations"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrationLockKey is the advisory lock that serializes schema migrations
+// when several binaries start up at once.
+const migrationLockKey = 0x62677066 // "bgpf"
+
+const postgresSchemaVersionTable = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)
+`
+
+// PostgresStore is a Store backed by a Postgres connection pool.
+type PostgresStore struct {
+	db     *pgxpool.Pool
+	logger *logging.Logger
+}
+
+func NewPostgresStore(logger *logging.Logger, db *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{
+		db:     db,
+		logger: logger.ModuleLogger("PostgresStore"),
+	}
+}
+
+// Pool returns the underlying connection pool.
+func (s *PostgresStore) Pool() *pgxpool.Pool {
+	return s.db
+}
+
+func (s *PostgresStore) UpsertCollectors(ctx context.Context, collectors []Collector, dumpType DumpType, crawlTime time.Time) error {
+	return UpsertCollectors(ctx, s.logger, s.db, collectors, dumpType, crawlTime)
+}
+
+func (s *PostgresStore) InsertCollectors(ctx context.Context, collectors []Collector) error {
+	return InsertCollectors(ctx, s.logger, s.db, collectors)
+}
+
+func (s *PostgresStore) UpsertDumps(ctx context.Context, dumps []BGPDump) (UpsertStats, error) {
+	return BulkUpsertBGPDumps(ctx, s.logger, s.db, dumps)
+}
+
+func (s *PostgresStore) FetchDumps(ctx context.Context, query Query, opts FetchOptions) ([]BGPDump, error) {
+	return FetchDataFromDB(ctx, s.db, query, opts)
+}
+
+func (s *PostgresStore) StreamDumps(ctx context.Context, query Query, opts FetchOptions, fn func(BGPDump) error) error {
+	return StreamDataFromDB(ctx, s.db, query, opts, fn)
+}
+
+func (s *PostgresStore) FetchDumpChanges(ctx context.Context, query Query, since ChangeCursor, until time.Time, limit int, opts FetchOptions) ([]BGPDump, ChangeCursor, error) {
+	return FetchDataChangesFromDB(ctx, s.db, query, since, until, limit, opts)
+}
+
+func (s *PostgresStore) ChangeFeedHorizon(ctx context.Context) (time.Time, error) {
+	return ChangeFeedHorizonFromDB(ctx, s.db)
+}
+
+func (s *PostgresStore) ReconcileDumps(ctx context.Context, collector Collector, dumpType DumpType, window Interval, found []BGPDump) (ReconcileStats, error) {
+	return ReconcileBGPDumps(ctx, s.logger, s.db, collector, dumpType, window, found)
+}
+
+func (s *PostgresStore) FetchProjects(ctx context.Context) ([]Project, error) {
+	return FetchProjectsFromDB(ctx, s.db)
+}
+
+func (s *PostgresStore) FetchCollectors(ctx context.Context, project string) ([]Collector, error) {
+	return FetchCollectorsFromDB(ctx, s.db, project)
+}
+
+func (s *PostgresStore) RetireCollectors(ctx context.Context, collectors []Collector, at time.Time) (int, error) {
+	return RetireCollectorsInDB(ctx, s.db, collectors, at)
+}
+
+func (s *PostgresStore) FetchRetiredCollectors(ctx context.Context, project string) (map[string]time.Time, error) {
+	return FetchRetiredCollectorsFromDB(ctx, s.db, project)
+}
+
+func (s *PostgresStore) FetchLatestDumpTimes(ctx context.Context, project string, dumpType DumpType) (map[string]time.Time, error) {
+	return FetchLatestDumpTimesFromDB(ctx, s.db, project, dumpType)
+}
+
+func (s *PostgresStore) EnsurePartitions(ctx context.Context, from, until time.Time) error {
+	return EnsureDumpPartitions(ctx, s.db, from, until)
+}
+
+func (s *PostgresStore) DeleteDumpsBefore(ctx context.Context, dumpType DumpType, before time.Time) (int64, error) {
+	return DeleteBGPDumpsBefore(ctx, s.logger, s.db, dumpType, before)
+}
+
+func (s *PostgresStore) UpsertCrawlCoverage(ctx context.Context, collector Collector, dumpType DumpType, window Interval) error {
+	return UpsertCrawlCoverage(ctx, s.logger, s.db, collector, dumpType, window)
+}
+
+func (s *PostgresStore) FetchCrawlCoverage(ctx context.Context, collector Collector, dumpType DumpType, window Interval) ([]Interval, error) {
+	return FetchCrawlCoverageFromDB(ctx, s.db, collector, dumpType, window)
+}
+
+func (s *PostgresStore) UpsertCrawlWindow(ctx context.Context, window CrawlWindow) error {
+	return UpsertCrawlWindowToDB(ctx, s.db, window)
+}
+
+func (s *PostgresStore) FetchCrawlWindows(ctx context.Context, source string, collector Collector, dumpType DumpType) ([]CrawlWindow, error) {
+	return FetchCrawlWindowsFromDB(ctx, s.db, source, collector, dumpType)
+}
+
+func (s *PostgresStore) AcquireLease(ctx context.Context, collector Collector, dumpType DumpType, holder string, ttl time.Duration) (bool, error) {
+	return AcquireLeaseInDB(ctx, s.db, collector, dumpType, holder, ttl)
+}
+
+func (s *PostgresStore) ReleaseLease(ctx context.Context, collector Collector, dumpType DumpType, holder string) error {
+	return ReleaseLeaseInDB(ctx, s.db, collector, dumpType, holder)
+}
+
+func (s *PostgresStore) InsertScrapeRun(ctx context.Context, run *ScrapeRun) error {
+	return InsertScrapeRunToDB(ctx, s.db, run)
+}
+
+func (s *PostgresStore) UpdateScrapeRun(ctx context.Context, run ScrapeRun) error {
+	return UpdateScrapeRunInDB(ctx, s.db, run)
+}
+
+func (s *PostgresStore) FetchScrapeRuns(ctx context.Context, filter ScrapeRunFilter) ([]ScrapeRun, error) {
+	return FetchScrapeRunsFromDB(ctx, s.db, filter)
+}
+
+func (s *PostgresStore) Dialect() string {
+	return migrations.DialectPostgres
+}
+
+func (s *PostgresStore) SchemaVersion(ctx context.Context) (int, error) {
+	var exists bool
+	err := s.db.QueryRow(ctx, `SELECT to_regclass('schema_version') IS NOT NULL`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return postgresSchemaVersion(ctx, s.db)
+}
+
+func (s *PostgresStore) ApplyMigration(ctx context.Context, m migrations.Migration, up bool) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(migrationLockKey)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, postgresSchemaVersionTable); err != nil {
+		return err
+	}
+	current, err := postgresSchemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	apply, err := checkMigrationOrder(current, m, up)
+	if err != nil || !apply {
+		return err
+	}
+
+	if up {
+		if _, err := tx.Exec(ctx, m.Up); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO schema_version (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+	} else {
+		if _, err := tx.Exec(ctx, m.Down); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM schema_version WHERE version = $1`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func postgresSchemaVersion(ctx context.Context, q interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}) (int, error) {
+	var version int
+	err := q.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+func (s *PostgresStore) Close() {
+	s.db.Close()
+}
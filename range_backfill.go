@@ -0,0 +1,247 @@
+package bgpfinder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+const (
+	// DefaultRangeChunk is the size of the pieces that a range backfill
+	// crawls (and checkpoints) each collector's range in.
+	DefaultRangeChunk = 7 * 24 * time.Hour
+
+	// DefaultRangeConcurrency is how many collectors a range backfill
+	// crawls at once.
+	DefaultRangeConcurrency = 4
+)
+
+// RangeBackfillConfig configures a one-off crawl of a range of history.
+type RangeBackfillConfig struct {
+	Collectors []Collector
+
+	// DumpType to crawl. DumpTypeAny crawls both types in one go.
+	DumpType DumpType
+
+	// Window is the range to crawl
+	Window Interval
+
+	// Chunk is the size of the pieces each collector's range is crawled
+	// in. Chunks are aligned to multiples of it since the epoch (and
+	// clipped to the window). DefaultRangeChunk if unset.
+	Chunk time.Duration
+
+	// Concurrency is how many collectors are crawled at once.
+	// DefaultRangeConcurrency if unset.
+	Concurrency int
+
+	// RecrawlBefore makes chunks that were last crawled before it be
+	// crawled again. Otherwise a chunk that's been crawled before is
+	// skipped, so an interrupted backfill resumes where it left off. To
+	// reload a range, set it to the time the first attempt started and
+	// keep it the same when resuming.
+	RecrawlBefore time.Time
+
+	// Leaser takes a lease on each collector before crawling it, so that
+	// the backfill doesn't race the scrapers. Nothing is leased if unset.
+	Leaser *Leaser
+}
+
+// withDefaults fills in the unset settings, checking the rest.
+func (cfg RangeBackfillConfig) withDefaults() (RangeBackfillConfig, error) {
+	if cfg.Window.Empty() {
+		return cfg, fmt.Errorf("range backfill window %s is empty", cfg.Window)
+	}
+	if cfg.Chunk == 0 {
+		cfg.Chunk = DefaultRangeChunk
+	}
+	if cfg.Chunk < time.Second {
+		return cfg, fmt.Errorf("range backfill chunks must be at least 1s")
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultRangeConcurrency
+	}
+	return cfg, nil
+}
+
+// rangeChunks splits the window into chunks aligned to multiples of size,
+// oldest first.
+func rangeChunks(window Interval, size time.Duration) []Interval {
+	var chunks []Interval
+	step := int64(size.Seconds())
+	start := window.From.Unix() - window.From.Unix()%step
+	for ; start < window.Until.Unix(); start += step {
+		chunk := Interval{From: time.Unix(start, 0), Until: time.Unix(start+step, 0)}
+		if chunk.From.Before(window.From) {
+			chunk.From = window.From
+		}
+		if chunk.Until.After(window.Until) {
+			chunk.Until = window.Until
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// RunRangeBackfill crawls the window for each of the collectors, a chunk at
+// a time, upserting what's found and recording coverage as it goes. Each
+// chunk that's crawled is recorded as a crawl window, which is the
+// checkpoint that a later run resumes from. It records (and returns) one
+// scrape run for each of the collectors' projects. Collectors that fail are
+// recorded in their project's run but don't stop the others.
+func RunRangeBackfill(ctx context.Context, logger *logging.Logger, store Store, finder Finder, cfg RangeBackfillConfig) ([]*ScrapeRun, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	// A range doesn't make for a completed crawl of the collectors, so
+	// stored ones are left alone.
+	if err = store.InsertCollectors(ctx, cfg.Collectors); err != nil {
+		return nil, fmt.Errorf("failed to insert collectors: %w", err)
+	}
+
+	runs := map[string]*ScrapeRun{}
+	var ordered []*ScrapeRun
+	for _, c := range cfg.Collectors {
+		if runs[c.Project.Name] == nil {
+			run := NewScrapeRun(ScrapeRunRange, c.Project.Name, cfg.DumpType)
+			StartScrapeRun(ctx, logger, store, run)
+			runs[c.Project.Name] = run
+			ordered = append(ordered, run)
+		}
+	}
+
+	chunks := rangeChunks(cfg.Window, cfg.Chunk)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cfg.Concurrency)
+	for _, collector := range cfg.Collectors {
+		collector := collector
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var found int
+			var stats UpsertStats
+			err := cfg.Leaser.WithLease(ctx, collector, cfg.DumpType, func(ctx context.Context) error {
+				var err error
+				found, stats, err = crawlRangeChunks(ctx, logger, store, finder, collector, cfg, chunks)
+				return err
+			})
+			if errors.Is(err, ErrLeaseHeld) {
+				logger.Warn().Str("collector", collector.Name).Msg("Collector is being scraped by another replica, skipping")
+			}
+			if err != nil {
+				logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to backfill range")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			runs[collector.Project.Name].RecordCollector(collector.Name, found, stats, 0, err)
+		}()
+	}
+	wg.Wait()
+
+	for _, run := range ordered {
+		FinishScrapeRun(ctx, logger, store, run)
+	}
+	return ordered, ctx.Err()
+}
+
+// DiffRange compares what a range backfill would find in each of the
+// collectors' chunks with what's stored, without writing anything. Unlike
+// the backfill itself, it doesn't skip chunks that have been crawled before.
+func DiffRange(ctx context.Context, logger *logging.Logger, store Store, finder Finder, cfg RangeBackfillConfig) ([]CrawlDiff, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []CrawlDiff
+	for _, collector := range cfg.Collectors {
+		for _, chunk := range rangeChunks(cfg.Window, cfg.Chunk) {
+			if ctx.Err() != nil {
+				return diffs, ctx.Err()
+			}
+			diff, err := DiffCrawl(ctx, store, finder, collector, cfg.DumpType, chunk)
+			if err != nil {
+				logger.Error().Err(err).Str("collector", collector.Name).Str("window", chunk.String()).Msg("Failed to diff chunk")
+				diff.Error = err.Error()
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, nil
+}
+
+// crawlRangeChunks crawls the collector's chunks that haven't been crawled
+// since cfg.RecrawlBefore, oldest first, recording each one as it's done.
+// It stops at the first chunk that fails, so that resuming picks up there.
+func crawlRangeChunks(ctx context.Context,
+	logger *logging.Logger,
+	store Store,
+	finder Finder,
+	collector Collector,
+	cfg RangeBackfillConfig,
+	chunks []Interval) (int, UpsertStats, error) {
+
+	records, err := store.FetchCrawlWindows(ctx, ScrapeRunRange, collector, cfg.DumpType)
+	if err != nil {
+		return 0, UpsertStats{}, fmt.Errorf("failed to fetch crawl windows: %w", err)
+	}
+	crawled := map[[2]int64]time.Time{}
+	for _, r := range records {
+		crawled[[2]int64{r.Window.From.Unix(), r.Window.Until.Unix()}] = r.Crawled
+	}
+
+	var found, skipped int
+	var total UpsertStats
+	for _, chunk := range chunks {
+		if ctx.Err() != nil {
+			return found, total, ctx.Err()
+		}
+		if last, ok := crawled[[2]int64{chunk.From.Unix(), chunk.Until.Unix()}]; ok && !last.Before(cfg.RecrawlBefore) {
+			skipped++
+			continue
+		}
+
+		dumps, stats, err := CrawlCollector(ctx, logger, store, finder, collector, cfg.DumpType, chunk)
+		found += len(dumps)
+		total.Add(stats)
+		if err != nil {
+			return found, total, fmt.Errorf("chunk %s: %w", chunk, err)
+		}
+
+		record := CrawlWindow{
+			Source:     ScrapeRunRange,
+			Collector:  collector,
+			DumpType:   cfg.DumpType,
+			Window:     chunk,
+			Crawled:    time.Now(),
+			DumpsFound: len(dumps),
+		}
+		if err := store.UpsertCrawlWindow(ctx, record); err != nil {
+			return found, total, fmt.Errorf("failed to checkpoint chunk %s: %w", chunk, err)
+		}
+	}
+	logger.Info().
+		Str("collector", collector.Name).
+		Int("chunks", len(chunks)).
+		Int("skipped", skipped).
+		Int("dumps_found", found).
+		Int("inserted", total.Inserted).
+		Msg("Backfilled range")
+	return found, total, nil
+}
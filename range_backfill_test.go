@@ -0,0 +1,203 @@
+package bgpfinder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+func TestRangeChunks(t *testing.T) {
+	window := Interval{
+		From:  time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		Until: time.Date(2020, 1, 3, 6, 0, 0, 0, time.UTC),
+	}
+	chunks := rangeChunks(window, 24*time.Hour)
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %v", chunks)
+	}
+	if !chunks[0].From.Equal(window.From) || !chunks[2].Until.Equal(window.Until) {
+		t.Errorf("Expected the chunks to be clipped to the window, got %v", chunks)
+	}
+	if !chunks[1].From.Equal(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)) || !chunks[0].Until.Equal(chunks[1].From) {
+		t.Errorf("Expected the chunks to be aligned and contiguous, got %v", chunks)
+	}
+}
+
+func TestRunRangeBackfill(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	finder := &sliceFinder{dumps: append(testUpdates(base.Add(time.Hour), 3), testUpdates(base.Add(73*time.Hour), 2)...)}
+	cfg := RangeBackfillConfig{
+		Collectors: []Collector{testCollector},
+		DumpType:   DumpTypeUpdates,
+		Window:     Interval{From: base, Until: base.Add(48 * time.Hour)},
+		Chunk:      24 * time.Hour,
+	}
+
+	// The first two days, as if the backfill were interrupted there
+	runs, err := RunRangeBackfill(ctx, logger, store, finder, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finder.queries) != 2 || len(runs) != 1 || runs[0].Source != ScrapeRunRange || runs[0].DumpsInserted != 3 {
+		t.Errorf("Expected 2 chunks to be crawled in a range run, got %d queries and %+v", len(finder.queries), runs)
+	}
+
+	// Resuming over the whole range only crawls the chunks that are left
+	finder.queries = nil
+	cfg.Window.Until = base.Add(96 * time.Hour)
+	runs, err = RunRangeBackfill(ctx, logger, store, finder, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finder.queries) != 2 || !finder.queries[0].From.Equal(base.Add(48*time.Hour)) || runs[0].DumpsInserted != 2 {
+		t.Errorf("Expected only the last 2 chunks to be crawled, got %v and %+v", finder.queries, runs)
+	}
+	covered, err := store.FetchCrawlCoverage(ctx, testCollector, DumpTypeUpdates, cfg.Window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(covered) != 1 || !covered[0].From.Equal(cfg.Window.From) || !covered[0].Until.Equal(cfg.Window.Until) {
+		t.Errorf("Expected the whole range to be covered, got %v", covered)
+	}
+
+	// Reloading crawls everything again
+	finder.queries = nil
+	cfg.RecrawlBefore = time.Now()
+	if _, err := RunRangeBackfill(ctx, logger, store, finder, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(finder.queries) != 4 {
+		t.Errorf("Expected all 4 chunks to be recrawled, got %d", len(finder.queries))
+	}
+}
+
+func TestRunRangeBackfillIgnoresTieredBackfill(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	// The tiered backfill has just crawled a day that's also a chunk
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := Interval{From: base, Until: base.Add(24 * time.Hour)}
+	if err := store.UpsertCrawlWindow(ctx, CrawlWindow{
+		Source:    ScrapeRunBackfill,
+		Collector: testCollector,
+		DumpType:  DumpTypeUpdates,
+		Window:    day,
+		Crawled:   time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	finder := &sliceFinder{dumps: testUpdates(base.Add(time.Hour), 3)}
+	_, err = RunRangeBackfill(ctx, logger, store, finder, RangeBackfillConfig{
+		Collectors: []Collector{testCollector},
+		DumpType:   DumpTypeUpdates,
+		Window:     day,
+		Chunk:      24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finder.queries) != 1 {
+		t.Errorf("Expected the range to be crawled regardless, got %d queries", len(finder.queries))
+	}
+}
+
+func TestRunRangeBackfillUnlisted(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	stored := append(testUpdates(base, 3), testUpdates(base.Add(24*time.Hour), 3)...)
+	if _, err := store.UpsertDumps(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second day's directory fails to load
+	secondDay := Interval{From: base.Add(24 * time.Hour), Until: base.Add(48 * time.Hour)}
+	finder := &sliceFinder{dumps: stored, unlisted: []Interval{secondDay}}
+	cfg := RangeBackfillConfig{
+		Collectors: []Collector{testCollector},
+		DumpType:   DumpTypeUpdates,
+		Window:     Interval{From: base, Until: base.Add(48 * time.Hour)},
+		Chunk:      48 * time.Hour,
+	}
+	runs, err := RunRangeBackfill(ctx, logger, store, finder, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs[0].CollectorsSucceeded) != 0 {
+		t.Errorf("Expected the collector to fail, got %+v", runs[0])
+	}
+
+	// Its stored dumps aren't tombstoned, and it isn't covered or checkpointed
+	live, err := store.FetchDumps(ctx, Query{Collectors: []Collector{testCollector}, DumpType: DumpTypeUpdates, From: cfg.Window.From, Until: cfg.Window.Until}, FetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 6 {
+		t.Errorf("Expected the unlisted day's dumps to be left alone, got %d live dumps", len(live))
+	}
+	covered, err := store.FetchCrawlCoverage(ctx, testCollector, DumpTypeUpdates, cfg.Window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(covered) != 1 || !covered[0].Until.Equal(secondDay.From) {
+		t.Errorf("Expected only the first day to be covered, got %v", covered)
+	}
+	windows, err := store.FetchCrawlWindows(ctx, ScrapeRunRange, testCollector, DumpTypeUpdates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 0 {
+		t.Errorf("Expected the chunk not to be checkpointed, got %+v", windows)
+	}
+}
+
+func TestRunRangeBackfillLeavesCollectorsAlone(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	// A retired collector that was last crawled in full at lastCrawl
+	lastCrawl := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.UpsertCollectors(ctx, []Collector{testCollector}, DumpTypeAny, lastCrawl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RetireCollectors(ctx, []Collector{testCollector}, lastCrawl); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	finder := &sliceFinder{dumps: testUpdates(base, 3)}
+	cfg := RangeBackfillConfig{
+		Collectors: []Collector{testCollector},
+		DumpType:   DumpTypeUpdates,
+		Window:     Interval{From: base, Until: base.Add(24 * time.Hour)},
+	}
+	if _, err := RunRangeBackfill(ctx, logger, store, finder, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	checkCollectorUntouched(t, store, lastCrawl)
+}
@@ -49,6 +49,22 @@ func NewRISFinder() *RISFinder {
 	return f
 }
 
+// RefreshCollectors reloads the collector list from the archive.
+func (f *RISFinder) RefreshCollectors() error {
+	c, err := f.getCollectors()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		if f.collectors == nil {
+			f.collectorsErr = err
+		}
+		return err
+	}
+	f.collectors = c
+	f.collectorsErr = nil
+	return nil
+}
+
 func (f *RISFinder) Projects() ([]Project, error) {
 	return []Project{RisProject}, nil
 }
@@ -87,8 +103,11 @@ func (f *RISFinder) Collector(name string) (Collector, error) {
 // Find the BGP data corresponding to the query
 // The naming scheme for BGP data is as follows:
 // https://data.ris.ripe.net/rrcXX/YYYY.MM/TYPE.YYYYMMDD.HHmm.gz
+// Month directories that can't be listed are skipped, and returned in an
+// IncompleteFindError along with the rest of the dumps.
 func (f *RISFinder) Find(query Query) ([]BGPDump, error) {
 	var results []BGPDump
+	var unlisted []DirError
 	var allowedPrefixes []string
 
 	if query.DumpType == DumpTypeRibs || query.DumpType == DumpTypeAny {
@@ -120,6 +139,13 @@ func (f *RISFinder) Find(query Query) ([]BGPDump, error) {
 				dumps, err := f.scrapeFilesFromDir(finalDir, allowedPrefixes, collector, query)
 				if err != nil {
 					fmt.Printf("Warning: failed to process %s: %v\n", finalDir, err)
+					unlisted = append(unlisted, DirError{
+						Dir:       finalDir,
+						Collector: collector,
+						DumpType:  query.DumpType,
+						Window:    Interval{From: date, Until: date.AddDate(0, 1, 0)},
+						Err:       err,
+					})
 					continue
 				}
 				results = append(results, dumps...)
@@ -127,7 +153,7 @@ func (f *RISFinder) Find(query Query) ([]BGPDump, error) {
 			}
 		}
 	}
-	return results, nil
+	return results, incompleteFindError(unlisted)
 }
 
 // scrapeFilesFromDir
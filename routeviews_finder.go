@@ -69,6 +69,22 @@ func NewRouteViewsFinder() *RouteViewsFinder {
 	return f
 }
 
+// RefreshCollectors reloads the collector list from the archive.
+func (f *RouteViewsFinder) RefreshCollectors() error {
+	c, err := f.getCollectors()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		if f.collectors == nil {
+			f.collectorsErr = err
+		}
+		return err
+	}
+	f.collectors = c
+	f.collectorsErr = nil
+	return nil
+}
+
 // Projects Retrieves a list of supported projects
 func (f *RouteViewsFinder) Projects() ([]Project, error) {
 	return []Project{RouteviewsProject}, nil
@@ -155,9 +171,12 @@ func (f *RouteViewsFinder) getCollectorURL(collector Collector) string {
 	return RouteviewsArchiveUrl + collector.Name + "/bgpdata/"
 }
 
-// Find BGP dumps matching the specified query
+// Find BGP dumps matching the specified query. Month directories that can't
+// be listed are skipped, and returned in an IncompleteFindError along with
+// the rest of the dumps.
 func (f *RouteViewsFinder) Find(query Query) ([]BGPDump, error) {
 	var results []BGPDump
+	var unlisted []DirError
 	var allowedPrefixes []string
 
 	if query.DumpType == DumpTypeRibs || query.DumpType == DumpTypeAny {
@@ -196,6 +215,13 @@ func (f *RouteViewsFinder) Find(query Query) ([]BGPDump, error) {
 					dumps, err := f.scrapeFilesFromDir(finalDir, prefix, collector, query)
 					if err != nil {
 						fmt.Printf("Warning: failed to process %s: %v\n", finalDir, err)
+						unlisted = append(unlisted, DirError{
+							Dir:       finalDir,
+							Collector: collector,
+							DumpType:  f.getDumpTypeFromPrefix(prefix),
+							Window:    Interval{From: date, Until: date.AddDate(0, 1, 0)},
+							Err:       err,
+						})
 						continue
 					}
 					results = append(results, dumps...)
@@ -203,7 +229,7 @@ func (f *RouteViewsFinder) Find(query Query) ([]BGPDump, error) {
 			}
 		}
 	}
-	return results, nil
+	return results, incompleteFindError(unlisted)
 }
 
 func (f *RouteViewsFinder) scrapeFilesFromDir(dir string, prefix string, collector Collector, query Query) ([]BGPDump, error) {
@@ -2,21 +2,22 @@ package bgpfinder
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/alistairking/bgpfinder/internal/logging"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/alistairking/bgpfinder/internal/metrics"
 )
 
 // StartPeriodicScraping starts a goroutine that periodically calls UpdateCollectorsData.
 // interval defines how often to update the database with fresh data.
-func StartPeriodicScraping(ctx context.Context, logger *logging.Logger, interval time.Duration, db *pgxpool.Pool, finder Finder) {
+func StartPeriodicScraping(ctx context.Context, logger *logging.Logger, interval time.Duration, store Store, finder Finder, leaser *Leaser) {
 	ticker := time.NewTicker(interval)
 	go func() {
 		// Run once immediately before waiting for the ticker
 		logger.Info().Msg("Starting initial collectors data update")
-		err := UpdateCollectorsData(ctx, logger, db, finder)
+		err := UpdateCollectorsData(ctx, logger, store, finder, leaser)
 		if err != nil {
 			logger.Error().Err(err).Msg("Failed to update collectors data on initial run")
 		} else {
@@ -27,7 +28,7 @@ func StartPeriodicScraping(ctx context.Context, logger *logging.Logger, interval
 			select {
 			case <-ticker.C:
 				logger.Info().Msg("Starting periodic collectors data update")
-				err := UpdateCollectorsData(ctx, logger, db, finder)
+				err := UpdateCollectorsData(ctx, logger, store, finder, leaser)
 				if err != nil {
 					logger.Error().Err(err).Msg("Failed to update collectors data")
 				} else {
@@ -43,62 +44,194 @@ func StartPeriodicScraping(ctx context.Context, logger *logging.Logger, interval
 }
 
 // UpdateCollectorsData fetches projects and their collectors, then finds BGP dumps and upserts them into the DB.
-func UpdateCollectorsData(ctx context.Context, logger *logging.Logger, db *pgxpool.Pool, finder Finder) error {
+// Collectors that another replica holds the lease on are skipped.
+func UpdateCollectorsData(ctx context.Context, logger *logging.Logger, store Store, finder Finder, leaser *Leaser) error {
 	projects, err := finder.Projects()
 	if err != nil {
 		return fmt.Errorf("failed to get projects: %w", err)
 	}
 
 	for _, project := range projects {
-		collectors, err := finder.Collectors(project.Name)
-		if err != nil {
-			logger.Error().Err(err).Str("project", project.Name).Msg("Failed to get collectors")
-			continue
-		}
+		updateProjectData(ctx, logger, store, finder, leaser, project)
+	}
+	return nil
+}
 
-		logger.Info().
-			Str("project", project.Name).
-			Int("collector_count", len(collectors)).
-			Msg("Found collectors for project")
+// updateProjectData crawls the whole history of each of the project's
+// collectors, recording the run in the scrape history.
+func updateProjectData(ctx context.Context, logger *logging.Logger, store Store, finder Finder, leaser *Leaser, project Project) {
+	run := NewScrapeRun(ScrapeRunFull, project.Name, DumpTypeAny)
+	StartScrapeRun(ctx, logger, store, run)
+	defer FinishScrapeRun(ctx, logger, store, run)
+
+	collectors, err := finder.Collectors(project.Name)
+	if err != nil {
+		logger.Error().Err(err).Str("project", project.Name).Msg("Failed to get collectors")
+		run.RecordError(fmt.Errorf("failed to get collectors: %w", err))
+		return
+	}
+
+	logger.Info().
+		Str("project", project.Name).
+		Int("collector_count", len(collectors)).
+		Msg("Found collectors for project")
 
-		if err := UpsertCollectors(ctx, logger, db, collectors, DumpTypeAny, time.Now()); err != nil {
-			logger.Error().Err(err).Str("project", project.Name).Msg("Failed to upsert collectors")
+	if err := store.UpsertCollectors(ctx, collectors, DumpTypeAny, time.Now()); err != nil {
+		logger.Error().Err(err).Str("project", project.Name).Msg("Failed to upsert collectors")
+		run.RecordError(fmt.Errorf("failed to upsert collectors: %w", err))
+		return
+	}
+
+	// For each collector, find BGP dumps
+	for _, collector := range collectors {
+		window := Interval{
+			From:  time.Unix(0, 0),             // Start from Unix epoch (1970-01-01)
+			Until: time.Now().AddDate(0, 0, 1), // Until tomorrow (to ensure we get today's data)
+		}
+		// Failures shouldn't stop the other collectors
+		var dumps []BGPDump
+		var stats UpsertStats
+		err := leaser.WithLease(ctx, collector, DumpTypeAny, func(ctx context.Context) error {
+			var err error
+			dumps, stats, err = CrawlCollector(ctx, logger, store, finder, collector, DumpTypeAny, window)
+			return err
+		})
+		if errors.Is(err, ErrLeaseHeld) {
+			logger.Info().Str("collector", collector.Name).Msg("Collector is being scraped by another replica, skipping")
 			continue
 		}
+		run.RecordCollector(collector.Name, len(dumps), stats, 0, err)
+	}
+	metrics.ScrapeDuration.WithLabelValues(project.Name, DumpTypeAny.String()).Observe(time.Since(run.Started).Seconds())
+}
 
-		// For each collector, find BGP dumps
-		for _, collector := range collectors {
-			logger.Info().Str("collector", collector.Name).Msg("Starting to scrape collector data")
+// CrawlCollector finds the collector's dumps of the given type in the window
+// and upserts them. Stored dumps that the crawl no longer found are then
+// reconciled, and the settled part of the window is recorded as crawled. It
+// returns the dumps that were found and how upserting them went.
+//
+// If the finder couldn't list some of the archive's directories, what was
+// found is still upserted, but only the directories that were listed are
+// reconciled and recorded as crawled, and an IncompleteFindError is
+// returned.
+func CrawlCollector(ctx context.Context, logger *logging.Logger, store Store, finder Finder, collector Collector, dumpType DumpType, window Interval) ([]BGPDump, UpsertStats, error) {
+	logger.Info().Str("collector", collector.Name).Msg("Starting to scrape collector data")
 
-			query := Query{
-				Collectors: []Collector{collector},
-				DumpType:   DumpTypeAny,
-				From:       time.Unix(0, 0),             // Start from Unix epoch (1970-01-01)
-				Until:      time.Now().AddDate(0, 0, 1), // Until tomorrow (to ensure we get today's data)
-			}
+	crawlStart := time.Now()
+	query := Query{
+		Collectors: []Collector{collector},
+		DumpType:   dumpType,
+		From:       window.From,
+		Until:      window.Until,
+	}
 
-			dumps, err := finder.Find(query)
-			if err != nil {
-				logger.Error().
-					Err(err).
-					Str("collector", collector.Name).
-					Msg("Finder.Find failed")
-				continue
-			}
+	dumps, findErr := finder.Find(query)
+	var incomplete *IncompleteFindError
+	if findErr != nil && !errors.As(findErr, &incomplete) {
+		logger.Error().
+			Err(findErr).
+			Str("collector", collector.Name).
+			Msg("Finder.Find failed")
+		return nil, UpsertStats{}, fmt.Errorf("failed to find dumps for %s: %w", collector, findErr)
+	}
+	if incomplete != nil {
+		logger.Warn().
+			Err(findErr).
+			Str("collector", collector.Name).
+			Msg("Finder couldn't list all of the window, only crawling the rest")
+	}
+
+	logger.Info().
+		Str("collector", collector.Name).
+		Int("dumps_found", len(dumps)).
+		Msg("Found BGP dumps for collector")
 
-			logger.Info().
-				Str("collector", collector.Name).
-				Int("dumps_found", len(dumps)).
-				Msg("Found BGP dumps for collector")
+	stats, err := store.UpsertDumps(ctx, dumps)
+	if err != nil {
+		logger.Error().
+			Err(err).
+			Str("collector", collector.Name).
+			Msg("Failed to upsert dumps")
+		return dumps, stats, fmt.Errorf("failed to upsert dumps for %s: %w", collector, err)
+	}
+	logger.Info().
+		Str("collector", collector.Name).
+		Int("inserted", stats.Inserted).
+		Int("updated", stats.Updated).
+		Int("unchanged", stats.Unchanged).
+		Msg("Upserted BGP dumps for collector")
+	RecordScrapeMetrics(collector, dumps, stats)
 
-			if err := UpsertBGPDumps(ctx, logger, db, dumps); err != nil {
+	// Only the settled part of the window is known to be complete
+	settled := window
+	if horizon := crawlStart.Add(-DefaultSettleDelay); settled.Until.After(horizon) {
+		settled.Until = horizon
+	}
+	for _, dt := range concreteDumpTypes(dumpType) {
+		var unlisted []Interval
+		if incomplete != nil {
+			unlisted = incomplete.Unlisted(collector, dt, window)
+		}
+		for _, listed := range subtractIntervals(window, unlisted) {
+			ReconcileCrawl(ctx, logger, store, collector, dt, listed, dumps)
+		}
+		if settled.Empty() {
+			continue
+		}
+		for _, crawled := range subtractIntervals(settled, unlisted) {
+			if err := store.UpsertCrawlCoverage(ctx, collector, dt, crawled); err != nil {
 				logger.Error().
 					Err(err).
 					Str("collector", collector.Name).
-					Msg("Failed to upsert dumps")
-				continue
+					Msg("Failed to record crawl coverage")
 			}
 		}
 	}
-	return nil
+	if incomplete != nil {
+		return dumps, stats, fmt.Errorf("failed to find all dumps for %s: %w", collector, findErr)
+	}
+	return dumps, stats, nil
+}
+
+// RecordScrapeMetrics exports the outcome of scraping a collector: the dumps
+// that were found, how upserting them went, and the newest of them.
+func RecordScrapeMetrics(collector Collector, dumps []BGPDump, stats UpsertStats) {
+	project := collector.Project.Name
+	metrics.DumpsDiscovered.WithLabelValues(project, collector.Name).Add(float64(len(dumps)))
+	metrics.DumpsUpserted.WithLabelValues(project, collector.Name, "inserted").Add(float64(stats.Inserted))
+	metrics.DumpsUpserted.WithLabelValues(project, collector.Name, "updated").Add(float64(stats.Updated))
+	metrics.DumpsUpserted.WithLabelValues(project, collector.Name, "unchanged").Add(float64(stats.Unchanged))
+	for _, d := range dumps {
+		metrics.ObserveNewestDump(project, collector.Name, d.DumpType.String(), time.Unix(d.Timestamp, 0))
+	}
+}
+
+// ReconcileCrawl tombstones stored dumps that the crawl of the window no
+// longer found, and restores any that came back. The window must have been
+// listed in full. An empty crawl is more likely to be an archive problem
+// than a mass deletion, so it's ignored.
+func ReconcileCrawl(ctx context.Context, logger *logging.Logger, store Store, collector Collector, dumpType DumpType, window Interval, found []BGPDump) {
+	if len(found) == 0 {
+		logger.Warn().
+			Str("collector", collector.Name).
+			Str("window", window.String()).
+			Msg("Crawl found no dumps, not reconciling")
+		return
+	}
+	stats, err := store.ReconcileDumps(ctx, collector, dumpType, window, found)
+	if err != nil {
+		logger.Error().
+			Err(err).
+			Str("collector", collector.Name).
+			Msg("Failed to reconcile dumps")
+		return
+	}
+	if stats.Removed > 0 || stats.Restored > 0 {
+		logger.Info().
+			Str("collector", collector.Name).
+			Str("window", window.String()).
+			Int("removed", stats.Removed).
+			Int("restored", stats.Restored).
+			Msg("Reconciled dumps with the archive")
+	}
 }
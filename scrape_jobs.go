@@ -0,0 +1,289 @@
+package bgpfinder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+// DefaultScrapeJobHistory is how many finished scrape jobs are remembered.
+const DefaultScrapeJobHistory = 100
+
+var (
+	ErrScrapeJobNotFound = errors.New("scrape job not found")
+	ErrScrapeJobFinished = errors.New("scrape job already finished")
+)
+
+type ScrapeJobState string
+
+const (
+	ScrapeJobQueued    ScrapeJobState = "queued"
+	ScrapeJobRunning   ScrapeJobState = "running"
+	ScrapeJobSucceeded ScrapeJobState = "succeeded"
+	ScrapeJobFailed    ScrapeJobState = "failed"
+	ScrapeJobCanceled  ScrapeJobState = "canceled"
+)
+
+// Finished reports whether a job in this state will never run again.
+func (s ScrapeJobState) Finished() bool {
+	return s == ScrapeJobSucceeded || s == ScrapeJobFailed || s == ScrapeJobCanceled
+}
+
+// ScrapeRequest asks for the dumps of the given type in the window to be
+// re-crawled for each of the collectors.
+type ScrapeRequest struct {
+	Collectors []Collector `json:"collectors"`
+	DumpType   DumpType    `json:"type"`
+	Window     Interval    `json:"window"`
+}
+
+// ScrapeProgress counts what a scrape job has done so far.
+type ScrapeProgress struct {
+	CollectorsDone  int         `json:"collectorsDone"`
+	CollectorsTotal int         `json:"collectorsTotal"`
+	DumpsFound      int         `json:"dumpsFound"`
+	Upserted        UpsertStats `json:"upserted"`
+}
+
+// ScrapeJob is a snapshot of a requested scrape.
+type ScrapeJob struct {
+	ID int64 `json:"id"`
+	ScrapeRequest
+
+	State    ScrapeJobState `json:"state"`
+	Created  time.Time      `json:"created"`
+	Started  *time.Time     `json:"started,omitempty"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Progress ScrapeProgress `json:"progress"`
+
+	// Errors has an entry for each collector that failed to scrape
+	Errors []string `json:"errors"`
+}
+
+type scrapeJob struct {
+	ScrapeJob
+	cancel context.CancelFunc
+}
+
+// ScrapeJobs runs requested scrapes one at a time, in the order they were
+// requested, and keeps track of the running, queued and recently finished
+// ones.
+type ScrapeJobs struct {
+	logger *logging.Logger
+	store  Store
+	finder Finder
+	leaser *Leaser
+
+	mu     sync.Mutex
+	nextID int64
+	jobs   []*scrapeJob // oldest first
+	wake   chan struct{}
+}
+
+// NewScrapeJobs returns a job queue that scrapes into the store. Each
+// collector is scraped under a lease from leaser, if it's set, so that jobs
+// don't race the scrapers.
+func NewScrapeJobs(logger *logging.Logger, store Store, finder Finder, leaser *Leaser) *ScrapeJobs {
+	return &ScrapeJobs{
+		logger: logger.ModuleLogger("ScrapeJobs"),
+		store:  store,
+		finder: finder,
+		leaser: leaser,
+		nextID: 1,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Start runs queued jobs in a goroutine until the context is canceled.
+func (s *ScrapeJobs) Start(ctx context.Context) {
+	go func() {
+		for {
+			job, jobCtx := s.next(ctx)
+			if job == nil {
+				select {
+				case <-s.wake:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			s.run(jobCtx, job)
+			job.cancel()
+		}
+	}()
+}
+
+// Enqueue queues a scrape, returning the new job.
+func (s *ScrapeJobs) Enqueue(req ScrapeRequest) ScrapeJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := &scrapeJob{ScrapeJob: ScrapeJob{
+		ID:            s.nextID,
+		ScrapeRequest: req,
+		State:         ScrapeJobQueued,
+		Created:       time.Now(),
+		Progress:      ScrapeProgress{CollectorsTotal: len(req.Collectors)},
+	}}
+	s.nextID++
+	s.jobs = append(s.jobs, job)
+	s.trim()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return job.snapshot()
+}
+
+// List returns the known jobs, newest first.
+func (s *ScrapeJobs) List() []ScrapeJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]ScrapeJob, 0, len(s.jobs))
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, s.jobs[i].snapshot())
+	}
+	return jobs
+}
+
+// Get returns the job with the given ID.
+func (s *ScrapeJobs) Get(id int64) (ScrapeJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.find(id)
+	if job == nil {
+		return ScrapeJob{}, ErrScrapeJobNotFound
+	}
+	return job.snapshot(), nil
+}
+
+// Cancel stops the job with the given ID. Queued jobs are canceled straight
+// away. Running jobs stop once the collector they're scraping is done.
+func (s *ScrapeJobs) Cancel(id int64) (ScrapeJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.find(id)
+	if job == nil {
+		return ScrapeJob{}, ErrScrapeJobNotFound
+	}
+	switch {
+	case job.State.Finished():
+		return job.snapshot(), ErrScrapeJobFinished
+	case job.State == ScrapeJobQueued:
+		s.finish(job, ScrapeJobCanceled)
+	default:
+		job.cancel()
+	}
+	return job.snapshot(), nil
+}
+
+// next marks the oldest queued job as running and returns it with the
+// context to run it in, or nil if there isn't one.
+func (s *ScrapeJobs) next(ctx context.Context) (*scrapeJob, context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.State == ScrapeJobQueued {
+			started := time.Now()
+			job.State = ScrapeJobRunning
+			job.Started = &started
+			jobCtx, cancel := context.WithCancel(ctx)
+			job.cancel = cancel
+			return job, jobCtx
+		}
+	}
+	return nil, nil
+}
+
+// run scrapes each of the job's collectors in turn, recording progress as
+// it goes. Failed collectors, including ones that another scraper holds the
+// lease on, are recorded but don't stop the job.
+func (s *ScrapeJobs) run(ctx context.Context, job *scrapeJob) {
+	s.logger.Info().Int64("job", job.ID).Str("window", job.Window.String()).Msg("Starting scrape job")
+	for _, collector := range job.Collectors {
+		if ctx.Err() != nil {
+			break
+		}
+		var dumps []BGPDump
+		var stats UpsertStats
+		err := s.leaser.WithLease(ctx, collector, job.DumpType, func(ctx context.Context) error {
+			var err error
+			dumps, stats, err = CrawlCollector(ctx, s.logger, s.store, s.finder, collector, job.DumpType, job.Window)
+			return err
+		})
+		if errors.Is(err, ErrLeaseHeld) {
+			s.logger.Warn().Int64("job", job.ID).Str("collector", collector.Name).Msg("Collector is being scraped by another replica, skipping")
+			err = fmt.Errorf("%s: %w", collector, err)
+		}
+
+		s.mu.Lock()
+		job.Progress.CollectorsDone++
+		job.Progress.DumpsFound += len(dumps)
+		job.Progress.Upserted.Add(stats)
+		if err != nil {
+			job.Errors = append(job.Errors, err.Error())
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case ctx.Err() != nil:
+		s.finish(job, ScrapeJobCanceled)
+	case len(job.Errors) > 0:
+		s.finish(job, ScrapeJobFailed)
+	default:
+		s.finish(job, ScrapeJobSucceeded)
+	}
+	s.logger.Info().Int64("job", job.ID).Str("state", string(job.State)).Msg("Finished scrape job")
+}
+
+// finish must be called with the lock held.
+func (s *ScrapeJobs) finish(job *scrapeJob, state ScrapeJobState) {
+	finished := time.Now()
+	job.State = state
+	job.Finished = &finished
+}
+
+// trim forgets the oldest finished jobs beyond DefaultScrapeJobHistory. It
+// must be called with the lock held.
+func (s *ScrapeJobs) trim() {
+	finished := 0
+	for _, job := range s.jobs {
+		if job.State.Finished() {
+			finished++
+		}
+	}
+	kept := s.jobs[:0]
+	for _, job := range s.jobs {
+		if job.State.Finished() && finished > DefaultScrapeJobHistory {
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	s.jobs = kept
+}
+
+// find must be called with the lock held.
+func (s *ScrapeJobs) find(id int64) *scrapeJob {
+	for _, job := range s.jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// snapshot must be called with the lock held.
+func (j *scrapeJob) snapshot() ScrapeJob {
+	snap := j.ScrapeJob
+	snap.Errors = append([]string{}, j.Errors...)
+	return snap
+}
@@ -0,0 +1,119 @@
+package bgpfinder
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+func TestScrapeJobs(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestSQLiteStore(t)
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	finder := &sliceFinder{dumps: testUpdates(base, 24)}
+	jobs := NewScrapeJobs(logger, store, finder, nil)
+
+	// Queue two jobs and cancel the second before anything runs
+	req := ScrapeRequest{
+		Collectors: []Collector{testCollector},
+		DumpType:   DumpTypeUpdates,
+		Window:     Interval{base, base.Add(time.Hour)},
+	}
+	first := jobs.Enqueue(req)
+	second := jobs.Enqueue(req)
+	if first.State != ScrapeJobQueued || first.Progress.CollectorsTotal != 1 {
+		t.Errorf("Expected a queued job for 1 collector, got %+v", first)
+	}
+	if canceled, err := jobs.Cancel(second.ID); err != nil || canceled.State != ScrapeJobCanceled {
+		t.Errorf("Expected the queued job to be canceled, got %+v (%v)", canceled, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs.Start(ctx)
+
+	job, err := waitForScrapeJob(jobs, first.ID)
+	if err != nil || job.State != ScrapeJobSucceeded {
+		t.Fatalf("Expected the job to succeed, got %+v (%v)", job, err)
+	}
+	if job.Progress.CollectorsDone != 1 || job.Progress.DumpsFound != 12 || job.Progress.Upserted.Inserted != 12 {
+		t.Errorf("Expected 12 dumps found and inserted, got %+v", job.Progress)
+	}
+	if job.Started == nil || job.Finished == nil {
+		t.Errorf("Expected start and finish times, got %+v", job)
+	}
+
+	stored, err := store.FetchDumps(ctx, Query{
+		Collectors: []Collector{testCollector},
+		DumpType:   DumpTypeUpdates,
+		From:       base,
+		Until:      base.Add(24 * time.Hour),
+	}, FetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 12 {
+		t.Errorf("Expected the scraped window to be stored, got %d dumps", len(stored))
+	}
+
+	if _, err := jobs.Cancel(first.ID); !errors.Is(err, ErrScrapeJobFinished) {
+		t.Errorf("Expected canceling a finished job to fail, got %v", err)
+	}
+	if _, err := jobs.Get(42); !errors.Is(err, ErrScrapeJobNotFound) {
+		t.Errorf("Expected an unknown job to be missing, got %v", err)
+	}
+	if list := jobs.List(); len(list) != 2 || list[0].ID != second.ID {
+		t.Errorf("Expected both jobs, newest first, got %+v", list)
+	}
+}
+
+func TestScrapeJobsLeaseHeld(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestSQLiteStore(t)
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	finder := &sliceFinder{dumps: testUpdates(base, 12)}
+	jobs := NewScrapeJobs(logger, store, finder, NewLeaser(logger, store, "server", 0))
+
+	// A scraper replica is busy with the collector
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := NewLeaser(logger, store, "scraper", 0).Acquire(ctx, testCollector, DumpTypeAny); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := jobs.Enqueue(ScrapeRequest{
+		Collectors: []Collector{testCollector},
+		DumpType:   DumpTypeUpdates,
+		Window:     Interval{base, base.Add(time.Hour)},
+	})
+	jobs.Start(ctx)
+	job, err := waitForScrapeJob(jobs, queued.ID)
+	if err != nil || job.State != ScrapeJobFailed {
+		t.Fatalf("Expected the job to fail, got %+v (%v)", job, err)
+	}
+	if len(job.Errors) != 1 || !strings.Contains(job.Errors[0], ErrLeaseHeld.Error()) || len(finder.queries) != 0 {
+		t.Errorf("Expected the collector to be skipped as leased, got %v and %d queries", job.Errors, len(finder.queries))
+	}
+}
+
+// waitForScrapeJob waits (for up to 5s) for the job to finish, returning
+// its last snapshot.
+func waitForScrapeJob(jobs *ScrapeJobs, id int64) (ScrapeJob, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	job, err := jobs.Get(id)
+	for err == nil && !job.State.Finished() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		job, err = jobs.Get(id)
+	}
+	return job, err
+}
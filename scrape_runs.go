@@ -0,0 +1,207 @@
+package bgpfinder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+// Kinds of scrape run, recorded as the run's source.
+const (
+	// ScrapeRunFull is a crawl of the whole history of every collector, as
+	// done by UpdateCollectorsData
+	ScrapeRunFull = "full"
+
+	// ScrapeRunPeriodic is a crawl of the dumps published since the last
+	// run, as done by the periodic scraper
+	ScrapeRunPeriodic = "periodic"
+
+	// ScrapeRunBackfill is a recrawl of the windows that the tiered backfill
+	// found were due
+	ScrapeRunBackfill = "backfill"
+
+	// ScrapeRunRange is a one-off crawl of a range of history, as done by
+	// RunRangeBackfill
+	ScrapeRunRange = "range"
+)
+
+type ScrapeRunStatus string
+
+const (
+	ScrapeRunRunning   ScrapeRunStatus = "running"
+	ScrapeRunSucceeded ScrapeRunStatus = "succeeded"
+	ScrapeRunPartial   ScrapeRunStatus = "partial"
+	ScrapeRunFailed    ScrapeRunStatus = "failed"
+)
+
+// ScrapeRun is the history record of a scrape of one project's collectors.
+type ScrapeRun struct {
+	ID       int64           `json:"id"`
+	Source   string          `json:"source"`
+	Project  string          `json:"project"`
+	DumpType DumpType        `json:"type"`
+	Status   ScrapeRunStatus `json:"status"`
+	Started  time.Time       `json:"started"`
+	Finished *time.Time      `json:"finished,omitempty"`
+
+	CollectorsAttempted []string `json:"collectorsAttempted"`
+	CollectorsSucceeded []string `json:"collectorsSucceeded"`
+	DumpsFound          int      `json:"dumpsFound"`
+	DumpsInserted       int      `json:"dumpsInserted"`
+	Retries             int      `json:"retries"`
+	Errors              []string `json:"errors"`
+}
+
+// ScrapeRunFilter selects scrape runs from the history. Unset fields match
+// every run.
+type ScrapeRunFilter struct {
+	Project string
+
+	// Collector matches the runs that attempted to scrape the collector
+	Collector string
+
+	// DumpType matches runs of the type. DumpTypeAny matches all runs.
+	DumpType DumpType
+
+	// Succeeded only matches runs that succeeded. If Collector is set, it's
+	// enough for the run to have succeeded for that collector.
+	Succeeded bool
+
+	// Limit is the most runs to return. Unlimited if 0
+	Limit int
+}
+
+// NewScrapeRun starts the record of a scrape run.
+func NewScrapeRun(source, project string, dumpType DumpType) *ScrapeRun {
+	return &ScrapeRun{
+		Source:              source,
+		Project:             project,
+		DumpType:            dumpType,
+		Status:              ScrapeRunRunning,
+		Started:             time.Now(),
+		CollectorsAttempted: []string{},
+		CollectorsSucceeded: []string{},
+		Errors:              []string{},
+	}
+}
+
+// RecordCollector adds the outcome of scraping a collector to the run.
+func (r *ScrapeRun) RecordCollector(collector string, found int, stats UpsertStats, retries int, err error) {
+	r.CollectorsAttempted = append(r.CollectorsAttempted, collector)
+	r.DumpsFound += found
+	r.DumpsInserted += stats.Inserted
+	r.Retries += retries
+	if err != nil {
+		r.Errors = append(r.Errors, collector+": "+err.Error())
+	} else {
+		r.CollectorsSucceeded = append(r.CollectorsSucceeded, collector)
+	}
+}
+
+// RecordError adds an error that isn't specific to a collector to the run.
+func (r *ScrapeRun) RecordError(err error) {
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// Finish sets the finish time of the run and works out its status: failed
+// if nothing succeeded, partial if there were any errors.
+func (r *ScrapeRun) Finish() {
+	finished := time.Now()
+	r.Finished = &finished
+	switch {
+	case len(r.CollectorsSucceeded) == 0 && (len(r.Errors) > 0 || len(r.CollectorsAttempted) > 0):
+		r.Status = ScrapeRunFailed
+	case len(r.Errors) > 0:
+		r.Status = ScrapeRunPartial
+	default:
+		r.Status = ScrapeRunSucceeded
+	}
+}
+
+// StartScrapeRun records the start of the run in the store. Failures are
+// only logged, since scraping shouldn't stop for want of a history.
+func StartScrapeRun(ctx context.Context, logger *logging.Logger, store Store, run *ScrapeRun) {
+	if err := store.InsertScrapeRun(ctx, run); err != nil {
+		logger.Error().Err(err).Str("project", run.Project).Msg("Failed to record scrape run start")
+	}
+}
+
+// FinishScrapeRun finishes the run and records its outcome in the store.
+// The outcome is still recorded if the context has been canceled (e.g., the
+// scraper is shutting down), since why a run stopped is worth knowing.
+func FinishScrapeRun(ctx context.Context, logger *logging.Logger, store Store, run *ScrapeRun) {
+	run.Finish()
+	ctx = context.WithoutCancel(ctx)
+	var err error
+	if run.ID == 0 {
+		// The start was never recorded
+		err = store.InsertScrapeRun(ctx, run)
+	} else {
+		err = store.UpdateScrapeRun(ctx, *run)
+	}
+	if err != nil {
+		logger.Error().Err(err).Str("project", run.Project).Msg("Failed to record scrape run")
+		return
+	}
+	logger.Info().
+		Int64("run", run.ID).
+		Str("project", run.Project).
+		Str("dump_type", run.DumpType.String()).
+		Str("status", string(run.Status)).
+		Dur("runtime", run.Finished.Sub(run.Started)).
+		Msg("Recorded scrape run")
+}
+
+// scrapeRunConditions builds the WHERE clause (and its arguments) for the
+// filter. contains returns the dialect's condition for a list column
+// containing the given placeholder.
+func scrapeRunConditions(filter ScrapeRunFilter, contains func(column, placeholder string) string) (string, []interface{}) {
+	conditions := []string{"TRUE"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.Project != "" {
+		conditions = append(conditions, "project_name = "+arg(filter.Project))
+	}
+	if filter.DumpType != DumpTypeAny {
+		conditions = append(conditions, "dump_type = "+arg(int16(filter.DumpType)))
+	}
+	switch {
+	case filter.Collector != "" && filter.Succeeded:
+		conditions = append(conditions, contains("collectors_succeeded", arg(filter.Collector)))
+	case filter.Collector != "":
+		conditions = append(conditions, contains("collectors_attempted", arg(filter.Collector)))
+	case filter.Succeeded:
+		conditions = append(conditions, "status = "+arg(string(ScrapeRunSucceeded)))
+	}
+
+	clause := strings.Join(conditions, " AND ") + " ORDER BY started DESC, scrape_run_id DESC"
+	if filter.Limit > 0 {
+		clause += " LIMIT " + arg(filter.Limit)
+	}
+	return clause, args
+}
+
+// unixOrNil converts an optional time to seconds since the epoch.
+func unixOrNil(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	ts := t.Unix()
+	return &ts
+}
+
+// timeOrNil converts optional seconds since the epoch to a time.
+func timeOrNil(ts *int64) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := time.Unix(*ts, 0)
+	return &t
+}
@@ -0,0 +1,970 @@
+package bgpfinder
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/alistairking/bgpfinder/migrations"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMaxConns is how many connections a file-backed SQLiteStore opens.
+// Writers still take turns, but in WAL mode readers (such as a long
+// StreamDumps) don't hold them up.
+const sqliteMaxConns = 8
+
+const sqliteSchemaVersionTable = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)
+`
+
+// SQLiteStore is a Store backed by an embedded SQLite database file. It's
+// meant for small deployments (e.g., a sidecar next to bgpstream) that don't
+// want to run Postgres.
+type SQLiteStore struct {
+	db     *sql.DB
+	logger *logging.Logger
+}
+
+// OpenSQLiteStore opens (creating if needed) the SQLite database at path.
+// The schema is managed by the migrations package, so a new database needs
+// MigrateUp before it can be used.
+func OpenSQLiteStore(ctx context.Context, logger *logging.Logger, path string) (*SQLiteStore, error) {
+	// Writers take the lock up front so that a transaction that reads
+	// before it writes can't deadlock with another process. SQLite only
+	// enforces foreign keys when asked to.
+	dsn := "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// An in-memory database only exists for the lifetime of its
+	// connection, so it can only have the one.
+	if path == ":memory:" {
+		db.SetMaxOpenConns(1)
+	} else {
+		db.SetMaxOpenConns(sqliteMaxConns)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	logger.Info().Str("path", path).Msg("Opened SQLite database")
+	return &SQLiteStore{
+		db:     db,
+		logger: logger.ModuleLogger("SQLiteStore"),
+	}, nil
+}
+
+// DB returns the underlying database handle.
+func (s *SQLiteStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLiteStore) UpsertCollectors(ctx context.Context, collectors []Collector, dumpType DumpType, crawlTime time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to begin transaction for UpsertCollectors")
+		return err
+	}
+	defer tx.Rollback()
+
+	var crawlFields []string
+	switch dumpType {
+	case DumpTypeRibs:
+		crawlFields = []string{"last_completed_crawl_time_ribs"}
+	case DumpTypeUpdates:
+		crawlFields = []string{"last_completed_crawl_time_updates"}
+	case DumpTypeAny:
+		crawlFields = []string{"last_completed_crawl_time_ribs", "last_completed_crawl_time_updates"}
+	}
+	crawlValues := make([]string, len(crawlFields))
+	crawlUpdates := make([]string, len(crawlFields))
+	for i, f := range crawlFields {
+		crawlValues[i] = "$4"
+		crawlUpdates[i] = f + " = excluded." + f
+	}
+
+	stmt := `
+		INSERT INTO collectors (name, project_name, cdate, mdate, most_recent_file_timestamp, ` + strings.Join(crawlFields, ", ") + `)
+		VALUES ($1, $2, $3, $3, COALESCE((SELECT max(timestamp) FROM bgp_dumps WHERE project_name = $2 AND collector_name = $1), 0), ` + strings.Join(crawlValues, ", ") + `)
+		ON CONFLICT (project_name, name) DO UPDATE
+		SET mdate = excluded.mdate,
+			most_recent_file_timestamp = excluded.most_recent_file_timestamp,
+			retired_at = NULL,
+			` + strings.Join(crawlUpdates, ",\n\t\t\t")
+
+	now := time.Now().Unix()
+	s.logger.Info().Int("collector_count", len(collectors)).Msg("Upserting collectors into DB")
+	for _, c := range collectors {
+		if _, err := tx.ExecContext(ctx, stmt, c.Name, c.Project.Name, now, crawlTime.Unix()); err != nil {
+			s.logger.Error().Err(err).Str("collector", c.Name).Msg("Failed to execute upsert")
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to commit transaction for UpsertCollectors")
+		return err
+	}
+	return nil
+}
+
+func (s *SQLiteStore) UpsertDumps(ctx context.Context, dumps []BGPDump) (UpsertStats, error) {
+	const batchSize = 10000
+
+	// Unchanged rows are skipped by the WHERE clause and so return nothing.
+	// Updated rows keep their id, so anything above the batch's starting
+	// max id was inserted.
+	stmt := `
+		INSERT INTO bgp_dumps (project_name, collector_name, url, dump_type, duration, timestamp, cdate, mdate)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+		ON CONFLICT (project_name, collector_name, url) DO UPDATE
+		SET dump_type = excluded.dump_type,
+			duration = excluded.duration,
+			timestamp = excluded.timestamp,
+			mdate = excluded.mdate
+		WHERE bgp_dumps.dump_type != excluded.dump_type
+			OR bgp_dumps.duration != excluded.duration
+			OR bgp_dumps.timestamp != excluded.timestamp
+		RETURNING bgp_dump_id
+	`
+
+	var stats UpsertStats
+	if err := checkDumpDurations(dumps); err != nil {
+		return stats, err
+	}
+	dumps = dedupeDumps(dumps)
+	for start := 0; start < len(dumps); start += batchSize {
+		end := start + batchSize
+		if end > len(dumps) {
+			end = len(dumps)
+		}
+
+		batchStats, err := s.upsertDumpsBatch(ctx, stmt, dumps[start:end])
+		if err != nil {
+			return stats, err
+		}
+		stats.Add(batchStats)
+		s.logger.Debug().
+			Int("batch_start", start).
+			Int("batch_end", end).
+			Int("inserted", batchStats.Inserted).
+			Int("updated", batchStats.Updated).
+			Int("unchanged", batchStats.Unchanged).
+			Msg("Committed BGP dumps batch")
+	}
+	return stats, nil
+}
+
+func (s *SQLiteStore) InsertCollectors(ctx context.Context, collectors []Collector) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to begin transaction for InsertCollectors")
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.insertCollectors(ctx, tx, collectors, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertCollectors adds a record for each of the collectors that isn't
+// already stored. Nothing is known to have been crawled for them.
+func (s *SQLiteStore) insertCollectors(ctx context.Context, tx *sql.Tx, collectors []Collector, now int64) error {
+	for _, c := range collectors {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO collectors (project_name, name, cdate, mdate)
+			VALUES ($1, $2, $3, $3)
+			ON CONFLICT (project_name, name) DO NOTHING
+		`, c.Project.Name, c.Name, now)
+		if err != nil {
+			s.logger.Error().Err(err).Str("collector", c.Name).Msg("Failed to insert collector")
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) upsertDumpsBatch(ctx context.Context, stmt string, dumps []BGPDump) (UpsertStats, error) {
+	var stats UpsertStats
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to begin transaction for UpsertDumps batch")
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	// Dumps must belong to a known collector
+	now := time.Now().Unix()
+	if err := s.insertCollectors(ctx, tx, dumpCollectors(dumps), now); err != nil {
+		return stats, err
+	}
+
+	var maxID int64
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(bgp_dump_id), 0) FROM bgp_dumps`).Scan(&maxID); err != nil {
+		return stats, err
+	}
+
+	prepared, err := tx.PrepareContext(ctx, stmt)
+	if err != nil {
+		return stats, err
+	}
+	defer prepared.Close()
+
+	for _, d := range dumps {
+		var id int64
+		err := prepared.QueryRowContext(ctx, d.Collector.Project.Name, d.Collector.Name, d.URL, int16(d.DumpType), durationSeconds(d.Duration), d.Timestamp, now).Scan(&id)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			stats.Unchanged++
+		case err != nil:
+			s.logger.Error().Err(err).Str("collector", d.Collector.Name).Str("url", d.URL).Msg("Failed to execute upsert for BGP dump")
+			return UpsertStats{}, err
+		case id > maxID:
+			stats.Inserted++
+		default:
+			stats.Updated++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to commit transaction for UpsertDumps batch")
+		return UpsertStats{}, err
+	}
+	return stats, nil
+}
+
+func (s *SQLiteStore) FetchDumps(ctx context.Context, query Query, opts FetchOptions) ([]BGPDump, error) {
+	var results []BGPDump
+	err := s.StreamDumps(ctx, query, opts, func(d BGPDump) error {
+		results = append(results, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *SQLiteStore) StreamDumps(ctx context.Context, query Query, opts FetchOptions, fn func(BGPDump) error) error {
+	if len(query.Collectors) == 0 {
+		return nil
+	}
+
+	// See FetchDataFromDB for why the earliest start time is needed
+	earliest := query.From.Add(-time.Duration(MaxDumpDuration))
+	args := []interface{}{query.From.Unix(), query.Until.Unix(), earliest.Unix()}
+	placeholders := make([]string, len(query.Collectors))
+	for i, c := range query.Collectors {
+		args = append(args, c.Project.Name, c.Name)
+		placeholders[i] = fmt.Sprintf("($%d, $%d)", len(args)-1, len(args))
+	}
+
+	sqlQuery := `
+		SELECT d.url, d.dump_type, d.duration, d.collector_name, d.project_name, d.timestamp, COALESCE(d.removed_at, 0)
+		FROM bgp_dumps d
+		WHERE (d.project_name, d.collector_name) IN (VALUES ` + strings.Join(placeholders, ", ") + `)
+		AND d.timestamp >= $3
+		AND d.timestamp + d.duration >= $1
+		AND d.timestamp <= $2
+	`
+	if query.DumpType != DumpTypeAny {
+		args = append(args, int16(query.DumpType))
+		sqlQuery += fmt.Sprintf(" AND d.dump_type = $%d", len(args))
+	}
+	if !opts.IncludeRemoved {
+		sqlQuery += " AND d.removed_at IS NULL"
+	}
+	if opts.After != nil {
+		args = append(args, opts.After.Timestamp, int16(opts.After.DumpType), opts.After.URL)
+		sqlQuery += fmt.Sprintf(" AND (d.timestamp, d.dump_type, d.url) > ($%d, $%d, $%d)", len(args)-2, len(args)-1, len(args))
+	}
+	sqlQuery += " ORDER BY d.timestamp ASC, d.dump_type ASC, d.url ASC"
+	if opts.Limit > 0 {
+		args = append(args, opts.Limit)
+		sqlQuery += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			url           string
+			dumpTypeInt   int16
+			duration      int64
+			collectorName string
+			projectName   string
+			timestamp     int64
+			removedAt     int64
+		)
+		if err := rows.Scan(&url, &dumpTypeInt, &duration, &collectorName, &projectName, &timestamp, &removedAt); err != nil {
+			return err
+		}
+		err := fn(BGPDump{
+			URL:       url,
+			DumpType:  DumpType(dumpTypeInt),
+			Duration:  DumpDuration(time.Duration(duration) * time.Second),
+			Collector: Collector{Project: Project{Name: projectName}, Name: collectorName},
+			Timestamp: timestamp,
+			RemovedAt: removedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ChangeFeedHorizon only applies the lag to the clock that stamps mdate,
+// since SQLite writes one transaction at a time and they're short.
+func (s *SQLiteStore) ChangeFeedHorizon(ctx context.Context) (time.Time, error) {
+	return time.Now().Add(-ChangeFeedLag), nil
+}
+
+func (s *SQLiteStore) FetchDumpChanges(ctx context.Context, query Query, since ChangeCursor, until time.Time, limit int, opts FetchOptions) ([]BGPDump, ChangeCursor, error) {
+	if len(query.Collectors) == 0 {
+		return nil, since, nil
+	}
+
+	// mdate is only kept in seconds here, but the cursor is in
+	// microseconds so that it works with either store.
+	earliest := query.From.Add(-time.Duration(MaxDumpDuration))
+	args := []interface{}{query.From.Unix(), query.Until.Unix(), earliest.Unix(), since.Modified, since.ID, until.Unix(), limit}
+	placeholders := make([]string, len(query.Collectors))
+	for i, c := range query.Collectors {
+		args = append(args, c.Project.Name, c.Name)
+		placeholders[i] = fmt.Sprintf("($%d, $%d)", len(args)-1, len(args))
+	}
+
+	sqlQuery := `
+		SELECT d.url, d.dump_type, d.duration, d.collector_name, d.project_name, d.timestamp, COALESCE(d.removed_at, 0),
+			d.mdate, d.bgp_dump_id
+		FROM bgp_dumps d
+		WHERE (d.project_name, d.collector_name) IN (VALUES ` + strings.Join(placeholders, ", ") + `)
+		AND d.timestamp >= $3
+		AND d.timestamp + d.duration >= $1
+		AND d.timestamp <= $2
+		AND (d.mdate * 1000000, d.bgp_dump_id) > ($4, $5)
+		AND d.mdate <= $6
+	`
+	if query.DumpType != DumpTypeAny {
+		args = append(args, int16(query.DumpType))
+		sqlQuery += fmt.Sprintf(" AND d.dump_type = $%d", len(args))
+	}
+	if !opts.IncludeRemoved {
+		sqlQuery += " AND d.removed_at IS NULL"
+	}
+	sqlQuery += " ORDER BY d.mdate ASC, d.bgp_dump_id ASC LIMIT $7"
+
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, since, err
+	}
+	defer rows.Close()
+
+	var results []BGPDump
+	next := since
+	for rows.Next() {
+		var (
+			url           string
+			dumpTypeInt   int16
+			duration      int64
+			collectorName string
+			projectName   string
+			timestamp     int64
+			removedAt     int64
+			mdate         int64
+		)
+		if err := rows.Scan(&url, &dumpTypeInt, &duration, &collectorName, &projectName, &timestamp, &removedAt, &mdate, &next.ID); err != nil {
+			return nil, since, err
+		}
+		next.Modified = time.Unix(mdate, 0).UnixMicro()
+		results = append(results, BGPDump{
+			URL:       url,
+			DumpType:  DumpType(dumpTypeInt),
+			Duration:  DumpDuration(time.Duration(duration) * time.Second),
+			Collector: Collector{Project: Project{Name: projectName}, Name: collectorName},
+			Timestamp: timestamp,
+			RemovedAt: removedAt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, since, err
+	}
+	return results, next, nil
+}
+
+func (s *SQLiteStore) ReconcileDumps(ctx context.Context, collector Collector, dumpType DumpType, window Interval, found []BGPDump) (ReconcileStats, error) {
+	// The found URLs are passed as a JSON array to avoid building a huge
+	// list of placeholders.
+	urls := make([]string, len(found))
+	for i, d := range found {
+		urls[i] = d.URL
+	}
+	urlsJSON, err := json.Marshal(urls)
+	if err != nil {
+		return ReconcileStats{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to begin transaction for ReconcileDumps")
+		return ReconcileStats{}, err
+	}
+	defer tx.Rollback()
+
+	var stats ReconcileStats
+	now := time.Now().Unix()
+	for _, dt := range concreteDumpTypes(dumpType) {
+		args := []any{collector.Project.Name, collector.Name, int16(dt), window.From.Unix(), window.Until.Unix(), string(urlsJSON), now}
+		res, err := tx.ExecContext(ctx, `
+			UPDATE bgp_dumps
+			SET removed_at = $7, mdate = $7
+			WHERE project_name = $1
+			AND collector_name = $2
+			AND dump_type = $3
+			AND timestamp >= $4
+			AND timestamp < $5
+			AND removed_at IS NULL
+			AND url NOT IN (SELECT value FROM json_each($6))
+		`, args...)
+		if err != nil {
+			return ReconcileStats{}, err
+		}
+		removed, err := res.RowsAffected()
+		if err != nil {
+			return ReconcileStats{}, err
+		}
+		res, err = tx.ExecContext(ctx, `
+			UPDATE bgp_dumps
+			SET removed_at = NULL, mdate = $7
+			WHERE project_name = $1
+			AND collector_name = $2
+			AND dump_type = $3
+			AND timestamp >= $4
+			AND timestamp < $5
+			AND removed_at IS NOT NULL
+			AND url IN (SELECT value FROM json_each($6))
+		`, args...)
+		if err != nil {
+			return ReconcileStats{}, err
+		}
+		restored, err := res.RowsAffected()
+		if err != nil {
+			return ReconcileStats{}, err
+		}
+		stats.Removed += int(removed)
+		stats.Restored += int(restored)
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to commit transaction for ReconcileDumps")
+		return ReconcileStats{}, err
+	}
+	return stats, nil
+}
+
+func (s *SQLiteStore) FetchProjects(ctx context.Context) ([]Project, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT project_name FROM collectors ORDER BY project_name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []Project
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		projects = append(projects, Project{Name: name})
+	}
+	return projects, rows.Err()
+}
+
+func (s *SQLiteStore) FetchCollectors(ctx context.Context, project string) ([]Collector, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name, project_name
+		FROM collectors
+		WHERE $1 = '' OR project_name = $1
+		ORDER BY project_name ASC, name ASC
+	`, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collectors []Collector
+	for rows.Next() {
+		var name, projectName string
+		if err := rows.Scan(&name, &projectName); err != nil {
+			return nil, err
+		}
+		collectors = append(collectors, Collector{
+			Project: Project{Name: projectName},
+			Name:    name,
+		})
+	}
+	return collectors, rows.Err()
+}
+
+func (s *SQLiteStore) RetireCollectors(ctx context.Context, collectors []Collector, at time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	retired := 0
+	for _, c := range collectors {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE collectors
+			SET retired_at = $3, mdate = $4
+			WHERE project_name = $1
+			AND name = $2
+			AND retired_at IS NULL
+		`, c.Project.Name, c.Name, at.Unix(), time.Now().Unix())
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		retired += int(n)
+	}
+	return retired, tx.Commit()
+}
+
+func (s *SQLiteStore) FetchRetiredCollectors(ctx context.Context, project string) (map[string]time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name, retired_at
+		FROM collectors
+		WHERE project_name = $1
+		AND retired_at IS NOT NULL
+	`, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retired := map[string]time.Time{}
+	for rows.Next() {
+		var name string
+		var at int64
+		if err := rows.Scan(&name, &at); err != nil {
+			return nil, err
+		}
+		retired[name] = time.Unix(at, 0)
+	}
+	return retired, rows.Err()
+}
+
+func (s *SQLiteStore) FetchLatestDumpTimes(ctx context.Context, project string, dumpType DumpType) (map[string]time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT collector_name, MAX(timestamp)
+		FROM bgp_dumps
+		WHERE project_name = $1
+		AND dump_type = $2
+		GROUP BY collector_name
+	`, project, int16(dumpType))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	latest := map[string]time.Time{}
+	for rows.Next() {
+		var collectorName string
+		var timestamp int64
+		if err := rows.Scan(&collectorName, &timestamp); err != nil {
+			return nil, err
+		}
+		latest[collectorName] = time.Unix(timestamp, 0)
+	}
+	return latest, rows.Err()
+}
+
+// EnsurePartitions is a no-op, since SQLite tables can't be partitioned.
+func (s *SQLiteStore) EnsurePartitions(ctx context.Context, from, until time.Time) error {
+	return nil
+}
+
+func (s *SQLiteStore) DeleteDumpsBefore(ctx context.Context, dumpType DumpType, before time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to begin transaction for DeleteDumpsBefore")
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	now := time.Now().Unix()
+	for _, dt := range concreteDumpTypes(dumpType) {
+		res, err := tx.ExecContext(ctx, `DELETE FROM bgp_dumps WHERE dump_type = $1 AND timestamp < $2`, int16(dt), before.Unix())
+		if err != nil {
+			return 0, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += rows
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM crawl_coverage WHERE dump_type = $1 AND until_time <= $2`, int16(dt), before.Unix())
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE crawl_coverage
+			SET from_time = $2, mdate = $3
+			WHERE dump_type = $1
+			AND from_time < $2
+		`, int16(dt), before.Unix(), now)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to commit transaction for DeleteDumpsBefore")
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (s *SQLiteStore) UpsertCrawlCoverage(ctx context.Context, collector Collector, dumpType DumpType, window Interval) error {
+	if dumpType == DumpTypeAny {
+		return fmt.Errorf("coverage must be recorded for a specific dump type")
+	}
+	if window.Empty() {
+		return nil
+	}
+
+	// Transactions take the write lock immediately (see _txlock), so there
+	// is no need for the advisory lock that the Postgres version uses.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to begin transaction for UpsertCrawlCoverage")
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM crawl_coverage
+		WHERE project_name = $1
+		AND collector_name = $2
+		AND dump_type = $3
+		AND from_time <= $5
+		AND until_time >= $4
+		RETURNING from_time, until_time
+	`, collector.Project.Name, collector.Name, int16(dumpType), window.From.Unix(), window.Until.Unix())
+	if err != nil {
+		return err
+	}
+	spans := []Interval{window}
+	for rows.Next() {
+		var from, until int64
+		if err := rows.Scan(&from, &until); err != nil {
+			rows.Close()
+			return err
+		}
+		spans = append(spans, Interval{From: time.Unix(from, 0), Until: time.Unix(until, 0)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	merged := mergeIntervals(spans)[0]
+	now := time.Now().Unix()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO crawl_coverage (project_name, collector_name, dump_type, from_time, until_time, cdate, mdate)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)
+	`, collector.Project.Name, collector.Name, int16(dumpType), merged.From.Unix(), merged.Until.Unix(), now)
+	if err != nil {
+		s.logger.Error().Err(err).Str("collector", collector.Name).Msg("Failed to insert crawl coverage")
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) FetchCrawlCoverage(ctx context.Context, collector Collector, dumpType DumpType, window Interval) ([]Interval, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT from_time, until_time
+		FROM crawl_coverage
+		WHERE project_name = $1
+		AND collector_name = $2
+		AND dump_type = $3
+		AND from_time < $5
+		AND until_time > $4
+		ORDER BY from_time ASC
+	`, collector.Project.Name, collector.Name, int16(dumpType), window.From.Unix(), window.Until.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spans []Interval
+	for rows.Next() {
+		var from, until int64
+		if err := rows.Scan(&from, &until); err != nil {
+			return nil, err
+		}
+		spans = append(spans, Interval{From: time.Unix(from, 0), Until: time.Unix(until, 0)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return clipIntervals(spans, window), nil
+}
+
+func (s *SQLiteStore) UpsertCrawlWindow(ctx context.Context, window CrawlWindow) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO crawl_windows (source, project_name, collector_name, dump_type, from_time, until_time, crawled, dumps_found)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (source, project_name, collector_name, dump_type, from_time, until_time)
+		DO UPDATE SET crawled = excluded.crawled, dumps_found = excluded.dumps_found
+	`, window.Source, window.Collector.Project.Name, window.Collector.Name, int16(window.DumpType),
+		window.Window.From.Unix(), window.Window.Until.Unix(), window.Crawled.Unix(), window.DumpsFound)
+	return err
+}
+
+func (s *SQLiteStore) FetchCrawlWindows(ctx context.Context, source string, collector Collector, dumpType DumpType) ([]CrawlWindow, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT from_time, until_time, crawled, dumps_found
+		FROM crawl_windows
+		WHERE source = $1
+		AND project_name = $2
+		AND collector_name = $3
+		AND dump_type = $4
+		ORDER BY from_time ASC
+	`, source, collector.Project.Name, collector.Name, int16(dumpType))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []CrawlWindow
+	for rows.Next() {
+		var from, until, crawled int64
+		w := CrawlWindow{Source: source, Collector: collector, DumpType: dumpType}
+		if err := rows.Scan(&from, &until, &crawled, &w.DumpsFound); err != nil {
+			return nil, err
+		}
+		w.Window = Interval{From: time.Unix(from, 0), Until: time.Unix(until, 0)}
+		w.Crawled = time.Unix(crawled, 0)
+		windows = append(windows, w)
+	}
+	return windows, rows.Err()
+}
+
+func (s *SQLiteStore) AcquireLease(ctx context.Context, collector Collector, dumpType DumpType, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	rows, err := s.db.QueryContext(ctx, `
+		INSERT INTO scrape_leases (project_name, collector_name, dump_type, holder, acquired, expires)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (project_name, collector_name, dump_type) DO UPDATE
+		SET holder = excluded.holder,
+			acquired = CASE WHEN scrape_leases.holder = excluded.holder THEN scrape_leases.acquired ELSE excluded.acquired END,
+			expires = excluded.expires
+		WHERE scrape_leases.holder = excluded.holder OR scrape_leases.expires < $5
+		RETURNING holder
+	`, collector.Project.Name, collector.Name, int16(dumpType), holder, now.Unix(), now.Add(ttl).Unix())
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	acquired := rows.Next()
+	return acquired, rows.Err()
+}
+
+func (s *SQLiteStore) ReleaseLease(ctx context.Context, collector Collector, dumpType DumpType, holder string) error {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM scrape_leases
+		WHERE project_name = $1
+		AND collector_name = $2
+		AND dump_type = $3
+		AND holder = $4
+	`, collector.Project.Name, collector.Name, int16(dumpType), holder)
+	return err
+}
+
+func (s *SQLiteStore) InsertScrapeRun(ctx context.Context, run *ScrapeRun) error {
+	lists, err := encodeScrapeRunLists(*run)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO scrape_runs (source, project_name, dump_type, status, started, finished,
+			collectors_attempted, collectors_succeeded, dumps_found, dumps_inserted, retries, errors)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`, run.Source, run.Project, int16(run.DumpType), string(run.Status), run.Started.Unix(), unixOrNil(run.Finished),
+		lists[0], lists[1], run.DumpsFound, run.DumpsInserted, run.Retries, lists[2])
+	if err != nil {
+		return err
+	}
+	run.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *SQLiteStore) UpdateScrapeRun(ctx context.Context, run ScrapeRun) error {
+	lists, err := encodeScrapeRunLists(run)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE scrape_runs
+		SET status = $2, finished = $3,
+			collectors_attempted = $4, collectors_succeeded = $5,
+			dumps_found = $6, dumps_inserted = $7, retries = $8, errors = $9
+		WHERE scrape_run_id = $1
+	`, run.ID, string(run.Status), unixOrNil(run.Finished),
+		lists[0], lists[1], run.DumpsFound, run.DumpsInserted, run.Retries, lists[2])
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("scrape run %d not found", run.ID)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) FetchScrapeRuns(ctx context.Context, filter ScrapeRunFilter) ([]ScrapeRun, error) {
+	where, args := scrapeRunConditions(filter, func(column, placeholder string) string {
+		return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) WHERE value = %s)", column, placeholder)
+	})
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT scrape_run_id, source, project_name, dump_type, status, started, finished,
+			collectors_attempted, collectors_succeeded, dumps_found, dumps_inserted, retries, errors
+		FROM scrape_runs
+		WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []ScrapeRun{}
+	for rows.Next() {
+		var run ScrapeRun
+		var dumpType int16
+		var status, attempted, succeeded, errs string
+		var started int64
+		var finished *int64
+		if err := rows.Scan(&run.ID, &run.Source, &run.Project, &dumpType, &status, &started, &finished,
+			&attempted, &succeeded, &run.DumpsFound, &run.DumpsInserted, &run.Retries, &errs); err != nil {
+			return nil, err
+		}
+		run.DumpType = DumpType(dumpType)
+		run.Status = ScrapeRunStatus(status)
+		run.Started = time.Unix(started, 0)
+		run.Finished = timeOrNil(finished)
+		for _, list := range []struct {
+			raw string
+			dst *[]string
+		}{{attempted, &run.CollectorsAttempted}, {succeeded, &run.CollectorsSucceeded}, {errs, &run.Errors}} {
+			if err := json.Unmarshal([]byte(list.raw), list.dst); err != nil {
+				return nil, fmt.Errorf("invalid scrape run %d: %w", run.ID, err)
+			}
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// encodeScrapeRunLists encodes the collectors attempted, collectors
+// succeeded and errors of the run as JSON arrays.
+func encodeScrapeRunLists(run ScrapeRun) ([3]string, error) {
+	var lists [3]string
+	for i, list := range [][]string{run.CollectorsAttempted, run.CollectorsSucceeded, run.Errors} {
+		if list == nil {
+			list = []string{}
+		}
+		raw, err := json.Marshal(list)
+		if err != nil {
+			return lists, err
+		}
+		lists[i] = string(raw)
+	}
+	return lists, nil
+}
+
+func (s *SQLiteStore) Dialect() string {
+	return migrations.DialectSQLite
+}
+
+func (s *SQLiteStore) SchemaVersion(ctx context.Context) (int, error) {
+	var tables int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err = s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+func (s *SQLiteStore) ApplyMigration(ctx context.Context, m migrations.Migration, up bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, sqliteSchemaVersionTable); err != nil {
+		return err
+	}
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&current); err != nil {
+		return err
+	}
+	apply, err := checkMigrationOrder(current, m, up)
+	if err != nil || !apply {
+		return err
+	}
+
+	if up {
+		if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)`, m.Version, m.Name, time.Now().Unix())
+	} else {
+		if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_version WHERE version = $1`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Close() {
+	s.db.Close()
+}
+
+func durationSeconds(d DumpDuration) int64 {
+	return int64(time.Duration(d) / time.Second)
+}
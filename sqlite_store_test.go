@@ -0,0 +1,548 @@
+package bgpfinder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenSQLiteStore(context.Background(), logger, ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open SQLite store: %v", err)
+	}
+	t.Cleanup(store.Close)
+	if _, err := MigrateUp(context.Background(), logger, store); err != nil {
+		t.Fatalf("Failed to migrate SQLite store: %v", err)
+	}
+	return store
+}
+
+func TestSQLiteStoreMigrations(t *testing.T) {
+	ctx := context.Background()
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestSQLiteStore(t)
+	if err := CheckSchemaVersion(ctx, store); err != nil {
+		t.Fatalf("Expected schema to be current, got %v", err)
+	}
+
+	version, err := MigrateDown(ctx, logger, store, 1000)
+	if err != nil {
+		t.Fatalf("MigrateDown failed: %v", err)
+	}
+	if version != 0 {
+		t.Errorf("Expected schema version 0, got %d", version)
+	}
+	if err := CheckSchemaVersion(ctx, store); !errors.Is(err, ErrSchemaIncompatible) {
+		t.Errorf("Expected ErrSchemaIncompatible, got %v", err)
+	}
+
+	// And back up again, to make sure the down scripts cleaned up properly
+	if _, err := MigrateUp(ctx, logger, store); err != nil {
+		t.Fatalf("MigrateUp failed: %v", err)
+	}
+	if err := CheckSchemaVersion(ctx, store); err != nil {
+		t.Errorf("Expected schema to be current, got %v", err)
+	}
+}
+
+func TestSQLiteStoreDumps(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	dumps := testUpdates(base, 12)
+	if err := store.UpsertCollectors(ctx, []Collector{testCollector}, DumpTypeAny, base); err != nil {
+		t.Fatalf("UpsertCollectors failed: %v", err)
+	}
+	stats, err := store.UpsertDumps(ctx, dumps)
+	if err != nil {
+		t.Fatalf("UpsertDumps failed: %v", err)
+	}
+	if expected := (UpsertStats{Inserted: 12}); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+	// Upserting again shouldn't create duplicates, and should only touch
+	// the rows that changed.
+	changed := append([]BGPDump(nil), dumps...)
+	changed[11].Duration = DumpDuration(10 * time.Minute)
+	stats, err = store.UpsertDumps(ctx, changed)
+	if err != nil {
+		t.Fatalf("UpsertDumps failed: %v", err)
+	}
+	if expected := (UpsertStats{Updated: 1, Unchanged: 11}); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+	dumps = changed
+
+	results, err := store.FetchDumps(ctx, Query{
+		Collectors: []Collector{testCollector},
+		From:       base,
+		Until:      base.Add(30 * time.Minute),
+		DumpType:   DumpTypeUpdates,
+	}, FetchOptions{})
+	if err != nil {
+		t.Fatalf("FetchDumps failed: %v", err)
+	}
+	// Anything overlapping the window is returned, so the 00:30 file is too.
+	if len(results) != 7 {
+		t.Fatalf("Expected 7 dumps, got %d", len(results))
+	}
+	if results[0] != dumps[0] {
+		t.Errorf("Expected %+v, got %+v", dumps[0], results[0])
+	}
+
+	latest, err := store.FetchLatestDumpTimes(ctx, RIS, DumpTypeUpdates)
+	if err != nil {
+		t.Fatalf("FetchLatestDumpTimes failed: %v", err)
+	}
+	if got := latest[testCollector.Name]; got.Unix() != dumps[len(dumps)-1].Timestamp {
+		t.Errorf("Expected latest dump at %d, got %v", dumps[len(dumps)-1].Timestamp, got)
+	}
+
+	collectors, err := store.FetchCollectors(ctx, RIS)
+	if err != nil {
+		t.Fatalf("FetchCollectors failed: %v", err)
+	}
+	if len(collectors) != 1 || collectors[0] != testCollector {
+		t.Errorf("Expected [%v], got %v", testCollector, collectors)
+	}
+}
+
+func TestSQLiteStoreConcurrentStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenSQLiteStore(ctx, logger, filepath.Join(t.TempDir(), "bgpfinder.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := MigrateUp(ctx, logger, store); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := store.UpsertDumps(ctx, testUpdates(base, 3)); err != nil {
+		t.Fatal(err)
+	}
+	query := Query{Collectors: []Collector{testCollector}, DumpType: DumpTypeUpdates, From: base, Until: base.Add(time.Hour)}
+
+	// Other reads and writes go ahead while a stream is still reading
+	streamed := 0
+	err = store.StreamDumps(ctx, query, FetchOptions{}, func(d BGPDump) error {
+		streamed++
+		if streamed > 1 {
+			return nil
+		}
+		if _, err := store.FetchDumps(ctx, query, FetchOptions{}); err != nil {
+			return fmt.Errorf("failed to read during the stream: %w", err)
+		}
+		if _, err := store.UpsertDumps(ctx, testUpdates(base.Add(24*time.Hour), 1)); err != nil {
+			return fmt.Errorf("failed to write during the stream: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed != 3 {
+		t.Errorf("Expected 3 dumps to be streamed, got %d", streamed)
+	}
+}
+
+func TestSQLiteStoreProjectCollectorIdentity(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	// A collector in another project that happens to share a name
+	other := Collector{Project: RouteviewsProject, Name: testCollector.Name}
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	dumps := testUpdates(base, 3)
+	otherDumps := testUpdates(base, 5)
+	for i := range otherDumps {
+		otherDumps[i].Collector = other
+	}
+
+	// Unknown collectors are added as needed
+	for _, d := range [][]BGPDump{dumps, otherDumps} {
+		if _, err := store.UpsertDumps(ctx, d); err != nil {
+			t.Fatalf("UpsertDumps failed: %v", err)
+		}
+	}
+	collectors, err := store.FetchCollectors(ctx, "")
+	if err != nil {
+		t.Fatalf("FetchCollectors failed: %v", err)
+	}
+	if len(collectors) != 2 {
+		t.Errorf("Expected 2 collectors, got %v", collectors)
+	}
+
+	for _, c := range []struct {
+		collector Collector
+		expected  int
+	}{{testCollector, 3}, {other, 5}} {
+		results, err := store.FetchDumps(ctx, Query{
+			Collectors: []Collector{c.collector},
+			From:       base,
+			Until:      base.Add(time.Hour),
+			DumpType:   DumpTypeUpdates,
+		}, FetchOptions{})
+		if err != nil {
+			t.Fatalf("FetchDumps failed: %v", err)
+		}
+		if len(results) != c.expected {
+			t.Errorf("Expected %d dumps for %v, got %d", c.expected, c.collector, len(results))
+		}
+		for _, r := range results {
+			if r.Collector != c.collector {
+				t.Errorf("Expected dump for %v, got %v", c.collector, r.Collector)
+			}
+		}
+	}
+}
+
+func TestSQLiteStoreCrawlCoverage(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return base.Add(time.Duration(h) * time.Hour) }
+
+	for _, span := range []Interval{{at(0), at(2)}, {at(4), at(6)}, {at(2), at(3)}} {
+		if err := store.UpsertCrawlCoverage(ctx, testCollector, DumpTypeRibs, span); err != nil {
+			t.Fatalf("UpsertCrawlCoverage failed: %v", err)
+		}
+	}
+
+	covered, err := store.FetchCrawlCoverage(ctx, testCollector, DumpTypeRibs, Interval{at(1), at(10)})
+	if err != nil {
+		t.Fatalf("FetchCrawlCoverage failed: %v", err)
+	}
+	expected := []Interval{{at(1), at(3)}, {at(4), at(6)}}
+	if len(covered) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, covered)
+	}
+	for i := range expected {
+		if !covered[i].From.Equal(expected[i].From) || !covered[i].Until.Equal(expected[i].Until) {
+			t.Errorf("Expected %v, got %v", expected[i], covered[i])
+		}
+	}
+
+	// The adjacent spans should have been merged into a single row
+	var rows int
+	if err := store.DB().QueryRow(`SELECT COUNT(*) FROM crawl_coverage`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 {
+		t.Errorf("Expected 2 coverage rows, got %d", rows)
+	}
+}
+
+func TestSQLiteStoreRetention(t *testing.T) {
+	ctx := context.Background()
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestSQLiteStore(t)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ribs := []BGPDump{{
+		URL:       "https://data.ris.ripe.net/rrc00/2020.01/bview.20200101.0000.gz",
+		Collector: testCollector,
+		Duration:  RISRibDuration,
+		DumpType:  DumpTypeRibs,
+		Timestamp: base.Unix(),
+	}}
+	if _, err := store.UpsertDumps(ctx, append(testUpdates(base, 12), ribs...)); err != nil {
+		t.Fatalf("UpsertDumps failed: %v", err)
+	}
+	window := Interval{base, base.Add(time.Hour)}
+	for _, dumpType := range []DumpType{DumpTypeRibs, DumpTypeUpdates} {
+		if err := store.UpsertCrawlCoverage(ctx, testCollector, dumpType, window); err != nil {
+			t.Fatalf("UpsertCrawlCoverage failed: %v", err)
+		}
+	}
+
+	// Keep the last half hour of updates, and all of the RIBs
+	now := base.Add(time.Hour)
+	cfg := MaintenanceConfig{Retention: RetentionPolicies{{DumpType: DumpTypeUpdates, MaxAge: 30 * time.Minute}}}
+	if err := RunMaintenance(ctx, logger, store, cfg, now); err != nil {
+		t.Fatalf("RunMaintenance failed: %v", err)
+	}
+
+	results, err := store.FetchDumps(ctx, Query{Collectors: []Collector{testCollector}, From: base, Until: now}, FetchOptions{})
+	if err != nil {
+		t.Fatalf("FetchDumps failed: %v", err)
+	}
+	// 1 RIB and the updates from 00:30 onwards
+	if len(results) != 7 {
+		t.Errorf("Expected 7 dumps, got %d", len(results))
+	}
+
+	covered, err := store.FetchCrawlCoverage(ctx, testCollector, DumpTypeUpdates, window)
+	if err != nil {
+		t.Fatalf("FetchCrawlCoverage failed: %v", err)
+	}
+	if len(covered) != 1 || !covered[0].From.Equal(base.Add(30*time.Minute)) {
+		t.Errorf("Expected updates coverage to be trimmed to 00:30, got %v", covered)
+	}
+	covered, err = store.FetchCrawlCoverage(ctx, testCollector, DumpTypeRibs, window)
+	if err != nil {
+		t.Fatalf("FetchCrawlCoverage failed: %v", err)
+	}
+	if len(covered) != 1 || !covered[0].From.Equal(base) {
+		t.Errorf("Expected RIB coverage to be untouched, got %v", covered)
+	}
+}
+
+func TestSQLiteStoreReconcileDumps(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := Interval{base, base.Add(time.Hour)}
+	dumps := testUpdates(base, 12)
+	if _, err := store.UpsertDumps(ctx, dumps); err != nil {
+		t.Fatalf("UpsertDumps failed: %v", err)
+	}
+
+	// The archive loses two files
+	crawl := append(append([]BGPDump(nil), dumps[:3]...), dumps[5:]...)
+	stats, err := store.ReconcileDumps(ctx, testCollector, DumpTypeUpdates, window, crawl)
+	if err != nil {
+		t.Fatalf("ReconcileDumps failed: %v", err)
+	}
+	if expected := (ReconcileStats{Removed: 2}); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+
+	query := Query{Collectors: []Collector{testCollector}, From: window.From, Until: window.Until, DumpType: DumpTypeUpdates}
+	results, err := store.FetchDumps(ctx, query, FetchOptions{})
+	if err != nil {
+		t.Fatalf("FetchDumps failed: %v", err)
+	}
+	if len(results) != 10 {
+		t.Errorf("Expected 10 dumps, got %d", len(results))
+	}
+	results, err = store.FetchDumps(ctx, query, FetchOptions{IncludeRemoved: true})
+	if err != nil {
+		t.Fatalf("FetchDumps failed: %v", err)
+	}
+	var removed []string
+	for _, d := range results {
+		if d.RemovedAt != 0 {
+			removed = append(removed, d.URL)
+		}
+	}
+	if len(results) != 12 || len(removed) != 2 || removed[0] != dumps[3].URL {
+		t.Errorf("Expected 12 dumps with %s and %s removed, got %d with %v removed", dumps[3].URL, dumps[4].URL, len(results), removed)
+	}
+
+	// And one of them comes back
+	crawl = append(crawl, dumps[4])
+	stats, err = store.ReconcileDumps(ctx, testCollector, DumpTypeUpdates, window, crawl)
+	if err != nil {
+		t.Fatalf("ReconcileDumps failed: %v", err)
+	}
+	if expected := (ReconcileStats{Restored: 1}); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestSQLiteStoreDumpChanges(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := time.Now().Add(-time.Second)
+	dumps := testUpdates(base, 12)
+	if _, err := store.UpsertDumps(ctx, dumps); err != nil {
+		t.Fatalf("UpsertDumps failed: %v", err)
+	}
+	query := Query{Collectors: []Collector{testCollector}, From: base, Until: base.Add(time.Hour)}
+
+	// Nothing is fed until it's older than the horizon
+	since := ChangesSince(start)
+	results, next, err := store.FetchDumpChanges(ctx, query, since, start, 5, FetchOptions{})
+	if err != nil {
+		t.Fatalf("FetchDumpChanges failed: %v", err)
+	}
+	if len(results) != 0 || next != since {
+		t.Errorf("Expected no changes and an unchanged cursor, got %d changes and %+v", len(results), next)
+	}
+
+	// Then it's fed in pages, without duplicates, via the encoded cursor
+	until := time.Now().Add(time.Minute)
+	var fed []BGPDump
+	for page := 0; page < 4; page++ {
+		results, next, err = store.FetchDumpChanges(ctx, query, since, until, 5, FetchOptions{})
+		if err != nil {
+			t.Fatalf("FetchDumpChanges failed: %v", err)
+		}
+		fed = append(fed, results...)
+		since, err = ParseChangeCursor(next.String())
+		if err != nil {
+			t.Fatalf("ParseChangeCursor failed: %v", err)
+		}
+		if since != next {
+			t.Errorf("Expected cursor %+v to round trip, got %+v", next, since)
+		}
+	}
+	if len(fed) != 12 {
+		t.Fatalf("Expected 12 changes, got %d", len(fed))
+	}
+	for i, d := range fed {
+		if d.URL != dumps[i].URL {
+			t.Errorf("Expected change %d to be %s, got %s", i, dumps[i].URL, d.URL)
+		}
+	}
+
+	if _, err := ParseChangeCursor("not a cursor"); err == nil {
+		t.Error("Expected an invalid cursor to be rejected")
+	}
+}
+
+func TestSQLiteStorePagination(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	dumps := testUpdates(base, 12)
+	// A second collector with dumps at the same times, so that pages
+	// have to break ties
+	other := Collector{Project: RisProject, Name: "rrc01"}
+	for _, d := range testUpdates(base, 12) {
+		d.Collector = other
+		d.URL = strings.Replace(d.URL, "rrc00", "rrc01", 1)
+		dumps = append(dumps, d)
+	}
+	if _, err := store.UpsertDumps(ctx, dumps); err != nil {
+		t.Fatalf("UpsertDumps failed: %v", err)
+	}
+	query := Query{Collectors: []Collector{testCollector, other}, From: base, Until: base.Add(time.Hour)}
+
+	all, err := store.FetchDumps(ctx, query, FetchOptions{})
+	if err != nil {
+		t.Fatalf("FetchDumps failed: %v", err)
+	}
+	var paged []BGPDump
+	var after *DumpCursor
+	for {
+		page, err := store.FetchDumps(ctx, query, FetchOptions{After: after, Limit: 5})
+		if err != nil {
+			t.Fatalf("FetchDumps failed: %v", err)
+		}
+		paged = append(paged, page...)
+		if len(page) < 5 {
+			break
+		}
+		cursor, err := ParseDumpCursor(CursorOf(page[len(page)-1]).String())
+		if err != nil {
+			t.Fatalf("ParseDumpCursor failed: %v", err)
+		}
+		after = &cursor
+	}
+	if len(all) != 24 || !reflect.DeepEqual(paged, all) {
+		t.Errorf("Expected pages to add up to all %d dumps in order, got %d", len(all), len(paged))
+	}
+}
+
+func TestSQLiteStoreScrapeRuns(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	// A run that failed for rrc01, then one that's still going
+	first := NewScrapeRun(ScrapeRunPeriodic, RIS, DumpTypeUpdates)
+	first.Started = time.Unix(1000, 0)
+	if err := store.InsertScrapeRun(ctx, first); err != nil {
+		t.Fatalf("InsertScrapeRun failed: %v", err)
+	}
+	first.RecordCollector("rrc00", 12, UpsertStats{Inserted: 10, Unchanged: 2}, 0, nil)
+	first.RecordCollector("rrc01", 0, UpsertStats{}, 4, fmt.Errorf("archive unavailable"))
+	first.Finish()
+	if err := store.UpdateScrapeRun(ctx, *first); err != nil {
+		t.Fatalf("UpdateScrapeRun failed: %v", err)
+	}
+	second := NewScrapeRun(ScrapeRunPeriodic, RIS, DumpTypeUpdates)
+	second.Started = time.Unix(2000, 0)
+	if err := store.InsertScrapeRun(ctx, second); err != nil {
+		t.Fatalf("InsertScrapeRun failed: %v", err)
+	}
+
+	runs, err := store.FetchScrapeRuns(ctx, ScrapeRunFilter{})
+	if err != nil {
+		t.Fatalf("FetchScrapeRuns failed: %v", err)
+	}
+	if len(runs) != 2 || runs[0].ID != second.ID || runs[0].Status != ScrapeRunRunning || runs[0].Finished != nil {
+		t.Fatalf("Expected the running run first, got %+v", runs)
+	}
+	got := runs[1]
+	if got.Status != ScrapeRunPartial || got.DumpsFound != 12 || got.DumpsInserted != 10 || got.Retries != 4 ||
+		!reflect.DeepEqual(got.CollectorsSucceeded, []string{"rrc00"}) ||
+		!reflect.DeepEqual(got.Errors, []string{"rrc01: archive unavailable"}) {
+		t.Errorf("Expected the partial run to round trip, got %+v", got)
+	}
+
+	for _, tc := range []struct {
+		filter ScrapeRunFilter
+		want   int
+	}{
+		{ScrapeRunFilter{Collector: "rrc01"}, 1},
+		{ScrapeRunFilter{Collector: "rrc01", Succeeded: true}, 0},
+		{ScrapeRunFilter{Collector: "rrc00", Succeeded: true}, 1},
+		{ScrapeRunFilter{Succeeded: true}, 0},
+		{ScrapeRunFilter{DumpType: DumpTypeRibs}, 0},
+		{ScrapeRunFilter{Project: RIS, Limit: 1}, 1},
+	} {
+		runs, err := store.FetchScrapeRuns(ctx, tc.filter)
+		if err != nil {
+			t.Fatalf("FetchScrapeRuns(%+v) failed: %v", tc.filter, err)
+		}
+		if len(runs) != tc.want {
+			t.Errorf("FetchScrapeRuns(%+v) returned %d runs, expected %d", tc.filter, len(runs), tc.want)
+		}
+	}
+}
+
+func TestUpdateCollectorsDataRecordsRun(t *testing.T) {
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	finder := &sliceFinder{dumps: testUpdates(base, 12)}
+
+	if err := UpdateCollectorsData(ctx, logger, store, finder, nil); err != nil {
+		t.Fatalf("UpdateCollectorsData failed: %v", err)
+	}
+	runs, err := store.FetchScrapeRuns(ctx, ScrapeRunFilter{Collector: testCollector.Name, Succeeded: true})
+	if err != nil {
+		t.Fatalf("FetchScrapeRuns failed: %v", err)
+	}
+	if len(runs) != 1 || runs[0].Source != ScrapeRunFull || runs[0].Status != ScrapeRunSucceeded ||
+		runs[0].DumpsFound != 12 || runs[0].DumpsInserted != 12 || runs[0].Finished == nil {
+		t.Errorf("Expected a successful full run, got %+v", runs)
+	}
+}
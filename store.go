@@ -0,0 +1,218 @@
+package bgpfinder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+	"github.com/alistairking/bgpfinder/migrations"
+)
+
+const (
+	StoreDriverPostgres = migrations.DialectPostgres
+	StoreDriverSQLite   = migrations.DialectSQLite
+)
+
+// MaxDumpDuration is the longest dump duration that stores accept. Knowing
+// it lets overlap queries use an index on the dump timestamp.
+const MaxDumpDuration = DumpDuration(time.Hour)
+
+// Store is the persistence layer that the cache, the scrapers and the
+// server share. There is one implementation per supported database.
+type Store interface {
+	// UpsertCollectors inserts or updates collector records, setting the
+	// last completed crawl time for the given dump type (both types if
+	// DumpTypeAny).
+	UpsertCollectors(ctx context.Context, collectors []Collector, dumpType DumpType, crawlTime time.Time) error
+
+	// InsertCollectors adds records for the collectors that aren't stored
+	// yet, with nothing known to have been crawled. Stored collectors are
+	// left alone, including their crawl times and retirement.
+	InsertCollectors(ctx context.Context, collectors []Collector) error
+
+	// UpsertDumps inserts or updates BGP dump records, reporting how many
+	// were new, changed or already up to date.
+	UpsertDumps(ctx context.Context, dumps []BGPDump) (UpsertStats, error)
+
+	// FetchDumps retrieves the stored dumps that match the query.
+	FetchDumps(ctx context.Context, query Query, opts FetchOptions) ([]BGPDump, error)
+
+	// StreamDumps calls fn for each stored dump that matches the query, in
+	// the same order as FetchDumps, without holding them all in memory. It
+	// stops at the first error returned by fn.
+	StreamDumps(ctx context.Context, query Query, opts FetchOptions, fn func(BGPDump) error) error
+
+	// FetchDumpChanges retrieves up to limit stored dumps that match the
+	// query and were added or changed after the cursor, but no later than
+	// until, in the order that they changed. It also returns the cursor to
+	// resume from, which is since if nothing changed.
+	FetchDumpChanges(ctx context.Context, query Query, since ChangeCursor, until time.Time, limit int, opts FetchOptions) ([]BGPDump, ChangeCursor, error)
+
+	// ChangeFeedHorizon returns the latest time that the change feed can
+	// reach: ChangeFeedLag ago by the clock that stamps mdate, or earlier
+	// if a transaction that may still commit dumps changed before then is
+	// open.
+	ChangeFeedHorizon(ctx context.Context) (time.Time, error)
+
+	// ReconcileDumps compares the dumps found by crawling the window against
+	// the stored ones, marking stored dumps that weren't found as removed and
+	// restoring removed dumps that were found again.
+	ReconcileDumps(ctx context.Context, collector Collector, dumpType DumpType, window Interval, found []BGPDump) (ReconcileStats, error)
+
+	// FetchProjects retrieves the projects that have stored collectors.
+	FetchProjects(ctx context.Context) ([]Project, error)
+
+	// FetchCollectors retrieves the stored collectors for the given
+	// project. All projects if unset.
+	FetchCollectors(ctx context.Context, project string) ([]Collector, error)
+
+	// RetireCollectors flags the collectors as no longer listed by their
+	// archive, as of at. Upserting a collector clears the flag. It returns
+	// how many of the collectors weren't already retired.
+	RetireCollectors(ctx context.Context, collectors []Collector, at time.Time) (int, error)
+
+	// FetchRetiredCollectors retrieves when each of the project's retired
+	// collectors was retired, keyed by collector name.
+	FetchRetiredCollectors(ctx context.Context, project string) (map[string]time.Time, error)
+
+	// FetchLatestDumpTimes retrieves the timestamp of the newest stored dump
+	// of the given type for each of the project's collectors, keyed by
+	// collector name.
+	FetchLatestDumpTimes(ctx context.Context, project string, dumpType DumpType) (map[string]time.Time, error)
+
+	// EnsurePartitions prepares storage for dumps between from and until.
+	// It's a no-op for stores that aren't partitioned.
+	EnsurePartitions(ctx context.Context, from, until time.Time) error
+
+	// DeleteDumpsBefore removes stored dumps of the given type (both if
+	// DumpTypeAny) older than before, and trims the crawl coverage to match
+	// so that the deleted spans are treated as uncrawled. It returns the
+	// number of dumps removed.
+	DeleteDumpsBefore(ctx context.Context, dumpType DumpType, before time.Time) (int64, error)
+
+	// UpsertCrawlCoverage records that the window has been fully crawled,
+	// merging it with any overlapping or adjacent spans.
+	UpsertCrawlCoverage(ctx context.Context, collector Collector, dumpType DumpType, window Interval) error
+
+	// FetchCrawlCoverage retrieves the crawled spans that overlap the
+	// window, clipped to the window.
+	FetchCrawlCoverage(ctx context.Context, collector Collector, dumpType DumpType, window Interval) ([]Interval, error)
+
+	// UpsertCrawlWindow records when the window's source last crawled it,
+	// replacing any earlier record of the same window.
+	UpsertCrawlWindow(ctx context.Context, window CrawlWindow) error
+
+	// FetchCrawlWindows retrieves the source's records of the collector's
+	// windows for the dump type.
+	FetchCrawlWindows(ctx context.Context, source string, collector Collector, dumpType DumpType) ([]CrawlWindow, error)
+
+	// AcquireLease takes (or renews) the holder's lease on scraping the
+	// collector's dumps of the (concrete) type for ttl. It returns false if
+	// another holder has a lease that hasn't expired.
+	AcquireLease(ctx context.Context, collector Collector, dumpType DumpType, holder string, ttl time.Duration) (bool, error)
+
+	// ReleaseLease gives up the holder's lease, if it still has it.
+	ReleaseLease(ctx context.Context, collector Collector, dumpType DumpType, holder string) error
+
+	// InsertScrapeRun records a new scrape run, setting its ID.
+	InsertScrapeRun(ctx context.Context, run *ScrapeRun) error
+
+	// UpdateScrapeRun overwrites the record of the run with the given ID.
+	UpdateScrapeRun(ctx context.Context, run ScrapeRun) error
+
+	// FetchScrapeRuns retrieves the scrape runs that match the filter,
+	// newest first.
+	FetchScrapeRuns(ctx context.Context, filter ScrapeRunFilter) ([]ScrapeRun, error)
+
+	// Dialect returns the name of the migrations dialect for this store.
+	Dialect() string
+
+	// SchemaVersion returns the newest applied migration version, or 0 for
+	// an empty database.
+	SchemaVersion(ctx context.Context) (int, error)
+
+	// ApplyMigration runs the up (or down) script of the migration and
+	// records the new schema version in a single transaction.
+	ApplyMigration(ctx context.Context, m migrations.Migration, up bool) error
+
+	// Close releases the underlying database connections.
+	Close()
+}
+
+// UpsertStats counts the outcome of a dump upsert.
+type UpsertStats struct {
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+// Add accumulates the counts from other into s.
+func (s *UpsertStats) Add(other UpsertStats) {
+	s.Inserted += other.Inserted
+	s.Updated += other.Updated
+	s.Unchanged += other.Unchanged
+}
+
+// Total returns the number of dumps that were processed.
+func (s UpsertStats) Total() int {
+	return s.Inserted + s.Updated + s.Unchanged
+}
+
+// FetchOptions adjusts which stored dumps FetchDumps returns.
+type FetchOptions struct {
+	// IncludeRemoved returns dumps that have disappeared from the archive
+	// too (with RemovedAt set)
+	IncludeRemoved bool
+
+	// After only returns the dumps that come after the cursor
+	After *DumpCursor
+
+	// Limit caps the number of dumps returned. Unlimited if 0
+	Limit int
+}
+
+// ReconcileStats counts the outcome of reconciling a crawl.
+type ReconcileStats struct {
+	Removed  int `json:"removed"`
+	Restored int `json:"restored"`
+}
+
+// StoreConfig selects and configures a Store implementation.
+type StoreConfig struct {
+	// Driver is one of StoreDriverPostgres or StoreDriverSQLite
+	Driver string
+
+	// EnvFile holds the Postgres connection settings (see LoadDBConfig)
+	EnvFile string
+
+	// SQLitePath is the path of the SQLite database file
+	SQLitePath string
+}
+
+// OpenStore connects to the database described by cfg.
+func OpenStore(ctx context.Context, logger *logging.Logger, cfg StoreConfig) (Store, error) {
+	switch cfg.Driver {
+	case StoreDriverPostgres, "":
+		db, err := ConnectDB(ctx, cfg.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewPostgresStore(logger, db), nil
+	case StoreDriverSQLite:
+		return OpenSQLiteStore(ctx, logger, cfg.SQLitePath)
+	default:
+		return nil, fmt.Errorf("unknown database driver: '%s'", cfg.Driver)
+	}
+}
+
+// checkDumpDurations makes sure that no dump is longer than MaxDumpDuration.
+func checkDumpDurations(dumps []BGPDump) error {
+	for _, d := range dumps {
+		if d.Duration > MaxDumpDuration {
+			return fmt.Errorf("dump %s is longer than the maximum duration (%v > %v)",
+				d.URL, time.Duration(d.Duration), time.Duration(MaxDumpDuration))
+		}
+	}
+	return nil
+}
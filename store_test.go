@@ -0,0 +1,162 @@
+package bgpfinder
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alistairking/bgpfinder/internal/logging"
+)
+
+// The store tests run against SQLite, and also against Postgres if
+// BGPFINDER_TEST_ENV_FILE points at an env file for a scratch database (in
+// the format LoadDBConfig expects). They delete testCollector's dumps there.
+const testEnvFileVar = "BGPFINDER_TEST_ENV_FILE"
+
+func newTestPostgresStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	envFile := os.Getenv(testEnvFileVar)
+	if envFile == "" {
+		t.Skipf("%s not set", testEnvFileVar)
+	}
+	ctx := context.Background()
+	logger, err := logging.NewLogger(logging.LoggerConfig{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := ConnectDB(ctx, envFile)
+	if err != nil {
+		t.Fatalf("Failed to connect to Postgres: %v", err)
+	}
+	store := NewPostgresStore(logger, db)
+	t.Cleanup(store.Close)
+	if _, err := MigrateUp(ctx, logger, store); err != nil {
+		t.Fatalf("Failed to migrate Postgres store: %v", err)
+	}
+	cleanup := func() {
+		_, err := db.Exec(ctx, `DELETE FROM bgp_dumps WHERE project_name = $1 AND collector_name = $2`, testCollector.Project.Name, testCollector.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+	return store
+}
+
+// forEachStore runs the test against each of the stores.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("sqlite", func(t *testing.T) { test(t, newTestSQLiteStore(t)) })
+	t.Run("postgres", func(t *testing.T) { test(t, newTestPostgresStore(t)) })
+}
+
+func TestStoreURLChangesTimestamp(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		dump := testUpdates(base, 1)[0]
+		if _, err := store.UpsertDumps(ctx, []BGPDump{dump}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The archive republishes the same file with a later timestamp
+		// (in another month, so on Postgres in another partition)
+		moved := dump
+		moved.Timestamp = base.AddDate(0, 1, 0).Unix()
+		stats, err := store.UpsertDumps(ctx, []BGPDump{moved})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (UpsertStats{Updated: 1}); stats != expected {
+			t.Errorf("Expected %+v, got %+v", expected, stats)
+		}
+
+		stored, err := store.FetchDumps(ctx, Query{
+			Collectors: []Collector{testCollector},
+			DumpType:   DumpTypeUpdates,
+			From:       base,
+			Until:      base.AddDate(0, 2, 0),
+		}, FetchOptions{IncludeRemoved: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 1 || stored[0].Timestamp != moved.Timestamp {
+			t.Errorf("Expected the dump to be stored once with its new timestamp, got %+v", stored)
+		}
+
+		// Upserting it again changes nothing
+		stats, err = store.UpsertDumps(ctx, []BGPDump{moved})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (UpsertStats{Unchanged: 1}); stats != expected {
+			t.Errorf("Expected %+v, got %+v", expected, stats)
+		}
+	})
+}
+
+func TestStoreFetchesDumpAtWindowBounds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		dumps := testUpdates(base, 3)
+		if _, err := store.UpsertDumps(ctx, dumps); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the second dump spans the window. The bounds are compared
+		// with the stored timestamps, so they have to be in the same time
+		// zone.
+		at := time.Unix(dumps[1].Timestamp+1, 0)
+		stored, err := store.FetchDumps(ctx, Query{
+			Collectors: []Collector{testCollector},
+			DumpType:   DumpTypeUpdates,
+			From:       at,
+			Until:      at,
+		}, FetchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 1 || stored[0].URL != dumps[1].URL {
+			t.Errorf("Expected only the dump spanning %s, got %+v", at.UTC(), stored)
+		}
+	})
+}
+
+func TestStoreChangeFeedHorizon(t *testing.T) {
+	ctx := context.Background()
+	forEachStore(t, func(t *testing.T, store Store) {
+		before := time.Now()
+		horizon, err := store.ChangeFeedHorizon(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Postgres uses its own clock, which may be a little off ours
+		if horizon.Before(before.Add(-ChangeFeedLag-time.Second)) || horizon.After(time.Now().Add(-ChangeFeedLag+time.Second)) {
+			t.Errorf("Expected the horizon to be %s ago, got %s", ChangeFeedLag, horizon)
+		}
+	})
+
+	// A transaction that has written holds the feed back until it commits,
+	// however long it takes (here, longer than no lag at all)
+	t.Run("postgres open transaction", func(t *testing.T) {
+		store := newTestPostgresStore(t)
+		tx, err := store.db.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback(ctx)
+		var started time.Time
+		if err := tx.QueryRow(ctx, `SELECT now() FROM txid_current()`).Scan(&started); err != nil {
+			t.Fatal(err)
+		}
+		horizon, err := changeFeedHorizonFromDB(ctx, store.db, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := started.Add(-time.Microsecond); !horizon.Equal(expected) {
+			t.Errorf("Expected the horizon to be just before the transaction started at %s, got %s", started, horizon)
+		}
+	})
+}